@@ -0,0 +1,63 @@
+/*
+	Encrypts the OTP secrets, active or pending, saved in plaintext before they were encrypted at rest.
+	Secrets wrapped with an older master key are rewrapped with the newest one, so that the old key can be removed
+	from SECRETS_MASTER_KEYS once this has run.
+
+	encrypt-otp-secrets [-dry-run]
+
+	Uses the same environment as the server. Can be run several times, secrets already up to date are left untouched.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/envelope"
+	"os"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "Only count the secrets to migrate")
+	flag.Parse()
+
+	e, err := envelope.FromEnv("SECRETS_MASTER_KEYS")
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+	defer database.GetDB().Close()
+
+	var users []database.User
+	err = database.GetDB().Where("otp_secret <> '' OR pending_otp_secret <> ''").Find(&users).Error
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+
+	migrated, failed := 0, 0
+	for _, user := range users {
+		if *dryRun {
+			if user.NeedsOTPSecretMigration(e) {
+				migrated++
+			}
+			continue
+		}
+		updated, err := user.MigrateOTPSecret(e)
+		if err != nil {
+			fmt.Println("Could not migrate the secret of user", user.ID, ":", err.Error())
+			failed++
+		} else if updated {
+			migrated++
+		}
+	}
+
+	if *dryRun {
+		fmt.Println(migrated, "of", len(users), "secrets would be migrated")
+	} else {
+		fmt.Println(migrated, "of", len(users), "secrets migrated,", failed, "failed")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+	Manages a directory of token signing keys, as read by the server when <prefix>_KEYS_DIR is set.
+
+	keyring add -dir ./keys/access [-kid 2020-06] [-alg HS512|EdDSA|ES256] [-size 64]
+	keyring retire -dir ./keys/access -kid 2020-05 [-grace 2h]
+	keyring list -dir ./keys/access
+
+	Adding a key makes it the signing key. EdDSA and ES256 keys are published on /.well-known/jwks.json,
+	so that other services can verify tokens without being able to sign them. Retiring a key stops it from signing,
+	and tokens it signed remain valid until the end of the grace window.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/keyring"
+	"os"
+	"regexp"
+	"time"
+)
+
+var kidFormat = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+func usage() {
+	fmt.Println("usage: keyring add|retire|list -dir <directory> [options]")
+}
+
+func findKey(keys []keyring.Key, kid string) (keyring.Key, error) {
+	for _, key := range keys {
+		if key.ID == kid {
+			return key, nil
+		}
+	}
+	return keyring.Key{}, errors.New("key " + kid + " not found")
+}
+
+func add(dir string, kid string, alg string, size int) error {
+	if kid == "" {
+		kid = time.Now().UTC().Format("20060102-150405")
+	}
+	if !kidFormat.MatchString(kid) {
+		return errors.New("kid must only contain letters, digits, '.', '_' and '-'")
+	}
+	keys, err := keyring.ReadDirectory(dir)
+	if err != nil {
+		return err
+	}
+	if _, err = findKey(keys, kid); err == nil {
+		return errors.New("key " + kid + " already exists")
+	}
+	key, err := keyring.Generate(kid, alg, size)
+	if err != nil {
+		return err
+	}
+	err = keyring.WriteKey(dir, key)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Added " + key.Alg() + " key " + kid + ", it is now used to sign tokens")
+	return nil
+}
+
+func retire(dir string, kid string, grace time.Duration) error {
+	keys, err := keyring.ReadDirectory(dir)
+	if err != nil {
+		return err
+	}
+	key, err := findKey(keys, kid)
+	if err != nil {
+		return err
+	}
+	if key.IsRetiring() {
+		return errors.New("key " + kid + " is already retiring")
+	}
+	retiresAt := time.Now().Add(grace)
+	key.RetiresAt = &retiresAt
+	err = keyring.WriteKey(dir, key)
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if keys[i].ID == kid {
+			keys[i] = key
+		}
+	}
+	if _, err = keyring.New(keys).SigningKey(); err != nil {
+		fmt.Println("Warning: no key is left to sign tokens, add one")
+	}
+	fmt.Println("Key", kid, "retires at", retiresAt.Format(time.RFC3339))
+	return nil
+}
+
+func list(dir string) error {
+	keys, err := keyring.ReadDirectory(dir)
+	if err != nil {
+		return err
+	}
+	signingKey, _ := keyring.New(keys).SigningKey()
+	for _, key := range keyring.New(keys).Keys() {
+		status := "active"
+		if key.ID == signingKey.ID {
+			status = "signing"
+		} else if key.IsRetiring() && key.IsValidAt(time.Now()) {
+			status = "retiring until " + key.RetiresAt.Format(time.RFC3339)
+		} else if key.IsRetiring() {
+			status = "retired, can be deleted"
+		}
+		fmt.Printf("%s\t%s\tcreated %s\t%s\n", key.ID, key.Alg(), key.CreatedAt.Format(time.RFC3339), status)
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	dir := flags.String("dir", "", "Keys directory")
+	kid := flags.String("kid", "", "Key ID")
+	alg := flags.String("alg", keyring.AlgorithmHS512, "Signing algorithm: HS512, EdDSA or ES256")
+	size := flags.Int("size", 64, "Size of generated HS512 secrets, in bytes")
+	grace := flags.Duration("grace", time.Hour * 2, "Delay during which tokens signed by a retiring key stay valid")
+	_ = flags.Parse(os.Args[2:])
+	if *dir == "" {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "add":
+		err = add(*dir, *kid, *alg, *size)
+	case "retire":
+		err = retire(*dir, *kid, *grace)
+	case "list":
+		err = list(*dir)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+}
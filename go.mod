@@ -4,18 +4,21 @@ go 1.14
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
-	github.com/dgryski/dgoogauth v0.0.0-20190221195224-5a805980a5f3 // indirect
-	github.com/didip/tollbooth v4.0.2+incompatible // indirect
-	github.com/getsentry/sentry-go v0.6.0 // indirect
+	github.com/dgryski/dgoogauth v0.0.0-20190221195224-5a805980a5f3
+	github.com/didip/tollbooth v4.0.2+incompatible
+	github.com/fxamacker/cbor/v2 v2.2.0
+	github.com/getsentry/sentry-go v0.6.0
 	github.com/go-playground/validator/v10 v10.2.0
-	github.com/google/uuid v1.1.1 // indirect
+	github.com/google/uuid v1.1.1
 	github.com/jinzhu/gorm v1.9.12
 	github.com/labstack/echo/v4 v4.1.15
 	github.com/lib/pq v1.1.1
-	github.com/ovh/go-ovh v0.0.0-20181109152953-ba5adb4cf014 // indirect
-	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
-	github.com/skip2/go-qrcode v0.0.0-20191027152451-9434209cb086 // indirect
-	github.com/stretchr/testify v1.5.1 // indirect
+	github.com/ovh/go-ovh v0.0.0-20181109152953-ba5adb4cf014
+	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/skip2/go-qrcode v0.0.0-20191027152451-9434209cb086
+	github.com/stretchr/testify v1.5.1
 	golang.org/x/crypto v0.0.0-20200221231518-2aa609cf4a9d
 	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1 // indirect
+	gopkg.in/ini.v1 v1.55.0 // indirect
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -4,25 +4,52 @@ import (
 	"errors"
 	"github.com/Yuruh/encrypted-diary/src/api"
 	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/jobs"
+	"github.com/Yuruh/encrypted-diary/src/keyring"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
 	"github.com/getsentry/sentry-go"
 	"log"
-	"math/rand"
 	"os"
 	"time"
 )
 
 func EnsureEnvSet() error {
 	required := []string{
-		"ACCESS_TOKEN_SECRET",
-		"2FA_TOKEN_SECRET",
 		"DIARY_DB_USER",
 		"DIARY_DB_PWD",
+		"SECRETS_MASTER_KEYS",
 	}
 	for _, elem := range required {
 		if os.Getenv(elem) == "" {
 			return errors.New("Env variable " + elem + " missing")
 		}
 	}
+	// Either a single secret, a list of keys or a keys directory
+	keys := []string{
+		"ACCESS_TOKEN",
+		"2FA_TOKEN",
+	}
+	for _, elem := range keys {
+		if !keyring.IsConfigured(elem) {
+			return errors.New("Env variable " + elem + "_SECRET, " + elem + "_KEYS or " + elem + "_KEYS_DIR missing")
+		}
+	}
+	_, err := mailer.FromEnv()
+	if err == mailer.ErrNotConfigured {
+		// Unverified accounts could never be verified
+		if os.Getenv("EMAIL_VERIFICATION") != "" && os.Getenv("EMAIL_VERIFICATION") != "none" {
+			return errors.New("EMAIL_VERIFICATION requires emails, SMTP_HOST or MAILER=log missing")
+		}
+		log.Println("Warning: SMTP_HOST not set, password reset, email verification and email change are disabled")
+	} else if err != nil {
+		return err
+	}
+	if !api.CheckEmailVerificationPolicy() {
+		return errors.New("EMAIL_VERIFICATION must be none, login or entries")
+	}
+	if !api.CheckEntriesBatchMaxSize() {
+		return errors.New("ENTRIES_BATCH_MAX_SIZE must be a positive integer")
+	}
 
 	return nil
 }
@@ -38,7 +65,6 @@ func InitSentry() {
 func main() {
 	InitSentry()
 
-	rand.Seed(int64(os.Getpid()) * time.Now().Unix())
 	err := EnsureEnvSet()
 	if err != nil {
 		sentry.CaptureException(err)
@@ -49,5 +75,15 @@ func main() {
 
 	defer database.GetDB().Close()
 
+	jobs.Every(time.Hour, "purge revoked tokens", database.PurgeRevokedTokens)
+	jobs.Every(time.Hour, "purge refresh tokens", database.PurgeRefreshTokens)
+	jobs.Every(time.Hour, "purge trusted devices", database.PurgeTwoFactorsCookies)
+	jobs.Every(time.Hour, "purge security key ceremonies", database.PurgeWebAuthnCeremonies)
+	jobs.Every(time.Hour, "purge password reset tokens", database.PurgePasswordResetTokens)
+	jobs.Every(time.Hour, "purge email verification tokens", database.PurgeEmailVerificationTokens)
+	jobs.Every(time.Hour, "purge deleted accounts", api.PurgeDeletedAccounts)
+	jobs.Every(time.Hour, "purge account exports", api.PurgeAccountExports)
+	jobs.Every(time.Minute, "reload keyrings", api.ReloadKeyrings)
+
 	api.RunHttpServer()
 }
@@ -23,4 +23,18 @@ func TestInitSentry(t *testing.T) {
 	assert.NotPanics(func() {
 		InitSentry()
 	})
-}
\ No newline at end of file
+}
+func TestEnsureEnvSet_WithoutSMTP(t *testing.T) {
+	assert := asserthelper.New(t)
+	previousMailer, previousHost := os.Getenv("MAILER"), os.Getenv("SMTP_HOST")
+	defer os.Setenv("MAILER", previousMailer)
+	defer os.Setenv("SMTP_HOST", previousHost)
+	os.Setenv("2FA_TOKEN_SECRET", "Secret value")
+	os.Setenv("MAILER", "")
+	os.Setenv("SMTP_HOST", "")
+
+	assert.Nil(EnsureEnvSet())
+	os.Setenv("EMAIL_VERIFICATION", "login")
+	assert.NotNil(EnsureEnvSet())
+	os.Setenv("EMAIL_VERIFICATION", "")
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Time the user has to change their mind, the account is purged afterwards by PurgeDeletedAccounts
+const accountDeletionGracePeriod = time.Hour * 24 * 7
+
+type DeleteAccountBody struct {
+	// The current password, or a proof for users who switched to SRP
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+}
+
+/*
+	Schedules the deletion of the account and logs the user out everywhere.
+	Logging in again during the grace period is still possible, to cancel.
+*/
+func DeleteAccount(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody DeleteAccountBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+
+	scheduledAt, err := database.ScheduleAccountDeletion(user.ID, time.Now().Add(accountDeletionGracePeriod))
+	if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditAccountDeletionScheduled, scheduledAt.Format(time.RFC3339))
+
+	err = RevokeAllUserTokens(user.ID)
+	if err != nil {
+		return InternalError(context, fmt.Errorf("could not revoke tokens: %v", err))
+	}
+	err = database.DeleteUserTwoFactorsCookies(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	forgetUser(user.ID)
+	deliver(mailer.AccountDeletion, user.Email, map[string]string{
+		"Date": scheduledAt.UTC().Format("January 2, 2006 15:04 MST"),
+	})
+	return context.JSON(http.StatusAccepted, map[string]interface{}{"deletion_scheduled_at": scheduledAt})
+}
+
+func CancelAccountDeletion(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	cancelled, err := database.CancelAccountDeletion(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !cancelled {
+		return context.String(http.StatusNotFound, "No deletion scheduled")
+	}
+	forgetUser(user.ID)
+	audit(context, user.ID, auditAccountDeletionCancelled, "")
+	return context.NoContent(http.StatusOK)
+}
+
+// Replaced in tests
+var purgeAccount = database.PurgeAccount
+
+/*
+	Purges the accounts whose grace period is over, then deletes their avatars from object storage.
+	An account that could not be purged is reported to sentry and does not hold back the others, it is retried on
+	the next run, as are the avatars that could not be deleted.
+*/
+func PurgeDeletedAccounts() error {
+	ids, err := database.GetAccountsDueForDeletion(time.Now())
+	if err != nil {
+		return err
+	}
+	failures := 0
+	for _, id := range ids {
+		_, err = purgeAccount(id, time.Now(), avatarFileDescriptor)
+		if err != nil {
+			sentry.CaptureException(fmt.Errorf("could not purge account %v: %v", id, err))
+			failures++
+			continue
+		}
+		forgetUser(id)
+	}
+	err = deletePendingObjects()
+	if err == nil && failures > 0 {
+		err = fmt.Errorf("could not purge %v of %v accounts", failures, len(ids))
+	}
+	return err
+}
+
+// Deletes the object storage files queued for deletion. Files that could not be deleted are retried on the next call.
+func deletePendingObjects() error {
+	deletions, err := database.GetPendingObjectDeletions()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, deletion := range deletions {
+		err = deleteObject(deletion.Descriptor)
+		if err != nil {
+			lastErr = fmt.Errorf("could not delete %v: %v", deletion.Descriptor, err)
+			continue
+		}
+		err = deletion.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return lastErr
+}
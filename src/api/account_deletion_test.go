@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func deleteAccount(user database.User, password string) int {
+	marsh, _ := json.Marshal(DeleteAccountBody{Password: password})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	_ = DeleteAccount(context)
+	return recorder.Code
+}
+
+func cancelAccountDeletion(user database.User) int {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	_ = CancelAccountDeletion(context)
+	return recorder.Code
+}
+
+// Lets the purge job run as if the grace period was over
+func expireGracePeriod(userID uint) {
+	database.GetDB().Model(&database.User{}).
+		Where("id = ?", userID).
+		Update("deletion_scheduled_at", time.Now().Add(-time.Minute))
+}
+
+func countUserRows(model interface{}, userID uint) int {
+	var count int
+	database.GetDB().Unscoped().Model(model).Where("user_id = ?", userID).Count(&count)
+	return count
+}
+
+func TestDeleteAccount(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	messages, restoreMailer := fakeMailer()
+	defer restoreMailer()
+	label := setupDiary(user.ID)
+	otherLabel := setupDiary(other.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "avatar"
+	objects[avatarFileDescriptor(otherLabel.ID, 0)] = "other avatar"
+	entry := userEntries(user.ID)[0]
+	database.GetDB().Model(&entry).Association("Labels").Append(label)
+	trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+	_, _ = openSession(user, time.Minute, authLevelPassword)
+
+	assert.Equal(http.StatusBadRequest, deleteAccount(user, "wrong"))
+	assert.Equal(http.StatusAccepted, deleteAccount(user, "azer"))
+	message, sent := nextMail(messages)
+	assert.True(sent)
+	assert.Equal(user.Email, message.To)
+	assert.Equal(0, countUserRows(&database.TwoFactorsCookie{}, user.ID))
+	var refreshTokens int
+	database.GetDB().Model(&database.RefreshToken{}).Where("user_id = ? AND revoked = ?", user.ID, false).Count(&refreshTokens)
+	assert.Equal(0, refreshTokens)
+
+	// Nothing happens during the grace period, and the deletion can be cancelled
+	assert.Nil(PurgeDeletedAccounts())
+	assert.Equal(2, len(userEntries(user.ID)))
+	assert.Equal(http.StatusOK, cancelAccountDeletion(user))
+	assert.Equal(http.StatusNotFound, cancelAccountDeletion(user))
+	var cancelled database.User
+	database.GetDB().First(&cancelled, user.ID)
+	assert.Nil(cancelled.DeletionScheduledAt)
+
+	assert.Equal(http.StatusAccepted, deleteAccount(user, "azer"))
+	expireGracePeriod(user.ID)
+	assert.Nil(PurgeDeletedAccounts())
+
+	var users int
+	database.GetDB().Unscoped().Model(&database.User{}).Where("id = ?", user.ID).Count(&users)
+	assert.Equal(0, users)
+	for _, model := range []interface{}{&database.Entry{}, &database.Label{}, &database.AuditEvent{}, &database.RefreshToken{}} {
+		assert.Equal(0, countUserRows(model, user.ID))
+	}
+	var entryLabels int
+	database.GetDB().Table("entry_labels").Where("entry_id = ?", entry.ID).Count(&entryLabels)
+	assert.Equal(0, entryLabels)
+	assert.Equal(map[string]string{avatarFileDescriptor(otherLabel.ID, 0): "other avatar"}, objects)
+	assert.Equal(2, len(userEntries(other.ID)))
+
+	var tombstone database.DeletedAccount
+	assert.Nil(database.GetDB().Where("user_id = ?", user.ID).First(&tombstone).Error)
+}
+
+// Avatars that could not be deleted are retried on the next run
+func TestPurgeDeletedAccounts_ObjectStorageDown(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "avatar"
+
+	assert.Equal(http.StatusAccepted, deleteAccount(user, "azer"))
+	expireGracePeriod(user.ID)
+	working := deleteObject
+	deleteObject = func(descriptor string) error {
+		return errors.New("unavailable")
+	}
+	assert.NotNil(PurgeDeletedAccounts())
+	assert.Equal(0, len(userEntries(user.ID)))
+	assert.Equal(1, len(objects))
+
+	deleteObject = working
+	assert.Nil(PurgeDeletedAccounts())
+	assert.Equal(0, len(objects))
+	pending, _ := database.GetPendingObjectDeletions()
+	assert.Equal(0, len(pending))
+}
+
+// An account that cannot be purged does not hold back the others
+func TestPurgeDeletedAccounts_Failure(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	otherLabel := setupDiary(other.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "avatar"
+	objects[avatarFileDescriptor(otherLabel.ID, 0)] = "other avatar"
+
+	assert.Equal(http.StatusAccepted, deleteAccount(user, "azer"))
+	assert.Equal(http.StatusAccepted, deleteAccount(other, "azer"))
+	expireGracePeriod(user.ID)
+	expireGracePeriod(other.ID)
+	purgeAccount = func(userID uint, now time.Time, avatarDescriptor func(labelID uint, version int) string) (bool, error) {
+		if userID == user.ID {
+			return false, errors.New("unavailable")
+		}
+		return database.PurgeAccount(userID, now, avatarDescriptor)
+	}
+	defer func() { purgeAccount = database.PurgeAccount }()
+
+	assert.NotNil(PurgeDeletedAccounts())
+	assert.Equal(2, len(userEntries(user.ID)))
+	assert.Equal(0, len(userEntries(other.ID)))
+	assert.Equal(map[string]string{avatarFileDescriptor(label.ID, 0): "avatar"}, objects)
+
+	purgeAccount = database.PurgeAccount
+	assert.Nil(PurgeDeletedAccounts())
+	assert.Equal(0, len(userEntries(user.ID)))
+	assert.Equal(0, len(objects))
+}
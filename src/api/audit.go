@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	auditRecoveryCodesGenerated = "recovery_codes_generated"
+	auditRecoveryCodeUsed = "recovery_code_used"
+	auditWebAuthnRegistered = "webauthn_registered"
+	auditWebAuthnRemoved = "webauthn_removed"
+	auditOTPEnabled = "otp_enabled"
+	auditOTPReplaced = "otp_replaced"
+	auditOTPDisabled = "otp_disabled"
+	auditAccountLocked = "account_locked"
+	auditTrustedDeviceRevoked = "trusted_device_revoked"
+	auditTrustedDevicesRevoked = "trusted_devices_revoked"
+	auditSRPEnabled = "srp_enabled"
+	auditKDFParamsChanged = "kdf_params_changed"
+	auditPasswordChanged = "password_changed"
+	auditDataKeyWrapped = "data_key_wrapped"
+	auditAccountRecovered = "account_recovered"
+	auditPasswordResetRequested = "password_reset_requested"
+	auditPasswordReset = "password_reset"
+	auditEmailVerified = "email_verified"
+	auditEmailChangeRequested = "email_change_requested"
+	auditAccountDeletionScheduled = "account_deletion_scheduled"
+	auditAccountDeletionCancelled = "account_deletion_cancelled"
+	auditAccountExported = "account_exported"
+	auditAccountImported = "account_imported"
+)
+
+// Records a security related action. Failing to do so is reported but does not fail the request.
+func audit(context echo.Context, userID uint, action string, details string) {
+	agent := context.Request().UserAgent()
+	if len(agent) > 200 {
+		agent = agent[:200]
+	}
+	event := database.AuditEvent{
+		UserID:    userID,
+		Action:    action,
+		IpAddr:    context.RealIP(),
+		UserAgent: agent,
+		Details:   details,
+	}
+	err := database.Insert(&event)
+	if err != nil {
+		fmt.Println("could not audit", action, err.Error())
+		sentry.CaptureException(err)
+	}
+}
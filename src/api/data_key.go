@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+/*
+	Entries and avatars can be encrypted with a random data key instead of the key derived from the password.
+	The server only ever sees the data key wrapped (encrypted) by the client, once per way of unlocking it, so that
+	changing the password only replaces the password wrapping instead of re-encrypting every entry.
+*/
+
+// Data must not claim a key version the user does not have yet
+func knownKeyVersion(user database.User, version int) bool {
+	return version <= user.DataKeyVersion
+}
+
+// Version of the data key, and every wrapping of it. The user is read again, the cached one may be stale.
+func GetDataKeys(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	err := database.GetDB().Where("id = ?", user.ID).First(&user).Error
+	if err != nil {
+		return InternalError(context, err)
+	}
+	keys, err := database.GetWrappedKeys(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{
+		"data_key_version": user.DataKeyVersion,
+		"keys":             keys,
+	})
+}
+
+type WrappedKeyBody struct {
+	KeyVersion int `json:"key_version"`
+	Wrapped []byte `json:"wrapped"`
+	// Recovery wrapping only, see SetRecoveryKey
+	RecoverySecret []byte `json:"recovery_secret"`
+
+	// The current password, or a proof for users who switched to SRP
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+}
+
+/*
+	Stores a wrapping of the data key, replacing the previous one of the same kind.
+	Saving the password wrapping of the next key version creates a new data key, for users without one or who lost it
+	in a password reset. Other kinds can only wrap an existing key. Rotating the data key is not supported otherwise.
+
+	The recovery wrapping comes with the secret proving possession of the recovery key, see RecoverAccount.
+*/
+func PutWrappedKey(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody WrappedKeyBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+
+	key := database.WrappedKey{
+		Kind:       context.Param("kind"),
+		KeyVersion: parsedBody.KeyVersion,
+		Wrapped:    parsedBody.Wrapped,
+	}
+	if key.Kind == database.WrappedWithRecoveryKey {
+		if !validRecoverySecret(parsedBody.RecoverySecret) {
+			return context.String(http.StatusBadRequest, "Bad recovery secret")
+		}
+		err = database.SetRecoveryKey(user.ID, recoverySecretHash(parsedBody.RecoverySecret), key)
+	} else {
+		err = database.SaveWrappedKey(user.ID, key)
+	}
+	if validationErrors, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(validationErrors))
+	} else if err == database.ErrKeyVersionMismatch {
+		return context.String(http.StatusConflict, "Key version mismatch")
+	} else if err == database.ErrLegacyData {
+		return context.String(http.StatusConflict, "Entries and avatars must be encrypted with the data key first")
+	} else if err != nil {
+		return InternalError(context, err)
+	}
+	forgetUser(user.ID)
+	audit(context, user.ID, auditDataKeyWrapped, key.Kind)
+	return GetDataKeys(context)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+type dataKeysResponse struct {
+	DataKeyVersion int `json:"data_key_version"`
+	Keys []database.WrappedKey `json:"keys"`
+}
+
+func getDataKeys() dataKeysResponse {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	_ = GetDataKeys(context)
+	var response dataKeysResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response
+}
+
+func putWrappedKey(kind string, body WrappedKeyBody) (int, string) {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	context.SetParamNames("kind")
+	context.SetParamValues(kind)
+	_ = PutWrappedKey(context)
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestDataKey(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "old key avatar"
+
+	assert.Equal(0, getDataKeys().DataKeyVersion)
+	assert.Equal(0, len(getDataKeys().Keys))
+
+	dataKeyEntry, _ := json.Marshal(database.PartialEntry{Title: "Title", Content: "data key", KeyVersion: 1})
+	recorder := runAddEntry(dataKeyEntry, t)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("Unknown key version", recorder.Body.String())
+
+	wrapped := bytes.Repeat([]byte{1}, 48)
+	code, msg := putWrappedKey(database.WrappedWithPassword, WrappedKeyBody{KeyVersion: 1, Wrapped: wrapped, Password: "wrong"})
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Wrong password", msg)
+	code, _ = putWrappedKey(database.WrappedWithPassword, WrappedKeyBody{KeyVersion: 1, Wrapped: wrapped, Password: "azer"})
+	assert.Equal(http.StatusOK, code)
+	// Entries encrypted with the key derived from the password could not be recovered
+	secret := bytes.Repeat([]byte{3}, 32)
+	code, _ = putWrappedKey(database.WrappedWithRecoveryKey,
+		WrappedKeyBody{KeyVersion: 1, Wrapped: wrapped, RecoverySecret: secret, Password: "azer"})
+	assert.Equal(http.StatusConflict, code)
+	code, _ = putWrappedKey("unknown", WrappedKeyBody{KeyVersion: 1, Wrapped: wrapped, Password: "azer"})
+	assert.Equal(http.StatusBadRequest, code)
+
+	keys := getDataKeys()
+	assert.Equal(1, keys.DataKeyVersion)
+	assert.Equal(1, len(keys.Keys))
+
+	recorder = runAddEntry(dataKeyEntry, t)
+	assert.Equal(http.StatusCreated, recorder.Code)
+
+	// Only data still encrypted with the key derived from the password is re-encrypted
+	var legacyEntries []database.Entry
+	database.GetDB().Where("user_id = ?", user.ID).Where("key_version = ?", 0).Order("id").Find(&legacyEntries)
+	body := PasswordChangeBody{
+		Password:    "azer",
+		NewPassword: "N3w password!",
+		Entries:     reEncrypt(legacyEntries),
+		Avatars:     []ReEncryptedAvatar{{LabelID: label.ID, Data: []byte("new key avatar")}},
+	}
+	code, _ = changePassword(body)
+	assert.Equal(http.StatusConflict, code)
+
+	rewrapped := bytes.Repeat([]byte{2}, 48)
+	body.WrappedKey = rewrapped
+	code, _ = changePassword(body)
+	assert.Equal(http.StatusOK, code)
+
+	for _, entry := range userEntries(user.ID) {
+		if entry.KeyVersion == 0 {
+			assert.Contains(entry.Content, "new key:")
+		} else {
+			assert.Equal("data key", entry.Content)
+		}
+	}
+	keys = getDataKeys()
+	assert.Equal(database.WrappedWithPassword, keys.Keys[0].Kind)
+	assert.Equal(rewrapped, keys.Keys[0].Wrapped)
+}
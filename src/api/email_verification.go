@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+	Addresses are verified with a link emailed at registration, and when changed. EMAIL_VERIFICATION sets what
+	unverified accounts cannot do: "login", "entries" (they can log in but not write), or nothing by default.
+*/
+
+const (
+	emailVerificationLogin = "login"
+	emailVerificationEntries = "entries"
+)
+
+const emailVerificationPurpose = "email-verification"
+const emailVerificationTokenDuration = time.Hour * 24
+// At most this many emails per user in an hour, so that the endpoints cannot be used to spam
+const maxEmailVerificationRequests = 3
+
+// Checks the EMAIL_VERIFICATION value, at startup
+func CheckEmailVerificationPolicy() bool {
+	policy := os.Getenv("EMAIL_VERIFICATION")
+	return policy == "" || policy == "none" || policy == emailVerificationLogin || policy == emailVerificationEntries
+}
+
+// Whether the policy prevents the user from doing this, as long as their address is not verified
+func blockedUntilVerified(user database.User, action string) bool {
+	if user.EmailVerifiedAt != nil {
+		return false
+	}
+	policy := os.Getenv("EMAIL_VERIFICATION")
+	// Sessions opened before the policy was set are not logged out, entries are blocked for them too
+	return policy == action || (policy == emailVerificationLogin && action == emailVerificationEntries)
+}
+
+func emailNotVerified(context echo.Context) error {
+	return context.String(http.StatusForbidden, "Email not verified")
+}
+
+/*
+	Emails a verification link for the given address, the current one or the one replacing it.
+	SRP users changing address send a verifier computed with it, used once it is verified.
+	Returns false if too many emails were sent recently.
+*/
+func sendEmailVerification(user database.User, email string, newSRP *SRPRegistrationBody) (bool, error) {
+	if !mailEnabled() {
+		return false, nil
+	}
+	count, err := database.CountEmailVerificationTokens(user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		return false, err
+	}
+	if count >= maxEmailVerificationRequests {
+		return false, nil
+	}
+	token, err := newEmailedToken(emailVerificationPurpose)
+	if err != nil {
+		return false, err
+	}
+	verificationToken := database.EmailVerificationToken{
+		TokenHash: hashEmailedToken(token),
+		UserID:    user.ID,
+		Email:     email,
+		Expires:   time.Now().Add(emailVerificationTokenDuration),
+	}
+	if newSRP != nil {
+		verificationToken.SRPSalt = newSRP.Salt
+		verificationToken.SRPVerifier = newSRP.Verifier
+	}
+	err = database.Insert(&verificationToken)
+	if err != nil {
+		return false, err
+	}
+	deliver(mailer.VerifyEmail, email, map[string]string{
+		"Email":    email,
+		"Link":     clientLink("/verify-email", token),
+		"ValidFor": "24 hours",
+	})
+	return true, nil
+}
+
+type EmailVerificationBody struct {
+	Token string `json:"token"`
+}
+
+// Marks the address the token was sent to as verified, and makes it the email of the user if it is a new one
+func VerifyEmail(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody EmailVerificationBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	if !verifyEmailedToken(emailVerificationPurpose, parsedBody.Token) {
+		return context.String(http.StatusBadRequest, "Invalid or expired token")
+	}
+
+	user, err := database.VerifyEmail(hashEmailedToken(parsedBody.Token))
+	if err == database.ErrInvalidVerificationToken {
+		return context.String(http.StatusBadRequest, "Invalid or expired token")
+	} else if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return context.String(http.StatusConflict, "Email already used by another account")
+	} else if err != nil {
+		return InternalError(context, err)
+	}
+	forgetUser(user.ID)
+	audit(context, user.ID, auditEmailVerified, user.Email)
+	return context.JSON(http.StatusOK, map[string]interface{}{"user": user})
+}
+
+type ResendEmailVerificationBody struct {
+	Email string `json:"email"`
+}
+
+// Not authenticated, unverified users may not be able to log in. The response never tells if an email was sent.
+func ResendEmailVerification(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody ResendEmailVerificationBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || parsedBody.Email == "" {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	var user database.User
+	result := database.GetDB().Where("email = ?", parsedBody.Email).First(&user)
+	if result.RecordNotFound() || (result.Error == nil && user.EmailVerifiedAt != nil) {
+		return context.NoContent(http.StatusAccepted)
+	} else if result.Error != nil {
+		return InternalError(context, result.Error)
+	}
+	_, err = sendEmailVerification(user, user.Email, nil)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.NoContent(http.StatusAccepted)
+}
+
+type ChangeEmailBody struct {
+	Email string `json:"email" validate:"email,required"`
+
+	// The current password, or a proof for users who switched to SRP
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+
+	// Required for users who switched to SRP: a verifier computed with the new address as identity
+	NewSRP *SRPRegistrationBody `json:"new_srp"`
+}
+
+// The address only changes once the link sent to it is opened
+func ChangeEmail(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody ChangeEmailBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	err = validator.New().StructPartial(parsedBody, "Email")
+	if err, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(err))
+	}
+	if parsedBody.Email == user.Email {
+		return context.String(http.StatusBadRequest, "Same email")
+	}
+	if user.UsesSRP {
+		if parsedBody.NewSRP == nil {
+			return context.String(http.StatusBadRequest, "New SRP verifier required")
+		}
+		if msg, ok := parsedBody.NewSRP.validate(); !ok {
+			return context.String(http.StatusBadRequest, msg)
+		}
+	} else {
+		parsedBody.NewSRP = nil
+	}
+
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+	var taken int
+	err = database.GetDB().Model(&database.User{}).Where("email = ?", parsedBody.Email).Count(&taken).Error
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if taken > 0 {
+		return context.String(http.StatusConflict, "Email already used by another account")
+	}
+
+	sent, err := sendEmailVerification(user, parsedBody.Email, parsedBody.NewSRP)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !sent {
+		return context.String(http.StatusTooManyRequests, "Too many emails sent, retry later")
+	}
+	audit(context, user.ID, auditEmailChangeRequested, parsedBody.Email)
+	return context.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
+	"github.com/Yuruh/encrypted-diary/src/srp"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+)
+
+var verificationTokenPattern = regexp.MustCompile(`verify-email\?token=(\S+)`)
+
+func verificationToken(t *testing.T, messages <-chan mailer.Message, to string) string {
+	message, sent := nextMail(messages)
+	if !sent {
+		t.Fatal("no verification email sent")
+	}
+	asserthelper.Equal(t, to, message.To)
+	return verificationTokenPattern.FindStringSubmatch(message.Text)[1]
+}
+
+func verifyEmail(token string) int {
+	marsh, _ := json.Marshal(EmailVerificationBody{Token: token})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = VerifyEmail(context)
+	return recorder.Code
+}
+
+func resendEmailVerification(email string) int {
+	marsh, _ := json.Marshal(ResendEmailVerificationBody{Email: email})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = ResendEmailVerification(context)
+	return recorder.Code
+}
+
+func changeEmail(user database.User, body ChangeEmailBody) (int, string) {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	_ = ChangeEmail(context)
+	return recorder.Code, recorder.Body.String()
+}
+
+// A proof for checkPassword, from a handshake started as a client would
+func srpProof(t *testing.T, email string, password string) *SRPProof {
+	marsh, _ := json.Marshal(SRPBeginBody{Email: email})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	if err := BeginSRPLogin(context); err != nil {
+		t.Fatal(err)
+	}
+	var begin srpBeginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &begin)
+	client, _ := srp.NewClient(email, password)
+	proof, _ := client.Proof(begin.Salt, begin.ServerEphemeral)
+	return &SRPProof{begin.Handshake, client.PublicEphemeral(), proof}
+}
+
+func TestVerifyEmail_Registration(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+	defer os.Unsetenv("EMAIL_VERIFICATION")
+
+	email := "new@user.com"
+	marsh, _ := json.Marshal(LoginBody{Email: email, Password: "N3w password!"})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(Register(context))
+	assert.Equal(http.StatusCreated, recorder.Code)
+	token := verificationToken(t, messages, email)
+
+	_ = os.Setenv("EMAIL_VERIFICATION", emailVerificationLogin)
+	code, _ := login(email, "N3w password!")
+	assert.Equal(http.StatusForbidden, code)
+	// Only once the password is checked
+	code, _ = login(email, "wrong")
+	assert.Equal(http.StatusNotFound, code)
+
+	assert.Equal(http.StatusBadRequest, verifyEmail(token[:20] + "." + token[len(token) - 10:]))
+	assert.Equal(http.StatusOK, verifyEmail(token))
+	assert.Equal(http.StatusBadRequest, verifyEmail(token))
+
+	var user database.User
+	database.GetDB().Where("email = ?", email).First(&user)
+	assert.NotNil(user.EmailVerifiedAt)
+	code, _ = login(email, "N3w password!")
+	assert.Equal(http.StatusOK, code)
+
+	// Already verified, nothing to resend
+	assert.Equal(http.StatusAccepted, resendEmailVerification(email))
+	_, sent := nextMail(messages)
+	assert.False(sent)
+}
+
+func TestVerifyEmail_Entries(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	defer os.Unsetenv("EMAIL_VERIFICATION")
+	entry, _ := json.Marshal(database.PartialEntry{Title: "Title", Content: "content"})
+
+	_ = os.Setenv("EMAIL_VERIFICATION", emailVerificationEntries)
+	code, _ := login(user.Email, "azer")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(http.StatusForbidden, runAddEntry(entry, t).Code)
+
+	// Logged in before the policy was set
+	_ = os.Setenv("EMAIL_VERIFICATION", emailVerificationLogin)
+	assert.Equal(http.StatusForbidden, runAddEntry(entry, t).Code)
+
+	_ = os.Setenv("EMAIL_VERIFICATION", "")
+	assert.Equal(http.StatusCreated, runAddEntry(entry, t).Code)
+}
+
+func TestResendEmailVerification_Throttle(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+
+	assert.Equal(http.StatusAccepted, resendEmailVerification("unknown@mail.com"))
+	_, sent := nextMail(messages)
+	assert.False(sent)
+
+	for i := 0; i < maxEmailVerificationRequests; i++ {
+		assert.Equal(http.StatusAccepted, resendEmailVerification(user.Email))
+		verificationToken(t, messages, user.Email)
+	}
+	assert.Equal(http.StatusAccepted, resendEmailVerification(user.Email))
+	_, sent = nextMail(messages)
+	assert.False(sent)
+}
+
+func TestChangeEmail(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+
+	code, _ := changeEmail(user, ChangeEmailBody{Email: "changed@user.com", Password: "wrong"})
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = changeEmail(user, ChangeEmailBody{Email: "not an email", Password: "azer"})
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = changeEmail(user, ChangeEmailBody{Email: other.Email, Password: "azer"})
+	assert.Equal(http.StatusConflict, code)
+
+	code, _ = changeEmail(user, ChangeEmailBody{Email: "changed@user.com", Password: "azer"})
+	assert.Equal(http.StatusAccepted, code)
+	token := verificationToken(t, messages, "changed@user.com")
+	// Unchanged until verified
+	code, _ = login(user.Email, "azer")
+	assert.Equal(http.StatusOK, code)
+
+	assert.Equal(http.StatusOK, verifyEmail(token))
+	code, _ = login("changed@user.com", "azer")
+	assert.Equal(http.StatusOK, code)
+	var updated database.User
+	database.GetDB().Where("id = ?", user.ID).First(&updated)
+	assert.Equal("changed@user.com", updated.Email)
+	assert.NotNil(updated.EmailVerifiedAt)
+}
+
+// Changing the password in between cancels the change
+func TestChangeEmail_CredentialsChanged(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+
+	code, _ := changeEmail(user, ChangeEmailBody{Email: "changed@user.com", Password: "azer"})
+	assert.Equal(http.StatusAccepted, code)
+	token := verificationToken(t, messages, "changed@user.com")
+
+	code, _ = changePassword(PasswordChangeBody{Password: "azer", NewPassword: "N3w password!"})
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(http.StatusBadRequest, verifyEmail(token))
+}
+
+// The SRP identity is the email, the verifier is replaced along with it
+func TestChangeEmail_SRP(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+	registerSRP(t, srpEmail, "correct horse")
+	verificationToken(t, messages, srpEmail)
+	var user database.User
+	database.GetDB().Where("email = ?", srpEmail).First(&user)
+
+	code, msg := changeEmail(user, ChangeEmailBody{Email: "changed@user.com", SRP: srpProof(t, srpEmail, "correct horse")})
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("New SRP verifier required", msg)
+
+	code, _ = changeEmail(user, ChangeEmailBody{
+		Email:  "changed@user.com",
+		SRP:    srpProof(t, srpEmail, "correct horse"),
+		NewSRP: &SRPRegistrationBody{Salt: srpSalt, Verifier: srp.Verifier(srpSalt, "changed@user.com", "correct horse")},
+	})
+	assert.Equal(http.StatusAccepted, code)
+	assert.Equal(http.StatusOK, verifyEmail(verificationToken(t, messages, "changed@user.com")))
+
+	_, code, _ = srpLogin(t, "changed@user.com", "correct horse")
+	assert.Equal(http.StatusOK, code)
+}
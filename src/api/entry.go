@@ -12,6 +12,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 /*
@@ -186,10 +187,15 @@ func GetEntry(context echo.Context) error {
 type AddEntryRequestBody struct {
 	database.PartialEntry
 	LabelsID []uint `json:"labels_id"`
+	// Date of the entry, now if not set. Set for entries imported from elsewhere.
+	CreatedAt *time.Time `json:"created_at"`
 }
 
 func AddEntry(context echo.Context) error {
 	var user database.User = context.Get("user").(database.User)
+	if blockedUntilVerified(user, emailVerificationEntries) {
+		return emailNotVerified(context)
+	}
 
 	entry, errorString := buildEntryFromRequestBody(context, user)
 	if errorString != "" {
@@ -231,7 +237,24 @@ func buildEntryFromRequestBody(context echo.Context, user database.User) (databa
 		fmt.Println(response.Error.Error())
 	}
 
+	return entryFromRequestBody(user, requestBody, labels)
+}
+
+// Checks the request body, and builds the entry it describes with the given labels, read beforehand
+func entryFromRequestBody(user database.User, requestBody AddEntryRequestBody, labels []database.Label) (database.Entry, string) {
+	if !knownKeyVersion(user, requestBody.KeyVersion) {
+		return database.Entry{}, "Unknown key version"
+	}
+	var createdAt time.Time
+	if requestBody.CreatedAt != nil {
+		if requestBody.CreatedAt.After(time.Now().Add(time.Minute)) {
+			return database.Entry{}, "Date in the future"
+		}
+		createdAt = *requestBody.CreatedAt
+	}
+
 	return database.Entry{
+		BaseModel: database.BaseModel{CreatedAt: createdAt},
 		PartialEntry: requestBody.PartialEntry,
 		UserID:user.ID,
 		Labels: labels,
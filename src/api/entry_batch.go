@@ -0,0 +1,199 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Most operations in a batch, unless set by ENTRIES_BATCH_MAX_SIZE
+const defaultEntriesBatchMaxSize = 500
+
+const (
+	batchApplied = "ok"
+	batchInvalid = "invalid"
+	batchNotFound = "not_found"
+)
+
+type EntryBatchOperation struct {
+	// Chosen by the client, given back in the result of the operation
+	Ref string `json:"ref"`
+	// create, update or delete
+	Op string `json:"op"`
+	// Entry to update or delete
+	ID uint `json:"id"`
+	// Entry to create, or new version of the entry to update
+	Entry AddEntryRequestBody `json:"entry"`
+}
+
+type EntryBatchBody struct {
+	Operations []EntryBatchOperation `json:"operations"`
+}
+
+type EntryBatchResult struct {
+	Ref string `json:"ref"`
+	// ok once applied. When the batch fails, invalid or not_found for the operations at fault, empty for the others.
+	Status string `json:"status"`
+	// Entry created or updated
+	Entry *database.Entry `json:"entry,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func entriesBatchMaxSize() (int, error) {
+	value := os.Getenv("ENTRIES_BATCH_MAX_SIZE")
+	if value == "" {
+		return defaultEntriesBatchMaxSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 {
+		return 0, errors.New("ENTRIES_BATCH_MAX_SIZE must be a positive integer")
+	}
+	return size, nil
+}
+
+// Checks the ENTRIES_BATCH_MAX_SIZE value, at startup
+func CheckEntriesBatchMaxSize() bool {
+	_, err := entriesBatchMaxSize()
+	return err == nil
+}
+
+// Labels of the user among the ones of every operation, read in a single query, by ID
+func batchLabels(userID uint, operations []EntryBatchOperation) (map[uint]database.Label, error) {
+	var ids []uint
+	for _, operation := range operations {
+		ids = append(ids, operation.Entry.LabelsID...)
+	}
+	labels := make(map[uint]database.Label)
+	if len(ids) == 0 {
+		return labels, nil
+	}
+	var found []database.Label
+	err := database.GetDB().
+		Where("user_id = ?", userID).
+		Where("id IN (?)", ids).
+		Find(&found).Error
+	for _, label := range found {
+		labels[label.ID] = label
+	}
+	return labels, err
+}
+
+// Builds the database operation. Returns a message for the user if the operation is invalid.
+func buildEntryOperation(user database.User, operation EntryBatchOperation, labels map[uint]database.Label) (database.EntryOperation, string) {
+	switch operation.Op {
+	case database.BatchCreate, database.BatchUpdate:
+		if operation.Op == database.BatchUpdate && operation.ID == 0 {
+			return database.EntryOperation{}, "Missing id"
+		}
+		// Unknown labels are ignored, as in AddEntry
+		entryLabels := []database.Label{}
+		associated := make(map[uint]bool, len(operation.Entry.LabelsID))
+		for _, id := range operation.Entry.LabelsID {
+			if label, found := labels[id]; found && !associated[id] {
+				associated[id] = true
+				entryLabels = append(entryLabels, label)
+			}
+		}
+		entry, msg := entryFromRequestBody(user, operation.Entry, entryLabels)
+		if msg != "" {
+			return database.EntryOperation{}, msg
+		}
+		if operation.Op == database.BatchUpdate {
+			entry.ID = operation.ID
+		}
+		if err := entry.Validate(); err != nil {
+			return database.EntryOperation{}, validationMessage(err)
+		}
+		return database.EntryOperation{Op: operation.Op, Entry: entry}, ""
+	case database.BatchDelete:
+		if operation.ID == 0 {
+			return database.EntryOperation{}, "Missing id"
+		}
+		return database.EntryOperation{Op: operation.Op, Entry: database.Entry{BaseModel: database.BaseModel{ID: operation.ID}}}, ""
+	}
+	return database.EntryOperation{}, "Unknown operation " + operation.Op
+}
+
+/*
+	Creates, updates and deletes entries in a single transaction, so that importing or re-encrypting a diary does not
+	take one request per entry. If any operation fails, nothing is applied and the results tell which one.
+*/
+func BatchEntries(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody EntryBatchBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	operations := parsedBody.Operations
+	if len(operations) == 0 {
+		return context.String(http.StatusBadRequest, "No operations")
+	}
+	maxSize, err := entriesBatchMaxSize()
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if len(operations) > maxSize {
+		return context.String(http.StatusRequestEntityTooLarge, "At most " + strconv.Itoa(maxSize) + " operations per batch")
+	}
+	for _, operation := range operations {
+		if operation.Op == database.BatchCreate && blockedUntilVerified(user, emailVerificationEntries) {
+			return emailNotVerified(context)
+		}
+	}
+
+	labels, err := batchLabels(user.ID, operations)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	results := make([]EntryBatchResult, len(operations))
+	entryOperations := make([]database.EntryOperation, len(operations))
+	refs := make(map[string]bool, len(operations))
+	invalid := false
+	for i, operation := range operations {
+		results[i].Ref = operation.Ref
+		var msg string
+		if operation.Ref == "" {
+			msg = "Missing ref"
+		} else if refs[operation.Ref] {
+			msg = "Duplicate ref"
+		} else {
+			entryOperations[i], msg = buildEntryOperation(user, operation, labels)
+		}
+		refs[operation.Ref] = true
+		if msg != "" {
+			results[i].Status, results[i].Error = batchInvalid, msg
+			invalid = true
+		}
+	}
+	if invalid {
+		return context.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"results": results})
+	}
+
+	entries, err := database.ApplyEntryBatch(user.ID, entryOperations)
+	if batchErr, ok := err.(database.EntryBatchError); ok && batchErr.Err == database.ErrEntryNotFound {
+		results[batchErr.Index].Status, results[batchErr.Index].Error = batchNotFound, "Entry not found"
+		return context.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"results": results})
+	}
+	if err != nil {
+		return InternalError(context, err)
+	}
+	for i := range entries {
+		results[i].Status = batchApplied
+		if entryOperations[i].Op != database.BatchDelete {
+			results[i].Entry = &entries[i]
+		}
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"results": results})
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func batchEntries(user database.User, operations []EntryBatchOperation) (int, []EntryBatchResult) {
+	marsh, _ := json.Marshal(EntryBatchBody{Operations: operations})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	_ = BatchEntries(context)
+	var response struct {
+		Results []EntryBatchResult `json:"results"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response.Results
+}
+
+func batchEntry(title string, labels ...uint) AddEntryRequestBody {
+	return AddEntryRequestBody{PartialEntry: database.PartialEntry{Title: title, Content: "ciphertext"}, LabelsID: labels}
+}
+
+func TestBatchEntries(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	label := setupDiary(user.ID)
+	setupDiary(other.ID)
+	entries := userEntries(user.ID)
+	date := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	created := batchEntry("Imported", label.ID, label.ID, 99999)
+	created.CreatedAt = &date
+
+	code, results := batchEntries(user, []EntryBatchOperation{
+		{Ref: "new", Op: database.BatchCreate, Entry: created},
+		{Ref: "edit", Op: database.BatchUpdate, ID: entries[0].ID, Entry: batchEntry("Edited", label.ID)},
+		{Ref: "remove", Op: database.BatchDelete, ID: entries[1].ID},
+	})
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(3, len(results))
+	for _, result := range results {
+		assert.Equal(batchApplied, result.Status)
+	}
+	assert.Equal("new", results[0].Ref)
+	assert.Nil(results[2].Entry)
+
+	var imported database.Entry
+	database.GetDB().Preload("Labels").First(&imported, results[0].Entry.ID)
+	assert.True(date.Equal(imported.CreatedAt))
+	assert.Equal(1, len(imported.Labels))
+
+	var edited database.Entry
+	database.GetDB().Preload("Labels").First(&edited, entries[0].ID)
+	assert.Equal("Edited", edited.Title)
+	assert.True(entries[0].CreatedAt.Equal(edited.CreatedAt))
+	assert.Equal(1, len(edited.Labels))
+	assert.Equal(2, len(userEntries(user.ID)))
+}
+
+// A single failing operation cancels the whole batch
+func TestBatchEntries_Failures(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	setupDiary(user.ID)
+	setupDiary(other.ID)
+	otherEntry := userEntries(other.ID)[0]
+
+	code, _ := batchEntries(user, nil)
+	assert.Equal(http.StatusBadRequest, code)
+
+	code, results := batchEntries(user, []EntryBatchOperation{
+		{Ref: "valid", Op: database.BatchCreate, Entry: batchEntry("Valid")},
+		{Op: database.BatchCreate, Entry: batchEntry("No ref")},
+		{Ref: "valid", Op: database.BatchCreate, Entry: batchEntry("Same ref")},
+		{Ref: "short", Op: database.BatchCreate, Entry: batchEntry("ab")},
+		{Ref: "no id", Op: database.BatchUpdate, Entry: batchEntry("Valid")},
+		{Ref: "unknown", Op: "upsert", Entry: batchEntry("Valid")},
+	})
+	assert.Equal(http.StatusUnprocessableEntity, code)
+	assert.Equal("", results[0].Status)
+	assert.Equal("Missing ref", results[1].Error)
+	assert.Equal("Duplicate ref", results[2].Error)
+	for _, result := range results[1:] {
+		assert.Equal(batchInvalid, result.Status)
+	}
+	assert.Equal(2, len(userEntries(user.ID)))
+
+	code, results = batchEntries(user, []EntryBatchOperation{
+		{Ref: "valid", Op: database.BatchCreate, Entry: batchEntry("Valid")},
+		{Ref: "not mine", Op: database.BatchDelete, ID: otherEntry.ID},
+	})
+	assert.Equal(http.StatusUnprocessableEntity, code)
+	assert.Equal("", results[0].Status)
+	assert.Equal(batchNotFound, results[1].Status)
+	assert.Equal(2, len(userEntries(user.ID)))
+	assert.Equal(2, len(userEntries(other.ID)))
+
+	_ = os.Setenv("ENTRIES_BATCH_MAX_SIZE", "1")
+	defer os.Unsetenv("ENTRIES_BATCH_MAX_SIZE")
+	code, _ = batchEntries(user, []EntryBatchOperation{
+		{Ref: "first", Op: database.BatchCreate, Entry: batchEntry("First")},
+		{Ref: "second", Op: database.BatchCreate, Entry: batchEntry("Second")},
+	})
+	assert.Equal(http.StatusRequestEntityTooLarge, code)
+}
+
+func TestCheckEntriesBatchMaxSize(t *testing.T) {
+	assert := asserthelper.New(t)
+	defer os.Unsetenv("ENTRIES_BATCH_MAX_SIZE")
+
+	assert.True(CheckEntriesBatchMaxSize())
+	_ = os.Setenv("ENTRIES_BATCH_MAX_SIZE", "0")
+	assert.False(CheckEntriesBatchMaxSize())
+	_ = os.Setenv("ENTRIES_BATCH_MAX_SIZE", "many")
+	assert.False(CheckEntriesBatchMaxSize())
+	_ = os.Setenv("ENTRIES_BATCH_MAX_SIZE", "1000")
+	assert.True(CheckEntriesBatchMaxSize())
+}
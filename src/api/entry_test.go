@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"strconv"
 	"testing"
+	"time"
 )
 
 type getEntriesResponse struct {
@@ -459,6 +460,7 @@ func TestAddEntry(t *testing.T) {
 	t.Run("Invalid json", testAddInvalidJson)
 
 	t.Run("Associate existing labels", testAssociateLabels)
+	t.Run("Backdated", testAddBackdatedEntry)
 }
 
 func runAddEntry(arg []byte, t *testing.T) *httptest.ResponseRecorder {
@@ -531,6 +533,25 @@ func testAddInvalidJson(t *testing.T) {
 	}
 }
 
+func testAddBackdatedEntry(t *testing.T) {
+	assert := asserthelper.New(t)
+	date := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	marshall, _ := json.Marshal(AddEntryRequestBody{PartialEntry: validEntry.PartialEntry, CreatedAt: &date})
+	recorder := runAddEntry(marshall, t)
+	assert.Equal(http.StatusCreated, recorder.Code)
+
+	var response response
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	var entry database.Entry
+	database.GetDB().First(&entry, response.Entry.ID)
+	assert.True(date.Equal(entry.CreatedAt))
+
+	future := time.Now().Add(time.Hour)
+	marshall, _ = json.Marshal(AddEntryRequestBody{PartialEntry: validEntry.PartialEntry, CreatedAt: &future})
+	recorder = runAddEntry(marshall, t)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+}
+
 func testAssociateLabels(t *testing.T) {
 	assert := asserthelper.New(t)
 
@@ -0,0 +1,536 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/object-storage/ovh"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+	Version of the archive layout, see the Export schemas in openapi.yml.
+	Increased on any change that is not only an addition.
+*/
+const exportFormatVersion = 1
+
+// Format of the manifest, tells an export archive from any other zip
+const exportFormat = "encrypted-diary-export"
+
+const (
+	// How long the archive of a background export can be downloaded
+	exportRetention = time.Hour * 24
+	// How long a download link of a background export is valid
+	exportLinkDuration = time.Hour
+	// Background exports pending for longer will never finish
+	exportStalledAfter = time.Hour
+	// Entries read at once while an archive is written
+	exportEntriesBatchSize = 200
+)
+
+var (
+	// Accounts with more entries and avatars are exported in the background, var so that tests can lower it
+	exportSyncMaxItems = 500
+	fetchObject = ovh.DownloadFileFromPrivateObjectStorage
+	objectTemporaryAccess = ovh.GetFileTemporaryAccess
+)
+
+type ExportManifest struct {
+	Format string `json:"format"`
+	Version int `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID uint `json:"user_id"`
+	Entries int `json:"entries"`
+	Labels int `json:"labels"`
+	Avatars int `json:"avatars"`
+}
+
+type ExportedAccount struct {
+	database.User
+	KDFParams *database.KDFParams `json:"kdf_params"`
+	WrappedKeys []database.WrappedKey `json:"wrapped_keys"`
+}
+
+// The content stays encrypted, title, dates and labels are exported as stored
+type ExportedEntry struct {
+	ID uint `json:"id"`
+	Title string `json:"title"`
+	Content string `json:"content"`
+	KeyVersion int `json:"key_version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	LabelIDs []uint `json:"label_ids"`
+}
+
+type ExportedLabel struct {
+	ID uint `json:"id"`
+	Name string `json:"name"`
+	Color string `json:"color"`
+	KeyVersion int `json:"key_version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Path of the encrypted avatar in the archive, empty without avatar
+	Avatar string `json:"avatar"`
+}
+
+type ExportedDevices struct {
+	HasRegisteredOTP bool `json:"has_registered_otp"`
+	SecurityKeys []database.WebAuthnCredential `json:"security_keys"`
+	TrustedDevices []database.TwoFactorsCookie `json:"trusted_devices"`
+	RecoveryCodesLeft int `json:"recovery_codes_left"`
+}
+
+/*
+	Everything in the archive. Unless prefetched, entries and avatars are only read while the archive is written,
+	so that exporting a large account does not hold it all in memory.
+*/
+type accountArchive struct {
+	manifest ExportManifest
+	account ExportedAccount
+	// Read from the database in batches while written when streamedEntries is set
+	entries []ExportedEntry
+	streamedEntries bool
+	labels []ExportedLabel
+	// Content by path in the archive, the others are fetched from object storage while written
+	avatars map[string][]byte
+	avatarDescriptors map[string]string
+	devices ExportedDevices
+	history []database.AuditEvent
+}
+
+func exportAvatarPath(labelID uint) string {
+	return "avatars/label_" + strconv.Itoa(int(labelID))
+}
+
+func countExportItems(userID uint) (int, error) {
+	var entries, avatars int
+	err := database.GetDB().Model(&database.Entry{}).Where("user_id = ?", userID).Count(&entries).Error
+	if err != nil {
+		return 0, err
+	}
+	err = database.GetDB().Model(&database.Label{}).
+		Where("user_id = ?", userID).
+		Where("has_avatar = ?", true).
+		Count(&avatars).Error
+	return entries + avatars, err
+}
+
+// Entries of the user after afterID, by ID
+func readExportedEntries(userID uint, afterID uint, limit int) ([]ExportedEntry, error) {
+	var entries []database.Entry
+	err := database.GetDB().
+		Preload("Labels").
+		Where("user_id = ?", userID).
+		Where("id > ?", afterID).
+		Order("id").
+		Limit(limit).
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	exported := make([]ExportedEntry, 0, len(entries))
+	for _, entry := range entries {
+		labelIDs := make([]uint, 0, len(entry.Labels))
+		for _, label := range entry.Labels {
+			labelIDs = append(labelIDs, label.ID)
+		}
+		exported = append(exported, ExportedEntry{
+			ID:         entry.ID,
+			Title:      entry.Title,
+			Content:    entry.Content,
+			KeyVersion: entry.KeyVersion,
+			CreatedAt:  entry.CreatedAt,
+			UpdatedAt:  entry.UpdatedAt,
+			LabelIDs:   labelIDs,
+		})
+	}
+	return exported, nil
+}
+
+// Reads all but the entries and avatars, see prefetch
+func readAccountArchive(userID uint) (accountArchive, error) {
+	archive := accountArchive{
+		streamedEntries:   true,
+		avatars:           map[string][]byte{},
+		avatarDescriptors: map[string]string{},
+	}
+	db := database.GetDB()
+
+	err := db.Where("id = ?", userID).First(&archive.account.User).Error
+	if err != nil {
+		return archive, err
+	}
+	params, found, err := database.GetKDFParams(userID)
+	if err != nil {
+		return archive, err
+	}
+	if found {
+		archive.account.KDFParams = &params
+	}
+	archive.account.WrappedKeys, err = database.GetWrappedKeys(userID)
+	if err != nil {
+		return archive, err
+	}
+
+	var entries int
+	err = db.Model(&database.Entry{}).Where("user_id = ?", userID).Count(&entries).Error
+	if err != nil {
+		return archive, err
+	}
+
+	var labels []database.Label
+	err = db.Where("user_id = ?", userID).Order("id").Find(&labels).Error
+	if err != nil {
+		return archive, err
+	}
+	archive.labels = make([]ExportedLabel, 0, len(labels))
+	for _, label := range labels {
+		exported := ExportedLabel{
+			ID:         label.ID,
+			Name:       label.Name,
+			Color:      label.Color,
+			KeyVersion: label.KeyVersion,
+			CreatedAt:  label.CreatedAt,
+			UpdatedAt:  label.UpdatedAt,
+		}
+		if label.HasAvatar {
+			exported.Avatar = exportAvatarPath(label.ID)
+			archive.avatarDescriptors[exported.Avatar] = getLabelAvatarFileDescriptor(label)
+		}
+		archive.labels = append(archive.labels, exported)
+	}
+
+	archive.devices.HasRegisteredOTP = archive.account.HasRegisteredOTP
+	archive.devices.SecurityKeys, err = database.GetWebAuthnCredentials(userID)
+	if err != nil {
+		return archive, err
+	}
+	archive.devices.TrustedDevices, err = database.GetTwoFactorsCookies(userID)
+	if err != nil {
+		return archive, err
+	}
+	archive.devices.RecoveryCodesLeft, err = database.CountRemainingRecoveryCodes(userID)
+	if err != nil {
+		return archive, err
+	}
+
+	err = db.Where("user_id = ?", userID).Order("id").Find(&archive.history).Error
+	if err != nil {
+		return archive, err
+	}
+
+	archive.manifest = ExportManifest{
+		Format:    exportFormat,
+		Version:   exportFormatVersion,
+		CreatedAt: time.Now(),
+		UserID:    userID,
+		Entries:   entries,
+		Labels:    len(archive.labels),
+		Avatars:   len(archive.avatarDescriptors),
+	}
+	return archive, nil
+}
+
+// Reads the entries and avatars, so that nothing is left to fail once the archive is being written
+func (archive *accountArchive) prefetch() error {
+	archive.entries = []ExportedEntry{}
+	for {
+		var afterID uint
+		if len(archive.entries) > 0 {
+			afterID = archive.entries[len(archive.entries) - 1].ID
+		}
+		batch, err := readExportedEntries(archive.manifest.UserID, afterID, exportEntriesBatchSize)
+		if err != nil {
+			return err
+		}
+		archive.entries = append(archive.entries, batch...)
+		if len(batch) < exportEntriesBatchSize {
+			break
+		}
+	}
+	archive.streamedEntries = false
+	archive.manifest.Entries = len(archive.entries)
+
+	for _, label := range archive.labels {
+		if label.Avatar == "" {
+			continue
+		}
+		content, err := archive.avatar(label)
+		if err != nil {
+			return err
+		}
+		archive.avatars[label.Avatar] = content
+	}
+	return nil
+}
+
+func (archive accountArchive) avatar(label ExportedLabel) ([]byte, error) {
+	if content, found := archive.avatars[label.Avatar]; found {
+		return content, nil
+	}
+	content, err := fetchObject(archive.avatarDescriptors[label.Avatar])
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch avatar of label %v: %v", label.ID, err)
+	}
+	return content, nil
+}
+
+func writeArchiveFile(writer *zip.Writer, name string, content []byte) error {
+	file, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	return err
+}
+
+func writeArchiveJSON(writer *zip.Writer, name string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeArchiveFile(writer, name, content)
+}
+
+// Writes entries.json a batch at a time, as the same JSON array writeArchiveJSON would
+func (archive accountArchive) writeStreamedEntries(writer *zip.Writer) error {
+	file, err := writer.CreateHeader(&zip.FileHeader{Name: "entries.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, "[")
+	if err != nil {
+		return err
+	}
+	separator := "\n  "
+	var afterID uint
+	for {
+		batch, err := readExportedEntries(archive.manifest.UserID, afterID, exportEntriesBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range batch {
+			content, err := json.MarshalIndent(entry, "  ", "  ")
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(file, separator + string(content))
+			if err != nil {
+				return err
+			}
+			separator = ",\n  "
+			afterID = entry.ID
+		}
+		if len(batch) < exportEntriesBatchSize {
+			break
+		}
+	}
+	_, err = io.WriteString(file, "\n]")
+	return err
+}
+
+func (archive accountArchive) write(output io.Writer) error {
+	writer := zip.NewWriter(output)
+	files := []struct {
+		name string
+		value interface{}
+	}{
+		{"manifest.json", archive.manifest},
+		{"account.json", archive.account},
+		{"entries.json", archive.entries},
+		{"labels.json", archive.labels},
+		{"devices.json", archive.devices},
+		{"history.json", archive.history},
+	}
+	for _, file := range files {
+		var err error
+		if file.name == "entries.json" && archive.streamedEntries {
+			err = archive.writeStreamedEntries(writer)
+		} else {
+			err = writeArchiveJSON(writer, file.name, file.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// One at a time, each is only held until written
+	for _, label := range archive.labels {
+		if label.Avatar != "" {
+			content, err := archive.avatar(label)
+			if err != nil {
+				return err
+			}
+			err = writeArchiveFile(writer, label.Avatar, content)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writer.Close()
+}
+
+func exportFileDescriptor(export database.AccountExport) string {
+	return "export_" + strconv.Itoa(int(export.ID)) + "_" + strconv.FormatInt(export.CreatedAt.Unix(), 10) + ".zip"
+}
+
+// Counts the bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+/*
+	Builds the archive of a background export and stores it in object storage.
+	The archive is streamed to the storage as it is written, memory does not grow with the size of the account.
+*/
+func buildAccountExport(export database.AccountExport) error {
+	archive, err := readAccountArchive(export.UserID)
+	if err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	var size int64
+	written := make(chan error, 1)
+	go func() {
+		counter := &countingWriter{writer: writer}
+		err := archive.write(counter)
+		size = counter.count
+		_ = writer.CloseWithError(err)
+		written <- err
+	}()
+	descriptor := exportFileDescriptor(export)
+	err = storeObject(descriptor, reader)
+	// Stops the writer if the storage gave up reading
+	_ = reader.Close()
+	writeErr := <-written
+	if err != nil {
+		return fmt.Errorf("could not store %v: %v", descriptor, err)
+	}
+	if writeErr != nil {
+		// The storage may have kept a truncated archive
+		deleteObjects([]string{descriptor})
+		return writeErr
+	}
+	finished, err := database.FinishAccountExport(export.ID, descriptor, size)
+	if err != nil || !finished {
+		// Not pending anymore, or unknown state, nobody will download it
+		deleteObjects([]string{descriptor})
+	}
+	return err
+}
+
+func runAccountExport(export database.AccountExport) {
+	err := buildAccountExport(export)
+	if err != nil {
+		sentry.CaptureException(fmt.Errorf("export %v: %v", export.ID, err))
+		err = database.FailAccountExport(export.ID)
+		if err != nil {
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+/*
+	Streams a zip of all the user's data. Accounts with more than exportSyncMaxItems entries and avatars are
+	exported in the background instead, the archive is then downloaded with GetAccountExport.
+*/
+func ExportAccount(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	items, err := countExportItems(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if items > exportSyncMaxItems {
+		export, pending, err := database.GetPendingAccountExport(user.ID)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		if !pending {
+			export = database.AccountExport{
+				UserID:  user.ID,
+				Status:  database.ExportPending,
+				Expires: time.Now().Add(exportRetention),
+			}
+			err = database.Insert(&export)
+			if err != nil {
+				return InternalError(context, err)
+			}
+			audit(context, user.ID, auditAccountExported, "background export "+strconv.Itoa(int(export.ID)))
+			go runAccountExport(export)
+		}
+		context.Response().Header().Set(echo.HeaderLocation, "/me/export/"+strconv.Itoa(int(export.ID)))
+		return context.JSON(http.StatusAccepted, map[string]interface{}{"export": export})
+	}
+
+	archive, err := readAccountArchive(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	err = archive.prefetch()
+	if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditAccountExported, "")
+	response := context.Response()
+	response.Header().Set(echo.HeaderContentType, "application/zip")
+	response.Header().Set(echo.HeaderContentDisposition, `attachment; filename="diary-export.zip"`)
+	response.WriteHeader(http.StatusOK)
+	err = archive.write(response)
+	if err != nil {
+		// Too late to change the status, the client gets a truncated archive
+		sentry.CaptureException(fmt.Errorf("could not write export: %v", err))
+	}
+	return nil
+}
+
+// Status of a background export, with a temporary download link once ready
+func GetAccountExport(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	id, err := strconv.Atoi(context.Param("id"))
+	if err != nil || id < 0 {
+		return context.String(http.StatusBadRequest, "Bad id")
+	}
+	export, found, err := database.GetAccountExport(user.ID, uint(id))
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !found || export.Expires.Before(time.Now()) {
+		return context.String(http.StatusNotFound, "Export not found")
+	}
+	if export.Status != database.ExportReady {
+		return context.JSON(http.StatusOK, map[string]interface{}{"export": export})
+	}
+
+	duration := exportLinkDuration
+	if remaining := time.Until(export.Expires); remaining < duration {
+		duration = remaining
+	}
+	link, err := objectTemporaryAccess(export.Descriptor, duration)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"export": export, "url": link})
+}
+
+// Deletes expired export archives, see database.PurgeAccountExports
+func PurgeAccountExports() error {
+	err := database.PurgeAccountExports(time.Now(), time.Now().Add(-exportStalledAfter))
+	if err != nil {
+		return err
+	}
+	return deletePendingObjects()
+}
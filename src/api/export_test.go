@@ -0,0 +1,188 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func exportAccount(user database.User) (int, []byte) {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	_ = ExportAccount(context)
+	return recorder.Code, recorder.Body.Bytes()
+}
+
+func getAccountExport(user database.User, id uint) (int, map[string]interface{}) {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	context.SetParamNames("id")
+	context.SetParamValues(strconv.Itoa(int(id)))
+	_ = GetAccountExport(context)
+	var response map[string]interface{}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+// The files of a zip archive by name
+func readArchive(t *testing.T, content []byte) map[string][]byte {
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, file := range reader.File {
+		opened, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name], _ = ioutil.ReadAll(opened)
+		_ = opened.Close()
+	}
+	return files
+}
+
+func TestExportAccount(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	setupDiary(other.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "encrypted avatar"
+	entry := userEntries(user.ID)[0]
+	database.GetDB().Model(&entry).Association("Labels").Append(label)
+	trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+
+	code, body := exportAccount(user)
+	assert.Equal(http.StatusOK, code)
+	files := readArchive(t, body)
+
+	var manifest ExportManifest
+	assert.Nil(json.Unmarshal(files["manifest.json"], &manifest))
+	assert.Equal(exportFormatVersion, manifest.Version)
+	assert.Equal(user.ID, manifest.UserID)
+	assert.Equal(2, manifest.Entries)
+	assert.Equal(1, manifest.Labels)
+	assert.Equal(1, manifest.Avatars)
+
+	var entries []ExportedEntry
+	assert.Nil(json.Unmarshal(files["entries.json"], &entries))
+	assert.Equal(2, len(entries))
+	assert.Equal("first", entries[0].Content)
+	assert.Equal([]uint{label.ID}, entries[0].LabelIDs)
+	assert.Equal([]uint{}, entries[1].LabelIDs)
+
+	var labels []ExportedLabel
+	assert.Nil(json.Unmarshal(files["labels.json"], &labels))
+	assert.Equal(1, len(labels))
+	assert.Equal("#FFFFFF", labels[0].Color)
+	assert.Equal("encrypted avatar", string(files[labels[0].Avatar]))
+
+	var devices ExportedDevices
+	assert.Nil(json.Unmarshal(files["devices.json"], &devices))
+	assert.Equal(1, len(devices.TrustedDevices))
+
+	// Secrets stay out of the archive
+	assert.Contains(string(files["account.json"]), user.Email)
+	assert.NotContains(string(files["account.json"]), "password\"")
+	assert.NotContains(string(files["account.json"]), "otp_secret")
+	assert.Contains(files, "history.json")
+
+	// A missing avatar fails the export rather than leaving it out
+	delete(objects, avatarFileDescriptor(label.ID, 0))
+	code, _ = exportAccount(user)
+	assert.Equal(http.StatusInternalServerError, code)
+}
+
+func waitAccountExport(user database.User, id uint) (int, map[string]interface{}) {
+	for i := 0; i < 40; i++ {
+		code, response := getAccountExport(user, id)
+		if code != http.StatusOK || response["export"].(map[string]interface{})["status"] != database.ExportPending {
+			return code, response
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return getAccountExport(user, id)
+}
+
+func TestExportAccount_Background(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "encrypted avatar"
+	exportSyncMaxItems = 2
+	defer func() { exportSyncMaxItems = 500 }()
+
+	code, body := exportAccount(user)
+	assert.Equal(http.StatusAccepted, code)
+	var response map[string]database.AccountExport
+	assert.Nil(json.Unmarshal(body, &response))
+	id := response["export"].ID
+
+	code, status := waitAccountExport(user, id)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(database.ExportReady, status["export"].(map[string]interface{})["status"])
+	assert.NotEmpty(status["url"].(map[string]interface{})["getURL"])
+	code, _ = getAccountExport(other, id)
+	assert.Equal(http.StatusNotFound, code)
+
+	var export database.AccountExport
+	database.GetDB().First(&export, id)
+	files := readArchive(t, []byte(objects[export.Descriptor]))
+	assert.Equal("encrypted avatar", string(files[exportAvatarPath(label.ID)]))
+	var entries []ExportedEntry
+	assert.Nil(json.Unmarshal(files["entries.json"], &entries))
+	expected, err := readExportedEntries(user.ID, 0, 100)
+	assert.Nil(err)
+	assert.NotEmpty(entries)
+	assert.Len(entries, len(expected))
+	for i := range entries {
+		assert.Equal(expected[i].ID, entries[i].ID)
+		assert.Equal(expected[i].Content, entries[i].Content)
+		assert.Equal(expected[i].LabelIDs, entries[i].LabelIDs)
+	}
+
+	// Expired archives are deleted
+	database.GetDB().Model(&export).Update("expires", time.Now().Add(-time.Minute))
+	code, _ = getAccountExport(user, id)
+	assert.Equal(http.StatusNotFound, code)
+	assert.Nil(PurgeAccountExports())
+	assert.NotContains(objects, export.Descriptor)
+	assert.True(database.GetDB().First(&database.AccountExport{}, id).RecordNotFound())
+}
+
+// A background export that cannot be built is failed, not left pending
+func TestExportAccount_BackgroundFailure(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	setupDiary(user.ID)
+	exportSyncMaxItems = 0
+	defer func() { exportSyncMaxItems = 500 }()
+
+	code, body := exportAccount(user)
+	assert.Equal(http.StatusAccepted, code)
+	var response map[string]database.AccountExport
+	assert.Nil(json.Unmarshal(body, &response))
+
+	code, status := waitAccountExport(user, response["export"].ID)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(database.ExportFailed, status["export"].(map[string]interface{})["status"])
+	assert.Nil(status["url"])
+	// The avatar is missing once the upload started, the truncated archive is not kept
+	var export database.AccountExport
+	database.GetDB().First(&export, response["export"].ID)
+	assert.NotContains(objects, exportFileDescriptor(export))
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/dgryski/dgoogauth"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
 	"net/http/httptest"
+	"time"
 )
 
 const (
@@ -58,3 +60,8 @@ func BuildEchoContext(body []byte, contentType string) (echo.Context, *httptest.
 
 	return context, recorder
 }
+
+// What an authenticator app would display right now
+func currentPasscode(secret string) string {
+	return fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, time.Now().Unix() / 30))
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// Bounds the size of an imported archive, as sent
+const importMaxArchiveSize = "100M"
+
+/*
+	Bounds the decompressed size of all the files read from an imported archive together, so that an archive of
+	highly compressed files cannot exhaust the memory. Replaced in tests.
+*/
+var importMaxDecompressedSize int64 = 200 * 1024 * 1024
+
+const (
+	importCreated = "created"
+	importExisting = "existing"
+	importInvalid = "invalid"
+)
+
+// What became of a label or an entry of the archive, identified by its ID in the archive
+type ImportItemReport struct {
+	ID uint `json:"id"`
+	Status string `json:"status"`
+	// ID of the label or entry created, or of the one already there
+	NewID uint `json:"new_id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type ImportReport struct {
+	Labels []ImportItemReport `json:"labels"`
+	Entries []ImportItemReport `json:"entries"`
+}
+
+func (report ImportReport) invalid() bool {
+	for _, items := range [][]ImportItemReport{report.Labels, report.Entries} {
+		for _, item := range items {
+			if item.Status == importInvalid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errImportTooLarge = errors.New("archive too large once decompressed")
+
+// Files of an imported archive, read within the decompressed size left
+type importArchive struct {
+	files map[string]*zip.File
+	remaining int64
+}
+
+func (archive *importArchive) read(file *zip.File) ([]byte, error) {
+	opened, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer opened.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(opened, archive.remaining + 1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > archive.remaining {
+		return nil, errImportTooLarge
+	}
+	archive.remaining -= int64(len(content))
+	return content, nil
+}
+
+// Reads a JSON file of the archive into value. Returns a message for the user if it cannot.
+func (archive *importArchive) readJSON(name string, value interface{}) string {
+	file, found := archive.files[name]
+	if !found {
+		return "Missing " + name
+	}
+	content, err := archive.read(file)
+	if err != nil {
+		return "Could not read " + name + ": " + err.Error()
+	}
+	if json.Unmarshal(content, value) != nil {
+		return "Bad " + name
+	}
+	return ""
+}
+
+func validationMessage(err error) string {
+	if err, ok := err.(validator.ValidationErrors); ok {
+		return database.BuildValidationErrorMsg(err)
+	}
+	return err.Error()
+}
+
+// Returns a message for the user if the label cannot be imported
+func checkImportedLabel(user database.User, label database.Label) string {
+	if !knownKeyVersion(user, label.KeyVersion) {
+		return "Unknown key version"
+	}
+	if err := label.Validate(); err != nil {
+		return validationMessage(err)
+	}
+	return ""
+}
+
+// Reads the labels of the archive with their avatar, and checks them
+func readImportedLabels(user database.User, archive *importArchive, labels []ExportedLabel) ([]database.ImportedLabel, []ImportItemReport) {
+	imported := make([]database.ImportedLabel, 0, len(labels))
+	reports := make([]ImportItemReport, 0, len(labels))
+	seen := make(map[uint]bool, len(labels))
+	for _, exported := range labels {
+		label := database.Label{
+			BaseModel: database.BaseModel{CreatedAt: exported.CreatedAt, UpdatedAt: exported.UpdatedAt},
+			PartialLabel: database.PartialLabel{Name: exported.Name, Color: exported.Color, KeyVersion: exported.KeyVersion},
+			UserID: user.ID,
+		}
+		report := ImportItemReport{ID: exported.ID, Error: checkImportedLabel(user, label)}
+		if seen[exported.ID] {
+			report.Error = "Duplicate label ID"
+		}
+		seen[exported.ID] = true
+
+		var avatar []byte
+		if exported.Avatar != "" && report.Error == "" {
+			file, found := archive.files[exported.Avatar]
+			if !found {
+				report.Error = "Missing avatar " + exported.Avatar
+			} else if content, err := archive.read(file); err != nil {
+				report.Error = "Could not read avatar: " + err.Error()
+			} else {
+				avatar = content
+			}
+		}
+		if report.Error != "" {
+			report.Status = importInvalid
+		}
+		reports = append(reports, report)
+		imported = append(imported, database.ImportedLabel{ArchiveID: exported.ID, Label: label, Avatar: avatar})
+	}
+	return imported, reports
+}
+
+// Returns a message for the user if the entry cannot be imported. archiveLabels are the label IDs of the archive.
+func checkImportedEntry(user database.User, entry database.Entry, labelIDs []uint, archiveLabels map[uint]bool) string {
+	for _, labelID := range labelIDs {
+		if !archiveLabels[labelID] {
+			return "Unknown label " + strconv.Itoa(int(labelID))
+		}
+	}
+	if !knownKeyVersion(user, entry.KeyVersion) {
+		return "Unknown key version"
+	}
+	if err := entry.Validate(); err != nil {
+		return validationMessage(err)
+	}
+	return ""
+}
+
+func readImportedEntries(user database.User, entries []ExportedEntry, labels []ExportedLabel) ([]database.ImportedEntry, []ImportItemReport) {
+	archiveLabels := make(map[uint]bool, len(labels))
+	for _, label := range labels {
+		archiveLabels[label.ID] = true
+	}
+	imported := make([]database.ImportedEntry, 0, len(entries))
+	reports := make([]ImportItemReport, 0, len(entries))
+	for _, exported := range entries {
+		entry := database.Entry{
+			BaseModel: database.BaseModel{CreatedAt: exported.CreatedAt, UpdatedAt: exported.UpdatedAt},
+			PartialEntry: database.PartialEntry{Title: exported.Title, Content: exported.Content, KeyVersion: exported.KeyVersion},
+			UserID: user.ID,
+		}
+		report := ImportItemReport{ID: exported.ID, Error: checkImportedEntry(user, entry, exported.LabelIDs, archiveLabels)}
+		if report.Error != "" {
+			report.Status = importInvalid
+		}
+		reports = append(reports, report)
+
+		// An entry cannot be associated twice with the same label
+		associated := make(map[uint]bool, len(exported.LabelIDs))
+		var labelIDs []uint
+		for _, labelID := range exported.LabelIDs {
+			if !associated[labelID] {
+				associated[labelID] = true
+				labelIDs = append(labelIDs, labelID)
+			}
+		}
+		imported = append(imported, database.ImportedEntry{ArchiveID: exported.ID, Entry: entry, LabelIDs: labelIDs})
+	}
+	return imported, reports
+}
+
+/*
+	Restores an archive made by ExportAccount. Labels and entries the user already has are left as they are, so that
+	importing twice is harmless. If any of them is invalid, nothing is imported and the report tells which.
+*/
+func ImportAccount(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+	if blockedUntilVerified(user, emailVerificationEntries) {
+		return emailNotVerified(context)
+	}
+
+	// Bounded by the body limit of the route
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		return err
+	}
+	reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad archive")
+	}
+	archive := &importArchive{files: make(map[string]*zip.File, len(reader.File)), remaining: importMaxDecompressedSize}
+	for _, file := range reader.File {
+		archive.files[file.Name] = file
+	}
+
+	var manifest ExportManifest
+	if msg := archive.readJSON("manifest.json", &manifest); msg != "" {
+		return context.String(http.StatusBadRequest, msg)
+	}
+	if manifest.Format != exportFormat {
+		return context.String(http.StatusBadRequest, "Not an export archive")
+	}
+	if manifest.Version < 1 || manifest.Version > exportFormatVersion {
+		return context.String(http.StatusBadRequest, "Unsupported archive version " + strconv.Itoa(manifest.Version))
+	}
+	var exportedLabels []ExportedLabel
+	if msg := archive.readJSON("labels.json", &exportedLabels); msg != "" {
+		return context.String(http.StatusBadRequest, msg)
+	}
+	var exportedEntries []ExportedEntry
+	if msg := archive.readJSON("entries.json", &exportedEntries); msg != "" {
+		return context.String(http.StatusBadRequest, msg)
+	}
+
+	var report ImportReport
+	labels, labelReports := readImportedLabels(user, archive, exportedLabels)
+	entries, entryReports := readImportedEntries(user, exportedEntries, exportedLabels)
+	report.Labels, report.Entries = labelReports, entryReports
+	if report.invalid() {
+		return context.JSON(http.StatusUnprocessableEntity, map[string]interface{}{"report": report})
+	}
+
+	// Avatars are stored before the transaction commits, and deleted if it does not
+	var uploaded []string
+	storeAvatar := func(labelID uint, avatar []byte) error {
+		descriptor := avatarFileDescriptor(labelID, 0)
+		err := storeObject(descriptor, bytes.NewReader(avatar))
+		if err != nil {
+			return fmt.Errorf("could not store %v: %v", descriptor, err)
+		}
+		uploaded = append(uploaded, descriptor)
+		return nil
+	}
+	labelOutcomes, entryOutcomes, err := database.ImportDiary(user.ID, labels, entries, storeAvatar)
+	if err != nil {
+		deleteObjects(uploaded)
+		return InternalError(context, err)
+	}
+
+	created := 0
+	for i, outcome := range labelOutcomes {
+		report.Labels[i].NewID, report.Labels[i].Status = outcome.ID, importExisting
+		if outcome.Created {
+			report.Labels[i].Status = importCreated
+			created++
+		}
+	}
+	for i, outcome := range entryOutcomes {
+		report.Entries[i].NewID, report.Entries[i].Status = outcome.ID, importExisting
+		if outcome.Created {
+			report.Entries[i].Status = importCreated
+			created++
+		}
+	}
+	audit(context, user.ID, auditAccountImported, strconv.Itoa(created) + " labels and entries created")
+	return context.JSON(http.StatusOK, map[string]interface{}{"report": report})
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/importers"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// An entry read from another journaling app, shaped like the body of AddEntry. The content is not encrypted yet.
+type ImportPreviewEntry struct {
+	AddEntryRequestBody
+	// Tags without a label yet, as label names. The client creates them and adds them to labels_id before submitting.
+	NewLabels []string `json:"new_labels"`
+	// File name or ID in the source
+	Source string `json:"source"`
+}
+
+// Label names only have letters and digits, the others are removed from tags
+func labelName(tag string) string {
+	name := []rune(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, tag))
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	return string(name)
+}
+
+/*
+	Reads the export of another journaling app, format is given in the query. Nothing is stored: the client encrypts
+	the entries returned, and submits them.
+
+	Tags become labels, those the user already has by name regardless of case are in labels_id.
+*/
+func PreviewImport(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	// Bounded by the body limit of the route
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		return err
+	}
+	records, recordErrors, err := importers.Parse(context.QueryParam("format"), body)
+	if err == importers.ErrUnknownFormat {
+		return context.String(http.StatusBadRequest, "Unknown format, expected one of: " +
+			strings.Join(importers.Formats(), ", "))
+	}
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Could not read export: " + err.Error())
+	}
+
+	var labels []database.Label
+	err = database.GetDB().Where("user_id = ?", user.ID).Find(&labels).Error
+	if err != nil {
+		return InternalError(context, err)
+	}
+	labelIDs := make(map[string]uint, len(labels))
+	for _, label := range labels {
+		labelIDs[strings.ToLower(label.Name)] = label.ID
+	}
+
+	entries := make([]ImportPreviewEntry, 0, len(records))
+	for _, record := range records {
+		date := record.Date
+		entry := ImportPreviewEntry{
+			AddEntryRequestBody: AddEntryRequestBody{
+				PartialEntry: database.PartialEntry{Title: record.Title, Content: record.Content, KeyVersion: user.DataKeyVersion},
+				LabelsID:     []uint{},
+				CreatedAt:    &date,
+			},
+			NewLabels: []string{},
+			Source:    record.Source,
+		}
+		seen := make(map[string]bool, len(record.Tags))
+		for _, tag := range record.Tags {
+			name := labelName(tag)
+			if name == "" || seen[strings.ToLower(name)] {
+				continue
+			}
+			seen[strings.ToLower(name)] = true
+			if id, exists := labelIDs[strings.ToLower(name)]; exists {
+				entry.LabelsID = append(entry.LabelsID, id)
+			} else {
+				entry.NewLabels = append(entry.NewLabels, name)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"entries": entries, "errors": recordErrors})
+}
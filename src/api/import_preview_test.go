@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/importers"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type importPreviewResponse struct {
+	Entries []ImportPreviewEntry `json:"entries"`
+	Errors []importers.RecordError `json:"errors"`
+}
+
+func previewImport(user database.User, format string, content []byte) (int, importPreviewResponse) {
+	context, recorder := BuildEchoContext(content, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	context.QueryParams().Set("format", format)
+	_ = PreviewImport(context)
+	var response importPreviewResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+func TestPreviewImport(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	travel := database.Label{PartialLabel: database.PartialLabel{Name: "Travel", Color: "#FFFFFF"}, UserID: user.ID}
+	assert.Nil(database.Insert(&travel))
+
+	journal := `{"entries": [
+		{"uuid": "A1", "creationDate": "2019-03-04T05:06:07Z", "text": "# Lisbon\nSunny day", "tags": ["travel", "road trip", "!!"]},
+		{"uuid": "B2", "creationDate": "yesterday", "text": "Lost"}
+	]}`
+	code, response := previewImport(user, importers.DayOne, []byte(journal))
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(1, len(response.Entries))
+	entry := response.Entries[0]
+	assert.Equal("A1", entry.Source)
+	assert.Equal("Lisbon", entry.Title)
+	assert.Equal("# Lisbon\nSunny day", entry.Content)
+	assert.True(time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC).Equal(*entry.CreatedAt))
+	assert.Equal([]uint{travel.ID}, entry.LabelsID)
+	assert.Equal([]string{"roadtrip"}, entry.NewLabels)
+	assert.Equal([]importers.RecordError{{Source: "B2", Error: "Bad creation date"}}, response.Errors)
+
+	// Nothing is stored
+	assert.Equal(0, len(userEntries(user.ID)))
+
+	code, _ = previewImport(user, "unknown", []byte(journal))
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = previewImport(user, importers.Journey, []byte(journal))
+	assert.Equal(http.StatusBadRequest, code)
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	asserthelper "github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func importAccount(user database.User, archive []byte) (int, ImportReport) {
+	context, recorder := BuildEchoContext(archive, "application/zip")
+	context.Set("user", user)
+	_ = ImportAccount(context)
+	var response struct {
+		Report ImportReport `json:"report"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response.Report
+}
+
+func writeTestArchive(archive accountArchive) []byte {
+	var buffer bytes.Buffer
+	_ = archive.write(&buffer)
+	return buffer.Bytes()
+}
+
+func testArchive(labels []ExportedLabel, entries []ExportedEntry, avatars map[string][]byte) accountArchive {
+	return accountArchive{
+		manifest: ExportManifest{Format: exportFormat, Version: exportFormatVersion},
+		labels:   labels,
+		entries:  entries,
+		avatars:  avatars,
+	}
+}
+
+func userLabels(userID uint) []database.Label {
+	var labels []database.Label
+	database.GetDB().Where("user_id = ?", userID).Order("id").Find(&labels)
+	return labels
+}
+
+func TestImportAccount(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "encrypted avatar"
+	entry := userEntries(user.ID)[0]
+	database.GetDB().Model(&entry).Association("Labels").Append(label)
+	past := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	database.GetDB().Model(&entry).UpdateColumn("created_at", past)
+
+	code, archive := exportAccount(user)
+	assert.Equal(http.StatusOK, code)
+
+	code, report := importAccount(other, archive)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(1, len(report.Labels))
+	assert.Equal(importCreated, report.Labels[0].Status)
+	assert.Equal(2, len(report.Entries))
+	assert.Equal(importCreated, report.Entries[0].Status)
+
+	labels := userLabels(other.ID)
+	assert.Equal(1, len(labels))
+	assert.Equal(labels[0].ID, report.Labels[0].NewID)
+	assert.True(labels[0].HasAvatar)
+	assert.Equal("encrypted avatar", objects[avatarFileDescriptor(labels[0].ID, 0)])
+
+	var imported database.Entry
+	database.GetDB().Preload("Labels").First(&imported, report.Entries[0].NewID)
+	assert.Equal(other.ID, imported.UserID)
+	assert.Equal("first", imported.Content)
+	assert.True(past.Equal(imported.CreatedAt))
+	assert.Equal(1, len(imported.Labels))
+	assert.Equal(labels[0].ID, imported.Labels[0].ID)
+
+	// Importing again, or in the original account, creates nothing
+	for _, target := range []database.User{other, user} {
+		code, report = importAccount(target, archive)
+		assert.Equal(http.StatusOK, code)
+		assert.Equal(importExisting, report.Labels[0].Status)
+		assert.Equal(importExisting, report.Entries[0].Status)
+		assert.Equal(importExisting, report.Entries[1].Status)
+	}
+	assert.Equal(2, len(userEntries(other.ID)))
+	assert.Equal(1, len(userLabels(other.ID)))
+	assert.Equal(2, len(userEntries(user.ID)))
+	assert.Equal(2, len(objects))
+}
+
+// Labels are matched by name regardless of case, and keep their avatar
+func TestImportAccount_ExistingLabel(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	existing := database.Label{PartialLabel: database.PartialLabel{Name: "Travel", Color: "#000000"}, UserID: user.ID}
+	assert.Nil(database.Insert(&existing))
+
+	archive := writeTestArchive(testArchive(
+		[]ExportedLabel{{ID: 7, Name: "travel", Color: "#FFFFFF", Avatar: exportAvatarPath(7)}},
+		[]ExportedEntry{{ID: 3, Title: "Lisbon", Content: "ciphertext", CreatedAt: time.Now(), LabelIDs: []uint{7, 7}}},
+		map[string][]byte{exportAvatarPath(7): []byte("avatar")},
+	))
+	code, report := importAccount(user, archive)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(importExisting, report.Labels[0].Status)
+	assert.Equal(existing.ID, report.Labels[0].NewID)
+	assert.Equal(0, len(objects))
+
+	var imported database.Entry
+	database.GetDB().Preload("Labels").First(&imported, report.Entries[0].NewID)
+	assert.Equal(1, len(imported.Labels))
+	assert.Equal(existing.ID, imported.Labels[0].ID)
+	assert.Equal("#000000", imported.Labels[0].Color)
+}
+
+func TestImportAccount_Invalid(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	_, restore := fakeObjectStorage()
+	defer restore()
+
+	code, _ := importAccount(user, []byte("not a zip"))
+	assert.Equal(http.StatusBadRequest, code)
+
+	newer := testArchive(nil, nil, nil)
+	newer.manifest.Version = exportFormatVersion + 1
+	code, _ = importAccount(user, writeTestArchive(newer))
+	assert.Equal(http.StatusBadRequest, code)
+
+	// Nothing is imported if a single item is invalid
+	archive := writeTestArchive(testArchive(
+		[]ExportedLabel{
+			{ID: 1, Name: "valid", Color: "#FFFFFF"},
+			{ID: 2, Name: "color", Color: "blue"},
+		},
+		[]ExportedEntry{
+			{ID: 1, Title: "Valid entry", CreatedAt: time.Now(), LabelIDs: []uint{1}},
+			{ID: 2, Title: "ab", CreatedAt: time.Now()},
+			{ID: 3, Title: "Unknown label", CreatedAt: time.Now(), LabelIDs: []uint{9}},
+			{ID: 4, Title: "Unknown key", CreatedAt: time.Now(), KeyVersion: 1},
+		},
+		nil,
+	))
+	code, report := importAccount(user, archive)
+	assert.Equal(http.StatusUnprocessableEntity, code)
+	assert.Equal("", report.Labels[0].Status)
+	assert.Equal(importInvalid, report.Labels[1].Status)
+	assert.NotEmpty(report.Labels[1].Error)
+	assert.Equal("", report.Entries[0].Status)
+	for _, item := range report.Entries[1:] {
+		assert.Equal(importInvalid, item.Status)
+	}
+	assert.Equal("Unknown label 9", report.Entries[2].Error)
+	assert.Equal("Unknown key version", report.Entries[3].Error)
+	assert.Equal(0, len(userEntries(user.ID)))
+	assert.Equal(0, len(userLabels(user.ID)))
+}
+
+// A failing avatar upload rolls the whole import back
+func TestImportAccount_Rollback(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	working := storeObject
+	uploads := 0
+	storeObject = func(descriptor string, file io.Reader) error {
+		uploads++
+		if uploads > 1 {
+			return errors.New("unavailable")
+		}
+		return working(descriptor, file)
+	}
+
+	archive := writeTestArchive(testArchive(
+		[]ExportedLabel{
+			{ID: 1, Name: "first", Color: "#FFFFFF", Avatar: exportAvatarPath(1)},
+			{ID: 2, Name: "second", Color: "#FFFFFF", Avatar: exportAvatarPath(2)},
+		},
+		[]ExportedEntry{{ID: 1, Title: "Entry", CreatedAt: time.Now(), LabelIDs: []uint{1, 2}}},
+		map[string][]byte{exportAvatarPath(1): []byte("first"), exportAvatarPath(2): []byte("second")},
+	))
+	code, _ := importAccount(user, archive)
+	assert.Equal(http.StatusInternalServerError, code)
+	assert.Equal(0, len(userLabels(user.ID)))
+	assert.Equal(0, len(userEntries(user.ID)))
+	assert.Equal(0, len(objects))
+}
+
+// Compressed files are read within a total budget, and the archive itself is bounded
+func TestImportAccount_TooLarge(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	_, restore := fakeObjectStorage()
+	defer restore()
+	previous := importMaxDecompressedSize
+	importMaxDecompressedSize = 4096
+	defer func() { importMaxDecompressedSize = previous }()
+
+	var labels []ExportedLabel
+	avatars := map[string][]byte{}
+	for i, name := range []string{"first", "second", "third"} {
+		id := uint(i + 1)
+		labels = append(labels, ExportedLabel{ID: id, Name: name, Color: "#FFFFFF", Avatar: exportAvatarPath(id)})
+		// Compressed to a few bytes each
+		avatars[exportAvatarPath(id)] = bytes.Repeat([]byte{0}, 1500)
+	}
+	archive := writeTestArchive(testArchive(labels, nil, avatars))
+	code, report := importAccount(user, archive)
+	assert.Equal(http.StatusUnprocessableEntity, code)
+	assert.Equal("", report.Labels[0].Status)
+	assert.Equal("Could not read avatar: " + errImportTooLarge.Error(), report.Labels[2].Error)
+	assert.Equal(0, len(userLabels(user.ID)))
+
+	context, _ := BuildEchoContext(archive, "application/zip")
+	context.Set("user", user)
+	err := middleware.BodyLimit("1K")(ImportAccount)(context)
+	assert.Equal(http.StatusRequestEntityTooLarge, err.(*echo.HTTPError).Code)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+/*
+	Read before login, to derive the encryption key. Version 0 means the derivation clients had before parameters.
+	Unknown emails get the same answer as users who never stored parameters, so that this endpoint cannot tell
+	which accounts exist.
+*/
+func GetKDFParams(context echo.Context) error {
+	email := context.QueryParam("email")
+	if email == "" {
+		return context.String(http.StatusBadRequest, "Missing email")
+	}
+
+	var user database.User
+	result := database.GetDB().Where("email = ?", email).First(&user)
+	if result.RecordNotFound() {
+		return context.JSON(http.StatusOK, map[string]interface{}{"kdf": database.KDFParams{Version: 0}})
+	} else if result.Error != nil {
+		return InternalError(context, result.Error)
+	}
+	params, found, err := database.GetKDFParams(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !found {
+		params = database.KDFParams{Version: 0}
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"kdf": params})
+}
+
+type KDFParamsBody struct {
+	// The version the client read, the change is refused if it is not the current one anymore
+	PreviousVersion int `json:"previous_version"`
+	Algorithm string `json:"algorithm"`
+	Salt []byte `json:"salt"`
+	Iterations int `json:"iterations"`
+	MemoryKiB int `json:"memory_kib"`
+	Parallelism int `json:"parallelism"`
+	// Wrong parameters would make the data unreadable, a stolen session is not enough
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+}
+
+/*
+	To be called once the data is encrypted with the key derived with the new parameters,
+	the server cannot check that it is.
+*/
+func UpdateKDFParams(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody KDFParamsBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || parsedBody.PreviousVersion < 0 {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+
+	params := database.KDFParams{
+		Algorithm:   parsedBody.Algorithm,
+		Salt:        parsedBody.Salt,
+		Iterations:  parsedBody.Iterations,
+		MemoryKiB:   parsedBody.MemoryKiB,
+		Parallelism: parsedBody.Parallelism,
+	}
+	replaced, err := database.ReplaceKDFParams(user.ID, params, parsedBody.PreviousVersion)
+	if validationErrors, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(validationErrors))
+	} else if err == database.ErrWeakKDFParams {
+		return context.String(http.StatusBadRequest, "Parameters too weak")
+	} else if err != nil {
+		return InternalError(context, err)
+	}
+	if !replaced {
+		return context.String(http.StatusConflict, "Parameters changed in between")
+	}
+	audit(context, user.ID, auditKDFParamsChanged, parsedBody.Algorithm)
+
+	params, _, err = database.GetKDFParams(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"kdf": params})
+}
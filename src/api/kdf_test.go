@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+type kdfResponse struct {
+	KDF database.KDFParams `json:"kdf"`
+}
+
+func getKDFParams(email string) (int, database.KDFParams) {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.QueryParams().Set("email", email)
+	_ = GetKDFParams(context)
+	var response kdfResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response.KDF
+}
+
+// The raw response, so that fields the client ignores are compared too
+func getKDFParamsBody(email string) string {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.QueryParams().Set("email", email)
+	_ = GetKDFParams(context)
+	return recorder.Body.String()
+}
+
+func updateKDFParams(body KDFParamsBody) (int, string) {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = UpdateKDFParams(context)
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestGetKDFParams(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	database.GetDB().Unscoped().Delete(database.KDFParams{})
+
+	// Users who never changed them use the original derivation
+	code, params := getKDFParams(user.Email)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(0, params.Version)
+
+	// Unknown emails get exactly the same answer
+	code, unknown := getKDFParams("nobody@user.com")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(params, unknown)
+	legacy := getKDFParamsBody(user.Email)
+	assert.Equal(legacy, getKDFParamsBody("nobody@user.com"))
+	assert.Equal(legacy, getKDFParamsBody("someone@user.com"))
+
+	code, _ = getKDFParams("")
+	assert.Equal(http.StatusBadRequest, code)
+}
+
+func TestUpdateKDFParams(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	database.GetDB().Unscoped().Delete(database.KDFParams{})
+
+	body := KDFParamsBody{
+		PreviousVersion: 0,
+		Algorithm:       database.KDFArgon2id,
+		Salt:            bytes.Repeat([]byte{7}, 32),
+		Iterations:      3,
+		MemoryKiB:       65536,
+		Parallelism:     4,
+		Password:        "wrong",
+	}
+	code, msg := updateKDFParams(body)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Wrong password", msg)
+
+	body.Password = "azer"
+	code, _ = updateKDFParams(body)
+	assert.Equal(http.StatusOK, code)
+	_, params := getKDFParams(user.Email)
+	assert.Equal(1, params.Version)
+	assert.Equal(database.KDFArgon2id, params.Algorithm)
+	assert.Equal(body.Salt, params.Salt)
+
+	// Another client changed them in between
+	code, _ = updateKDFParams(body)
+	assert.Equal(http.StatusConflict, code)
+
+	body.PreviousVersion = 1
+	body.MemoryKiB = 1024
+	code, msg = updateKDFParams(body)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Parameters too weak", msg)
+
+	body.Salt = []byte("short")
+	code, msg = updateKDFParams(body)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Contains(msg, "Salt")
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/envelope"
+	"github.com/Yuruh/encrypted-diary/src/keyring"
+	"github.com/labstack/echo/v4"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var keyringsOnce sync.Once
+var accessKeyring *keyring.Keyring
+var twoFactorsKeyring *keyring.Keyring
+
+func loadKeyrings() {
+	var err error
+	accessKeyring, err = keyring.FromEnv("ACCESS_TOKEN")
+	if err != nil {
+		log.Fatalln("failed to load access token keys", err)
+	}
+	twoFactorsKeyring, err = keyring.FromEnv("2FA_TOKEN")
+	if err != nil {
+		log.Fatalln("failed to load 2FA token keys", err)
+	}
+}
+
+// Keys of the tokens giving access to the API
+func AccessKeyring() *keyring.Keyring {
+	keyringsOnce.Do(loadKeyrings)
+	return accessKeyring
+}
+
+// Keys of the tokens that can only be used to complete a 2FA authentication
+func TwoFactorsKeyring() *keyring.Keyring {
+	keyringsOnce.Do(loadKeyrings)
+	return twoFactorsKeyring
+}
+
+// Takes added and retired keys into account without restarting
+func ReloadKeyrings() error {
+	err := AccessKeyring().Reload()
+	if err != nil {
+		return err
+	}
+	return TwoFactorsKeyring().Reload()
+}
+
+var secretsEnvelopeOnce sync.Once
+var secretsEnvelope *envelope.Envelope
+
+// Encrypts secrets stored in database, with the master keys of SECRETS_MASTER_KEYS
+func SecretsEnvelope() *envelope.Envelope {
+	secretsEnvelopeOnce.Do(func() {
+		var err error
+		secretsEnvelope, err = envelope.FromEnv("SECRETS_MASTER_KEYS")
+		if err != nil {
+			log.Fatalln("failed to load secrets master keys", err)
+		}
+	})
+	return secretsEnvelope
+}
+
+// Defaults are the values used before they could be configured, so that tokens already issued stay valid
+func TokenIssuer() string {
+	if issuer := os.Getenv("TOKEN_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "auth.yuruh.fr"
+}
+
+func TokenAudience() string {
+	if audience := os.Getenv("TOKEN_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return "api.diary.yuruh.fr"
+}
+
+type issuerAndAudienceVerifier interface {
+	VerifyIssuer(cmp string, req bool) bool
+	VerifyAudience(cmp string, req bool) bool
+}
+
+func verifyIssuerAndAudience(claims issuerAndAudienceVerifier) error {
+	if !claims.VerifyIssuer(TokenIssuer(), true) {
+		return errors.New("unexpected jwt issuer")
+	}
+	if !claims.VerifyAudience(TokenAudience(), true) {
+		return errors.New("unexpected jwt audience")
+	}
+	return nil
+}
+
+// Public keys of the access tokens, for other services to verify them. Only asymmetric keys are published.
+func GetJWKS(context echo.Context) error {
+	set, err := AccessKeyring().JWKS()
+	if err != nil {
+		return InternalError(context, err)
+	}
+	context.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return context.JSON(http.StatusOK, set)
+}
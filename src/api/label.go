@@ -13,7 +13,6 @@ import (
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"strconv"
-	"strings"
 )
 
 func PopulateLabelsUrls(labels []database.Label) []database.Label {
@@ -102,18 +101,20 @@ func AddLabel(context echo.Context) error {
 	if err != nil {
 		return context.String(http.StatusBadRequest, "Could not read JSON body")
 	}
+	if !knownKeyVersion(user, partialLabel.KeyVersion) {
+		return context.String(http.StatusBadRequest, "Unknown key version")
+	}
 
 	var label = database.Label{
 		PartialLabel: partialLabel,
 		UserID:       user.ID,
 	}
 
-	var existingLabel database.Label
-	result := database.GetDB().
-		Where("user_id = ?", user.ID).
-		Where("LOWER(name) = ?", strings.ToLower(label.Name)).
-		Find(&existingLabel)
-	if !result.RecordNotFound() {
+	_, exists, err := database.FindLabelByName(user.ID, label.Name)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if exists {
 		return context.String(http.StatusConflict, "Label with name " + label.Name + " already exists")
 	}
 
@@ -130,7 +131,16 @@ func AddLabel(context echo.Context) error {
 }
 
 func getLabelAvatarFileDescriptor(label database.Label) string {
-	return "label_" + strconv.Itoa(int(label.ID)) + "_avatar"
+	return avatarFileDescriptor(label.ID, label.AvatarVersion)
+}
+
+// The first version keeps the name avatars had before versions
+func avatarFileDescriptor(labelID uint, version int) string {
+	descriptor := "label_" + strconv.Itoa(int(labelID)) + "_avatar"
+	if version > 0 {
+		descriptor += "_v" + strconv.Itoa(version)
+	}
+	return descriptor
 }
 
 func EditLabel(context echo.Context) error {
@@ -181,6 +191,9 @@ func EditLabel(context echo.Context) error {
 		if err != nil {
 			return context.String(http.StatusBadRequest, "Could not read JSON body")
 		}
+		if !knownKeyVersion(user, partialLabel.KeyVersion) {
+			return context.String(http.StatusBadRequest, "Unknown key version")
+		}
 		label.PartialLabel = partialLabel
 	}
 
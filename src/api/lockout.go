@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kinds of credentials, each has its own failure counter
+const (
+	authFailurePassword = "password"
+	authFailureOTP = "otp"
+	authFailureRecovery = "recovery"
+)
+
+const (
+	// Failures allowed before the next attempts are delayed
+	freeAuthAttempts = 3
+	// Delay after the first failure past the free attempts, doubled by each following failure
+	authBackoffBase = time.Second
+	// From this many failures the account is locked, and its owner notified
+	lockoutThreshold = 10
+	lockoutDuration = time.Minute * 30
+	// Failures older than this are forgotten
+	authFailuresTTL = time.Hour * 24
+)
+
+// Called when an account gets locked, so that its owner knows someone may be guessing their credentials
+var NotifyLockout = func(user database.User, kind string, until time.Time) {
+	sentry.CaptureMessage(fmt.Sprintf("user %v locked until %v after too many %v failures",
+		user.ID, until.Format(time.RFC3339), kind))
+	deliver(mailer.AccountLocked, user.Email, map[string]string{
+		"Kind":  kind,
+		"Until": until.UTC().Format("January 2, 15:04 MST"),
+	})
+}
+
+// How long to refuse any attempt after this many failures
+func authFailureDelay(failures int) time.Duration {
+	if failures < freeAuthAttempts {
+		return 0
+	}
+	if failures >= lockoutThreshold {
+		return lockoutDuration
+	}
+	return authBackoffBase << uint(failures - freeAuthAttempts)
+}
+
+// Refused attempt, the user has to wait until then
+type authLocked time.Time
+
+func (until authLocked) Error() string {
+	return "authentication locked until " + time.Time(until).Format(time.RFC3339)
+}
+
+func tooManyAttempts(context echo.Context, until time.Time) error {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	context.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return context.String(http.StatusTooManyRequests, "Too many failed attempts, retry later")
+}
+
+// Response to an error of beginAuthAttempt, or of a check relying on it
+func authError(context echo.Context, err error) error {
+	if until, ok := err.(authLocked); ok {
+		return tooManyAttempts(context, time.Time(until))
+	}
+	return InternalError(context, err)
+}
+
+/*
+	Counts the attempt as a failure before the credential is checked, so that concurrent guesses are all counted and
+	delayed like sequential ones. Returns an authLocked error while the user has to wait.
+	Must be followed by authFailed or authSucceeded once the credential is checked.
+*/
+func beginAuthAttempt(user database.User, kind string) (database.AuthFailure, error) {
+	attempt, allowed, err := database.BeginAuthAttempt(user.ID, kind, time.Now().Add(-authFailuresTTL), authFailureDelay)
+	if err != nil {
+		return attempt, fmt.Errorf("could not record auth attempt: %v", err)
+	}
+	if !allowed {
+		return attempt, authLocked(*attempt.LockedUntil)
+	}
+	return attempt, nil
+}
+
+// The attempt is already counted, the owner is told when it locks the account
+func authFailed(context echo.Context, user database.User, kind string, attempt database.AuthFailure) {
+	if attempt.Failures == lockoutThreshold {
+		audit(context, user.ID, auditAccountLocked, kind)
+		NotifyLockout(user, kind, *attempt.LockedUntil)
+	}
+}
+
+func authSucceeded(user database.User, kind string) error {
+	return database.ResetAuthFailures(user.ID, kind)
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthFailureDelay(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	assert.Equal(time.Duration(0), authFailureDelay(0))
+	assert.Equal(time.Duration(0), authFailureDelay(2))
+	assert.Equal(time.Second, authFailureDelay(3))
+	assert.Equal(time.Second * 2, authFailureDelay(4))
+	assert.Equal(time.Second * 64, authFailureDelay(9))
+	assert.Equal(lockoutDuration, authFailureDelay(10))
+	assert.Equal(lockoutDuration, authFailureDelay(50))
+}
+
+func login(email string, password string) (int, *http.Response) {
+	marsh, _ := json.Marshal(LoginBody{Email: email, Password: password})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = Login(context)
+	return recorder.Code, recorder.Result()
+}
+
+// Lets the user try again right away, as if the delay was over
+func expireLock(userID uint, kind string) {
+	database.GetDB().Model(&database.AuthFailure{}).
+		Where("user_id = ? AND kind = ?", userID, kind).
+		Update("locked_until", time.Now().Add(-time.Second))
+}
+
+func TestLogin_Lockout(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+
+	var notified []string
+	previousNotifier := NotifyLockout
+	NotifyLockout = func(user database.User, kind string, until time.Time) {
+		notified = append(notified, user.Email + ":" + kind)
+	}
+	defer func() { NotifyLockout = previousNotifier }()
+
+	for i := 0; i < freeAuthAttempts; i++ {
+		code, _ := login(user.Email, "wrong")
+		assert.Equal(http.StatusNotFound, code)
+	}
+	// Even the right password is refused during the delay
+	code, response := login(user.Email, "azer")
+	assert.Equal(http.StatusTooManyRequests, code)
+	retryAfter, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+	assert.Equal(1, retryAfter)
+
+	// Other accounts are not affected
+	code, _ = login(other.Email, "azer")
+	assert.Equal(http.StatusOK, code)
+
+	// The delay doubles
+	expireLock(user.ID, authFailurePassword)
+	code, _ = login(user.Email, "wrong")
+	assert.Equal(http.StatusNotFound, code)
+	failure, _ := database.GetAuthFailure(user.ID, authFailurePassword)
+	assert.Equal(4, failure.Failures)
+	assert.WithinDuration(time.Now().Add(time.Second * 2), *failure.LockedUntil, time.Second)
+
+	// Success resets the counter
+	expireLock(user.ID, authFailurePassword)
+	code, _ = login(user.Email, "azer")
+	assert.Equal(http.StatusOK, code)
+	failure, _ = database.GetAuthFailure(user.ID, authFailurePassword)
+	assert.Equal(0, failure.Failures)
+
+	// Locked out, the owner is notified once
+	for i := 0; i < lockoutThreshold + 1; i++ {
+		expireLock(user.ID, authFailurePassword)
+		code, _ = login(user.Email, "wrong")
+		assert.Equal(http.StatusNotFound, code)
+	}
+	code, response = login(user.Email, "azer")
+	assert.Equal(http.StatusTooManyRequests, code)
+	retryAfter, _ = strconv.Atoi(response.Header.Get("Retry-After"))
+	assert.Equal(int(lockoutDuration.Seconds()), retryAfter)
+	assert.Equal([]string{user.Email + ":" + authFailurePassword}, notified)
+
+	var count int
+	database.GetDB().Model(&database.AuditEvent{}).
+		Where("user_id = ? AND action = ?", user.ID, auditAccountLocked).
+		Count(&count)
+	assert.Equal(1, count)
+
+	// Old failures are forgotten
+	database.GetDB().Model(&database.AuthFailure{}).
+		Where("user_id = ? AND kind = ?", user.ID, authFailurePassword).
+		Updates(map[string]interface{}{"last_failure": time.Now().Add(-authFailuresTTL * 2)})
+	expireLock(user.ID, authFailurePassword)
+	code, _ = login(user.Email, "wrong")
+	assert.Equal(http.StatusNotFound, code)
+	failure, _ = database.GetAuthFailure(user.ID, authFailurePassword)
+	assert.Equal(1, failure.Failures)
+}
+
+func TestValidateOTPCode_Lockout(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	assert.Nil(user.SetPendingOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
+	confirmed, _ := user.ConfirmPendingOTPSecret(SecretsEnvelope(), 0)
+	assert.Equal(true, confirmed)
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, TwoFactorsKeyring())
+
+	wrong := "000000"
+	if currentPasscode("2SH3V3GDW7ZNMGYE") == wrong {
+		wrong = "111111"
+	}
+	validate := func(passcode string) int {
+		marsh, _ := json.Marshal(OTPCodeBody{Passcode: passcode, Token: ss})
+		context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+		assert.Nil(ValidateOTPCode(context))
+		return recorder.Code
+	}
+
+	for i := 0; i < freeAuthAttempts; i++ {
+		assert.Equal(http.StatusBadRequest, validate(wrong))
+	}
+	assert.Equal(http.StatusTooManyRequests, validate(currentPasscode("2SH3V3GDW7ZNMGYE")))
+
+	// Password failures are counted separately
+	failure, _ := database.GetAuthFailure(user.ID, authFailurePassword)
+	assert.Equal(0, failure.Failures)
+
+	expireLock(user.ID, authFailureOTP)
+	assert.Equal(http.StatusOK, validate(currentPasscode("2SH3V3GDW7ZNMGYE")))
+	failure, _ = database.GetAuthFailure(user.ID, authFailureOTP)
+	assert.Equal(0, failure.Failures)
+}
+
+// Password checks of authenticated actions count towards the same lockout as logins
+func TestCheckPassword_Lockout(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	context, _ := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+
+	for i := 0; i < freeAuthAttempts; i++ {
+		valid, err := checkPassword(context, user, "wrong", nil)
+		assert.False(valid)
+		assert.Nil(err)
+	}
+	valid, err := checkPassword(context, user, "azer", nil)
+	assert.False(valid)
+	assert.IsType(authLocked{}, err)
+	code, _ := login(user.Email, "azer")
+	assert.Equal(http.StatusTooManyRequests, code)
+
+	expireLock(user.ID, authFailurePassword)
+	valid, err = checkPassword(context, user, "azer", nil)
+	assert.True(valid)
+	assert.Nil(err)
+	failure, _ := database.GetAuthFailure(user.ID, authFailurePassword)
+	assert.Equal(0, failure.Failures)
+}
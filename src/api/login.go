@@ -4,15 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/keyring"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 	"unicode"
 )
@@ -55,28 +57,35 @@ func sanitizeParsedBody(parsedBody *LoginBody) {
 	}
 }
 
-// Add a user to claims without otp secret and password.
+// Only the user ID is put in claims, along with the session and how the user authenticated.
 // Expects a duration in nanoseconds
-// Could implement a key rotation system
-func BuildJwtToken(user database.User, sessionDuration time.Duration, secret []byte) string {
-	user.Password = ""
-	user.OTPSecret = ""
-
+// Signed with the newest key of the keyring
+func BuildJwtToken(user database.User, sessionID string, authLevel string, sessionDuration time.Duration, keys *keyring.Keyring) string {
 	claims := &TokenClaims{
-		user,
+		sessionID,
+		authLevel,
 		jwt.StandardClaims{
+			Id: uuid.New().String(),
+			Subject: strconv.Itoa(int(user.ID)),
 			ExpiresAt: time.Now().Unix() + int64(sessionDuration / time.Second),
 			IssuedAt: time.Now().Unix(),
-			Issuer: "auth.yuruh.fr", // This would make sense if auth server was external
-			Audience: "api.diary.yuruh.fr",
+			Issuer: TokenIssuer(),
+			Audience: TokenAudience(),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	ss, _ := token.SignedString(secret)
+	ss, err := keys.Sign(claims)
+	if err != nil {
+		sentry.CaptureException(err)
+	}
 
 	return ss
 }
 
+// Same response for unknown emails, wrong passwords and users who log in another way, see BeginSRPLogin
+func loginRefused(context echo.Context) error {
+	return context.String(http.StatusNotFound, "User not found")
+}
+
 // 2FA could check: Cookie, IP, device / fingerprint, link to element which validates the cookie
 func Login(context echo.Context) error {
 	body, err := ioutil.ReadAll(context.Request().Body)
@@ -95,48 +104,83 @@ func Login(context echo.Context) error {
 	var user database.User
 	database.GetDB().Where("email = ?", parsedBody.Email).First(&user)
 
+	// Users who switched to SRP have no password hash, they are refused like unknown users
+	if user.UsesSRP {
+		user = database.User{}
+	}
+
+	// Counted before the password is checked, so that guesses are refused whether they are right or not
+	var attempt database.AuthFailure
+	if user.ID != 0 {
+		attempt, err = beginAuthAttempt(user, authFailurePassword)
+		if err != nil {
+			return authError(context, err)
+		}
+	}
+
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(parsedBody.Password))
 
 	if err != nil {
-		return context.String(http.StatusNotFound, "User not found")
+		if user.ID != 0 {
+			authFailed(context, user, authFailurePassword, attempt)
+		}
+		return loginRefused(context)
 	} else {
-		//2FA enabled
-		if user.HasRegisteredOTP {
-			var active database.TwoFactorsCookie
-			cookie, err := context.Cookie("tfa-active")
-			// Cookie found
-			if err == nil {
-				result := database.GetDB().
-					Where("user_id = ?", user.ID).
-					Where("uuid = ?", cookie.Value).
-					Find(&active)
-				if !result.RecordNotFound() {
-					// Todo also check IP addr (we want to ask again if the ip addr changed)
-					if time.Now().UnixNano() > active.Expires.UnixNano() {
-						err = active.Delete()
-						if err != nil {
-							sentry.CaptureException(err)
-						}
-					} else {
-						active.LastUsed = time.Now()
-						err = database.Update(&active)
-						if err != nil {
-							sentry.CaptureException(err)
-						}
-						ss := BuildJwtToken(user, parsedBody.SessionDurationMs, []byte(os.Getenv("ACCESS_TOKEN_SECRET")))
-						return context.JSON(http.StatusOK, map[string]interface{}{"token": ss, "two_factors_methods": nil})
-					}
+		err = authSucceeded(user, authFailurePassword)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		if blockedUntilVerified(user, emailVerificationLogin) {
+			return emailNotVerified(context)
+		}
+		response, err := passwordVerified(context, user, parsedBody.SessionDurationMs)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		return context.JSON(http.StatusOK, response)
+	}
+}
+
+/*
+	What follows a valid password, whatever the way it was checked: either the tokens of a new session, or a 2FA token
+	if a second factor is required and the device is not trusted.
+*/
+func passwordVerified(context echo.Context, user database.User, sessionDuration time.Duration) (map[string]interface{}, error) {
+	if !user.HasTwoFactors() {
+		return openSession(user, sessionDuration, authLevelPassword)
+	}
+	var active database.TwoFactorsCookie
+	cookie, err := context.Cookie("tfa-active")
+	// Cookie found
+	if err == nil {
+		result := database.GetDB().
+			Where("user_id = ?", user.ID).
+			Where("uuid = ?", cookie.Value).
+			Find(&active)
+		if !result.RecordNotFound() {
+			if active.IsExpired() {
+				err = active.Delete()
+				if err != nil {
+					sentry.CaptureException(err)
 				}
+			} else if active.IpAddr == context.RealIP() {
+				active.LastUsed = time.Now()
+				err = database.Update(&active)
+				if err != nil {
+					sentry.CaptureException(err)
+				}
+				return openSession(user, sessionDuration, authLevelTwoFactors)
 			}
-			methods := [1]string{"OTP"}
-			// We generate a token that cannot be used to authenticate request but will be used to validate 2FA
-			ss := BuildJwtToken(user, parsedBody.SessionDurationMs, []byte(os.Getenv("2FA_TOKEN_SECRET")))
-			return context.JSON(http.StatusOK, map[string]interface{}{"token": ss, "two_factors_methods": methods})
+			// From another IP address the second factor is asked again. The device stays trusted from its address.
 		}
-		ss := BuildJwtToken(user, parsedBody.SessionDurationMs, []byte(os.Getenv("ACCESS_TOKEN_SECRET")))
-		return context.JSON(http.StatusOK, map[string]interface{}{"token": ss, "two_factors_methods": nil})
-
 	}
+	methods, err := twoFactorsMethods(user)
+	if err != nil {
+		return nil, err
+	}
+	// We generate a token that cannot be used to authenticate request but will be used to validate 2FA
+	ss := BuildJwtToken(user, "", authLevelPassword, sessionDuration, TwoFactorsKeyring())
+	return map[string]interface{}{"token": ss, "two_factors_methods": methods}, nil
 }
 
 func verifyPassword(s string) bool {
@@ -203,6 +247,11 @@ func Register(context echo.Context) error {
 		// not sure how to check which error it is from golang
 		return context.String(http.StatusBadRequest, err.Error())
 	}
+	// The account exists either way, the email can be sent again
+	_, err = sendEmailVerification(user, user.Email, nil)
+	if err != nil {
+		sentry.CaptureException(err)
+	}
 	return context.JSON(http.StatusCreated, map[string]interface{}{"user": user})
 }
 
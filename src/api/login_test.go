@@ -137,7 +137,10 @@ func caseRequire30Min(t* testing.T) {
 
 type loginResponse struct {
 	Token string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 	TwoFactorsMethods []string `json:"two_factors_methods"`
+	RecoveryCodes []string `json:"recovery_codes"`
+	RemainingRecoveryCodes int `json:"remaining_recovery_codes"`
 }
 
 func caseUserFound(t *testing.T) {
@@ -172,6 +175,9 @@ func caseUserFound(t *testing.T) {
 	if len(response.Token) < 300 {
 		t.Errorf("Token length incorrect, expected at least %v, got %v", 300, len(response.Token))
 	}
+	if response.RefreshToken == "" {
+		t.Errorf("Refresh token missing")
+	}
 }
 
 func TestRegister(t *testing.T) {
@@ -337,6 +343,7 @@ func TestLoginTFACookieValid(t *testing.T) {
 	cookie.Expires = time.Now().Add(24 * time.Hour * 14)
 
 	context.Request().Header.Set("cookie", cookie.String())
+	context.Request().Header.Set(echo.HeaderXRealIP, "1.2.4.4")
 
 	err := Login(context)
 	assert.Nil(err)
@@ -346,6 +353,24 @@ func TestLoginTFACookieValid(t *testing.T) {
 
 	assert.Equal(0, len(response.TwoFactorsMethods))
 	assert.Greater(len(response.Token), 400)
+
+	// The second factor is asked again from another address
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	context.Request().Header.Set("cookie", cookie.String())
+	context.Request().Header.Set(echo.HeaderXRealIP, "2001:db8::1")
+
+	err = Login(context)
+	assert.Nil(err)
+
+	response = loginResponse{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(err)
+	assert.Equal(1, len(response.TwoFactorsMethods))
+
+	// And the device stays trusted from its own
+	var stillTrusted database.TwoFactorsCookie
+	result := database.GetDB().Where("id = ?", validCookie.ID).First(&stillTrusted)
+	assert.False(result.RecordNotFound())
 }
 
 func TestLoginTFACookieExpired(t *testing.T) {
@@ -396,7 +421,7 @@ func TestLoginTFACookieExpired(t *testing.T) {
 
 	assert.Equal(1, len(response.TwoFactorsMethods))
 	assert.Equal("OTP", response.TwoFactorsMethods[0])
-	assert.Greater(len(response.Token), 400)
+	assert.Greater(len(response.Token), 300)
 
 
 	var deletedCookie database.TwoFactorsCookie
@@ -432,5 +457,5 @@ func TestLoginRequestOTP(t *testing.T) {
 
 	assert.Equal(1, len(response.TwoFactorsMethods))
 	assert.Equal("OTP", response.TwoFactorsMethods[0])
-	assert.Greater(len(response.Token), 400)
+	assert.Greater(len(response.Token), 300)
 }
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/patrickmn/go-cache"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Avoids a database request for every authenticated call.
+	Revocations are cached until the token expires, valid tokens only for a short time,
+	which is the delay for a revocation made by another instance to be effective here.
+*/
+const revocationCacheTTL = time.Second * 10
+
+var revocationCache = cache.New(revocationCacheTTL, time.Minute)
+
+func revocationCacheKey(claims *TokenClaims) string {
+	return strconv.Itoa(int(claims.UserID())) + ":" + claims.Id
+}
+
+func isTokenRevoked(claims *TokenClaims) (bool, error) {
+	key := revocationCacheKey(claims)
+	if revoked, found := revocationCache.Get(key); found {
+		return revoked.(bool), nil
+	}
+	revoked, err := database.IsTokenRevoked(claims.Id, claims.UserID(), time.Unix(claims.IssuedAt, 0))
+	if err != nil {
+		return false, err
+	}
+	if revoked {
+		revocationCache.Set(key, true, time.Until(time.Unix(claims.ExpiresAt, 0)))
+	} else {
+		revocationCache.SetDefault(key, false)
+	}
+	return revoked, nil
+}
+
+func RevokeToken(claims *TokenClaims) error {
+	revoked := database.RevokedToken{
+		Jti:     claims.Id,
+		UserID:  claims.UserID(),
+		Expires: time.Unix(claims.ExpiresAt, 0),
+	}
+	err := database.Insert(&revoked)
+	if err != nil {
+		return err
+	}
+	revocationCache.Set(revocationCacheKey(claims), true, time.Until(revoked.Expires))
+	return nil
+}
+
+// Revokes every access and refresh token issued to the user until now
+func RevokeAllUserTokens(userID uint) error {
+	revoked := database.RevokedToken{
+		UserID:       userID,
+		IssuedBefore: time.Now().Truncate(time.Second),
+		// No access token lives longer than that
+		Expires:      time.Now().Add(maxTokenDuration),
+	}
+	err := database.Insert(&revoked)
+	if err != nil {
+		return err
+	}
+	err = database.RevokeUserRefreshTokens(userID)
+	if err != nil {
+		return err
+	}
+	prefix := strconv.Itoa(int(userID)) + ":"
+	for key := range revocationCache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			revocationCache.Delete(key)
+		}
+	}
+	return nil
+}
+
+// Ends the current session: the access token and the refresh tokens of the session are revoked
+func Logout(context echo.Context) error {
+	var claims = context.Get("token").(*jwt.Token).Claims.(*TokenClaims)
+
+	if claims.SessionID != "" {
+		err := database.RevokeRefreshTokenFamily(claims.SessionID)
+		if err != nil {
+			return InternalError(context, fmt.Errorf("could not revoke session: %v", err))
+		}
+	}
+	err := RevokeToken(claims)
+	if err != nil {
+		return InternalError(context, fmt.Errorf("could not revoke token: %v", err))
+	}
+	return context.NoContent(http.StatusOK)
+}
+
+func LogoutAll(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	err := RevokeAllUserTokens(user.ID)
+	if err != nil {
+		return InternalError(context, fmt.Errorf("could not revoke tokens: %v", err))
+	}
+	return context.NoContent(http.StatusOK)
+}
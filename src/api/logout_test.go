@@ -0,0 +1,102 @@
+package api
+
+import (
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func parseAccessToken(t *testing.T, ss string) *jwt.Token {
+	token, err := jwt.ParseWithClaims(ss, &TokenClaims{}, AccessKeyring().Keyfunc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return token
+}
+
+// Calls a protected route through the auth middleware
+func callWithToken(ss string) int {
+	e := echo.New()
+	e.Use(AuthMiddleware())
+	e.GET("/protected", func(ctx echo.Context) error { return ctx.NoContent(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.Header.Add("Authorization", "Bearer " + ss)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestLogout(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	sessionID := uuid.New().String()
+	ss := BuildJwtToken(user, sessionID, authLevelPassword, time.Minute * 30, AccessKeyring())
+	other := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	refreshToken, _ := issueRefreshToken(user, sessionID, time.Minute * 30, time.Now().Add(maxSessionDuration), authLevelPassword)
+	assert.Equal(http.StatusOK, callWithToken(ss))
+
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.Set("token", parseAccessToken(t, ss))
+	err := Logout(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	assert.Equal(http.StatusUnauthorized, callWithToken(ss))
+	// Other sessions are untouched
+	assert.Equal(http.StatusOK, callWithToken(other))
+
+	var dbToken database.RefreshToken
+	database.GetDB().Where("token_hash = ?", hashRefreshToken(refreshToken)).First(&dbToken)
+	assert.Equal(true, dbToken.Revoked)
+}
+
+func TestLogoutAll(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	other := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	assert.Equal(http.StatusOK, callWithToken(other))
+	// Tokens carry their issue time in whole seconds, so do revocations
+	time.Sleep(time.Second)
+
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.Set("token", parseAccessToken(t, ss))
+	err := LogoutAll(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	assert.Equal(http.StatusUnauthorized, callWithToken(ss))
+	assert.Equal(http.StatusUnauthorized, callWithToken(other))
+
+	// Tokens issued afterwards are valid, even within the same second
+	assert.Equal(http.StatusOK, callWithToken(BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())))
+}
+
+func TestPurgeRevokedTokens(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	expired := database.RevokedToken{
+		UserID:       user.ID,
+		IssuedBefore: time.Now(),
+		Expires:      time.Now().Add(-time.Minute),
+	}
+	assert.Nil(database.Insert(&expired))
+
+	revoked, err := database.IsTokenRevoked("", user.ID, time.Now().Add(-time.Hour))
+	assert.Nil(err)
+	assert.Equal(false, revoked)
+
+	assert.Nil(database.PurgeRevokedTokens())
+	var count int
+	database.GetDB().Unscoped().Model(&database.RevokedToken{}).Where("id = ?", expired.ID).Count(&count)
+	assert.Equal(0, count)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
+	"github.com/Yuruh/encrypted-diary/src/secrets"
+	"github.com/getsentry/sentry-go"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var mailSenderOnce sync.Once
+var mailSender mailer.Sender
+
+// Configured from SMTP_* variables, see package mailer. Nil when emails are not configured.
+func MailSender() mailer.Sender {
+	mailSenderOnce.Do(func() {
+		var err error
+		mailSender, err = mailer.FromEnv()
+		if err == mailer.ErrNotConfigured {
+			mailSender = nil
+		} else if err != nil {
+			log.Fatalln("failed to configure mailer", err)
+		}
+	})
+	return mailSender
+}
+
+// Replaced in tests
+var mailEnabled = func() bool {
+	return MailSender() != nil
+}
+
+// Replaced in tests
+var sendMail = func(message mailer.Message) error {
+	return MailSender().Send(message)
+}
+
+/*
+	Renders and sends an email in the background, so that the response does not wait for the SMTP server,
+	nor reveals by its timing whether an email was sent. Failures are reported to sentry.
+*/
+func deliver(template string, to string, data interface{}) {
+	if !mailEnabled() {
+		return
+	}
+	message, err := mailer.Render(template, to, data)
+	if err != nil {
+		sentry.CaptureException(err)
+		return
+	}
+	go func() {
+		err := sendMail(message)
+		if err != nil {
+			sentry.CaptureException(err)
+		}
+	}()
+}
+
+/*
+	Tokens sent by email are a random value and its signature, so that forged tokens are refused without reaching the
+	database. The purpose is part of the signature, a token cannot be used for something else than what it was sent
+	for. Signed with a key derived from the current master key, rotating it invalidates pending tokens.
+*/
+func signEmailedToken(purpose string, value string) string {
+	mac := hmac.New(sha256.New, SecretsEnvelope().DeriveKey(purpose))
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newEmailedToken(purpose string) (string, error) {
+	value, err := secrets.Token(32)
+	if err != nil {
+		return "", err
+	}
+	return signEmailedToken(purpose, value), nil
+}
+
+func verifyEmailedToken(purpose string, token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	return hmac.Equal([]byte(signEmailedToken(purpose, parts[0])), []byte(token))
+}
+
+// Only the hash is stored
+func hashEmailedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// A page of the client, which sends the token to the API
+func clientLink(path string, token string) string {
+	return os.Getenv("ALLOWED_ORIGIN") + path + "?token=" + url.QueryEscape(token)
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/object-storage/ovh"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// Object storage calls, replaced in tests
+var (
+	storeObject = ovh.UploadFileToPrivateObjectStorage
+	deleteObject = ovh.DeleteFileFromPrivateObjectStorage
+)
+
+// A label avatar re-encrypted with the new key
+type ReEncryptedAvatar struct {
+	LabelID uint `json:"label_id"`
+	Data []byte `json:"data"`
+}
+
+type PasswordChangeBody struct {
+	// The current password, or a proof for users who switched to SRP
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+
+	// Either a new password, or a new SRP verifier. Users who switched to SRP cannot go back to a password.
+	NewPassword string `json:"new_password"`
+	NewSRP *SRPRegistrationBody `json:"new_srp"`
+
+	// Every entry and every label avatar still encrypted with the key derived from the password (key version 0),
+	// encrypted with the key derived from the new password
+	Entries []database.ReEncryptedEntry `json:"entries"`
+	Avatars []ReEncryptedAvatar `json:"avatars"`
+
+	// The data key wrapped with the new password, required once the user has a data key
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+func newCredentials(user database.User, newPassword string, newSRP *SRPRegistrationBody) (database.Credentials, string) {
+	if newSRP != nil {
+		if msg, ok := newSRP.validate(); !ok {
+			return database.Credentials{}, msg
+		}
+		return database.Credentials{SRPSalt: newSRP.Salt, SRPVerifier: newSRP.Verifier}, ""
+	}
+	if user.UsesSRP {
+		return database.Credentials{}, "New SRP verifier required"
+	}
+	if !verifyPassword(newPassword) {
+		return database.Credentials{}, "Bad password. Requirements: Minimum eight characters, at least one uppercase letter, " +
+			"one lowercase letter, one number and one special character"
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return database.Credentials{}, "Could not process password"
+	}
+	return database.Credentials{Password: string(hash)}, ""
+}
+
+// Current avatar version of every label with an avatar encrypted with the key derived from the password, by label ID
+func avatarVersions(userID uint) (map[uint]int, error) {
+	var labels []database.Label
+	err := database.GetDB().
+		Where("user_id = ?", userID).
+		Where("has_avatar = ?", true).
+		Where("key_version = ?", 0).
+		Find(&labels).Error
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[uint]int, len(labels))
+	for _, label := range labels {
+		versions[label.ID] = label.AvatarVersion
+	}
+	return versions, nil
+}
+
+// Same bounds as database.WrappedKey
+func validWrappedKey(wrapped []byte) bool {
+	return len(wrapped) >= 16 && len(wrapped) <= 1024
+}
+
+func deleteObjects(descriptors []string) {
+	for _, descriptor := range descriptors {
+		err := deleteObject(descriptor)
+		if err != nil {
+			sentry.CaptureException(fmt.Errorf("could not delete %v: %v", descriptor, err))
+		}
+	}
+}
+
+/*
+	Changes the password and replaces all the encrypted data at once, so that it is never left encrypted with two keys.
+	New avatars are stored under new names first, and only used once the database transaction succeeds.
+
+	Every session and trusted device is revoked afterwards, the user has to log in again.
+*/
+func ChangePassword(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody PasswordChangeBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+	credentials, msg := newCredentials(user, parsedBody.NewPassword, parsedBody.NewSRP)
+	if msg != "" {
+		return context.String(http.StatusBadRequest, msg)
+	}
+	if parsedBody.WrappedKey != nil && !validWrappedKey(parsedBody.WrappedKey) {
+		return context.String(http.StatusBadRequest, "Bad wrapped key")
+	}
+	credentials.WrappedKey = parsedBody.WrappedKey
+
+	versions, err := avatarVersions(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	// Each avatar exactly once, as every version is bumped
+	submitted := make(map[uint]bool, len(parsedBody.Avatars))
+	for _, avatar := range parsedBody.Avatars {
+		if submitted[avatar.LabelID] {
+			return context.String(http.StatusBadRequest, "Duplicate avatar")
+		}
+		submitted[avatar.LabelID] = true
+		if _, found := versions[avatar.LabelID]; !found {
+			return context.String(http.StatusConflict, "Every avatar must be re-encrypted")
+		}
+	}
+	if len(submitted) != len(versions) {
+		return context.String(http.StatusConflict, "Every avatar must be re-encrypted")
+	}
+	var stored, replaced []string
+	for _, avatar := range parsedBody.Avatars {
+		version := versions[avatar.LabelID]
+		descriptor := avatarFileDescriptor(avatar.LabelID, version + 1)
+		err = storeObject(descriptor, bytes.NewReader(avatar.Data))
+		if err != nil {
+			deleteObjects(stored)
+			return InternalError(context, err)
+		}
+		stored = append(stored, descriptor)
+		replaced = append(replaced, avatarFileDescriptor(avatar.LabelID, version))
+	}
+
+	err = database.ChangePassword(user.ID, credentials, parsedBody.Entries, versions)
+	if err != nil {
+		deleteObjects(stored)
+		if err == database.ErrDataChanged {
+			return context.String(http.StatusConflict,
+				"Entries, labels or data key changed, every entry must be re-encrypted and the data key re-wrapped")
+		}
+		return InternalError(context, err)
+	}
+	deleteObjects(replaced)
+	audit(context, user.ID, auditPasswordChanged, "")
+
+	err = RevokeAllUserTokens(user.ID)
+	if err != nil {
+		return InternalError(context, fmt.Errorf("could not revoke tokens: %v", err))
+	}
+	err = database.DeleteUserTwoFactorsCookies(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	forgetUser(user.ID)
+	return context.NoContent(http.StatusOK)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+	Password reset by email, for users who forgot their password and have no recovery key.
+	The server cannot decrypt anything: once the password is reset, data encrypted with the previous password, or with
+	a data key only the previous password could unwrap, is unreadable. Users with a recovery key should use
+	/auth/recover instead, or afterwards.
+
+	The second factor is not bypassed, it is still required on the next login.
+*/
+
+const passwordResetPurpose = "password-reset"
+const passwordResetTokenDuration = time.Hour
+// At most this many emails per user in passwordResetTokenDuration, so that the endpoint cannot be used to spam
+const maxPasswordResetRequests = 3
+
+type PasswordResetRequestBody struct {
+	Email string `json:"email"`
+}
+
+// Emails a reset link. The response is the same whether the email is known or not.
+func RequestPasswordReset(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody PasswordResetRequestBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || parsedBody.Email == "" {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	var user database.User
+	result := database.GetDB().Where("email = ?", parsedBody.Email).First(&user)
+	if result.RecordNotFound() {
+		return context.NoContent(http.StatusAccepted)
+	} else if result.Error != nil {
+		return InternalError(context, result.Error)
+	}
+	count, err := database.CountPasswordResetTokens(user.ID, time.Now().Add(-passwordResetTokenDuration))
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if count >= maxPasswordResetRequests {
+		return context.NoContent(http.StatusAccepted)
+	}
+
+	token, err := newEmailedToken(passwordResetPurpose)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	resetToken := database.PasswordResetToken{
+		TokenHash: hashEmailedToken(token),
+		UserID:    user.ID,
+		Expires:   time.Now().Add(passwordResetTokenDuration),
+	}
+	err = database.Insert(&resetToken)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditPasswordResetRequested, "")
+	deliver(mailer.PasswordReset, user.Email, map[string]string{
+		"Link":     clientLink("/reset-password", token),
+		"ValidFor": "1 hour",
+	})
+	return context.NoContent(http.StatusAccepted)
+}
+
+type PasswordResetBody struct {
+	Token string `json:"token"`
+
+	// Either a new password, or a new SRP verifier for users who switched to SRP
+	NewPassword string `json:"new_password"`
+	NewSRP *SRPRegistrationBody `json:"new_srp"`
+
+	// The client must have warned the user that their data will be unreadable
+	AcceptDataLoss bool `json:"accept_data_loss"`
+}
+
+/*
+	Replaces the credentials with the emailed token.
+	Every session and trusted device is revoked, the user has to log in again.
+*/
+func ResetPassword(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody PasswordResetBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	if !parsedBody.AcceptDataLoss {
+		return context.String(http.StatusBadRequest, "Entries encrypted with the current password will be unreadable, " +
+			"unless recovered with a recovery key. Set accept_data_loss to proceed")
+	}
+	if !verifyEmailedToken(passwordResetPurpose, parsedBody.Token) {
+		return context.String(http.StatusBadRequest, "Invalid or expired token")
+	}
+	tokenHash := hashEmailedToken(parsedBody.Token)
+	token, err := database.GetPasswordResetToken(tokenHash)
+	if err == database.ErrInvalidResetToken {
+		return context.String(http.StatusBadRequest, "Invalid or expired token")
+	} else if err != nil {
+		return InternalError(context, err)
+	}
+	var user database.User
+	err = database.GetDB().Where("id = ?", token.UserID).First(&user).Error
+	if err != nil {
+		return InternalError(context, err)
+	}
+	credentials, msg := newCredentials(user, parsedBody.NewPassword, parsedBody.NewSRP)
+	if msg != "" {
+		return context.String(http.StatusBadRequest, msg)
+	}
+
+	user, err = database.ResetPassword(tokenHash, credentials)
+	if err == database.ErrInvalidResetToken {
+		return context.String(http.StatusBadRequest, "Invalid or expired token")
+	} else if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditPasswordReset, "")
+
+	err = RevokeAllUserTokens(user.ID)
+	if err != nil {
+		return InternalError(context, fmt.Errorf("could not revoke tokens: %v", err))
+	}
+	err = database.DeleteUserTwoFactorsCookies(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	err = database.ResetAuthFailures(user.ID, authFailurePassword)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	forgetUser(user.ID)
+	// Tells the client whether the data key can still be recovered
+	return context.JSON(http.StatusOK, map[string]interface{}{"has_recovery_key": user.HasRecoveryKey})
+}
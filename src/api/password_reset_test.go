@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/mailer"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// Captures sent emails
+func fakeMailer() (<-chan mailer.Message, func()) {
+	messages := make(chan mailer.Message, 10)
+	previous, previousEnabled := sendMail, mailEnabled
+	sendMail = func(message mailer.Message) error {
+		messages <- message
+		return nil
+	}
+	mailEnabled = func() bool { return true }
+	return messages, func() {
+		sendMail = previous
+		mailEnabled = previousEnabled
+	}
+}
+
+// Emails are sent in the background
+func nextMail(messages <-chan mailer.Message) (mailer.Message, bool) {
+	select {
+	case message := <-messages:
+		return message, true
+	case <-time.After(time.Millisecond * 200):
+		return mailer.Message{}, false
+	}
+}
+
+func requestPasswordReset(email string) int {
+	marsh, _ := json.Marshal(PasswordResetRequestBody{Email: email})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = RequestPasswordReset(context)
+	return recorder.Code
+}
+
+func resetPassword(body PasswordResetBody) (int, string) {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = ResetPassword(context)
+	return recorder.Code, recorder.Body.String()
+}
+
+var resetTokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+func TestResetPassword(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+	code, msg := putWrappedKey(database.WrappedWithPassword,
+		WrappedKeyBody{KeyVersion: 1, Wrapped: bytes.Repeat([]byte{1}, 48), Password: "azer"})
+	assert.Equal(http.StatusOK, code, msg)
+	trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+
+	assert.Equal(http.StatusAccepted, requestPasswordReset("unknown@mail.com"))
+	_, sent := nextMail(messages)
+	assert.False(sent)
+
+	assert.Equal(http.StatusAccepted, requestPasswordReset(user.Email))
+	message, sent := nextMail(messages)
+	assert.True(sent)
+	assert.Equal(user.Email, message.To)
+	assert.Contains(message.Text, "unreadable")
+	token := resetTokenPattern.FindStringSubmatch(message.Text)[1]
+
+	body := PasswordResetBody{Token: token, NewPassword: "N3w password!", AcceptDataLoss: true}
+	notAccepted := body
+	notAccepted.AcceptDataLoss = false
+	code, _ = resetPassword(notAccepted)
+	assert.Equal(http.StatusBadRequest, code)
+	forged := body
+	forged.Token = token[:10] + "." + token[len(token) - 10:]
+	code, _ = resetPassword(forged)
+	assert.Equal(http.StatusBadRequest, code)
+	weak := body
+	weak.NewPassword = "weak"
+	code, _ = resetPassword(weak)
+	assert.Equal(http.StatusBadRequest, code)
+
+	code, msg = resetPassword(body)
+	assert.Equal(http.StatusOK, code)
+	assert.JSONEq(`{"has_recovery_key": false}`, msg)
+	// Single use
+	code, _ = resetPassword(body)
+	assert.Equal(http.StatusBadRequest, code)
+
+	devices, _ := database.GetTwoFactorsCookies(user.ID)
+	assert.Equal(0, len(devices))
+	code, _ = login(user.Email, "N3w password!")
+	assert.Equal(http.StatusOK, code)
+
+	// The data key is lost, a new one can be created
+	keys := getDataKeys()
+	assert.Equal(1, keys.DataKeyVersion)
+	assert.Equal(0, len(keys.Keys))
+	code, _ = putWrappedKey(database.WrappedWithPassword,
+		WrappedKeyBody{KeyVersion: 2, Wrapped: bytes.Repeat([]byte{2}, 48), Password: "N3w password!"})
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(2, getDataKeys().DataKeyVersion)
+}
+
+// The password wrapping is kept, so that the recovery key can still restore access to the data
+func TestResetPassword_RecoveryKey(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+	secret := bytes.Repeat([]byte{3}, 32)
+	setupRecoveryKey(t, secret, bytes.Repeat([]byte{4}, 48))
+
+	assert.Equal(http.StatusAccepted, requestPasswordReset(user.Email))
+	message, _ := nextMail(messages)
+	token := resetTokenPattern.FindStringSubmatch(message.Text)[1]
+	code, msg := resetPassword(PasswordResetBody{Token: token, NewPassword: "N3w password!", AcceptDataLoss: true})
+	assert.Equal(http.StatusOK, code)
+	assert.JSONEq(`{"has_recovery_key": true}`, msg)
+	assert.Equal(2, len(getDataKeys().Keys))
+
+	assert.Equal(http.StatusOK, recoverAccount(RecoverAccountBody{
+		RecoveryProofBody: RecoveryProofBody{Email: user.Email, RecoverySecret: secret},
+		NewPassword:       "Other passw0rd!",
+		WrappedKey:        bytes.Repeat([]byte{5}, 48),
+	}))
+}
+
+func TestRequestPasswordReset_RateLimit(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+
+	for i := 0; i < maxPasswordResetRequests; i++ {
+		assert.Equal(http.StatusAccepted, requestPasswordReset(user.Email))
+		_, sent := nextMail(messages)
+		assert.True(sent)
+	}
+	assert.Equal(http.StatusAccepted, requestPasswordReset(user.Email))
+	_, sent := nextMail(messages)
+	assert.False(sent)
+}
+
+func TestNotifyLockout(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+
+	NotifyLockout(user, authFailurePassword, time.Now().Add(lockoutDuration))
+	message, sent := nextMail(messages)
+	assert.True(sent)
+	assert.Equal(user.Email, message.To)
+	assert.Contains(message.Text, "failed password attempts")
+}
+
+func TestRequestPasswordReset_MailDisabled(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	messages, restore := fakeMailer()
+	defer restore()
+	mailEnabled = func() bool { return false }
+
+	marsh, _ := json.Marshal(PasswordResetRequestBody{Email: user.Email})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = RequireMail(RequestPasswordReset)(context)
+	assert.Equal(http.StatusServiceUnavailable, recorder.Code)
+
+	// Nor from the handlers sending alerts
+	NotifyLockout(user, authFailurePassword, time.Now().Add(lockoutDuration))
+	_, sent := nextMail(messages)
+	assert.False(sent)
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/srp"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// In memory object storage
+func fakeObjectStorage() (map[string]string, func()) {
+	objects := map[string]string{}
+	previousStore, previousDelete, previousFetch := storeObject, deleteObject, fetchObject
+	storeObject = func(descriptor string, file io.Reader) error {
+		content, _ := ioutil.ReadAll(file)
+		objects[descriptor] = string(content)
+		return nil
+	}
+	deleteObject = func(descriptor string) error {
+		delete(objects, descriptor)
+		return nil
+	}
+	fetchObject = func(descriptor string) ([]byte, error) {
+		content, found := objects[descriptor]
+		if !found {
+			return nil, errors.New("object not found")
+		}
+		return []byte(content), nil
+	}
+	return objects, func() { storeObject, deleteObject, fetchObject = previousStore, previousDelete, previousFetch }
+}
+
+func changePassword(body PasswordChangeBody) (int, string) {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = ChangePassword(context)
+	return recorder.Code, recorder.Body.String()
+}
+
+func userEntries(userID uint) []database.Entry {
+	var entries []database.Entry
+	database.GetDB().Where("user_id = ?", userID).Order("id").Find(&entries)
+	return entries
+}
+
+// What the client sends: every entry as it read it, with the content encrypted with the new key
+func reEncrypt(entries []database.Entry) []database.ReEncryptedEntry {
+	var reEncrypted []database.ReEncryptedEntry
+	for _, entry := range entries {
+		// Round trip through JSON, as a client would
+		var read database.Entry
+		marsh, _ := json.Marshal(entry)
+		_ = json.Unmarshal(marsh, &read)
+		reEncrypted = append(reEncrypted, database.ReEncryptedEntry{
+			ID:        read.ID,
+			UpdatedAt: read.UpdatedAt,
+			Content:   "new key:" + read.Content,
+		})
+	}
+	return reEncrypted
+}
+
+func setupDiary(userID uint) database.Label {
+	for _, content := range []string{"first", "second"} {
+		entry := database.Entry{PartialEntry: database.PartialEntry{Title: "Title", Content: content}, UserID: userID}
+		_ = database.Insert(&entry)
+	}
+	label := database.Label{PartialLabel: database.PartialLabel{Name: "avatar", Color: "#FFFFFF"}, UserID: userID, HasAvatar: true}
+	_ = database.Insert(&label)
+	return label
+}
+
+func TestChangePassword(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	setupDiary(other.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "old key avatar"
+	trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+	_, _ = openSession(user, time.Minute, authLevelPassword)
+
+	body := PasswordChangeBody{
+		Password:    "azer",
+		NewPassword: "N3w password!",
+		Entries:     reEncrypt(userEntries(user.ID)),
+		Avatars:     []ReEncryptedAvatar{{LabelID: label.ID, Data: []byte("new key avatar")}},
+	}
+
+	wrongPassword := body
+	wrongPassword.Password = "wrong"
+	code, msg := changePassword(wrongPassword)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Wrong password", msg)
+
+	weak := body
+	weak.NewPassword = "weak"
+	code, _ = changePassword(weak)
+	assert.Equal(http.StatusBadRequest, code)
+
+	code, _ = changePassword(body)
+	assert.Equal(http.StatusOK, code)
+
+	for _, entry := range userEntries(user.ID) {
+		assert.Contains(entry.Content, "new key:")
+	}
+	for _, entry := range userEntries(other.ID) {
+		assert.NotContains(entry.Content, "new key:")
+	}
+	assert.Equal(map[string]string{avatarFileDescriptor(label.ID, 1): "new key avatar"}, objects)
+
+	var updated database.User
+	database.GetDB().Where("id = ?", user.ID).First(&updated)
+	assert.Nil(bcrypt.CompareHashAndPassword([]byte(updated.Password), []byte("N3w password!")))
+
+	// Sessions and trusted devices are revoked
+	devices, _ := database.GetTwoFactorsCookies(user.ID)
+	assert.Equal(0, len(devices))
+	var refreshTokens int
+	database.GetDB().Model(&database.RefreshToken{}).Where("user_id = ? AND revoked = ?", user.ID, false).Count(&refreshTokens)
+	assert.Equal(0, refreshTokens)
+	var revoked int
+	database.GetDB().Model(&database.RevokedToken{}).Where("user_id = ?", user.ID).Count(&revoked)
+	assert.Equal(1, revoked)
+	// But not the session opened right after with the new password, even within the same second
+	assert.Equal(http.StatusOK, callWithToken(BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())))
+}
+
+// Nothing is changed unless every entry and avatar is re-encrypted, as the client read them
+func TestChangePassword_Incomplete(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	objects, restore := fakeObjectStorage()
+	defer restore()
+	label := setupDiary(user.ID)
+	objects[avatarFileDescriptor(label.ID, 0)] = "old key avatar"
+
+	entries := userEntries(user.ID)
+	complete := PasswordChangeBody{
+		Password:    "azer",
+		NewPassword: "N3w password!",
+		Entries:     reEncrypt(entries),
+		Avatars:     []ReEncryptedAvatar{{LabelID: label.ID, Data: []byte("new key avatar")}},
+	}
+
+	missingEntry := complete
+	missingEntry.Entries = complete.Entries[:1]
+	missingAvatar := complete
+	missingAvatar.Avatars = nil
+	duplicateEntry := complete
+	duplicateEntry.Entries = []database.ReEncryptedEntry{complete.Entries[0], complete.Entries[0]}
+	staleEntry := complete
+	staleEntry.Entries = reEncrypt(entries)
+	staleEntry.Entries[1].UpdatedAt = staleEntry.Entries[1].UpdatedAt.Add(-time.Second)
+
+	for _, body := range []PasswordChangeBody{missingEntry, missingAvatar, duplicateEntry, staleEntry} {
+		code, _ := changePassword(body)
+		assert.Equal(http.StatusConflict, code)
+		for _, entry := range userEntries(user.ID) {
+			assert.NotContains(entry.Content, "new key:")
+		}
+		assert.Equal(map[string]string{avatarFileDescriptor(label.ID, 0): "old key avatar"}, objects)
+		code, _ = login(user.Email, "azer")
+		assert.Equal(http.StatusOK, code)
+	}
+
+	// Would re-encrypt one avatar twice and lose the other
+	second := database.Label{PartialLabel: database.PartialLabel{Name: "second", Color: "#000000"}, UserID: user.ID, HasAvatar: true}
+	_ = database.Insert(&second)
+	objects[avatarFileDescriptor(second.ID, 0)] = "old key avatar"
+	duplicateAvatar := complete
+	duplicateAvatar.Avatars = []ReEncryptedAvatar{complete.Avatars[0], complete.Avatars[0]}
+	code, msg := changePassword(duplicateAvatar)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Duplicate avatar", msg)
+	assert.Equal(2, len(objects))
+}
+
+func TestChangePassword_SRP(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	registerSRP(t, srpEmail, "correct horse")
+	var user database.User
+	database.GetDB().Where("email = ?", srpEmail).First(&user)
+
+	marsh, _ := json.Marshal(SRPBeginBody{Email: srpEmail})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(BeginSRPLogin(context))
+	var begin srpBeginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &begin)
+	client, _ := srp.NewClient(srpEmail, "correct horse")
+	proof, _ := client.Proof(begin.Salt, begin.ServerEphemeral)
+
+	body := PasswordChangeBody{
+		SRP:    &SRPProof{begin.Handshake, client.PublicEphemeral(), proof},
+		NewSRP: &SRPRegistrationBody{Salt: srpSalt, Verifier: srp.Verifier(srpSalt, srpEmail, "battery staple")},
+	}
+	marsh, _ = json.Marshal(body)
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	context.Set("user", user)
+	assert.Nil(ChangePassword(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	_, code, _ := srpLogin(t, srpEmail, "battery staple")
+	assert.Equal(http.StatusOK, code)
+	_, code, _ = srpLogin(t, srpEmail, "correct horse")
+	assert.Equal(http.StatusNotFound, code)
+}
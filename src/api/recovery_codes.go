@@ -0,0 +1,173 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/authentication"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Generates a new set of codes, replacing the previous one. The returned codes are never stored in clear.
+func issueRecoveryCodes(context echo.Context, userID uint) ([]string, error) {
+	codes, err := authentication.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = authentication.HashRecoveryCode(userID, code)
+	}
+	err = database.ReplaceRecoveryCodes(userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	audit(context, userID, auditRecoveryCodesGenerated, "")
+	return codes, nil
+}
+
+// Second factors the user can authenticate with
+func twoFactorsMethods(user database.User) ([]string, error) {
+	var methods []string
+	if user.HasRegisteredOTP {
+		methods = append(methods, "OTP")
+	}
+	if user.HasRegisteredWebAuthn {
+		methods = append(methods, "WEBAUTHN")
+	}
+	remaining, err := database.CountRemainingRecoveryCodes(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if remaining > 0 {
+		methods = append(methods, "RECOVERY_CODE")
+	}
+	return methods, nil
+}
+
+type RecoveryCodeBody struct {
+	Code string `json:"code" validate:"required,max=20"`
+	Token string `json:"token" validate:"required"`
+	KeepActive bool `json:"keep_active"`
+}
+
+// Alternative to ValidateOTPCode when the user lost their device. Each code can only be used once.
+func AuthenticateWithRecoveryCode(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	var parsedBody RecoveryCodeBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	validate := validator.New()
+	err = validate.Struct(&parsedBody)
+	if err, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(err))
+	}
+
+	claims, err := ValidateJWTToken(parsedBody.Token, TwoFactorsKeyring())
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Token")
+	}
+
+	userID := twoFactorsTokenUserID(claims)
+	if userID == 0 {
+		return context.String(http.StatusUnauthorized, "Bad Token")
+	}
+	var user database.User
+	dbCpy := database.GetDB().Where("id = ?", userID).Find(&user)
+	if dbCpy.RecordNotFound() {
+		return context.NoContent(http.StatusNotFound)
+	}
+	if dbCpy.Error != nil {
+		return InternalError(context, dbCpy.Error)
+	}
+	if !user.HasTwoFactors() {
+		return context.String(http.StatusBadRequest, "Two factors authentication not enabled")
+	}
+
+	valid, err := database.ConsumeRecoveryCode(user.ID, authentication.HashRecoveryCode(user.ID, parsedBody.Code))
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !valid {
+		return context.String(http.StatusBadRequest, "Code refused")
+	}
+	remaining, err := database.CountRemainingRecoveryCodes(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditRecoveryCodeUsed, strconv.Itoa(remaining) + " remaining")
+
+	if parsedBody.KeepActive {
+		activeTFACookie(context, user.ID)
+	}
+	response, err := openSession(user, twoFactorsTokenTTL(claims), authLevelTwoFactors)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	// So that the client can suggest generating new codes
+	response["remaining_recovery_codes"] = remaining
+	return context.JSON(http.StatusOK, response)
+}
+
+type RegenerateRecoveryCodesBody struct {
+	// Required when OTP is registered
+	Passcode string `json:"passcode" validate:"omitempty,len=6,numeric"`
+}
+
+/*
+	Requires a current OTP passcode, so that a stolen access token is not enough to get codes.
+	Users with security keys only have no passcode to give, their session already required a key.
+*/
+func RegenerateRecoveryCodes(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	var parsedBody RegenerateRecoveryCodesBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	validate := validator.New()
+	err = validate.Struct(&parsedBody)
+	if err, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(err))
+	}
+
+	if !user.HasTwoFactors() {
+		return context.String(http.StatusBadRequest, "Two factors authentication not enabled")
+	}
+	if user.HasRegisteredOTP {
+		if parsedBody.Passcode == "" {
+			return context.String(http.StatusBadRequest, "Passcode required")
+		}
+		valid, err := checkOTPCode(user, parsedBody.Passcode)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		if !valid {
+			return context.String(http.StatusBadRequest, "Code refused")
+		}
+	}
+
+	codes, err := issueRecoveryCodes(context, user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
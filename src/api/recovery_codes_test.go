@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupUserWithRecoveryCodes() (database.User, []string) {
+	user, _ := SetupUsers()
+	user.OTPSecret = "2SH3V3GDW7ZNMGYE"
+	user.HasRegisteredOTP = true
+	_ = database.Update(&user)
+	context, _ := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	codes, _ := issueRecoveryCodes(context, user.ID)
+	return user, codes
+}
+
+func requestRecoveryAuthentication(user database.User, code string) (*loginResponse, int, string) {
+	return requestRecoveryAuthenticationWithToken(BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, TwoFactorsKeyring()), code)
+}
+
+func requestRecoveryAuthenticationWithToken(token string, code string) (*loginResponse, int, string) {
+	body := RecoveryCodeBody{
+		Code:  code,
+		Token: token,
+	}
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = AuthenticateWithRecoveryCode(context)
+
+	var response loginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return &response, recorder.Code, recorder.Body.String()
+}
+
+func TestAuthenticateWithRecoveryCode(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, codes := setupUserWithRecoveryCodes()
+	assert.Equal(10, len(codes))
+
+	methods, err := twoFactorsMethods(user)
+	assert.Nil(err)
+	assert.Equal([]string{"OTP", "RECOVERY_CODE"}, methods)
+
+	_, code, body := requestRecoveryAuthentication(user, "aaaa-aaaa-aaaa")
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Code refused", body)
+
+	// Case and dashes do not matter
+	response, code, _ := requestRecoveryAuthentication(user, strings.ToUpper(strings.Replace(codes[0], "-", "", -1)))
+	assert.Equal(http.StatusOK, code)
+	assert.Greater(len(response.Token), 300)
+	assert.NotEqual("", response.RefreshToken)
+	assert.Equal(9, response.RemainingRecoveryCodes)
+
+	// Consumed
+	_, code, _ = requestRecoveryAuthentication(user, codes[0])
+	assert.Equal(http.StatusBadRequest, code)
+
+	var events []database.AuditEvent
+	database.GetDB().Where("user_id = ? AND action = ?", user.ID, auditRecoveryCodeUsed).Find(&events)
+	assert.Equal(1, len(events))
+	assert.Equal("9 remaining", events[0].Details)
+
+	// Codes of other users are refused
+	_, other := SetupUsers()
+	other.HasRegisteredOTP = true
+	_ = database.Update(&other)
+	_, code, _ = requestRecoveryAuthentication(other, codes[1])
+	assert.Equal(http.StatusBadRequest, code)
+
+	// Tokens issued to nobody
+	_, code, _ = requestRecoveryAuthenticationWithToken(twoFactorsTokenWithoutSubject(), codes[1])
+	assert.Equal(http.StatusUnauthorized, code)
+	_, code, _ = requestRecoveryAuthentication(database.User{}, codes[1])
+	assert.Equal(http.StatusUnauthorized, code)
+}
+
+func TestAuthenticateWithRecoveryCodeLastCode(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, codes := setupUserWithRecoveryCodes()
+
+	for _, recoveryCode := range codes {
+		_, code, _ := requestRecoveryAuthentication(user, recoveryCode)
+		assert.Equal(http.StatusOK, code)
+	}
+	methods, _ := twoFactorsMethods(user)
+	assert.Equal([]string{"OTP"}, methods)
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, codes := setupUserWithRecoveryCodes()
+
+	marsh, _ := json.Marshal(RegenerateRecoveryCodesBody{Passcode: "000000"})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(RegenerateRecoveryCodes(context))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+
+	marsh, _ = json.Marshal(RegenerateRecoveryCodesBody{Passcode: currentPasscode(user.OTPSecret)})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(RegenerateRecoveryCodes(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	var response loginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Equal(10, len(response.RecoveryCodes))
+	assert.NotEqual(codes[0], response.RecoveryCodes[0])
+
+	// Previous codes do not work anymore
+	_, code, _ := requestRecoveryAuthentication(user, codes[0])
+	assert.Equal(http.StatusBadRequest, code)
+	_, code, _ = requestRecoveryAuthentication(user, response.RecoveryCodes[0])
+	assert.Equal(http.StatusOK, code)
+}
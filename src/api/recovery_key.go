@@ -0,0 +1,166 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+/*
+	Recovery of an account whose password is forgotten, with the recovery key set up with PutWrappedKey.
+	The server never sees the recovery key, only a secret derived from it: the client first proves possession to get
+	the recovery wrapping of the data key, unwraps it, then sets a new password and wraps the data key with it.
+
+	The second factor is not bypassed, it is still required on the next login.
+*/
+
+const (
+	minRecoverySecretSize = 32
+	maxRecoverySecretSize = 64
+)
+
+func validRecoverySecret(secret []byte) bool {
+	return len(secret) >= minRecoverySecretSize && len(secret) <= maxRecoverySecretSize
+}
+
+// The secret is high entropy, a fast hash is enough
+func recoverySecretHash(secret []byte) []byte {
+	hash := sha256.Sum256(secret)
+	return hash[:]
+}
+
+type RecoveryProofBody struct {
+	Email string `json:"email"`
+	RecoverySecret []byte `json:"recovery_secret"`
+}
+
+/*
+	Finds the user and checks the recovery secret. Unknown emails, users without recovery key and wrong secrets get
+	the same response, and failures count towards the lockout.
+	Returns nil and writes the response if refused.
+*/
+func checkRecoveryProof(context echo.Context, body RecoveryProofBody) (*database.User, error) {
+	if body.Email == "" || !validRecoverySecret(body.RecoverySecret) {
+		return nil, context.String(http.StatusBadRequest, "Bad Body")
+	}
+	var user database.User
+	result := database.GetDB().Where("email = ?", body.Email).First(&user)
+	if result.RecordNotFound() {
+		return nil, context.String(http.StatusBadRequest, "Wrong email or recovery key")
+	} else if result.Error != nil {
+		return nil, InternalError(context, result.Error)
+	}
+	if !user.HasRecoveryKey {
+		return nil, context.String(http.StatusBadRequest, "Wrong email or recovery key")
+	}
+	attempt, err := beginAuthAttempt(user, authFailureRecovery)
+	if err != nil {
+		return nil, authError(context, err)
+	}
+	if subtle.ConstantTimeCompare(user.RecoveryKeyHash, recoverySecretHash(body.RecoverySecret)) != 1 {
+		authFailed(context, user, authFailureRecovery, attempt)
+		return nil, context.String(http.StatusBadRequest, "Wrong email or recovery key")
+	}
+	err = authSucceeded(user, authFailureRecovery)
+	if err != nil {
+		return nil, InternalError(context, err)
+	}
+	return &user, nil
+}
+
+// First step: the client gets the data key wrapped with the recovery key
+func GetRecoveryWrappedKey(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody RecoveryProofBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	user, err := checkRecoveryProof(context, parsedBody)
+	if user == nil {
+		return err
+	}
+
+	keys, err := database.GetWrappedKeys(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	for _, key := range keys {
+		if key.Kind == database.WrappedWithRecoveryKey {
+			return context.JSON(http.StatusOK, map[string]interface{}{"key": key})
+		}
+	}
+	return InternalError(context, fmt.Errorf("user %v has a recovery key but no recovery wrapping", user.ID))
+}
+
+type RecoverAccountBody struct {
+	RecoveryProofBody
+
+	// Either a new password, or a new SRP verifier for users who switched to SRP
+	NewPassword string `json:"new_password"`
+	NewSRP *SRPRegistrationBody `json:"new_srp"`
+
+	// The data key, unwrapped with the recovery key and wrapped with the new password
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+/*
+	Second step: replaces the credentials and the password wrapping of the data key.
+	Every session and trusted device is revoked, the user has to log in again.
+*/
+func RecoverAccount(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody RecoverAccountBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	if !validWrappedKey(parsedBody.WrappedKey) {
+		return context.String(http.StatusBadRequest, "Bad wrapped key")
+	}
+	user, err := checkRecoveryProof(context, parsedBody.RecoveryProofBody)
+	if user == nil {
+		return err
+	}
+	credentials, msg := newCredentials(*user, parsedBody.NewPassword, parsedBody.NewSRP)
+	if msg != "" {
+		return context.String(http.StatusBadRequest, msg)
+	}
+	credentials.WrappedKey = parsedBody.WrappedKey
+
+	err = database.RecoverAccount(user.ID, user.RecoveryKeyHash, credentials)
+	if err == database.ErrDataChanged {
+		return context.String(http.StatusConflict, "Recovery key changed")
+	} else if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditAccountRecovered, "")
+
+	err = RevokeAllUserTokens(user.ID)
+	if err != nil {
+		return InternalError(context, fmt.Errorf("could not revoke tokens: %v", err))
+	}
+	err = database.DeleteUserTwoFactorsCookies(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	// The forgotten password may have locked the account
+	err = database.ResetAuthFailures(user.ID, authFailurePassword)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	forgetUser(user.ID)
+	return context.NoContent(http.StatusOK)
+}
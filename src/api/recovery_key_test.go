@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getRecoveryWrappedKey(email string, secret []byte) (int, database.WrappedKey) {
+	marsh, _ := json.Marshal(RecoveryProofBody{Email: email, RecoverySecret: secret})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = GetRecoveryWrappedKey(context)
+	var response struct {
+		Key database.WrappedKey `json:"key"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response.Key
+}
+
+func recoverAccount(body RecoverAccountBody) int {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = RecoverAccount(context)
+	return recorder.Code
+}
+
+func setupRecoveryKey(t *testing.T, secret []byte, wrapped []byte) {
+	code, msg := putWrappedKey(database.WrappedWithPassword,
+		WrappedKeyBody{KeyVersion: 1, Wrapped: bytes.Repeat([]byte{1}, 48), Password: "azer"})
+	if code != http.StatusOK {
+		t.Fatal(msg)
+	}
+	code, msg = putWrappedKey(database.WrappedWithRecoveryKey,
+		WrappedKeyBody{KeyVersion: 1, Wrapped: wrapped, RecoverySecret: secret, Password: "azer"})
+	if code != http.StatusOK {
+		t.Fatal(msg)
+	}
+}
+
+func TestRecoverAccount(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	secret := bytes.Repeat([]byte{3}, 32)
+	recoveryWrapped := bytes.Repeat([]byte{4}, 48)
+
+	// Without recovery key, same response as a wrong one
+	code, _ := getRecoveryWrappedKey(user.Email, secret)
+	assert.Equal(http.StatusBadRequest, code)
+
+	code, msg := putWrappedKey(database.WrappedWithRecoveryKey,
+		WrappedKeyBody{KeyVersion: 1, Wrapped: recoveryWrapped, Password: "azer"})
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Bad recovery secret", msg)
+	setupRecoveryKey(t, secret, recoveryWrapped)
+	var stored database.User
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	assert.True(stored.HasRecoveryKey)
+	assert.NotEqual(secret, stored.RecoveryKeyHash)
+
+	trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+	_, _ = openSession(user, time.Minute, authLevelPassword)
+
+	code, _ = getRecoveryWrappedKey("unknown@mail.com", secret)
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = getRecoveryWrappedKey(user.Email, bytes.Repeat([]byte{5}, 32))
+	assert.Equal(http.StatusBadRequest, code)
+	code, key := getRecoveryWrappedKey(user.Email, secret)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(recoveryWrapped, key.Wrapped)
+	assert.Equal(1, key.KeyVersion)
+
+	newWrapped := bytes.Repeat([]byte{6}, 48)
+	body := RecoverAccountBody{
+		RecoveryProofBody: RecoveryProofBody{Email: user.Email, RecoverySecret: secret},
+		NewPassword:       "N3w password!",
+		WrappedKey:        newWrapped,
+	}
+	missingKey := body
+	missingKey.WrappedKey = nil
+	assert.Equal(http.StatusBadRequest, recoverAccount(missingKey))
+	weak := body
+	weak.NewPassword = "weak"
+	assert.Equal(http.StatusBadRequest, recoverAccount(weak))
+
+	assert.Equal(http.StatusOK, recoverAccount(body))
+
+	// Sessions and trusted devices are revoked
+	devices, _ := database.GetTwoFactorsCookies(user.ID)
+	assert.Equal(0, len(devices))
+	var refreshTokens int
+	database.GetDB().Model(&database.RefreshToken{}).Where("user_id = ? AND revoked = ?", user.ID, false).Count(&refreshTokens)
+	assert.Equal(0, refreshTokens)
+
+	code, _ = login(user.Email, "N3w password!")
+	assert.Equal(http.StatusOK, code)
+	code, _ = login(user.Email, "azer")
+	assert.NotEqual(http.StatusOK, code)
+
+	keys := getDataKeys()
+	assert.Equal(2, len(keys.Keys))
+	assert.Equal(newWrapped, keys.Keys[0].Wrapped)
+	assert.Equal(recoveryWrapped, keys.Keys[1].Wrapped)
+}
+
+func TestRecoverAccount_Lockout(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	secret := bytes.Repeat([]byte{3}, 32)
+	setupRecoveryKey(t, secret, bytes.Repeat([]byte{4}, 48))
+
+	for i := 0; i < freeAuthAttempts; i++ {
+		code, _ := getRecoveryWrappedKey(user.Email, bytes.Repeat([]byte{5}, 32))
+		assert.Equal(http.StatusBadRequest, code)
+	}
+	code, _ := getRecoveryWrappedKey(user.Email, secret)
+	assert.Equal(http.StatusTooManyRequests, code)
+
+	// Recovery failures do not lock the password out
+	code, _ = login(user.Email, "azer")
+	assert.Equal(http.StatusOK, code)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/secrets"
+	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A refresh token must be used before this delay, or the user has to log in again
+const refreshTokenDuration = time.Hour * 12
+// Whatever the number of refresh, a session cannot last longer than this
+const maxSessionDuration = time.Hour * 24
+
+type RefreshTokenBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRefreshToken() (string, error) {
+	return secrets.Token(32)
+}
+
+/*
+	Creates a refresh token in the given family, which is also the session ID.
+	The returned string is the only copy of the token, we only store its hash.
+*/
+func issueRefreshToken(user database.User, family string, sessionDuration time.Duration,
+	sessionExpires time.Time, authLevel string) (string, error) {
+	token, err := generateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(refreshTokenDuration)
+	if expires.After(sessionExpires) {
+		expires = sessionExpires
+	}
+	dbToken := database.RefreshToken{
+		TokenHash:          hashRefreshToken(token),
+		Family:             family,
+		UserID:             user.ID,
+		AuthLevel:          authLevel,
+		SessionDuration:    sessionDuration,
+		Expires:            expires,
+		SessionExpires:     sessionExpires,
+	}
+	err = database.Insert(&dbToken)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+/*
+	Builds the access token and the refresh token starting a new session.
+	Must only be called once every required factor has been checked.
+*/
+func openSession(user database.User, sessionDuration time.Duration, authLevel string) (map[string]interface{}, error) {
+	sessionID := uuid.New().String()
+	refreshToken, err := issueRefreshToken(user, sessionID, sessionDuration, time.Now().Add(maxSessionDuration), authLevel)
+	if err != nil {
+		return nil, err
+	}
+	ss := BuildJwtToken(user, sessionID, authLevel, sessionDuration, AccessKeyring())
+	return map[string]interface{}{
+		"token": ss,
+		"refresh_token": refreshToken,
+		"two_factors_methods": nil,
+	}, nil
+}
+
+// Sends the tokens of a new session, see openSession
+func grantAccess(context echo.Context, user database.User, sessionDuration time.Duration, authLevel string) error {
+	response, err := openSession(user, sessionDuration, authLevel)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.JSON(http.StatusOK, response)
+}
+
+var errRefreshTokenReused = errors.New("refresh token reused, session revoked")
+
+func RefreshAccessToken(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	var parsedBody RefreshTokenBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || parsedBody.RefreshToken == "" {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	var refreshToken database.RefreshToken
+	result := database.GetDB().
+		Where("token_hash = ?", hashRefreshToken(parsedBody.RefreshToken)).
+		First(&refreshToken)
+	if result.RecordNotFound() {
+		return context.String(http.StatusUnauthorized, "Bad refresh token")
+	} else if result.Error != nil {
+		return InternalError(context, result.Error)
+	}
+	if refreshToken.Revoked {
+		return context.String(http.StatusUnauthorized, "Bad refresh token")
+	}
+
+	firstUse, err := refreshToken.MarkUsed()
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !firstUse {
+		// Either the client or an attacker holds a copy of this token, we cannot know which one, so we end the session
+		sentry.CaptureException(errRefreshTokenReused)
+		err = database.RevokeRefreshTokenFamily(refreshToken.Family)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		return context.String(http.StatusUnauthorized, "Bad refresh token")
+	}
+
+	now := time.Now()
+	if now.After(refreshToken.Expires) || now.After(refreshToken.SessionExpires) {
+		return context.String(http.StatusUnauthorized, "Session expired")
+	}
+
+	var user database.User
+	result = database.GetDB().Where("id = ?", refreshToken.UserID).First(&user)
+	if result.RecordNotFound() {
+		return context.String(http.StatusUnauthorized, "Bad refresh token")
+	} else if result.Error != nil {
+		return InternalError(context, result.Error)
+	}
+
+	// 2FA has been enabled since this session started, a refresh must not let the user skip it
+	if user.HasTwoFactors() && refreshToken.AuthLevel != authLevelTwoFactors {
+		err = database.RevokeRefreshTokenFamily(refreshToken.Family)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		return context.String(http.StatusUnauthorized, "Two factors authentication required")
+	}
+
+	newRefreshToken, err := issueRefreshToken(user, refreshToken.Family, refreshToken.SessionDuration,
+		refreshToken.SessionExpires, refreshToken.AuthLevel)
+	if err != nil {
+		return InternalError(context, err)
+	}
+
+	sessionDuration := refreshToken.SessionDuration
+	if remaining := refreshToken.SessionExpires.Sub(now); remaining < sessionDuration {
+		sessionDuration = remaining
+	}
+	ss := BuildJwtToken(user, refreshToken.Family, refreshToken.AuthLevel, sessionDuration, AccessKeyring())
+	return context.JSON(http.StatusOK, map[string]interface{}{"token": ss, "refresh_token": newRefreshToken})
+}
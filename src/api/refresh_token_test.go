@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func requestRefresh(refreshToken string) (*loginResponse, int, string) {
+	marsh, _ := json.Marshal(RefreshTokenBody{RefreshToken: refreshToken})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	_ = RefreshAccessToken(context)
+
+	var response loginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return &response, recorder.Code, recorder.Body.String()
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	token, err := issueRefreshToken(user, uuid.New().String(), time.Minute * 30, time.Now().Add(maxSessionDuration), authLevelPassword)
+	assert.Nil(err)
+
+	response, code, _ := requestRefresh(token)
+	assert.Equal(http.StatusOK, code)
+	assert.Greater(len(response.Token), 300)
+	assert.NotEqual("", response.RefreshToken)
+	assert.NotEqual(token, response.RefreshToken)
+
+	// The new token belongs to the same session
+	var first, second database.RefreshToken
+	database.GetDB().Where("token_hash = ?", hashRefreshToken(token)).First(&first)
+	database.GetDB().Where("token_hash = ?", hashRefreshToken(response.RefreshToken)).First(&second)
+	assert.Equal(first.Family, second.Family)
+	assert.Equal(first.SessionExpires.Unix(), second.SessionExpires.Unix())
+	assert.NotNil(first.UsedAt)
+
+	_, code, _ = requestRefresh("unknown token")
+	assert.Equal(http.StatusUnauthorized, code)
+}
+
+func TestRefreshAccessTokenReuse(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	token, _ := issueRefreshToken(user, uuid.New().String(), time.Minute * 30, time.Now().Add(maxSessionDuration), authLevelPassword)
+
+	response, code, _ := requestRefresh(token)
+	assert.Equal(http.StatusOK, code)
+
+	// Replaying the first token revokes the whole family, including the legitimate new token
+	_, code, _ = requestRefresh(token)
+	assert.Equal(http.StatusUnauthorized, code)
+
+	_, code, _ = requestRefresh(response.RefreshToken)
+	assert.Equal(http.StatusUnauthorized, code)
+}
+
+func TestRefreshAccessTokenSessionCeiling(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	token, _ := issueRefreshToken(user, uuid.New().String(), time.Minute * 30, time.Now().Add(time.Minute * 10), authLevelPassword)
+
+	var dbToken database.RefreshToken
+	database.GetDB().Where("token_hash = ?", hashRefreshToken(token)).First(&dbToken)
+	// Never outlives the session
+	assert.Equal(dbToken.SessionExpires.Unix(), dbToken.Expires.Unix())
+
+	response, code, _ := requestRefresh(token)
+	assert.Equal(http.StatusOK, code)
+	assert.Greater(len(response.Token), 300)
+
+	// Session ended
+	database.GetDB().Model(&database.RefreshToken{}).
+		Where("token_hash = ?", hashRefreshToken(response.RefreshToken)).
+		Update("session_expires", time.Now().Add(-time.Minute))
+	_, code, body := requestRefresh(response.RefreshToken)
+	assert.Equal(http.StatusUnauthorized, code)
+	assert.Equal("Session expired", body)
+}
+
+func TestRefreshAccessTokenRequiresTwoFactors(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	token, _ := issueRefreshToken(user, uuid.New().String(), time.Minute * 30, time.Now().Add(maxSessionDuration), authLevelPassword)
+
+	user.OTPSecret = "2SH3V3GDW7ZNMGYE"
+	user.HasRegisteredOTP = true
+	database.Update(&user)
+
+	_, code, body := requestRefresh(token)
+	assert.Equal(http.StatusUnauthorized, code)
+	assert.Equal("Two factors authentication required", body)
+
+	// Sessions opened with a second factor keep working
+	token, _ = issueRefreshToken(user, uuid.New().String(), time.Minute * 30, time.Now().Add(maxSessionDuration), authLevelTwoFactors)
+	_, code, _ = requestRefresh(token)
+	assert.Equal(http.StatusOK, code)
+}
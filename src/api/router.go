@@ -2,7 +2,6 @@ package api
 
 import (
 	"fmt"
-	"github.com/Yuruh/encrypted-diary/src/database"
 	"github.com/Yuruh/encrypted-diary/src/helpers"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/didip/tollbooth"
@@ -13,28 +12,77 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
 
 func AuthMiddleware() echo.MiddlewareFunc {
-	unprotectedPaths := [4]string{"/login", "/register", "/openapi.yml", "/auth/two-factors/otp/authenticate"}
-
-	return middleware.JWTWithConfig(middleware.JWTConfig{
-		Claims: &TokenClaims{},
-		SigningKey: []byte(os.Getenv("ACCESS_TOKEN_SECRET")),
-		SigningMethod: "HS512",
-		ContextKey: "token",
-		Skipper: func(context echo.Context) bool {
-			if helpers.ContainsString(unprotectedPaths[:], context.Path()) {
-				return true
+	unprotectedPaths := [19]string{"/login", "/register", "/openapi.yml", "/auth/two-factors/otp/authenticate", "/auth/refresh",
+		"/.well-known/jwks.json", "/auth/two-factors/recovery/authenticate",
+		"/auth/two-factors/webauthn/authenticate/begin", "/auth/two-factors/webauthn/authenticate/finish",
+		"/register/srp", "/login/srp/begin", "/login/srp/finish", "/auth/kdf",
+		"/auth/recover/key", "/auth/recover", "/auth/password-reset/request", "/auth/password-reset",
+		"/register/verify", "/register/verify/resend"}
+
+	skipper := func(context echo.Context) bool {
+		if helpers.ContainsString(unprotectedPaths[:], context.Path()) {
+			return true
+		}
+		return false
+	}
+
+	// Echo's JWT middleware only handles a fixed set of keys, so tokens are parsed here with the keyring
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(context echo.Context) error {
+			if skipper(context) {
+				return next(context)
 			}
-			return false
-		},
-		SuccessHandler: func(context echo.Context) {
-			context.Set("user", context.Get("token").(*jwt.Token).Claims.(*TokenClaims).User)
-		},
-	})
+			auth := context.Request().Header.Get("Authorization")
+			if len(auth) <= len("Bearer ") || !strings.HasPrefix(auth, "Bearer ") {
+				return middleware.ErrJWTMissing
+			}
+			token, err := jwt.ParseWithClaims(auth[len("Bearer "):], &TokenClaims{}, AccessKeyring().Keyfunc)
+			if err != nil || !token.Valid {
+				return &echo.HTTPError{
+					Code:     http.StatusUnauthorized,
+					Message:  "invalid or expired jwt",
+					Internal: err,
+				}
+			}
+			context.Set("token", token)
+
+			claims := token.Claims.(*TokenClaims)
+			revoked, err := isTokenRevoked(claims)
+			if err != nil {
+				return InternalError(context, err)
+			}
+			if revoked {
+				return &echo.HTTPError{
+					Code:     http.StatusUnauthorized,
+					Message:  "revoked jwt",
+				}
+			}
+			user, err := loadUser(claims.UserID())
+			if err == errUserNotFound {
+				return &echo.HTTPError{
+					Code:     http.StatusUnauthorized,
+					Message:  "unknown user",
+				}
+			} else if err != nil {
+				return InternalError(context, err)
+			}
+			// 2FA has been enabled since this token was issued
+			if user.HasTwoFactors() && claims.AuthLevel != authLevelTwoFactors {
+				return &echo.HTTPError{
+					Code:     http.StatusUnauthorized,
+					Message:  "two factors authentication required",
+				}
+			}
+			context.Set("user", user)
+			return next(context)
+		}
+	}
 }
 
 func BuildRateLimiterConf() *limiter.Limiter {
@@ -99,6 +147,16 @@ func RequireBody(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// For routes that only work by email, when the server cannot send any
+func RequireMail(next echo.HandlerFunc) echo.HandlerFunc {
+	return func (c echo.Context) error {
+		if !mailEnabled() {
+			return c.String(http.StatusServiceUnavailable, "Emails are not configured on this server")
+		}
+		return next(c)
+	}
+}
+
 func DeclareRoutes(app *echo.Echo) {
 	// Middleware
 	app.Use(RecoverMiddleware())
@@ -113,6 +171,16 @@ func DeclareRoutes(app *echo.Echo) {
 
 	app.POST("/login", Login, RequireBody)
 	app.POST("/register", Register, RequireBody)
+	app.POST("/register/srp", RegisterSRP, RequireBody)
+	app.POST("/register/verify", VerifyEmail, RequireBody)
+	app.POST("/register/verify/resend", ResendEmailVerification, RequireBody, RequireMail)
+	app.POST("/login/srp/begin", BeginSRPLogin, RequireBody)
+	app.POST("/login/srp/finish", FinishSRPLogin, RequireBody)
+	app.POST("/auth/refresh", RefreshAccessToken, RequireBody)
+	app.POST("/auth/recover/key", GetRecoveryWrappedKey, RequireBody)
+	app.POST("/auth/recover", RecoverAccount, RequireBody)
+	app.POST("/auth/password-reset/request", RequestPasswordReset, RequireBody, RequireMail)
+	app.POST("/auth/password-reset", ResetPassword, RequireBody)
 
 
 	// According to https://echo.labstack.com/middleware, "Middleware registered using Echo#Use() is only executed for paths which are registered after Echo#Use() has been called."
@@ -120,12 +188,29 @@ func DeclareRoutes(app *echo.Echo) {
 	app.Use(AuthMiddleware())
 	// Routes
 	app.GET("/openapi.yml", SendApiSpec)
+	app.GET("/.well-known/jwks.json", GetJWKS)
+	app.GET("/auth/kdf", GetKDFParams)
 
 	app.GET("/me", GetMe)
+	app.PUT("/me/kdf", UpdateKDFParams, RequireBody)
+	app.POST("/me/password", ChangePassword, RequireBody)
+	app.PUT("/me/email", ChangeEmail, RequireBody, RequireMail)
+	app.DELETE("/me", DeleteAccount, RequireBody)
+	app.POST("/me/deletion/cancel", CancelAccountDeletion)
+	app.GET("/me/export", ExportAccount)
+	app.GET("/me/export/:id", GetAccountExport)
+	app.POST("/me/import", ImportAccount, RequireBody, middleware.BodyLimit(importMaxArchiveSize))
+	app.POST("/me/import/preview", PreviewImport, RequireBody, middleware.BodyLimit(importMaxArchiveSize))
+	app.GET("/me/keys", GetDataKeys)
+	app.PUT("/me/keys/:kind", PutWrappedKey, RequireBody)
+
+	app.POST("/logout", Logout)
+	app.POST("/logout/all", LogoutAll)
 
 	app.GET("/entries", GetEntries)
 	app.GET("/entries/:id", GetEntry)
 	app.POST("/entries", AddEntry, RequireBody)
+	app.POST("/entries/batch", BatchEntries, RequireBody)
 	app.PUT("/entries/:id", EditEntry, RequireBody)
 	app.DELETE("/entries/:id", DeleteEntry)
 
@@ -135,8 +220,26 @@ func DeclareRoutes(app *echo.Echo) {
 	app.DELETE("/labels/:id", DeleteLabel)
 
 	app.POST("/auth/two-factors/otp/register", RequestGoogleAuthenticatorQRCode)
+	app.POST("/auth/two-factors/otp/confirm", ConfirmOTPRegistration, RequireBody)
+	app.DELETE("/auth/two-factors/otp", DisableOTP, RequireBody)
 	app.GET("/auth/two-factors/otp/token", RequestTwoFactorsToken)
 	app.POST("/auth/two-factors/otp/authenticate", ValidateOTPCode)
+	app.POST("/auth/two-factors/recovery/authenticate", AuthenticateWithRecoveryCode, RequireBody)
+	app.POST("/auth/two-factors/recovery/regenerate", RegenerateRecoveryCodes, RequireBody)
+
+	app.POST("/auth/two-factors/webauthn/register/begin", BeginWebAuthnRegistration)
+	app.POST("/auth/two-factors/webauthn/register/finish", FinishWebAuthnRegistration, RequireBody)
+	app.POST("/auth/two-factors/webauthn/authenticate/begin", BeginWebAuthnAuthentication, RequireBody)
+	app.POST("/auth/two-factors/webauthn/authenticate/finish", FinishWebAuthnAuthentication, RequireBody)
+	app.GET("/auth/two-factors/webauthn/credentials", GetWebAuthnCredentials)
+	app.POST("/auth/two-factors/webauthn/reauthenticate/begin", BeginWebAuthnReauthentication)
+	app.DELETE("/auth/two-factors/webauthn/credentials/:id", DeleteWebAuthnCredential, RequireBody)
+
+	app.POST("/auth/srp/enable", EnableSRP, RequireBody)
+
+	app.GET("/auth/two-factors/devices", GetTrustedDevices)
+	app.DELETE("/auth/two-factors/devices", RevokeTrustedDevices)
+	app.DELETE("/auth/two-factors/devices/:id", RevokeTrustedDevice)
 }
 
 // TODO
@@ -159,11 +262,33 @@ func SendApiSpec(c echo.Context) error {
 }
 
 func (c TokenClaims) Valid() error {
-	return c.StandardClaims.Valid()
+	err := c.StandardClaims.Valid()
+	if err != nil {
+		return err
+	}
+	return verifyIssuerAndAudience(&c)
+}
+
+// The subject is the user ID, the user itself is loaded from database on each request
+func (c TokenClaims) UserID() uint {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return uint(id)
 }
 
+const (
+	// Password only
+	authLevelPassword = "pwd"
+	// Password and a second factor
+	authLevelTwoFactors = "pwd+otp"
+)
+
 type TokenClaims struct {
-	User database.User `json:"user"`
+	// The refresh token family, empty for tokens that only give access to 2FA
+	SessionID string `json:"sid,omitempty"`
+	AuthLevel string `json:"auth_level"`
 	jwt.StandardClaims
 }
 
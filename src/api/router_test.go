@@ -1,13 +1,16 @@
 package api
 
 import (
+	"encoding/json"
 	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/keyring"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
 	asserthelper "github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -81,6 +84,11 @@ func TestAuthMiddleware(t *testing.T) {
 	t.Run("Unprotected", caseUnprotectedRoute)
 	t.Run("Expired", caseExpiredToken)
 	t.Run("Valid", caseValidToken)
+	t.Run("Deleted user", caseDeletedUser)
+	t.Run("Two factors enabled since", caseTwoFactorsEnabledSinceToken)
+	t.Run("Retiring key", caseRetiringKey)
+	t.Run("Other audience", caseOtherAudience)
+	t.Run("Asymmetric key", caseAsymmetricKey)
 }
 
 func caseNoToken(t *testing.T) {
@@ -114,10 +122,8 @@ func caseBadToken(t *testing.T) {
 
 func caseBadTokenSigning(t *testing.T) {
 	claims := &TokenClaims{
-		database.User{
-			BaseModel: database.BaseModel{ID: 321},
-		},
-		jwt.StandardClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject: "321",
 			ExpiresAt: time.Now().Unix() + int64(time.Hour * 24),
 		},
 	}
@@ -160,16 +166,13 @@ func caseUnprotectedRoute(t *testing.T) {
 
 func caseExpiredToken(t *testing.T) {
 	claims := &TokenClaims{
-		database.User{
-			BaseModel: database.BaseModel{ID:321},
-		},
-		jwt.StandardClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject: "321",
 			ExpiresAt: time.Now().Unix() - 10000,
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	ss, _ := token.SignedString([]byte(os.Getenv("ACCESS_TOKEN_SECRET")))
+	ss, _ := AccessKeyring().Sign(claims)
 
 	e := echo.New()
 	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
@@ -191,17 +194,18 @@ func caseExpiredToken(t *testing.T) {
 }
 
 func caseValidToken(t *testing.T) {
+	user, _ := SetupUsers()
 	claims := &TokenClaims{
-		database.User{
-			BaseModel: database.BaseModel{ID:321},
-		},
-		jwt.StandardClaims{
+		AuthLevel: authLevelPassword,
+		StandardClaims: jwt.StandardClaims{
+			Subject: strconv.Itoa(int(user.ID)),
 			ExpiresAt: time.Now().Unix() + int64(time.Hour * 24),
+			Issuer: TokenIssuer(),
+			Audience: TokenAudience(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	ss, _ := token.SignedString([]byte(os.Getenv("ACCESS_TOKEN_SECRET")))
+	ss, _ := AccessKeyring().Sign(claims)
 
 	e := echo.New()
 	e.GET("/", func(ctx echo.Context) error {return ctx.NoContent(http.StatusOK)})
@@ -221,11 +225,119 @@ func caseValidToken(t *testing.T) {
 	}
 }
 
+func caseDeletedUser(t *testing.T) {
+	user, _ := SetupUsers()
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	assert := asserthelper.New(t)
+	assert.Equal(http.StatusOK, callWithToken(ss))
+
+	database.GetDB().Delete(&user)
+	forgetUser(user.ID)
+	assert.Equal(http.StatusUnauthorized, callWithToken(ss))
+}
+
+func caseTwoFactorsEnabledSinceToken(t *testing.T) {
+	user, _ := SetupUsers()
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	assert := asserthelper.New(t)
+	assert.Equal(http.StatusOK, callWithToken(ss))
+
+	database.GetDB().Model(&user).Update("HasRegisteredOTP", true)
+	forgetUser(user.ID)
+	assert.Equal(http.StatusUnauthorized, callWithToken(ss))
+	ss = BuildJwtToken(user, "", authLevelTwoFactors, time.Minute * 30, AccessKeyring())
+	assert.Equal(http.StatusOK, callWithToken(ss))
+}
+
+func caseRetiringKey(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	previous := AccessKeyring()
+	defer func() { accessKeyring = previous }()
+
+	retiring := keyring.Key{ID: "retiring", Secret: []byte("retiring secret"), CreatedAt: time.Now().Add(-time.Hour)}
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, keyring.New([]keyring.Key{retiring}))
+
+	graceEnd := time.Now().Add(time.Hour)
+	retiring.RetiresAt = &graceEnd
+	newKey := keyring.Key{ID: "new", Secret: []byte("new secret"), CreatedAt: time.Now()}
+	accessKeyring = keyring.New([]keyring.Key{retiring, newKey})
+	assert.Equal(http.StatusOK, callWithToken(ss))
+
+	graceEnd = time.Now().Add(-time.Second)
+	accessKeyring = keyring.New([]keyring.Key{retiring, newKey})
+	assert.Equal(http.StatusUnauthorized, callWithToken(ss))
+}
+
+func caseOtherAudience(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	assert.Equal(http.StatusOK, callWithToken(ss))
+
+	// A self-hosted instance does not accept tokens meant for another one
+	os.Setenv("TOKEN_AUDIENCE", "api.diary.example.com")
+	defer os.Unsetenv("TOKEN_AUDIENCE")
+	assert.Equal(http.StatusUnauthorized, callWithToken(ss))
+	ss = BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	assert.Equal(http.StatusOK, callWithToken(ss))
+}
+
+func caseAsymmetricKey(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	previous := AccessKeyring()
+	defer func() { accessKeyring = previous }()
+
+	for _, alg := range []string{keyring.AlgorithmEdDSA, keyring.AlgorithmES256} {
+		key, err := keyring.Generate("asymmetric", alg, 0)
+		assert.Nil(err)
+		accessKeyring = keyring.New([]keyring.Key{key})
+		ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+		assert.Equal(http.StatusOK, callWithToken(ss))
+
+		// The public key cannot be used as an HMAC secret to forge tokens
+		jwk, _ := key.JWK()
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS512, &TokenClaims{
+			AuthLevel: authLevelPassword,
+			StandardClaims: jwt.StandardClaims{
+				Subject: strconv.Itoa(int(user.ID)),
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+				Issuer: TokenIssuer(),
+				Audience: TokenAudience(),
+			},
+		})
+		forged.Header["kid"] = "asymmetric"
+		ss, _ = forged.SignedString([]byte(jwk.X))
+		assert.Equal(http.StatusUnauthorized, callWithToken(ss))
+	}
+}
+
+func TestGetJWKS(t *testing.T) {
+	assert := asserthelper.New(t)
+	previous := AccessKeyring()
+	defer func() { accessKeyring = previous }()
+
+	key, _ := keyring.Generate("ed", keyring.AlgorithmEdDSA, 0)
+	accessKeyring = keyring.New([]keyring.Key{key, {ID: "hmac", Secret: []byte("secret")}})
+
+	context, recorder := BuildEchoContext(nil, "")
+	assert.Nil(GetJWKS(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	var set keyring.JWKSet
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &set))
+	// HMAC secrets are never published
+	assert.Equal(1, len(set.Keys))
+	assert.Equal("ed", set.Keys[0].KeyID)
+	assert.Equal("OKP", set.Keys[0].KeyType)
+}
+
 func TestDeclareRoutes(t *testing.T) {
 	e := echo.New()
 	assert := asserthelper.New(t)
 	DeclareRoutes(e)
-	assert.Equal(16, len(e.Routes()))
+	assert.Equal(57, len(e.Routes()))
 }
 
 func TestRecoverMiddleware(t *testing.T) {
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/secrets"
+	"github.com/Yuruh/encrypted-diary/src/srp"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Zero-knowledge alternative to /login and /register, see package srp.
+	Users registered with a password can switch with EnableSRP, after which /login refuses them.
+*/
+
+// The client has this long to send its proof
+const srpHandshakeTTL = time.Minute * 2
+
+/*
+	Pending handshakes, by ID. A handshake can only be used once.
+	Kept in memory: a handshake must be finished on the instance that started it.
+*/
+var srpHandshakes = cache.New(srpHandshakeTTL, time.Minute * 5)
+var srpHandshakesMutex sync.Mutex
+
+type srpHandshake struct {
+	userID uint
+	server *srp.Server
+}
+
+func takeHandshake(id string) (srpHandshake, bool) {
+	srpHandshakesMutex.Lock()
+	defer srpHandshakesMutex.Unlock()
+	found, ok := srpHandshakes.Get(id)
+	if !ok {
+		return srpHandshake{}, false
+	}
+	srpHandshakes.Delete(id)
+	return found.(srpHandshake), true
+}
+
+// Binary values are base64 encoded, as any []byte in JSON
+type SRPRegistrationBody struct {
+	Email string `json:"email"`
+	Salt []byte `json:"salt"`
+	Verifier []byte `json:"verifier"`
+}
+
+func (body SRPRegistrationBody) validate() (string, bool) {
+	if len(body.Salt) < srp.MinSaltSize || len(body.Salt) > srp.MaxSaltSize {
+		return "Bad salt", false
+	}
+	if srp.ValidateVerifier(body.Verifier) != nil {
+		return "Bad verifier", false
+	}
+	return "", true
+}
+
+/*
+	The password strength cannot be checked server side, clients must enforce the same rules as Register.
+	The verifier is computed with the email as identity.
+*/
+func RegisterSRP(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody SRPRegistrationBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	if msg, ok := parsedBody.validate(); !ok {
+		return context.String(http.StatusBadRequest, msg)
+	}
+
+	user := database.User{
+		Email:       parsedBody.Email,
+		UsesSRP:     true,
+		SRPSalt:     parsedBody.Salt,
+		SRPVerifier: parsedBody.Verifier,
+	}
+	err = database.Insert(&user)
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return context.NoContent(http.StatusConflict)
+	} else if err != nil {
+		return context.String(http.StatusBadRequest, err.Error())
+	}
+	_, err = sendEmailVerification(user, user.Email, nil)
+	if err != nil {
+		sentry.CaptureException(err)
+	}
+	return context.JSON(http.StatusCreated, map[string]interface{}{"user": user})
+}
+
+type SRPBeginBody struct {
+	Email string `json:"email"`
+}
+
+/*
+	Users who cannot log in with SRP get a salt and a verifier that look like those of a real user, always the same
+	for a given email, so that BeginSRPLogin cannot tell which accounts exist nor how they log in. Their handshakes
+	fail like a wrong password.
+*/
+func decoySRPServer(email string) (*srp.Server, []byte, error) {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, SecretsEnvelope().DeriveKey("srp-decoy"))
+		mac.Write([]byte(purpose + ":" + strings.ToLower(email)))
+		return mac.Sum(nil)
+	}
+	salt := derive("salt")
+	server, err := srp.NewServer(email, salt, srp.Verifier(salt, email, hex.EncodeToString(derive("password"))))
+	return server, salt, err
+}
+
+// First step of the login: the client gets the salt of the user, and the public ephemeral value of the server
+func BeginSRPLogin(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody SRPBeginBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || parsedBody.Email == "" {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	var user database.User
+	result := database.GetDB().Where("email = ?", parsedBody.Email).First(&user)
+	if result.Error != nil && !result.RecordNotFound() {
+		return InternalError(context, result.Error)
+	}
+	var server *srp.Server
+	salt := user.SRPSalt
+	if user.UsesSRP {
+		server, err = srp.NewServer(user.Email, user.SRPSalt, user.SRPVerifier)
+	} else {
+		// Handshake of no user
+		user = database.User{}
+		server, salt, err = decoySRPServer(parsedBody.Email)
+	}
+	if err != nil {
+		return InternalError(context, err)
+	}
+	id, err := secrets.Token(secrets.DefaultSize)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	srpHandshakes.SetDefault(id, srpHandshake{user.ID, server})
+	return context.JSON(http.StatusOK, map[string]interface{}{
+		"handshake": id,
+		"salt":      salt,
+		"server_ephemeral": server.PublicEphemeral(),
+	})
+}
+
+// The client half of a handshake
+type SRPProof struct {
+	Handshake string `json:"handshake"`
+	ClientEphemeral []byte `json:"client_ephemeral"`
+	Proof []byte `json:"proof"`
+}
+
+func (proof SRPProof) isComplete() bool {
+	return proof.Handshake != "" && len(proof.ClientEphemeral) > 0 && len(proof.Proof) > 0
+}
+
+type SRPFinishBody struct {
+	SRPProof
+	SessionDurationMs time.Duration `json:"session_duration_ms"`
+}
+
+/*
+	Checks the proof of a handshake started for this user. Attempts count towards the lockout like passwords, the
+	handshake is left untouched while locked.
+	Returns the server proof, nil if refused.
+*/
+func verifySRPProof(context echo.Context, user database.User, proof SRPProof) ([]byte, error) {
+	attempt, err := beginAuthAttempt(user, authFailurePassword)
+	if err != nil {
+		return nil, err
+	}
+	handshake, found := takeHandshake(proof.Handshake)
+	if !found || handshake.userID != user.ID {
+		authFailed(context, user, authFailurePassword, attempt)
+		return nil, nil
+	}
+	serverProof, err := handshake.server.Verify(proof.ClientEphemeral, proof.Proof)
+	if err != nil {
+		authFailed(context, user, authFailurePassword, attempt)
+		return nil, nil
+	}
+	return serverProof, authSucceeded(user, authFailurePassword)
+}
+
+// Second step: the client proves it knows the password. Continues like Login, 2FA included.
+func FinishSRPLogin(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody SRPFinishBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || !parsedBody.SRPProof.isComplete() {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	sessionDuration := LoginBody{SessionDurationMs: parsedBody.SessionDurationMs}
+	sanitizeParsedBody(&sessionDuration)
+
+	// Peeked, the handshake is only taken once the lock is checked
+	found, ok := srpHandshakes.Get(parsedBody.Handshake)
+	if !ok {
+		return context.String(http.StatusBadRequest, "Unknown or expired handshake")
+	}
+	if found.(srpHandshake).userID == 0 {
+		takeHandshake(parsedBody.Handshake)
+		return loginRefused(context)
+	}
+	var user database.User
+	err = database.GetDB().Where("id = ?", found.(srpHandshake).userID).First(&user).Error
+	if err != nil {
+		return InternalError(context, err)
+	}
+	serverProof, err := verifySRPProof(context, user, parsedBody.SRPProof)
+	if err != nil {
+		return authError(context, err)
+	}
+	if serverProof == nil {
+		return loginRefused(context)
+	}
+	if blockedUntilVerified(user, emailVerificationLogin) {
+		return emailNotVerified(context)
+	}
+	response, err := passwordVerified(context, user, sessionDuration.SessionDurationMs)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	// Lets the client make sure the server knows the verifier
+	response["server_proof"] = serverProof
+	return context.JSON(http.StatusOK, response)
+}
+
+/*
+	Checks the password of the authenticated user before a sensitive action: the plaintext password for users who
+	did not switch to SRP, a proof from a handshake started with BeginSRPLogin otherwise.
+	Attempts count towards the lockout like logins, errors are handled with authError.
+*/
+func checkPassword(context echo.Context, user database.User, password string, proof *SRPProof) (bool, error) {
+	if !user.UsesSRP {
+		attempt, err := beginAuthAttempt(user, authFailurePassword)
+		if err != nil {
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+			authFailed(context, user, authFailurePassword, attempt)
+			return false, nil
+		}
+		return true, authSucceeded(user, authFailurePassword)
+	}
+	if proof == nil {
+		return false, nil
+	}
+	serverProof, err := verifySRPProof(context, user, *proof)
+	return serverProof != nil, err
+}
+
+type EnableSRPBody struct {
+	Password string `json:"password" validate:"required"`
+	SRPRegistrationBody
+}
+
+// Switches the authenticated user to SRP. The password is sent one last time, then only the verifier is stored.
+func EnableSRP(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody EnableSRPBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	if msg, ok := parsedBody.validate(); !ok {
+		return context.String(http.StatusBadRequest, msg)
+	}
+	if user.UsesSRP {
+		return context.String(http.StatusBadRequest, "SRP already enabled")
+	}
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, nil)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+
+	err = user.EnableSRP(parsedBody.Salt, parsedBody.Verifier)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	forgetUser(user.ID)
+	audit(context, user.ID, auditSRPEnabled, "")
+	return context.NoContent(http.StatusOK)
+}
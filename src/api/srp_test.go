@@ -0,0 +1,282 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/srp"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+const srpEmail = "srp@user.com"
+
+var srpSalt = []byte("0123456789abcdef")
+
+type srpBeginResponse struct {
+	Handshake       string `json:"handshake"`
+	Salt            []byte `json:"salt"`
+	ServerEphemeral []byte `json:"server_ephemeral"`
+}
+
+// Runs both steps of the login as a client would, returns the response of the second one
+func srpLogin(t *testing.T, email string, password string) (*srp.Client, int, map[string]interface{}) {
+	marsh, _ := json.Marshal(SRPBeginBody{Email: email})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	if err := BeginSRPLogin(context); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK {
+		return nil, recorder.Code, nil
+	}
+	var begin srpBeginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &begin)
+
+	client, _ := srp.NewClient(email, password)
+	proof, err := client.Proof(begin.Salt, begin.ServerEphemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish := SRPFinishBody{SRPProof: SRPProof{
+		Handshake:       begin.Handshake,
+		ClientEphemeral: client.PublicEphemeral(),
+		Proof:           proof,
+	}}
+	marsh, _ = json.Marshal(finish)
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	if err := FinishSRPLogin(context); err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return client, recorder.Code, response
+}
+
+func registerSRP(t *testing.T, email string, password string) int {
+	marsh, _ := json.Marshal(SRPRegistrationBody{
+		Email:    email,
+		Salt:     srpSalt,
+		Verifier: srp.Verifier(srpSalt, email, password),
+	})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	if err := RegisterSRP(context); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code
+}
+
+func TestRegisterSRP(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+
+	assert.Equal(http.StatusCreated, registerSRP(t, srpEmail, "correct horse"))
+
+	var user database.User
+	database.GetDB().Where("email = ?", srpEmail).First(&user)
+	assert.True(user.UsesSRP)
+	assert.Equal("", user.Password)
+	assert.Equal(srpSalt, user.SRPSalt)
+
+	// Bad salt or verifier
+	for _, body := range []SRPRegistrationBody{
+		{Email: "other@user.com", Salt: []byte("short"), Verifier: []byte{2}},
+		{Email: "other@user.com", Salt: srpSalt},
+		{Email: "other@user.com", Salt: srpSalt, Verifier: []byte{0}},
+	} {
+		marsh, _ := json.Marshal(body)
+		context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+		assert.Nil(RegisterSRP(context))
+		assert.Equal(http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestSRPLogin(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	registerSRP(t, srpEmail, "correct horse")
+
+	client, code, response := srpLogin(t, srpEmail, "correct horse")
+	assert.Equal(http.StatusOK, code)
+	assert.Greater(len(response["token"].(string)), 100)
+	assert.NotEmpty(response["refresh_token"])
+	serverProof := []byte{}
+	_ = json.Unmarshal([]byte(`"` + response["server_proof"].(string) + `"`), &serverProof)
+	assert.True(client.VerifyServer(serverProof))
+
+	// Wrong password, counted as a failure
+	_, code, _ = srpLogin(t, srpEmail, "correct h0rse")
+	assert.Equal(http.StatusNotFound, code)
+	var user database.User
+	database.GetDB().Where("email = ?", srpEmail).First(&user)
+	failure, _ := database.GetAuthFailure(user.ID, authFailurePassword)
+	assert.Equal(1, failure.Failures)
+
+	// The password login is refused, like for an unknown user
+	code, _ = login(srpEmail, "correct horse")
+	assert.Equal(http.StatusNotFound, code)
+	code, _ = login("unknown@user.com", "correct horse")
+	assert.Equal(http.StatusNotFound, code)
+
+	// And the SRP login is refused to users who did not switch, like for an unknown user
+	_, code, _ = srpLogin(t, UserHasAccessEmail, "azer")
+	assert.Equal(http.StatusNotFound, code)
+	_, code, _ = srpLogin(t, "unknown@user.com", "azer")
+	assert.Equal(http.StatusNotFound, code)
+}
+
+// The handshake does not tell whether the account exists nor whether it uses SRP
+func TestBeginSRPLogin_Decoy(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	registerSRP(t, srpEmail, "correct horse")
+
+	begin := func(email string) srpBeginResponse {
+		marsh, _ := json.Marshal(SRPBeginBody{Email: email})
+		context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+		assert.Nil(BeginSRPLogin(context))
+		assert.Equal(http.StatusOK, recorder.Code)
+		var response srpBeginResponse
+		_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+		return response
+	}
+	real := begin(srpEmail)
+	first, second := begin("unknown@user.com"), begin("unknown@user.com")
+	assert.Equal(first.Salt, second.Salt)
+	assert.NotEqual(first.ServerEphemeral, second.ServerEphemeral)
+	assert.Equal(len(real.ServerEphemeral), len(first.ServerEphemeral))
+	assert.NotEqual(first.Salt, begin(UserHasAccessEmail).Salt)
+}
+
+func TestSRPLogin_Handshake(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	registerSRP(t, srpEmail, "correct horse")
+
+	marsh, _ := json.Marshal(SRPBeginBody{Email: srpEmail})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(BeginSRPLogin(context))
+	var begin srpBeginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &begin)
+
+	client, _ := srp.NewClient(srpEmail, "correct horse")
+	proof, _ := client.Proof(begin.Salt, begin.ServerEphemeral)
+	finish, _ := json.Marshal(SRPFinishBody{SRPProof: SRPProof{begin.Handshake, client.PublicEphemeral(), proof}})
+
+	context, recorder = BuildEchoContext(finish, echo.MIMEApplicationJSON)
+	assert.Nil(FinishSRPLogin(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	// A handshake can only be used once
+	context, recorder = BuildEchoContext(finish, echo.MIMEApplicationJSON)
+	assert.Nil(FinishSRPLogin(context))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("Unknown or expired handshake", recorder.Body.String())
+}
+
+func TestSRPLogin_TwoFactors(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	registerSRP(t, srpEmail, "correct horse")
+	var user database.User
+	database.GetDB().Where("email = ?", srpEmail).First(&user)
+	database.GetDB().Model(&user).Update("HasRegisteredOTP", true)
+	forgetUser(user.ID)
+
+	_, code, response := srpLogin(t, srpEmail, "correct horse")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal([]interface{}{"OTP"}, response["two_factors_methods"])
+	_, err := ValidateJWTToken(response["token"].(string), TwoFactorsKeyring())
+	assert.Nil(err)
+}
+
+func TestEnableSRP(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	body := EnableSRPBody{Password: "wrong", SRPRegistrationBody: SRPRegistrationBody{
+		Salt:     srpSalt,
+		Verifier: srp.Verifier(srpSalt, user.Email, "new password"),
+	}}
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(EnableSRP(context))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("Wrong password", recorder.Body.String())
+
+	body.Password = "azer"
+	marsh, _ = json.Marshal(body)
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(EnableSRP(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	code, _ := login(user.Email, "azer")
+	assert.Equal(http.StatusNotFound, code)
+	_, code, _ = srpLogin(t, user.Email, "new password")
+	assert.Equal(http.StatusOK, code)
+}
+
+// Guesses count towards the lockout like logins
+func TestEnableSRP_Lockout(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	body := EnableSRPBody{Password: "wrong", SRPRegistrationBody: SRPRegistrationBody{
+		Salt:     srpSalt,
+		Verifier: srp.Verifier(srpSalt, user.Email, "new password"),
+	}}
+	for i := 0; i < freeAuthAttempts; i++ {
+		marsh, _ := json.Marshal(body)
+		context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+		assert.Nil(EnableSRP(context))
+		assert.Equal(http.StatusBadRequest, recorder.Code)
+	}
+
+	// Refused while locked, even with the right password
+	body.Password = "azer"
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(EnableSRP(context))
+	assert.Equal(http.StatusTooManyRequests, recorder.Code)
+	database.GetDB().Where("id = ?", user.ID).First(&user)
+	assert.False(user.UsesSRP)
+}
+
+// Sensitive actions take a handshake proof instead of the password
+func TestDisableOTP_SRP(t *testing.T) {
+	assert := asserthelper.New(t)
+	SetupUsers()
+	registerSRP(t, srpEmail, "correct horse")
+	var user database.User
+	database.GetDB().Where("email = ?", srpEmail).First(&user)
+	assert.Nil(user.SetOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
+	database.GetDB().Model(&user).Update("HasRegisteredOTP", true)
+	database.GetDB().Where("id = ?", user.ID).First(&user)
+
+	begin := func(password string) *SRPProof {
+		marsh, _ := json.Marshal(SRPBeginBody{Email: srpEmail})
+		context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+		assert.Nil(BeginSRPLogin(context))
+		var response srpBeginResponse
+		_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+		client, _ := srp.NewClient(srpEmail, password)
+		proof, _ := client.Proof(response.Salt, response.ServerEphemeral)
+		return &SRPProof{response.Handshake, client.PublicEphemeral(), proof}
+	}
+	disable := func(proof *SRPProof) (int, string) {
+		marsh, _ := json.Marshal(DisableOTPBody{SRP: proof, Passcode: currentPasscode("2SH3V3GDW7ZNMGYE")})
+		context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+		context.Set("user", user)
+		assert.Nil(DisableOTP(context))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	code, body := disable(nil)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Wrong password", body)
+	code, body = disable(begin("wrong"))
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Wrong password", body)
+	code, _ = disable(begin("correct horse"))
+	assert.Equal(http.StatusOK, code)
+}
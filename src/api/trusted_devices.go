@@ -0,0 +1,56 @@
+package api
+
+import (
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+// Devices where the second factor is not asked at login, created with keep_active on 2FA authentication
+
+func GetTrustedDevices(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	devices, err := database.GetTwoFactorsCookies(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"devices": devices})
+}
+
+func RevokeTrustedDevice(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	id, err := strconv.Atoi(context.Param("id"))
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad route parameter")
+	}
+	var device database.TwoFactorsCookie
+	result := database.GetDB().
+		Where("id = ?", id).
+		Where("user_id = ?", user.ID).
+		First(&device)
+	if result.RecordNotFound() {
+		return context.NoContent(http.StatusNotFound)
+	} else if result.Error != nil {
+		return InternalError(context, result.Error)
+	}
+	err = device.Delete()
+	if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditTrustedDeviceRevoked, device.UserAgent)
+	return context.NoContent(http.StatusOK)
+}
+
+func RevokeTrustedDevices(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	err := database.DeleteUserTwoFactorsCookies(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditTrustedDevicesRevoked, "")
+	return context.NoContent(http.StatusOK)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func trustDevice(userID uint, agent string, expires time.Time) database.TwoFactorsCookie {
+	cookie := database.TwoFactorsCookie{
+		Uuid:      agent + "-token",
+		IpAddr:    "2001:db8::1",
+		UserAgent: agent,
+		Expires:   expires,
+		UserID:    userID,
+		LastUsed:  time.Now(),
+	}
+	err := database.Insert(&cookie)
+	if err != nil {
+		panic(err)
+	}
+	return cookie
+}
+
+func TestGetTrustedDevices(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	database.GetDB().Unscoped().Delete(database.TwoFactorsCookie{})
+
+	trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+	trustDevice(user.ID, "old phone", time.Now().Add(-time.Hour))
+	trustDevice(other.ID, "someone else", time.Now().Add(time.Hour))
+
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	err := GetTrustedDevices(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	var response struct {
+		Devices []map[string]interface{} `json:"devices"`
+	}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Nil(err)
+	assert.Equal(1, len(response.Devices))
+	assert.Equal("laptop", response.Devices[0]["user_agent"])
+	assert.Equal("2001:db8::1", response.Devices[0]["ip_addr"])
+	// The cookie value must never be sent back
+	assert.NotContains(recorder.Body.String(), "laptop-token")
+
+	// Expired devices are purged
+	assert.Nil(database.PurgeTwoFactorsCookies())
+	var count int
+	database.GetDB().Unscoped().Model(&database.TwoFactorsCookie{}).Count(&count)
+	assert.Equal(2, count)
+}
+
+func TestRevokeTrustedDevice(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	database.GetDB().Unscoped().Delete(database.TwoFactorsCookie{})
+
+	mine := trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+	theirs := trustDevice(other.ID, "someone else", time.Now().Add(time.Hour))
+
+	// Cannot revoke the devices of another user
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.SetParamNames("id")
+	context.SetParamValues(strconv.Itoa(int(theirs.ID)))
+	assert.Nil(RevokeTrustedDevice(context))
+	assert.Equal(http.StatusNotFound, recorder.Code)
+
+	context, recorder = BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.SetParamNames("id")
+	context.SetParamValues("abc")
+	assert.Nil(RevokeTrustedDevice(context))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+
+	context, recorder = BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.SetParamNames("id")
+	context.SetParamValues(strconv.Itoa(int(mine.ID)))
+	assert.Nil(RevokeTrustedDevice(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	devices, _ := database.GetTwoFactorsCookies(user.ID)
+	assert.Equal(0, len(devices))
+	devices, _ = database.GetTwoFactorsCookies(other.ID)
+	assert.Equal(1, len(devices))
+}
+
+func TestRevokeTrustedDevices(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+	database.GetDB().Unscoped().Delete(database.TwoFactorsCookie{})
+
+	trustDevice(user.ID, "laptop", time.Now().Add(time.Hour))
+	trustDevice(user.ID, "phone", time.Now().Add(time.Hour))
+	trustDevice(other.ID, "someone else", time.Now().Add(time.Hour))
+
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	assert.Nil(RevokeTrustedDevices(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	devices, _ := database.GetTwoFactorsCookies(user.ID)
+	assert.Equal(0, len(devices))
+	devices, _ = database.GetTwoFactorsCookies(other.ID)
+	assert.Equal(1, len(devices))
+}
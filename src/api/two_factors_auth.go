@@ -1,55 +1,274 @@
 package api
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/Yuruh/encrypted-diary/src/authentication"
 	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/keyring"
+	"github.com/Yuruh/encrypted-diary/src/secrets"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/getsentry/sentry-go"
 	"github.com/go-playground/validator/v10"
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
+type OTPRegistrationBody struct {
+	// Required when OTP is already enabled, so that a stolen session is not enough to replace the secret
+	Passcode string `json:"passcode" validate:"omitempty,len=6,numeric"`
+}
+
+/*
+	First step of the enrolment: a new secret is generated and kept pending until a code generated with it is confirmed,
+	the active secret, if any, keeps working meanwhile.
+	Replies with the QR code, or with the otpauth:// URI and the secret as well when JSON is accepted.
+*/
 func RequestGoogleAuthenticatorQRCode(context echo.Context) error {
 	var user = context.Get("user").(database.User)
-	secret := authentication.GenerateRandomSecret()
 
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody OTPRegistrationBody
+	// The body was not required before re-enrolment needed a passcode
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &parsedBody)
+		if err != nil {
+			return context.String(http.StatusBadRequest, "Bad Body")
+		}
+	}
+	validate := validator.New()
+	err = validate.Struct(&parsedBody)
+	if err, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(err))
+	}
+
+	if user.HasRegisteredOTP {
+		if parsedBody.Passcode == "" {
+			return context.String(http.StatusBadRequest, "Passcode required")
+		}
+		valid, err := checkOTPCode(user, parsedBody.Passcode)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		if !valid {
+			return context.String(http.StatusBadRequest, "Code refused")
+		}
+	}
+
+	secret, err := authentication.GenerateRandomSecret(authentication.OTPSecretSize())
+	if err != nil {
+		return InternalError(context, err)
+	}
 	uri := authentication.BuildGAuthURI(user.Email, secret)
 	png, err := authentication.GenerateQRCodeFromURI(uri)
 	if err != nil {
 		return InternalError(context, err)
 	}
-	err = database.GetDB().Model(&user).Update("OTPSecret", secret).Error
+	err = user.SetPendingOTPSecret(secret, SecretsEnvelope())
 	if err != nil {
 		return InternalError(context, err)
 	}
+	forgetUser(user.ID)
 
+	// For users who cannot scan the QR code
+	if strings.Contains(context.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return context.JSON(http.StatusOK, map[string]interface{}{
+			"uri":     uri,
+			"secret":  secret,
+			"qr_code": base64.StdEncoding.EncodeToString(png),
+		})
+	}
 	return context.Blob(http.StatusOK, "image/png", png)
 }
 
+// Checks a code of the active secret. Each code is only accepted once, even by concurrent requests.
+func checkOTPCode(user database.User, passcode string) (bool, error) {
+	secret, err := user.GetOTPSecret(SecretsEnvelope())
+	if err != nil {
+		return false, err
+	}
+	step, valid, err := authentication.AuthorizeAfter(passcode, secret, user.LastOTPTimeStep)
+	if err != nil || !valid {
+		return false, err
+	}
+	return user.ConsumeOTPTimeStep(step)
+}
+
+/*
+	Promotes the pending secret if the code was generated with it, replacing the active one if any.
+	Returns recovery codes when this enables 2FA, they are only sent once.
+*/
+func confirmOTPEnrolment(context echo.Context, user database.User, passcode string) (bool, []string, error) {
+	secret, err := user.GetPendingOTPSecret(SecretsEnvelope())
+	if err != nil {
+		return false, nil, err
+	}
+	step, valid, err := authentication.AuthorizeAfter(passcode, secret, 0)
+	if err != nil || !valid {
+		return false, nil, err
+	}
+	firstSecondFactor := !user.HasTwoFactors()
+	replaced := user.HasRegisteredOTP
+	confirmed, err := user.ConfirmPendingOTPSecret(SecretsEnvelope(), step)
+	if err != nil || !confirmed {
+		return false, nil, err
+	}
+	forgetUser(user.ID)
+	if replaced {
+		audit(context, user.ID, auditOTPReplaced, "")
+	} else {
+		audit(context, user.ID, auditOTPEnabled, "")
+	}
+	// Users who registered a security key first already got their codes
+	if !firstSecondFactor {
+		return true, nil, nil
+	}
+	codes, err := issueRecoveryCodes(context, user.ID)
+	return true, codes, err
+}
+
+type OTPConfirmationBody struct {
+	Passcode string `json:"passcode" validate:"required,len=6,numeric"`
+}
+
+// Second step of the enrolment, with a code generated from the pending secret
+func ConfirmOTPRegistration(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody OTPConfirmationBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	validate := validator.New()
+	err = validate.Struct(&parsedBody)
+	if err, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(err))
+	}
+
+	// Not the cached user, the pending secret may have been set a moment ago, or by another instance
+	err = database.GetDB().Where("id = ?", user.ID).First(&user).Error
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if user.PendingOTPSecret == "" {
+		return context.String(http.StatusBadRequest, "No pending OTP registration")
+	}
+	enablesTwoFactors := !user.HasTwoFactors()
+	valid, recoveryCodes, err := confirmOTPEnrolment(context, user, parsedBody.Passcode)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !valid {
+		return context.String(http.StatusBadRequest, "Code refused")
+	}
+	if !enablesTwoFactors {
+		return context.NoContent(http.StatusOK)
+	}
+	// The current session only required a password, it is not accepted anymore
+	response, err := openSession(user, sessionTimeLeft(context), authLevelTwoFactors)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	response["recovery_codes"] = recoveryCodes
+	return context.JSON(http.StatusOK, response)
+}
+
+type DisableOTPBody struct {
+	// For users who switched to SRP, the proof of a handshake replaces the password
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+	Passcode string `json:"passcode" validate:"required,len=6,numeric"`
+}
+
+// Requires the password and a current code, a stolen session is not enough to turn 2FA off
+func DisableOTP(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody DisableOTPBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	validate := validator.New()
+	err = validate.Struct(&parsedBody)
+	if err, ok := err.(validator.ValidationErrors); ok {
+		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(err))
+	}
+
+	if !user.HasRegisteredOTP {
+		return context.String(http.StatusBadRequest, "OTP not enabled")
+	}
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+	valid, err := checkOTPCode(user, parsedBody.Passcode)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !valid {
+		return context.String(http.StatusBadRequest, "Code refused")
+	}
+
+	err = user.DisableOTP()
+	if err != nil {
+		return InternalError(context, fmt.Errorf("could not disable otp: %v", err))
+	}
+	forgetUser(user.ID)
+	audit(context, user.ID, auditOTPDisabled, "")
+	if !user.HasRegisteredWebAuthn {
+		err = forgetSecondFactors(user.ID)
+		if err != nil {
+			return InternalError(context, err)
+		}
+	}
+	return context.NoContent(http.StatusOK)
+}
+
+// Once no second factor is left, recovery codes and trusted devices would only get in the way of a new enrolment
+func forgetSecondFactors(userID uint) error {
+	err := database.ReplaceRecoveryCodes(userID, nil)
+	if err != nil {
+		return err
+	}
+	return database.DeleteUserTwoFactorsCookies(userID)
+}
+
+// Time left before the access token of the request expires
+func sessionTimeLeft(context echo.Context) time.Duration {
+	token, ok := context.Get("token").(*jwt.Token)
+	if !ok {
+		return defaultTokenDuration
+	}
+	claims := token.Claims.(*TokenClaims)
+	return time.Until(time.Unix(claims.ExpiresAt, 0))
+}
+
 func RequestTwoFactorsToken(context echo.Context) error {
 	var user = context.Get("user").(database.User)
 
-	user.Password = ""
-	user.OTPSecret = ""
-	claims := &TokenClaims{
-		user,
-		jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + 60 * 30,
-			IssuedAt: time.Now().Unix(),
-			Issuer: "auth.yuruh.fr",
-			Audience: "api.diary.yuruh.fr",
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	ss, _ := token.SignedString([]byte(os.Getenv("2FA_TOKEN_SECRET")))
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, TwoFactorsKeyring())
 	return context.JSON(http.StatusOK, map[string]interface{}{"token": ss})
 }
 
@@ -60,22 +279,36 @@ func InternalError(context echo.Context, err error) error {
 	return context.NoContent(http.StatusInternalServerError)
 }
 
-func ValidateJWTToken(token string, secret []byte) (jwt.MapClaims, error) {
-	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
+func ValidateJWTToken(token string, keys *keyring.Keyring) (jwt.MapClaims, error) {
+	parsedToken, err := jwt.Parse(token, keys.Keyfunc)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not parse token: %v", err)
 	}
 
 	if claims, ok := parsedToken.Claims.(jwt.MapClaims); ok && parsedToken.Valid {
+		err = verifyIssuerAndAudience(claims)
+		if err != nil {
+			return nil, fmt.Errorf("could not validate token: %v", err)
+		}
 		return claims, nil
 	} else {
 		return nil, fmt.Errorf("could not validate token")
 	}
 }
 
+// The user the 2FA token was issued to, 0 if it names none
+func twoFactorsTokenUserID(claims jwt.MapClaims) uint {
+	subject, _ := claims["sub"].(string)
+	return TokenClaims{StandardClaims: jwt.StandardClaims{Subject: subject}}.UserID()
+}
+
+// The session keeps the duration requested at login, which is when the 2FA token was issued
+func twoFactorsTokenTTL(claims jwt.MapClaims) time.Duration {
+	// Retrieve duration in nanoseconds from token
+	return time.Duration(claims["exp"].(float64)) * time.Second - time.Duration(time.Now().UnixNano())
+}
+
 type OTPCodeBody struct {
 	Passcode string `json:"passcode" validate:"required,len=6,numeric"`
 	Token string `json:"token" validate:"required"`
@@ -100,16 +333,18 @@ func ValidateOTPCode(context echo.Context) error {
 		return context.String(http.StatusBadRequest, database.BuildValidationErrorMsg(err))
 	}
 
-	claims, err := ValidateJWTToken(parsedBody.Token, []byte(os.Getenv("2FA_TOKEN_SECRET")))
+	claims, err := ValidateJWTToken(parsedBody.Token, TwoFactorsKeyring())
 	if err != nil {
 		return context.String(http.StatusBadRequest, "Bad Token")
 	}
 
+	// The OTP key isn't in the token (readable by anyone), only the user ID
+	userID := twoFactorsTokenUserID(claims)
+	if userID == 0 {
+		return context.String(http.StatusUnauthorized, "Bad Token")
+	}
 	var user database.User
-
-	var parsedUser  = claims["user"].(map[string]interface{})
-	// We fetch the user again as the OTP key shouldn't be in the token (readable by anyone)
-	dbCpy := database.GetDB().Where("email = ?", parsedUser["email"]).Find(&user)
+	dbCpy := database.GetDB().Where("id = ?", userID).Find(&user)
 	if dbCpy.RecordNotFound() {
 		return context.NoContent(http.StatusNotFound)
 	}
@@ -117,32 +352,59 @@ func ValidateOTPCode(context echo.Context) error {
 		return InternalError(context, dbCpy.Error)
 	}
 
-	// todo handle otpsecret encryption
-	valid, err := authentication.Authorize(parsedBody.Passcode, user.OTPSecret)
+	if !user.HasRegisteredOTP && user.PendingOTPSecret == "" {
+		return context.String(http.StatusBadRequest, "OTP not registered")
+	}
+	// Counted before the code is checked, so that concurrent guesses are delayed like sequential ones
+	attempt, err := beginAuthAttempt(user, authFailureOTP)
+	if err != nil {
+		return authError(context, err)
+	}
+
+	// Until OTP is enabled, the code confirms the enrolment of the pending secret
+	var valid bool
+	var recoveryCodes []string
+	if user.HasRegisteredOTP {
+		valid, err = checkOTPCode(user, parsedBody.Passcode)
+	} else {
+		valid, recoveryCodes, err = confirmOTPEnrolment(context, user, parsedBody.Passcode)
+	}
 	if err != nil {
 		return InternalError(context, err)
 	}
 	if valid {
-		if !user.HasRegisteredOTP {
-			err = database.GetDB().Model(&user).Update("HasRegisteredOTP", true).Error
-			if err != nil {
-				return InternalError(context, dbCpy.Error)
-			}
+		err = authSucceeded(user, authFailureOTP)
+		if err != nil {
+			return InternalError(context, err)
 		}
-		// Retrieve duration in nanoseconds from token
-		tokenTTL := time.Duration(claims["exp"].(float64)) * time.Second - time.Duration(time.Now().UnixNano())
-		ss := BuildJwtToken(user, tokenTTL, []byte(os.Getenv("ACCESS_TOKEN_SECRET")))
 		if parsedBody.KeepActive {
 			activeTFACookie(context, user.ID)
 		}
-		return context.JSON(http.StatusOK, map[string]interface{}{"token": ss})
+		response, err := openSession(user, twoFactorsTokenTTL(claims), authLevelTwoFactors)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		if recoveryCodes != nil {
+			// Only sent once, the user has to save them
+			response["recovery_codes"] = recoveryCodes
+		}
+		return context.JSON(http.StatusOK, response)
 	} else {
+		authFailed(context, user, authFailureOTP, attempt)
 		return context.String(http.StatusBadRequest, "Code refused")
 	}
 }
 
+// Size of the identifiers of 2FA cookies, 192 bits
+const twoFactorsCookieIDSize = 24
+
 func activeTFACookie(context echo.Context, userId uint) {
-	generatedUuid := uuid.New().String()
+	generatedID, err := secrets.Token(twoFactorsCookieIDSize)
+	if err != nil {
+		fmt.Println(err.Error())
+		sentry.CaptureException(err)
+		return
+	}
 	expires := time.Now().Add(24 * time.Hour * 14) // 2 weeks
 	agent := "Unknown"
 	if context.Request().Header.Get("user-agent") != "" {
@@ -151,7 +413,7 @@ func activeTFACookie(context echo.Context, userId uint) {
 
 	cookie := new(http.Cookie)
 	cookie.Name = "tfa-active"
-	cookie.Value = generatedUuid
+	cookie.Value = generatedID
 
 	if os.Getenv("DOMAIN") != "" {
 		cookie.Domain = os.Getenv("DOMAIN")
@@ -165,14 +427,14 @@ func activeTFACookie(context echo.Context, userId uint) {
 	context.SetCookie(cookie)
 
 	dbCookie := database.TwoFactorsCookie{
-		Uuid:      generatedUuid,
+		Uuid:      generatedID,
 		IpAddr:    context.RealIP(),
 		UserAgent: agent,
 		Expires:   expires,
 		UserID:	   userId,
 		LastUsed:  time.Now(),
 	}
-	err := database.Insert(&dbCookie)
+	err = database.Insert(&dbCookie)
 	if err != nil {
 		fmt.Println(err.Error())
 		sentry.CaptureException(err)
@@ -1,38 +1,42 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/envelope"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgryski/dgoogauth"
 	"github.com/labstack/echo/v4"
 	asserthelper "github.com/stretchr/testify/assert"
 	"net/http"
-	"os"
+	"net/http/httptest"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
 
+// A 2FA token signed by the server, but issued to nobody
+func twoFactorsTokenWithoutSubject() string {
+	ss, _ := TwoFactorsKeyring().Sign(&TokenClaims{"", authLevelPassword, jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		Issuer:    TokenIssuer(),
+		Audience:  TokenAudience(),
+	}})
+	return ss
+}
+
 func TestValidateOTPCode(t *testing.T) {
 	assert := asserthelper.New(t)
 	user, _ := SetupUsers()
 
-	user.OTPSecret = "2SH3V3GDW7ZNMGYE"
-	database.Update(&user)
+	// Registration pending, the first valid code confirms it
+	assert.Nil(user.SetPendingOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
 
 
-	user.Password = ""
-	user.OTPSecret = ""
-	claims := &TokenClaims{
-		user,
-		jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + 60 * 30,
-			IssuedAt: time.Now().Unix(),
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	ss, _ := token.SignedString([]byte(os.Getenv("2FA_TOKEN_SECRET")))
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, TwoFactorsKeyring())
 
 	// Bad passcode format test
 	body := OTPCodeBody{
@@ -56,6 +60,14 @@ func TestValidateOTPCode(t *testing.T) {
 	assert.Equal(http.StatusBadRequest, recorder.Code)
 	assert.Equal("Bad Token", recorder.Body.String())
 
+	// Valid token without user
+	body.Token = twoFactorsTokenWithoutSubject()
+	marsh, _ = json.Marshal(body)
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = ValidateOTPCode(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, recorder.Code)
+
 	// Bad code value test
 	body.Token = ss
 	marsh, _ = json.Marshal(body)
@@ -90,11 +102,23 @@ func TestValidateOTPCode(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(http.StatusOK, recorder.Code)
 
+	// Recovery codes are given once, when OTP registration is confirmed
+	var response loginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.Equal(10, len(response.RecoveryCodes))
+
 	assert.Contains(recorder.Header().Get("set-cookie"), "Expires=")
 	assert.Contains(recorder.Header().Get("set-cookie"), "Secure")
 	assert.Contains(recorder.Header().Get("set-cookie"), "HttpOnly")
 	assert.Contains(recorder.Header().Get("set-cookie"), "tfa-active=")
 
+	var stored database.User
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	assert.Equal(true, stored.HasRegisteredOTP)
+	assert.Equal("", stored.PendingOTPSecret)
+	secret, _ := stored.GetOTPSecret(SecretsEnvelope())
+	assert.Equal("2SH3V3GDW7ZNMGYE", secret)
+
 	var cookie database.TwoFactorsCookie
 	database.GetDB().Where("user_id = ?", user.ID).First(&cookie)
 
@@ -103,6 +127,41 @@ func TestValidateOTPCode(t *testing.T) {
 	assert.Greater(time.Now().Add(time.Hour * 24 * 15).UnixNano(), cookie.Expires.UnixNano())
 }
 
+func TestValidateOTPCode_Replay(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+	assert.Nil(user.SetPendingOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
+	confirmed, err := user.ConfirmPendingOTPSecret(SecretsEnvelope(), 0)
+	assert.Nil(err)
+	assert.Equal(true, confirmed)
+
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, TwoFactorsKeyring())
+	marsh, _ := json.Marshal(OTPCodeBody{Passcode: currentPasscode("2SH3V3GDW7ZNMGYE"), Token: ss})
+
+	// The same code sent twice at the same time, only one request can use it
+	const attempts = 2
+	var wg sync.WaitGroup
+	codes := make([]int, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+			assert.Nil(ValidateOTPCode(context))
+			codes[i] = recorder.Code
+		}(i)
+	}
+	wg.Wait()
+	assert.ElementsMatch([]int{http.StatusOK, http.StatusBadRequest}, codes)
+
+	// And it is still refused afterwards
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = ValidateOTPCode(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("Code refused", recorder.Body.String())
+}
+
 func TestRequestGoogleAuthenticatorQRCode(t *testing.T) {
 	assert := asserthelper.New(t)
 	user, _ := SetupUsers()
@@ -113,16 +172,237 @@ func TestRequestGoogleAuthenticatorQRCode(t *testing.T) {
 	assert.Equal(http.StatusOK, recorder.Code)
 	assert.Equal("image/png", recorder.Header().Get("content-type"))
 	assert.Greater(len(recorder.Body.Bytes()), 600)
-	assert.Greater(900, len(recorder.Body.Bytes()))
+	// 160 bits secret, with digits and period parameters
+	assert.Greater(1100, len(recorder.Body.Bytes()))
+
+	// A database dump is not enough to generate codes
+	var stored database.User
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	assert.Equal("", stored.OTPSecret)
+	assert.Equal(false, stored.HasRegisteredOTP)
+	assert.Equal(true, envelope.IsEncrypted(stored.PendingOTPSecret))
+	secret, err := stored.GetPendingOTPSecret(SecretsEnvelope())
+	assert.Nil(err)
+	assert.NotEqual("", secret)
+	assert.NotContains(stored.PendingOTPSecret, secret)
+
+	// For users who cannot scan
+	context, recorder = BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	context.Request().Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	err = RequestGoogleAuthenticatorQRCode(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+	var response struct{
+		URI string `json:"uri"`
+		Secret string `json:"secret"`
+		QRCode []byte `json:"qr_code"`
+	}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Contains(response.URI, "otpauth://totp/EncryptedDiary:user1@user.com?")
+	assert.Contains(response.URI, "secret=" + response.Secret)
+	assert.Greater(len(response.QRCode), 600)
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	secret, _ = stored.GetPendingOTPSecret(SecretsEnvelope())
+	assert.Equal(response.Secret, secret)
+
+	// Once OTP is enabled, a code from the active secret is required
+	confirmed, err := stored.ConfirmPendingOTPSecret(SecretsEnvelope(), 0)
+	assert.Nil(err)
+	assert.Equal(true, confirmed)
+	context, recorder = BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	err = RequestGoogleAuthenticatorQRCode(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("Passcode required", recorder.Body.String())
+
+	marsh, _ := json.Marshal(OTPRegistrationBody{Passcode: "000000"})
+	if currentPasscode(secret) == "000000" {
+		marsh, _ = json.Marshal(OTPRegistrationBody{Passcode: "111111"})
+	}
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = RequestGoogleAuthenticatorQRCode(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("Code refused", recorder.Body.String())
+
+	marsh, _ = json.Marshal(OTPRegistrationBody{Passcode: currentPasscode(secret)})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = RequestGoogleAuthenticatorQRCode(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	// The active secret is untouched until the new one is confirmed
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	active, _ := stored.GetOTPSecret(SecretsEnvelope())
+	assert.Equal(secret, active)
+	pending, _ := stored.GetPendingOTPSecret(SecretsEnvelope())
+	assert.NotEqual(secret, pending)
+}
+
+func TestConfirmOTPRegistration(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	marsh, _ := json.Marshal(OTPConfirmationBody{Passcode: "123456"})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err := ConfirmOTPRegistration(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("No pending OTP registration", recorder.Body.String())
+
+	assert.Nil(user.SetPendingOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
+	marsh, _ = json.Marshal(OTPConfirmationBody{Passcode: "12345"})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = ConfirmOTPRegistration(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+
+	// First enrolment, the password only session is replaced
+	marsh, _ = json.Marshal(OTPConfirmationBody{Passcode: currentPasscode("2SH3V3GDW7ZNMGYE")})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = ConfirmOTPRegistration(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+	var response loginResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	assert.NotEqual("", response.Token)
+	assert.NotEqual("", response.RefreshToken)
+	assert.Equal(10, len(response.RecoveryCodes))
+	if token, _ := jwt.Parse(response.Token, nil); token != nil {
+		assert.Equal(authLevelTwoFactors, token.Claims.(jwt.MapClaims)["auth_level"])
+	} else {
+		t.Errorf("Could not decode JWT token")
+	}
+
+	var stored database.User
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	assert.Equal(true, stored.HasRegisteredOTP)
+	assert.Equal("", stored.PendingOTPSecret)
+
+	// Re-enrolment, the current session stays valid and recovery codes are kept
+	assert.Nil(stored.SetPendingOTPSecret("KNKGW6KMMVHEINTL", SecretsEnvelope()))
+	marsh, _ = json.Marshal(OTPConfirmationBody{Passcode: currentPasscode("KNKGW6KMMVHEINTL")})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = ConfirmOTPRegistration(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+	assert.Equal("", recorder.Body.String())
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	secret, _ := stored.GetOTPSecret(SecretsEnvelope())
+	assert.Equal("KNKGW6KMMVHEINTL", secret)
+	remaining, _ := database.CountRemainingRecoveryCodes(user.ID)
+	assert.Equal(10, remaining)
+
+	var count int
+	database.GetDB().Model(&database.AuditEvent{}).
+		Where("user_id = ? AND action IN (?)", user.ID, []string{auditOTPEnabled, auditOTPReplaced}).
+		Count(&count)
+	assert.Equal(2, count)
+}
 
-	var updatedUser database.User
-	database.GetDB().Find(&updatedUser)
-	assert.Greater(5, len(user.OTPSecret))
+// Calls a route like the router does, the user is loaded by the auth middleware and may come from its cache
+func callRoute(ss string, handler echo.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.Use(AuthMiddleware())
+	e.POST("/", handler)
+	marsh, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(marsh))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer " + ss)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// Requests a new secret through the auth middleware, which caches the user
+func requestOTPSecret(assert *asserthelper.Assertions, ss string) string {
+	recorder := callRoute(ss, RequestGoogleAuthenticatorQRCode, OTPRegistrationBody{})
+	assert.Equal(http.StatusOK, recorder.Code)
+	var response struct{
+		Secret string `json:"secret"`
+	}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &response))
+	return response.Secret
+}
+
+// Confirmed right away, while the user loaded by the first request is still cached
+func TestConfirmOTPRegistration_RightAway(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+
+	ss := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	secret := requestOTPSecret(assert, ss)
+	recorder := callRoute(ss, ConfirmOTPRegistration, OTPConfirmationBody{Passcode: currentPasscode(secret)})
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	// The code is checked against the new pending secret, not the one read by the previous request
+	assert.Nil(other.SetPendingOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
+	ss = BuildJwtToken(other, "", authLevelPassword, time.Minute * 30, AccessKeyring())
+	secret = requestOTPSecret(assert, ss)
+	if currentPasscode(secret) != currentPasscode("2SH3V3GDW7ZNMGYE") {
+		recorder = callRoute(ss, ConfirmOTPRegistration, OTPConfirmationBody{Passcode: currentPasscode("2SH3V3GDW7ZNMGYE")})
+		assert.Equal(http.StatusBadRequest, recorder.Code)
+		assert.Equal("Code refused", recorder.Body.String())
+	}
+	recorder = callRoute(ss, ConfirmOTPRegistration, OTPConfirmationBody{Passcode: currentPasscode(secret)})
+	assert.Equal(http.StatusOK, recorder.Code)
+}
+
+func TestDisableOTP(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, _ := SetupUsers()
+
+	marsh, _ := json.Marshal(DisableOTPBody{Password: "azer", Passcode: "123456"})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err := DisableOTP(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("OTP not enabled", recorder.Body.String())
+
+	assert.Nil(user.SetPendingOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
+	confirmed, err := user.ConfirmPendingOTPSecret(SecretsEnvelope(), 0)
+	assert.Nil(err)
+	assert.Equal(true, confirmed)
+	_, _ = issueRecoveryCodes(context, user.ID)
+	activeTFACookie(context, user.ID)
+
+	marsh, _ = json.Marshal(DisableOTPBody{Password: "wrong", Passcode: currentPasscode("2SH3V3GDW7ZNMGYE")})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = DisableOTP(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+	assert.Equal("Wrong password", recorder.Body.String())
+
+	marsh, _ = json.Marshal(DisableOTPBody{Password: "azer", Passcode: "12345"})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = DisableOTP(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+
+	marsh, _ = json.Marshal(DisableOTPBody{Password: "azer", Passcode: currentPasscode("2SH3V3GDW7ZNMGYE")})
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	err = DisableOTP(context)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, recorder.Code)
+
+	var stored database.User
+	database.GetDB().Where("id = ?", user.ID).First(&stored)
+	assert.Equal(false, stored.HasRegisteredOTP)
+	assert.Equal(false, stored.HasTwoFactors())
+	assert.Equal("", stored.OTPSecret)
+
+	// Nothing is left from the previous enrolment
+	remaining, _ := database.CountRemainingRecoveryCodes(user.ID)
+	assert.Equal(0, remaining)
+	var cookies int
+	database.GetDB().Model(&database.TwoFactorsCookie{}).Where("user_id = ?", user.ID).Count(&cookies)
+	assert.Equal(0, cookies)
 }
 
 func TestRequestTwoFactorsToken(t *testing.T) {
 	assert := asserthelper.New(t)
-	SetupUsers()
+	user, _ := SetupUsers()
 	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
 
 	err := RequestTwoFactorsToken(context)
@@ -137,12 +417,11 @@ func TestRequestTwoFactorsToken(t *testing.T) {
 		t.Errorf("Token length incorrect, expected at least %v, got %v", 300, len(response.Token))
 	}
 
-	if parsedToken, _ := jwt.Parse(response.Token, func(token *jwt.Token) (interface{}, error) {
-		return os.Getenv("2FA_TOKEN_SECRET"), nil
-	}); parsedToken != nil {
-		var parsedUser = parsedToken.Claims.(jwt.MapClaims)["user"].(map[string]interface{})
-		assert.Equal(parsedUser["email"], UserHasAccessEmail)
-		assert.Equal(parsedUser["Password"], nil)
+	if parsedToken, err := jwt.Parse(response.Token, TwoFactorsKeyring().Keyfunc); err == nil {
+		var claims = parsedToken.Claims.(jwt.MapClaims)
+		assert.Equal(strconv.Itoa(int(user.ID)), claims["sub"])
+		assert.Equal(authLevelPassword, claims["auth_level"])
+		assert.Equal(nil, claims["user"])
 	} else {
 		t.Errorf("Could not decde JWT token")
 	}
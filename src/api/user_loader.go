@@ -0,0 +1,41 @@
+package api
+
+import (
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/patrickmn/go-cache"
+	"strconv"
+	"time"
+)
+
+/*
+	Users are read from database instead of trusting the token content.
+	The cache spares a request on every call, the TTL is the delay for a change made by another instance
+	(e.g. account deleted) to be effective here.
+*/
+const userCacheTTL = time.Second * 5
+
+var userCache = cache.New(userCacheTTL, time.Minute)
+
+var errUserNotFound = errors.New("user not found")
+
+func loadUser(id uint) (database.User, error) {
+	key := strconv.Itoa(int(id))
+	if user, found := userCache.Get(key); found {
+		return user.(database.User), nil
+	}
+	var user database.User
+	result := database.GetDB().Where("id = ?", id).First(&user)
+	if result.RecordNotFound() {
+		return database.User{}, errUserNotFound
+	} else if result.Error != nil {
+		return database.User{}, result.Error
+	}
+	userCache.SetDefault(key, user)
+	return user, nil
+}
+
+// Must be called after any change to a user, so that the next request sees it
+func forgetUser(id uint) {
+	userCache.Delete(strconv.Itoa(int(id)))
+}
@@ -0,0 +1,444 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/webauthn"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyAuthentication = "authentication"
+)
+
+// A ceremony must be finished before this delay, slightly longer than the timeout given to the browser
+const webauthnCeremonyTTL = time.Minute * 3
+
+func startCeremony(kind string, userID uint) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	ceremony := database.WebAuthnCeremony{
+		Challenge: challenge,
+		Kind:      kind,
+		UserID:    userID,
+		Expires:   time.Now().Add(webauthnCeremonyTTL),
+	}
+	return challenge, database.Insert(&ceremony)
+}
+
+// Returns false if the challenge was not issued to this user for this kind of ceremony, or was already used
+func takeCeremony(challenge string, kind string, userID uint) (bool, error) {
+	ceremony, found, err := database.TakeWebAuthnCeremony(challenge)
+	if err != nil || !found {
+		return false, err
+	}
+	return ceremony.Kind == kind && ceremony.UserID == userID, nil
+}
+
+/*
+	WEBAUTHN_RP_ID is the domain credentials are scoped to, DOMAIN by default.
+	WEBAUTHN_ORIGIN is where the web app runs, ALLOWED_ORIGIN by default.
+*/
+func relyingParty() webauthn.RelyingParty {
+	rp := webauthn.RelyingParty{
+		ID:     os.Getenv("WEBAUTHN_RP_ID"),
+		Name:   "EncryptedDiary",
+		Origin: os.Getenv("WEBAUTHN_ORIGIN"),
+	}
+	if rp.ID == "" {
+		rp.ID = os.Getenv("DOMAIN")
+	}
+	if rp.ID == "" {
+		rp.ID = "localhost"
+	}
+	if rp.Origin == "" {
+		rp.Origin = os.Getenv("ALLOWED_ORIGIN")
+	}
+	return rp
+}
+
+func credentialIDs(credentials []database.WebAuthnCredential) []string {
+	ids := make([]string, len(credentials))
+	for i, credential := range credentials {
+		ids[i] = credential.CredentialID
+	}
+	return ids
+}
+
+// The user handle is stored by the authenticator, it must not contain personal data
+func userHandle(user database.User) []byte {
+	return []byte(strconv.Itoa(int(user.ID)))
+}
+
+func BeginWebAuthnRegistration(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	credentials, err := database.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	challenge, err := startCeremony(ceremonyRegistration, user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	options := relyingParty().CreationOptions(challenge, userHandle(user), user.Email, credentialIDs(credentials))
+	return context.JSON(http.StatusOK, map[string]interface{}{"public_key": options})
+}
+
+type WebAuthnRegistrationBody struct {
+	Name string `json:"name"`
+	Credential webauthn.AttestationResponse `json:"credential"`
+	// Once 2FA is enabled, the password (or an SRP proof), or a current OTP code
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+	Passcode string `json:"passcode"`
+}
+
+func FinishWebAuthnRegistration(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody WebAuthnRegistrationBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	// Like replacing the OTP secret, a stolen session is not enough to add a second factor
+	if user.HasTwoFactors() {
+		if user.HasRegisteredOTP && parsedBody.Passcode != "" {
+			valid, err := checkOTPCode(user, parsedBody.Passcode)
+			if err != nil {
+				return InternalError(context, err)
+			}
+			if !valid {
+				return context.String(http.StatusBadRequest, "Code refused")
+			}
+		} else {
+			passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+			if err != nil {
+				return authError(context, err)
+			}
+			if !passwordValid {
+				return context.String(http.StatusBadRequest, "Wrong password")
+			}
+		}
+	}
+
+	challenge, err := webauthn.ClientDataChallenge(parsedBody.Credential.Response.ClientDataJSON)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Unknown or expired challenge")
+	}
+	taken, err := takeCeremony(challenge, ceremonyRegistration, user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if !taken {
+		return context.String(http.StatusBadRequest, "Unknown or expired challenge")
+	}
+	verified, err := relyingParty().VerifyAttestation(parsedBody.Credential, challenge)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Credential refused: " + err.Error())
+	}
+
+	credential := database.WebAuthnCredential{
+		UserID:       user.ID,
+		CredentialID: webauthn.EncodeID(verified.ID),
+		PublicKey:    verified.PublicKey,
+		SignCount:    verified.SignCount,
+		Name:         parsedBody.Name,
+	}
+	err = database.Insert(&credential)
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return context.String(http.StatusConflict, "Security key already registered")
+	} else if err != nil {
+		return context.String(http.StatusBadRequest, err.Error())
+	}
+	audit(context, user.ID, auditWebAuthnRegistered, credential.Name)
+
+	response := map[string]interface{}{"credential": credential}
+	if !user.HasRegisteredWebAuthn {
+		enablesTwoFactors := !user.HasTwoFactors()
+		err = database.GetDB().Model(&user).Update("HasRegisteredWebAuthn", true).Error
+		if err != nil {
+			return InternalError(context, err)
+		}
+		forgetUser(user.ID)
+		if enablesTwoFactors {
+			// The current session only required a password, it is not accepted anymore
+			response, err = openSession(user, sessionTimeLeft(context), authLevelTwoFactors)
+			if err != nil {
+				return InternalError(context, err)
+			}
+			response["credential"] = credential
+		}
+		// Users who registered OTP first already got their codes
+		if !user.HasRegisteredOTP {
+			codes, err := issueRecoveryCodes(context, user.ID)
+			if err != nil {
+				return InternalError(context, err)
+			}
+			// Only sent once, the user has to save them
+			response["recovery_codes"] = codes
+		}
+	}
+	return context.JSON(http.StatusCreated, response)
+}
+
+type WebAuthnAuthenticationBody struct {
+	// The token returned by login
+	Token string `json:"token"`
+	Credential webauthn.AssertionResponse `json:"credential"`
+	KeepActive bool `json:"keep_active"`
+}
+
+var errTokenWithoutUser = errors.New("token not issued to a user")
+
+// Reads the user the 2FA token was issued to
+func twoFactorsTokenUser(token string) (database.User, jwt.MapClaims, error) {
+	claims, err := ValidateJWTToken(token, TwoFactorsKeyring())
+	if err != nil {
+		return database.User{}, nil, err
+	}
+	userID := twoFactorsTokenUserID(claims)
+	if userID == 0 {
+		return database.User{}, nil, errTokenWithoutUser
+	}
+	var user database.User
+	err = database.GetDB().Where("id = ?", userID).First(&user).Error
+	return user, claims, err
+}
+
+func badTwoFactorsToken(context echo.Context, err error) error {
+	if err == errTokenWithoutUser {
+		return context.String(http.StatusUnauthorized, "Bad Token")
+	}
+	return context.String(http.StatusBadRequest, "Bad Token")
+}
+
+func BeginWebAuthnAuthentication(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody WebAuthnAuthenticationBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	user, _, err := twoFactorsTokenUser(parsedBody.Token)
+	if err != nil {
+		return badTwoFactorsToken(context, err)
+	}
+	return requestAssertion(context, user)
+}
+
+// Challenge for a sensitive action of the authenticated user, such as removing a security key
+func BeginWebAuthnReauthentication(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	return requestAssertion(context, user)
+}
+
+func requestAssertion(context echo.Context, user database.User) error {
+	credentials, err := database.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if len(credentials) == 0 {
+		return context.String(http.StatusBadRequest, "No security key registered")
+	}
+	challenge, err := startCeremony(ceremonyAuthentication, user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	options := relyingParty().RequestOptions(challenge, credentialIDs(credentials))
+	return context.JSON(http.StatusOK, map[string]interface{}{"public_key": options})
+}
+
+// Checks an assertion answering a challenge issued to the user. Returns a message for the user if refused.
+func verifyAssertion(user database.User, assertion webauthn.AssertionResponse) (string, error) {
+	challenge, err := webauthn.ClientDataChallenge(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return "Unknown or expired challenge", nil
+	}
+	taken, err := takeCeremony(challenge, ceremonyAuthentication, user.ID)
+	if err != nil || !taken {
+		return "Unknown or expired challenge", err
+	}
+
+	var credential database.WebAuthnCredential
+	result := database.GetDB().
+		Where("user_id = ?", user.ID).
+		Where("credential_id = ?", assertion.ID).
+		First(&credential)
+	if result.RecordNotFound() {
+		return "Unknown security key", nil
+	} else if result.Error != nil {
+		return "", result.Error
+	}
+
+	signCount, err := relyingParty().VerifyAssertion(assertion, challenge, webauthn.Credential{
+		PublicKey: credential.PublicKey,
+		SignCount: credential.SignCount,
+	})
+	if err != nil {
+		return "Credential refused", nil
+	}
+	updated, err := credential.MarkUsed(signCount)
+	if err != nil {
+		return "", err
+	}
+	if !updated {
+		return "Credential refused", nil
+	}
+	return "", nil
+}
+
+// Alternative to ValidateOTPCode
+func FinishWebAuthnAuthentication(context echo.Context) error {
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody WebAuthnAuthenticationBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+	user, claims, err := twoFactorsTokenUser(parsedBody.Token)
+	if err != nil {
+		return badTwoFactorsToken(context, err)
+	}
+
+	msg, err := verifyAssertion(user, parsedBody.Credential)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if msg != "" {
+		return context.String(http.StatusBadRequest, msg)
+	}
+
+	if parsedBody.KeepActive {
+		activeTFACookie(context, user.ID)
+	}
+	return grantAccess(context, user, twoFactorsTokenTTL(claims), authLevelTwoFactors)
+}
+
+func GetWebAuthnCredentials(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	credentials, err := database.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	return context.JSON(http.StatusOK, map[string]interface{}{"credentials": credentials})
+}
+
+type DeleteWebAuthnCredentialBody struct {
+	// For users who switched to SRP, the proof of a handshake replaces the password
+	Password string `json:"password"`
+	SRP *SRPProof `json:"srp"`
+	// A second factor: an OTP code, or an assertion answering BeginWebAuthnReauthentication
+	Passcode string `json:"passcode"`
+	Assertion *webauthn.AssertionResponse `json:"assertion"`
+}
+
+/*
+	Removing the last key disables WebAuthn, and 2FA altogether if OTP is not registered. Like DisableOTP, requires
+	the password and a second factor, a stolen session is not enough.
+*/
+func DeleteWebAuthnCredential(context echo.Context) error {
+	var user = context.Get("user").(database.User)
+
+	id, err := strconv.Atoi(context.Param("id"))
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad route parameter")
+	}
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	var parsedBody DeleteWebAuthnCredentialBody
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return context.String(http.StatusBadRequest, "Bad Body")
+	}
+
+	passwordValid, err := checkPassword(context, user, parsedBody.Password, parsedBody.SRP)
+	if err != nil {
+		return authError(context, err)
+	}
+	if !passwordValid {
+		return context.String(http.StatusBadRequest, "Wrong password")
+	}
+	if parsedBody.Assertion != nil {
+		msg, err := verifyAssertion(user, *parsedBody.Assertion)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		if msg != "" {
+			return context.String(http.StatusBadRequest, msg)
+		}
+	} else if user.HasRegisteredOTP && parsedBody.Passcode != "" {
+		valid, err := checkOTPCode(user, parsedBody.Passcode)
+		if err != nil {
+			return InternalError(context, err)
+		}
+		if !valid {
+			return context.String(http.StatusBadRequest, "Code refused")
+		}
+	} else {
+		return context.String(http.StatusBadRequest, "Second factor required")
+	}
+	var credential database.WebAuthnCredential
+	result := database.GetDB().
+		Where("id = ?", id).
+		Where("user_id = ?", user.ID).
+		First(&credential)
+	if result.RecordNotFound() {
+		return context.NoContent(http.StatusNotFound)
+	} else if result.Error != nil {
+		return InternalError(context, result.Error)
+	}
+	err = credential.Delete()
+	if err != nil {
+		return InternalError(context, err)
+	}
+	audit(context, user.ID, auditWebAuthnRemoved, credential.Name)
+
+	remaining, err := database.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return InternalError(context, err)
+	}
+	if len(remaining) == 0 {
+		err = database.GetDB().Model(&user).Update("HasRegisteredWebAuthn", false).Error
+		if err != nil {
+			return InternalError(context, fmt.Errorf("could not disable webauthn: %v", err))
+		}
+		forgetUser(user.ID)
+		if !user.HasRegisteredOTP {
+			err = forgetSecondFactors(user.ID)
+			if err != nil {
+				return InternalError(context, err)
+			}
+		}
+	}
+	return context.NoContent(http.StatusOK)
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/Yuruh/encrypted-diary/src/database"
+	"github.com/Yuruh/encrypted-diary/src/webauthn"
+	"github.com/Yuruh/encrypted-diary/src/webauthn/webauthntest"
+	"github.com/labstack/echo/v4"
+	asserthelper "github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const webauthnTestOrigin = "https://app.diary.example.com"
+
+func setupWebAuthnEnv() func() {
+	os.Setenv("WEBAUTHN_RP_ID", "diary.example.com")
+	os.Setenv("WEBAUTHN_ORIGIN", webauthnTestOrigin)
+	return func() {
+		os.Unsetenv("WEBAUTHN_RP_ID")
+		os.Unsetenv("WEBAUTHN_ORIGIN")
+	}
+}
+
+type webauthnRegistrationResponse struct {
+	Credential database.WebAuthnCredential `json:"credential"`
+	RecoveryCodes []string `json:"recovery_codes"`
+	// New session, when the key enables 2FA
+	Token string `json:"token"`
+}
+
+func registerSecurityKey(assert *asserthelper.Assertions, authenticator *webauthntest.Authenticator) (webauthnRegistrationResponse, int) {
+	return registerSecurityKeyWith(assert, authenticator, WebAuthnRegistrationBody{Name: "Yubikey"})
+}
+
+// Registers with the given password, proof or passcode
+func registerSecurityKeyWith(assert *asserthelper.Assertions, authenticator *webauthntest.Authenticator,
+	body WebAuthnRegistrationBody) (webauthnRegistrationResponse, int) {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	assert.Nil(BeginWebAuthnRegistration(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+	var options struct {
+		PublicKey webauthn.CreationOptions `json:"public_key"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &options)
+
+	credential, err := authenticator.Create(options.PublicKey)
+	assert.Nil(err)
+	body.Credential = credential
+	marsh, _ := json.Marshal(body)
+	context, recorder = BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(FinishWebAuthnRegistration(context))
+
+	var response webauthnRegistrationResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response, recorder.Code
+}
+
+func authenticateWithSecurityKey(assert *asserthelper.Assertions, user database.User,
+	authenticator *webauthntest.Authenticator) (WebAuthnAuthenticationBody, int) {
+	token := BuildJwtToken(user, "", authLevelPassword, time.Minute * 30, TwoFactorsKeyring())
+	marsh, _ := json.Marshal(WebAuthnAuthenticationBody{Token: token})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(BeginWebAuthnAuthentication(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+	var options struct {
+		PublicKey webauthn.RequestOptions `json:"public_key"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &options)
+
+	assertion, err := authenticator.Get(options.PublicKey)
+	assert.Nil(err)
+	body := WebAuthnAuthenticationBody{Token: token, Credential: assertion}
+	return body, finishWebAuthnAuthentication(assert, body)
+}
+
+func finishWebAuthnAuthentication(assert *asserthelper.Assertions, body WebAuthnAuthenticationBody) int {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(FinishWebAuthnAuthentication(context))
+	return recorder.Code
+}
+
+// Assertion answering a challenge of BeginWebAuthnReauthentication
+func reauthenticate(assert *asserthelper.Assertions, authenticator *webauthntest.Authenticator) *webauthn.AssertionResponse {
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	assert.Nil(BeginWebAuthnReauthentication(context))
+	assert.Equal(http.StatusOK, recorder.Code)
+	var options struct {
+		PublicKey webauthn.RequestOptions `json:"public_key"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &options)
+
+	assertion, err := authenticator.Get(options.PublicKey)
+	assert.Nil(err)
+	return &assertion
+}
+
+func deleteSecurityKey(id uint, body DeleteWebAuthnCredentialBody) int {
+	marsh, _ := json.Marshal(body)
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	context.SetParamNames("id")
+	context.SetParamValues(strconv.Itoa(int(id)))
+	_ = DeleteWebAuthnCredential(context)
+	return recorder.Code
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	assert := asserthelper.New(t)
+	defer setupWebAuthnEnv()()
+	user, _ := SetupUsers()
+	authenticator := webauthntest.New(webauthnTestOrigin)
+
+	response, code := registerSecurityKey(assert, authenticator)
+	assert.Equal(http.StatusCreated, code)
+	assert.Equal("Yubikey", response.Credential.Name)
+	// Challenges are stored, not kept by this instance, and used challenges are deleted
+	var ceremonies int
+	database.GetDB().Model(&database.WebAuthnCeremony{}).Where("user_id = ?", user.ID).Count(&ceremonies)
+	assert.Equal(0, ceremonies)
+	// First second factor, the password-level session is replaced
+	assert.Equal(10, len(response.RecoveryCodes))
+	assert.NotEmpty(response.Token)
+
+	database.GetDB().Where("id = ?", user.ID).First(&user)
+	assert.Equal(true, user.HasRegisteredWebAuthn)
+	methods, _ := twoFactorsMethods(user)
+	assert.Equal([]string{"WEBAUTHN", "RECOVERY_CODE"}, methods)
+
+	body, code := authenticateWithSecurityKey(assert, user, authenticator)
+	assert.Equal(http.StatusOK, code)
+	// A challenge can only be used once
+	assert.Equal(http.StatusBadRequest, finishWebAuthnAuthentication(assert, body))
+
+	// Another user cannot use this user's ceremony
+	_, other := SetupUsers()
+	body.Token = BuildJwtToken(other, "", authLevelPassword, time.Minute * 30, TwoFactorsKeyring())
+	assert.Equal(http.StatusBadRequest, finishWebAuthnAuthentication(assert, body))
+
+	// Nor a token issued to nobody
+	body.Token = twoFactorsTokenWithoutSubject()
+	assert.Equal(http.StatusUnauthorized, finishWebAuthnAuthentication(assert, body))
+	marsh, _ := json.Marshal(WebAuthnAuthenticationBody{Token: body.Token})
+	context, recorder := BuildEchoContext(marsh, echo.MIMEApplicationJSON)
+	assert.Nil(BeginWebAuthnAuthentication(context))
+	assert.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func TestWebAuthnRegisterFromOtherOrigin(t *testing.T) {
+	assert := asserthelper.New(t)
+	defer setupWebAuthnEnv()()
+	SetupUsers()
+
+	_, code := registerSecurityKey(assert, webauthntest.New("https://diary.evil.com"))
+	assert.Equal(http.StatusBadRequest, code)
+}
+
+func TestWebAuthnMultipleKeys(t *testing.T) {
+	assert := asserthelper.New(t)
+	defer setupWebAuthnEnv()()
+	user, _ := SetupUsers()
+	first := webauthntest.New(webauthnTestOrigin)
+	second := webauthntest.New(webauthnTestOrigin)
+	second.EdDSA = true
+
+	_, code := registerSecurityKey(assert, first)
+	assert.Equal(http.StatusCreated, code)
+	// Once 2FA is enabled, adding a key requires the password or an OTP code
+	_, code = registerSecurityKey(assert, second)
+	assert.Equal(http.StatusBadRequest, code)
+	_, code = registerSecurityKeyWith(assert, second, WebAuthnRegistrationBody{Name: "Backup", Password: "wrong"})
+	assert.Equal(http.StatusBadRequest, code)
+	response, code := registerSecurityKeyWith(assert, second, WebAuthnRegistrationBody{Name: "Backup", Password: "azer"})
+	assert.Equal(http.StatusCreated, code)
+	// Codes and session were given with the first key
+	assert.Equal(0, len(response.RecoveryCodes))
+	assert.Empty(response.Token)
+
+	database.GetDB().Where("id = ?", user.ID).First(&user)
+	_, code = authenticateWithSecurityKey(assert, user, first)
+	assert.Equal(http.StatusOK, code)
+	_, code = authenticateWithSecurityKey(assert, user, second)
+	assert.Equal(http.StatusOK, code)
+
+	context, recorder := BuildEchoContext(nil, echo.MIMEApplicationJSON)
+	assert.Nil(GetWebAuthnCredentials(context))
+	var list struct {
+		Credentials []database.WebAuthnCredential `json:"credentials"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &list)
+	assert.Equal(2, len(list.Credentials))
+	assert.NotNil(list.Credentials[0].LastUsed)
+
+	// The password and a second factor are required
+	assert.Equal(http.StatusBadRequest, deleteSecurityKey(list.Credentials[0].ID, DeleteWebAuthnCredentialBody{Password: "azer"}))
+	assert.Equal(http.StatusBadRequest, deleteSecurityKey(list.Credentials[0].ID, DeleteWebAuthnCredentialBody{
+		Password:  "wrong",
+		Assertion: reauthenticate(assert, first),
+	}))
+
+	for i, credential := range list.Credentials {
+		authenticator := []*webauthntest.Authenticator{first, second}[i]
+		assert.Equal(http.StatusOK, deleteSecurityKey(credential.ID, DeleteWebAuthnCredentialBody{
+			Password:  "azer",
+			Assertion: reauthenticate(assert, authenticator),
+		}))
+
+		database.GetDB().Where("id = ?", user.ID).First(&user)
+		// Disabled with the last key
+		assert.Equal(i == 0, user.HasRegisteredWebAuthn)
+	}
+	methods, _ := twoFactorsMethods(user)
+	assert.Equal(0, len(methods))
+}
+
+// With OTP enabled, a current code can replace the password
+func TestWebAuthnRegisterWithOTP(t *testing.T) {
+	assert := asserthelper.New(t)
+	defer setupWebAuthnEnv()()
+	user, _ := SetupUsers()
+	assert.Nil(user.SetPendingOTPSecret("2SH3V3GDW7ZNMGYE", SecretsEnvelope()))
+	database.GetDB().Where("id = ?", user.ID).First(&user)
+	confirmed, err := user.ConfirmPendingOTPSecret(SecretsEnvelope(), 0)
+	assert.Nil(err)
+	assert.True(confirmed)
+	authenticator := webauthntest.New(webauthnTestOrigin)
+
+	_, code := registerSecurityKey(assert, authenticator)
+	assert.Equal(http.StatusBadRequest, code)
+	_, code = registerSecurityKeyWith(assert, authenticator, WebAuthnRegistrationBody{
+		Name:     "Yubikey",
+		Passcode: currentPasscode("2SH3V3GDW7ZNMGYE"),
+	})
+	assert.Equal(http.StatusCreated, code)
+}
+
+// A challenge stored by another instance can be used here, once
+func TestTakeCeremony(t *testing.T) {
+	assert := asserthelper.New(t)
+	user, other := SetupUsers()
+
+	challenge, err := startCeremony(ceremonyAuthentication, user.ID)
+	assert.Nil(err)
+	taken, err := takeCeremony(challenge, ceremonyAuthentication, user.ID)
+	assert.Nil(err)
+	assert.True(taken)
+	taken, _ = takeCeremony(challenge, ceremonyAuthentication, user.ID)
+	assert.False(taken)
+
+	// Nor for another user or ceremony
+	challenge, _ = startCeremony(ceremonyAuthentication, user.ID)
+	taken, _ = takeCeremony(challenge, ceremonyAuthentication, other.ID)
+	assert.False(taken)
+	challenge, _ = startCeremony(ceremonyAuthentication, user.ID)
+	taken, _ = takeCeremony(challenge, ceremonyRegistration, user.ID)
+	assert.False(taken)
+
+	// Nor once expired
+	challenge, _ = startCeremony(ceremonyAuthentication, user.ID)
+	database.GetDB().Model(&database.WebAuthnCeremony{}).
+		Where("challenge = ?", challenge).
+		Update("expires", time.Now().Add(-time.Second))
+	taken, _ = takeCeremony(challenge, ceremonyAuthentication, user.ID)
+	assert.False(taken)
+	assert.Nil(database.PurgeWebAuthnCeremonies())
+	var count int
+	database.GetDB().Model(&database.WebAuthnCeremony{}).Where("challenge = ?", challenge).Count(&count)
+	assert.Equal(0, count)
+}
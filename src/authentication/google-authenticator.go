@@ -1,12 +1,23 @@
 package authentication
 
 import (
-	"encoding/base32"
 	"fmt"
 	"github.com/dgryski/dgoogauth"
+	"github.com/Yuruh/encrypted-diary/src/secrets"
 	"github.com/skip2/go-qrcode"
-	"math/rand"
+	"log"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parameters of the codes checked by Authorize, given to OTP applications in the URI
+const (
+	otpAlgorithm = "SHA1"
+	otpDigits    = 6
+	otpPeriod    = 30
 )
 
 func GenerateQRCodeFromURI(uri string) ([]byte, error) {
@@ -18,19 +29,26 @@ func GenerateQRCodeFromURI(uri string) ([]byte, error) {
 	return png, err
 }
 
-func GenerateRandomSecret() string {
-	const possibilitiesRange = 255
-	const secretLength = 10
-
-	b := make([]byte, secretLength)
-	for i := range b {
-		b[i] = byte(rand.Intn(possibilitiesRange))
+/*
+	Size of OTP secrets in bytes, OTP_SECRET_SIZE or 20 (160 bits) by default.
+	Values under 16 bytes are not safe and are ignored.
+*/
+func OTPSecretSize() int {
+	value := os.Getenv("OTP_SECRET_SIZE")
+	if value == "" {
+		return secrets.DefaultSize
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < secrets.MinSize {
+		log.Println("Invalid OTP_SECRET_SIZE, expected at least", secrets.MinSize, "bytes, using default")
+		return secrets.DefaultSize
 	}
-//	fmt.Println(b)
-	// this only works with this code --> must be 80 bit always ?
-	//b = []byte{ 'H', 'e', 'l', 'l', 'o', '!', 0xDE, 0xAD, 0xBE, 0xEF }
-	//fmt.Println(b)
-	return base32.StdEncoding.EncodeToString(b)
+	return size
+}
+
+// Base32 encoded, as expected by OTP applications
+func GenerateRandomSecret(size int) (string, error) {
+	return secrets.Base32(size)
 }
 
 func BuildGAuthURI(userEmail string, secret string) string {
@@ -46,23 +64,45 @@ func BuildGAuthURI(userEmail string, secret string) string {
 	params := url.Values{}
 	params.Add("secret", secret)
 	params.Add("issuer", issuer)
-	params.Add("algorithm", "SHA512")
+	params.Add("algorithm", otpAlgorithm)
+	params.Add("digits", strconv.Itoa(otpDigits))
+	params.Add("period", strconv.Itoa(otpPeriod))
 
 	URL.RawQuery = params.Encode()
 
 	return URL.String()
 }
 
-func Authorize(passCode string, secret string) (bool, error) {
-	otpc := &dgoogauth.OTPConfig{
-		Secret:      secret,
-		WindowSize:  2,
-		HotpCounter: 0,
+// Codes of the previous and next periods are accepted too, to allow for clock drift
+const otpWindow = 1
+
+func currentTimeStep() int64 {
+	return time.Now().Unix() / otpPeriod
+}
+
+/*
+	Checks a TOTP code, returning the time step it was generated for.
+	Only codes of steps after lastStep are accepted: storing the returned step prevents replaying a code.
+*/
+func AuthorizeAfter(passCode string, secret string, lastStep int64) (int64, bool, error) {
+	if len(passCode) != otpDigits || strings.Trim(passCode, "0123456789") != "" {
+		return 0, false, fmt.Errorf("could not authenticate: %v", dgoogauth.ErrInvalidCode)
 	}
-	val, err := otpc.Authenticate(passCode)
+	code, err := strconv.Atoi(passCode)
 	if err != nil {
-		err = fmt.Errorf("could not authenticate: %v", err)
-		return false, err
+		return 0, false, fmt.Errorf("could not authenticate: %v", err)
 	}
-	return val, err
-}
\ No newline at end of file
+	now := currentTimeStep()
+	for step := now - otpWindow; step <= now + otpWindow; step++ {
+		if step > lastStep && dgoogauth.ComputeCode(secret, step) == code {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Does not prevent replays, see AuthorizeAfter
+func Authorize(passCode string, secret string) (bool, error) {
+	_, valid, err := AuthorizeAfter(passCode, secret, 0)
+	return valid, err
+}
@@ -1,13 +1,16 @@
 package authentication
 
 import (
+	"fmt"
+	"github.com/dgryski/dgoogauth"
 	asserthelper "github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 )
 
 func TestBuildGAuthURI(t *testing.T) {
 	assert := asserthelper.New(t)
-	assert.Equal("otpauth://totp/EncryptedDiary:antoine.lempereur@epitech.eu?algorithm=SHA512&issuer=EncryptedDiary&secret=STkyLeND6kL7Wk1uhHlJICjehIB5dKHe",
+	assert.Equal("otpauth://totp/EncryptedDiary:antoine.lempereur@epitech.eu?algorithm=SHA1&digits=6&issuer=EncryptedDiary&period=30&secret=STkyLeND6kL7Wk1uhHlJICjehIB5dKHe",
 		BuildGAuthURI("antoine.lempereur@epitech.eu", "STkyLeND6kL7Wk1uhHlJICjehIB5dKHe"))
 }
 
@@ -27,12 +30,32 @@ func TestGenerateQRCodeFromURI(t *testing.T) {
 func TestGenerateRandomSecret(t *testing.T) {
 	assert := asserthelper.New(t)
 
-	s1 := GenerateRandomSecret()
-
-	assert.Equal(16, len(s1))
-	s2 := GenerateRandomSecret()
+	s1, err := GenerateRandomSecret(OTPSecretSize())
+	assert.Nil(err)
+	// 160 bits
+	assert.Equal(32, len(s1))
+	s2, err := GenerateRandomSecret(OTPSecretSize())
+	assert.Nil(err)
 	assert.Equal(len(s1), len(s2))
 	assert.NotEqual(s1, s2)
+
+	// Usable to check codes
+	_, err = Authorize("123456", s1)
+	assert.Nil(err)
+}
+
+func TestOTPSecretSize(t *testing.T) {
+	assert := asserthelper.New(t)
+	defer os.Unsetenv("OTP_SECRET_SIZE")
+
+	os.Unsetenv("OTP_SECRET_SIZE")
+	assert.Equal(20, OTPSecretSize())
+	os.Setenv("OTP_SECRET_SIZE", "32")
+	assert.Equal(32, OTPSecretSize())
+	os.Setenv("OTP_SECRET_SIZE", "10")
+	assert.Equal(20, OTPSecretSize())
+	os.Setenv("OTP_SECRET_SIZE", "not a number")
+	assert.Equal(20, OTPSecretSize())
 }
 
 func TestAuthorize(t *testing.T) {
@@ -46,4 +69,44 @@ func TestAuthorize(t *testing.T) {
 	assert.Equal(false, validate)
 	assert.NotNil(err)
 
-}
\ No newline at end of file
+}
+
+func TestAuthorizeAfter(t *testing.T) {
+	assert := asserthelper.New(t)
+	const secret = "2SH3V3GDW7ZNMGYE"
+	now := currentTimeStep()
+	code := fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, now))
+
+	step, valid, err := AuthorizeAfter(code, secret, 0)
+	assert.Nil(err)
+	assert.Equal(true, valid)
+	assert.Equal(now, step)
+
+	// Already used
+	_, valid, err = AuthorizeAfter(code, secret, now)
+	assert.Nil(err)
+	assert.Equal(false, valid)
+
+	// A later code was used
+	_, valid, _ = AuthorizeAfter(code, secret, now + 1)
+	assert.Equal(false, valid)
+
+	// Previous and next periods are accepted
+	previous := fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, now - 1))
+	step, valid, _ = AuthorizeAfter(previous, secret, now - 2)
+	assert.Equal(true, valid)
+	assert.Equal(now - 1, step)
+	next := fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, now + 1))
+	step, valid, _ = AuthorizeAfter(next, secret, now)
+	assert.Equal(true, valid)
+	assert.Equal(now + 1, step)
+	tooOld := fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, now - 3))
+	_, valid, _ = AuthorizeAfter(tooOld, secret, 0)
+	assert.Equal(false, valid)
+
+	for _, bad := range []string{"12345", "1234567", "+12345", "-12345", "12 456", "abcdef"} {
+		_, valid, err = AuthorizeAfter(bad, secret, 0)
+		assert.Equal(false, valid)
+		assert.NotNil(err, bad)
+	}
+}
@@ -0,0 +1,50 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"github.com/Yuruh/encrypted-diary/src/secrets"
+	"strconv"
+	"strings"
+)
+
+// Number of codes given to the user each time they are generated
+const RecoveryCodesCount = 10
+
+// Lowercase and without padding, easier to read and to type
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// 12 characters, 60 bits, displayed as xxxx-xxxx-xxxx
+func GenerateRecoveryCode() (string, error) {
+	b, err := secrets.Bytes(8)
+	if err != nil {
+		return "", err
+	}
+	code := recoveryCodeEncoding.EncodeToString(b)[:12]
+	return code[:4] + "-" + code[4:8] + "-" + code[8:], nil
+}
+
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodesCount)
+	for i := range codes {
+		code, err := GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// Users may type codes in uppercase, with spaces or without dashes
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// Codes are random enough for a fast hash, the user ID prevents comparing hashes between users
+func HashRecoveryCode(userID uint, code string) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(int(userID)) + ":" + NormalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
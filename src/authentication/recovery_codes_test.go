@@ -0,0 +1,29 @@
+package authentication
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	assert := asserthelper.New(t)
+	codes, err := GenerateRecoveryCodes()
+	assert.Nil(err)
+	assert.Equal(RecoveryCodesCount, len(codes))
+
+	unique := map[string]bool{}
+	for _, code := range codes {
+		assert.Regexp("^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$", code)
+		unique[code] = true
+	}
+	assert.Equal(RecoveryCodesCount, len(unique))
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	assert := asserthelper.New(t)
+	hash := HashRecoveryCode(1, "abcd-efgh-ijkl")
+	assert.Equal(64, len(hash))
+	assert.Equal(hash, HashRecoveryCode(1, "ABCD EFGH IJKL"))
+	assert.Equal(hash, HashRecoveryCode(1, "abcdefghijkl"))
+	assert.NotEqual(hash, HashRecoveryCode(2, "abcd-efgh-ijkl"))
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// What is kept of a purged account: when its deletion was due, and when it was done (CreatedAt)
+type DeletedAccount struct {
+	BaseModel
+	UserID		uint `json:"user_id" gorm:"index"`
+	ScheduledAt	time.Time `json:"scheduled_at"`
+}
+
+func (a DeletedAccount) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&a)
+}
+
+func (a *DeletedAccount) Update() error {
+	return GetDB().Save(&a).Error
+}
+
+func (a *DeletedAccount) Create() error {
+	return GetDB().Create(&a).Error
+}
+
+func (a *DeletedAccount) Delete() error {
+	return GetDB().Unscoped().Delete(&a).Error
+}
+
+// An object storage file left to delete, so that a failing deletion is retried
+type PendingObjectDeletion struct {
+	BaseModel
+	Descriptor	string `json:"-" validate:"required" gorm:"type:varchar(200)"`
+}
+
+func (d PendingObjectDeletion) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&d)
+}
+
+func (d *PendingObjectDeletion) Update() error {
+	return GetDB().Save(&d).Error
+}
+
+func (d *PendingObjectDeletion) Create() error {
+	return GetDB().Create(&d).Error
+}
+
+func (d *PendingObjectDeletion) Delete() error {
+	return GetDB().Unscoped().Delete(&d).Error
+}
+
+func GetPendingObjectDeletions() ([]PendingObjectDeletion, error) {
+	var deletions []PendingObjectDeletion
+	err := GetDB().Order("id").Find(&deletions).Error
+	return deletions, err
+}
+
+// Keeps the date of a deletion already scheduled. Returns the date the account will be purged.
+func ScheduleAccountDeletion(userID uint, at time.Time) (time.Time, error) {
+	err := GetDB().Model(&User{}).
+		Where("id = ?", userID).
+		Where("deletion_scheduled_at IS NULL").
+		Update("deletion_scheduled_at", at).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+	var user User
+	err = GetDB().Where("id = ?", userID).First(&user).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+	return *user.DeletionScheduledAt, nil
+}
+
+// Returns false if no deletion was scheduled
+func CancelAccountDeletion(userID uint) (bool, error) {
+	result := GetDB().Model(&User{}).
+		Where("id = ?", userID).
+		Where("deletion_scheduled_at IS NOT NULL").
+		Update("deletion_scheduled_at", nil)
+	return result.RowsAffected == 1, result.Error
+}
+
+// IDs of the accounts whose grace period is over
+func GetAccountsDueForDeletion(now time.Time) ([]uint, error) {
+	var ids []uint
+	err := GetDB().Unscoped().Model(&User{}).
+		Where("deletion_scheduled_at <= ?", now).
+		Pluck("id", &ids).Error
+	return ids, err
+}
+
+// Tables with a user_id column, all rows of a purged account are deleted
+var userTables = []interface{}{
+	&Entry{}, &Label{}, &TwoFactorsCookie{}, &RefreshToken{}, &RecoveryCode{}, &AuditEvent{}, &WebAuthnCredential{},
+	&AuthFailure{}, &KDFParams{}, &WrappedKey{}, &PasswordResetToken{}, &EmailVerificationToken{}, &AccountExport{},
+}
+
+/*
+	Hard deletes the user and every row of theirs in a single transaction, and leaves a DeletedAccount behind.
+	The avatars of their labels and their export archives are queued for deletion, avatarDescriptor gives the name
+	of an avatar in object storage.
+	Returns false if the deletion is not due anymore, e.g. cancelled in between.
+
+	Revoked tokens are kept until they expire, so that they stay revoked.
+*/
+func PurgeAccount(userID uint, now time.Time, avatarDescriptor func(labelID uint, version int) string) (bool, error) {
+	tx := GetDB().Begin()
+	purged, err := purgeAccount(tx, userID, now, avatarDescriptor)
+	if err != nil || !purged {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit().Error
+}
+
+func purgeAccount(tx *gorm.DB, userID uint, now time.Time, avatarDescriptor func(labelID uint, version int) string) (bool, error) {
+	var user User
+	result := tx.Unscoped().Where("id = ?", userID).First(&user)
+	if result.RecordNotFound() {
+		return false, nil
+	} else if result.Error != nil {
+		return false, result.Error
+	}
+	// Conditional, a cancellation in between wins
+	result = tx.Unscoped().
+		Where("id = ?", userID).
+		Where("deletion_scheduled_at <= ?", now).
+		Delete(User{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return false, nil
+	}
+
+	var labels []Label
+	err := tx.Unscoped().Where("user_id = ?", userID).Where("has_avatar = ?", true).Find(&labels).Error
+	if err != nil {
+		return false, err
+	}
+	for _, label := range labels {
+		deletion := PendingObjectDeletion{Descriptor: avatarDescriptor(label.ID, label.AvatarVersion)}
+		err = tx.Create(&deletion).Error
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var exports []AccountExport
+	err = tx.Where("user_id = ?", userID).Find(&exports).Error
+	if err != nil {
+		return false, err
+	}
+	err = queueExportDeletions(tx, exports)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Exec("DELETE FROM entry_labels WHERE entry_id IN (SELECT id FROM entries WHERE user_id = ?)", userID).Error
+	if err != nil {
+		return false, err
+	}
+	for _, table := range userTables {
+		err = tx.Unscoped().Where("user_id = ?", userID).Delete(table).Error
+		if err != nil {
+			return false, err
+		}
+	}
+
+	tombstone := DeletedAccount{UserID: userID, ScheduledAt: *user.DeletionScheduledAt}
+	return true, tx.Create(&tombstone).Error
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady = "ready"
+	ExportFailed = "failed"
+)
+
+// An export archive built in the background, for accounts too large to be exported in a single request
+type AccountExport struct {
+	BaseModel
+	UserID		uint `json:"-" gorm:"index"`
+	Status		string `json:"status" validate:"oneof=pending ready failed" gorm:"type:varchar(10)"`
+	// Name of the archive in object storage, once ready
+	Descriptor	string `json:"-" gorm:"type:varchar(200)"`
+	Size		int64 `json:"size"`
+	// The archive is deleted at this time
+	Expires		time.Time `json:"expires"`
+}
+
+func (e AccountExport) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&e)
+}
+
+func (e *AccountExport) Update() error {
+	return GetDB().Save(&e).Error
+}
+
+func (e *AccountExport) Create() error {
+	return GetDB().Create(&e).Error
+}
+
+func (e *AccountExport) Delete() error {
+	return GetDB().Unscoped().Delete(&e).Error
+}
+
+// Exports of another user are not found
+func GetAccountExport(userID uint, id uint) (AccountExport, bool, error) {
+	var export AccountExport
+	result := GetDB().Where("user_id = ?", userID).Where("id = ?", id).First(&export)
+	if result.RecordNotFound() {
+		return AccountExport{}, false, nil
+	}
+	return export, result.Error == nil, result.Error
+}
+
+func GetPendingAccountExport(userID uint) (AccountExport, bool, error) {
+	var export AccountExport
+	result := GetDB().Where("user_id = ?", userID).Where("status = ?", ExportPending).First(&export)
+	if result.RecordNotFound() {
+		return AccountExport{}, false, nil
+	}
+	return export, result.Error == nil, result.Error
+}
+
+/*
+	Marks the export as ready to download. Returns false if it is not pending anymore, e.g. the account was purged
+	in between, in which case the archive must be deleted.
+*/
+func FinishAccountExport(id uint, descriptor string, size int64) (bool, error) {
+	result := GetDB().Model(&AccountExport{}).
+		Where("id = ?", id).
+		Where("status = ?", ExportPending).
+		Updates(map[string]interface{}{"status": ExportReady, "descriptor": descriptor, "size": size})
+	return result.RowsAffected == 1, result.Error
+}
+
+func FailAccountExport(id uint) error {
+	return GetDB().Model(&AccountExport{}).
+		Where("id = ?", id).
+		Where("status = ?", ExportPending).
+		Update("status", ExportFailed).Error
+}
+
+// Queues the archives of the given exports for deletion
+func queueExportDeletions(tx *gorm.DB, exports []AccountExport) error {
+	for _, export := range exports {
+		if export.Descriptor == "" {
+			continue
+		}
+		deletion := PendingObjectDeletion{Descriptor: export.Descriptor}
+		err := tx.Create(&deletion).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Deletes the exports expired at now, and queues their archives for deletion.
+	Exports still pending since before stalledBefore will never finish, e.g. the server restarted, they are failed.
+*/
+func PurgeAccountExports(now time.Time, stalledBefore time.Time) error {
+	err := GetDB().Model(&AccountExport{}).
+		Where("status = ?", ExportPending).
+		Where("created_at < ?", stalledBefore).
+		Update("status", ExportFailed).Error
+	if err != nil {
+		return err
+	}
+
+	tx := GetDB().Begin()
+	err = purgeAccountExports(tx, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func purgeAccountExports(tx *gorm.DB, now time.Time) error {
+	var exports []AccountExport
+	err := tx.Where("expires < ?", now).Find(&exports).Error
+	if err != nil {
+		return err
+	}
+	err = queueExportDeletions(tx, exports)
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		err = tx.Unscoped().Delete(&export).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
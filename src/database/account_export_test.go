@@ -0,0 +1,42 @@
+package database
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPurgeAccountExports(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(AccountExport{})
+	GetDB().Unscoped().Delete(PendingObjectDeletion{})
+	now := time.Now()
+
+	stalled := AccountExport{UserID: 1, Status: ExportPending, Expires: now.Add(time.Hour)}
+	assert.Nil(Insert(&stalled))
+	GetDB().Model(&stalled).Update("created_at", now.Add(-2 * time.Hour))
+	running := AccountExport{UserID: 2, Status: ExportPending, Expires: now.Add(time.Hour)}
+	assert.Nil(Insert(&running))
+	expired := AccountExport{UserID: 3, Status: ExportPending, Expires: now.Add(-time.Minute)}
+	assert.Nil(Insert(&expired))
+	finished, err := FinishAccountExport(expired.ID, "export_expired.zip", 10)
+	assert.Nil(err)
+	assert.True(finished)
+
+	assert.Nil(PurgeAccountExports(now, now.Add(-time.Hour)))
+
+	GetDB().First(&stalled, stalled.ID)
+	assert.Equal(ExportFailed, stalled.Status)
+	GetDB().First(&running, running.ID)
+	assert.Equal(ExportPending, running.Status)
+	assert.True(GetDB().First(&AccountExport{}, expired.ID).RecordNotFound())
+	deletions, err := GetPendingObjectDeletions()
+	assert.Nil(err)
+	assert.Equal(1, len(deletions))
+	assert.Equal("export_expired.zip", deletions[0].Descriptor)
+
+	// A failed export cannot be finished anymore
+	finished, err = FinishAccountExport(stalled.ID, "export_stalled.zip", 10)
+	assert.Nil(err)
+	assert.False(finished)
+}
@@ -0,0 +1,32 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+)
+
+// Security related action on an account, kept so that the user or an admin can find out what happened
+type AuditEvent struct {
+	BaseModel
+	UserID		uint `json:"-" gorm:"index"`
+	Action		string `json:"action" validate:"required,max=50" gorm:"type:varchar(50)"`
+	IpAddr		string `json:"ip_addr" validate:"max=45" gorm:"type:varchar(45)"`
+	UserAgent	string `json:"user_agent" validate:"max=200" gorm:"type:varchar(200)"`
+	Details		string `json:"details" gorm:"type:text"`
+}
+
+func (e AuditEvent) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&e)
+}
+
+func (e *AuditEvent) Update() error {
+	return GetDB().Save(&e).Error
+}
+
+func (e *AuditEvent) Create() error {
+	return GetDB().Create(&e).Error
+}
+
+func (e *AuditEvent) Delete() error {
+	return GetDB().Delete(&e).Error
+}
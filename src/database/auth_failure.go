@@ -0,0 +1,93 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Failed authentication attempts of an account, by kind of credential (password, OTP...)
+type AuthFailure struct {
+	BaseModel
+	UserID		uint `json:"-" gorm:"unique_index:idx_auth_failures_user_kind"`
+	Kind		string `json:"kind" validate:"required,max=20" gorm:"type:varchar(20);unique_index:idx_auth_failures_user_kind"`
+	Failures	int `json:"failures" gorm:"not null;default:0"`
+	LastFailure	time.Time `json:"last_failure"`
+	// No attempt is accepted before this date
+	LockedUntil	*time.Time `json:"locked_until"`
+}
+
+func (f AuthFailure) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&f)
+}
+
+func (f *AuthFailure) Update() error {
+	return GetDB().Save(&f).Error
+}
+
+func (f *AuthFailure) Create() error {
+	return GetDB().Create(&f).Error
+}
+
+func (f *AuthFailure) Delete() error {
+	return GetDB().Unscoped().Delete(&f).Error
+}
+
+// The zero value if the user has no failure of this kind
+func GetAuthFailure(userID uint, kind string) (AuthFailure, error) {
+	var failure AuthFailure
+	result := GetDB().Where("user_id = ? AND kind = ?", userID, kind).First(&failure)
+	if result.RecordNotFound() {
+		return AuthFailure{}, nil
+	}
+	return failure, result.Error
+}
+
+/*
+	Counts an attempt as a failure before the credential is checked, and locks the next attempts for the delay
+	returned for the new count. Failures before forgetBefore are forgotten.
+	Returns false, and counts nothing, while a lock is running. Counted and locked in a single transaction, so that
+	concurrent attempts are all counted and see the lock set by the previous ones, whichever instance handles them.
+*/
+func BeginAuthAttempt(userID uint, kind string, forgetBefore time.Time, delay func(failures int) time.Duration) (AuthFailure, bool, error) {
+	tx := GetDB().Begin()
+	failure, allowed, err := beginAuthAttempt(tx, userID, kind, forgetBefore, delay)
+	if err != nil || !allowed {
+		tx.Rollback()
+		return failure, false, err
+	}
+	return failure, true, tx.Commit().Error
+}
+
+func beginAuthAttempt(tx *gorm.DB, userID uint, kind string, forgetBefore time.Time, delay func(failures int) time.Duration) (AuthFailure, bool, error) {
+	now := time.Now()
+	// The row stays locked by the transaction, concurrent attempts wait for the lock date
+	result := tx.Exec(`INSERT INTO auth_failures (created_at, updated_at, user_id, kind, failures, last_failure)
+		VALUES (?, ?, ?, ?, 1, ?)
+		ON CONFLICT (user_id, kind) DO UPDATE SET
+			failures = CASE WHEN auth_failures.last_failure < ? THEN 1 ELSE auth_failures.failures + 1 END,
+			last_failure = excluded.last_failure,
+			updated_at = excluded.updated_at
+		WHERE auth_failures.locked_until IS NULL OR auth_failures.locked_until <= ?`,
+		now, now, userID, kind, now, forgetBefore, now)
+	if result.Error != nil {
+		return AuthFailure{}, false, result.Error
+	}
+	var failure AuthFailure
+	err := tx.Where("user_id = ? AND kind = ?", userID, kind).First(&failure).Error
+	if err != nil || result.RowsAffected == 0 {
+		return failure, false, err
+	}
+	if lock := delay(failure.Failures); lock > 0 {
+		until := now.Add(lock)
+		err = tx.Model(&failure).Update("locked_until", until).Error
+		failure.LockedUntil = &until
+	}
+	return failure, true, err
+}
+
+// After a successful authentication
+func ResetAuthFailures(userID uint, kind string) error {
+	return GetDB().Unscoped().Where("user_id = ? AND kind = ?", userID, kind).Delete(AuthFailure{}).Error
+}
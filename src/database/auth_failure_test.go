@@ -0,0 +1,79 @@
+package database
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBeginAuthAttempt(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(AuthFailure{})
+	forgetBefore := time.Now().Add(-time.Hour)
+	noDelay := func(failures int) time.Duration { return 0 }
+
+	failure, err := GetAuthFailure(1, "password")
+	assert.Nil(err)
+	assert.Equal(0, failure.Failures)
+
+	// Concurrent attempts are all counted
+	const attempts = 5
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, allowed, err := BeginAuthAttempt(1, "password", forgetBefore, noDelay)
+			assert.Nil(err)
+			assert.True(allowed)
+		}()
+	}
+	wg.Wait()
+	failure, _ = GetAuthFailure(1, "password")
+	assert.Equal(attempts, failure.Failures)
+
+	// By user and kind
+	failure, _, _ = BeginAuthAttempt(1, "otp", forgetBefore, noDelay)
+	assert.Equal(1, failure.Failures)
+	failure, _, _ = BeginAuthAttempt(2, "password", forgetBefore, noDelay)
+	assert.Equal(1, failure.Failures)
+
+	// From the third attempt, the next ones are refused until the lock is over, even concurrent ones
+	lockFromThird := func(failures int) time.Duration {
+		if failures >= 3 {
+			return time.Minute
+		}
+		return 0
+	}
+	allowedCount := 0
+	var mutex sync.Mutex
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, allowed, err := BeginAuthAttempt(3, "password", forgetBefore, lockFromThird)
+			assert.Nil(err)
+			mutex.Lock()
+			if allowed {
+				allowedCount++
+			}
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(3, allowedCount)
+	failure, _ = GetAuthFailure(3, "password")
+	assert.Equal(3, failure.Failures)
+	assert.WithinDuration(time.Now().Add(time.Minute), *failure.LockedUntil, time.Second)
+
+	// Failures before forgetBefore are forgotten
+	failure, _, _ = BeginAuthAttempt(1, "password", time.Now().Add(time.Second), noDelay)
+	assert.Equal(1, failure.Failures)
+
+	assert.Nil(ResetAuthFailures(1, "password"))
+	failure, _ = GetAuthFailure(1, "password")
+	assert.Equal(0, failure.Failures)
+	failure, _ = GetAuthFailure(1, "otp")
+	assert.Equal(1, failure.Failures)
+}
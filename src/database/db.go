@@ -1,6 +1,7 @@
 package database
 
 import (
+	"database/sql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"log"
@@ -59,6 +60,18 @@ func Connect() *gorm.DB {
 	return db
 }
 
+// Maximum length of a varchar column, or 0 if unknown
+func columnLength(table string, column string) int64 {
+	var length sql.NullInt64
+	err := instance.Raw("SELECT character_maximum_length FROM information_schema.columns " +
+		"WHERE table_schema = CURRENT_SCHEMA() AND table_name = ? AND column_name = ?", table, column).
+		Row().Scan(&length)
+	if err != nil {
+		return 0
+	}
+	return length.Int64
+}
+
 /*
 	Auto Migrate seems to fail to create foreign keys, hence creation of a many to many relation for entries / label failed
 
@@ -67,8 +80,31 @@ func Connect() *gorm.DB {
 func RunMigration() {
 	instance.Exec("CREATE EXTENSION fuzzystrmatch")
 
+	// Accounts created before addresses were verified are trusted with theirs, once, when the column is added
+	verifiedColumn := instance.Dialect().HasColumn(instance.NewScope(&User{}).TableName(), "email_verified_at")
 	instance.AutoMigrate(&User{})
+	if !verifiedColumn {
+		instance.Exec("UPDATE users SET email_verified_at = created_at")
+	}
 	instance.AutoMigrate(&Entry{})
 	instance.AutoMigrate(&Label{})
 	instance.AutoMigrate(&TwoFactorsCookie{})
+	// Was varchar(12), too short for most addresses. AutoMigrate does not change column types.
+	if columnLength(instance.NewScope(&TwoFactorsCookie{}).TableName(), "ip_addr") < 45 {
+		instance.Model(&TwoFactorsCookie{}).ModifyColumn("ip_addr", "varchar(45)")
+	}
+	instance.AutoMigrate(&RefreshToken{})
+	instance.AutoMigrate(&RevokedToken{})
+	instance.AutoMigrate(&RecoveryCode{})
+	instance.AutoMigrate(&AuditEvent{})
+	instance.AutoMigrate(&WebAuthnCredential{})
+	instance.AutoMigrate(&WebAuthnCeremony{})
+	instance.AutoMigrate(&AuthFailure{})
+	instance.AutoMigrate(&KDFParams{})
+	instance.AutoMigrate(&WrappedKey{})
+	instance.AutoMigrate(&PasswordResetToken{})
+	instance.AutoMigrate(&EmailVerificationToken{})
+	instance.AutoMigrate(&DeletedAccount{})
+	instance.AutoMigrate(&PendingObjectDeletion{})
+	instance.AutoMigrate(&AccountExport{})
 }
@@ -10,3 +10,32 @@ func TestGetDB(t *testing.T) {
 
 	assert.Equal(GetDB(), GetDB())
 }
+
+// Accounts created before addresses were verified are considered verified, once, when the column is added
+func TestRunMigration_EmailVerifiedAt(t *testing.T) {
+	assert := asserthelper.New(t)
+	db := GetDB()
+	db.Unscoped().Delete(User{})
+	existing := User{Email: "existing@test.com", Password: "toto"}
+	assert.Nil(existing.Create())
+	assert.Nil(db.Model(&User{}).DropColumn("email_verified_at").Error)
+
+	RunMigration()
+	assert.Nil(db.First(&existing, existing.ID).Error)
+	assert.NotNil(existing.EmailVerifiedAt)
+	assert.True(existing.CreatedAt.Equal(*existing.EmailVerifiedAt))
+
+	created := User{Email: "created@test.com", Password: "toto"}
+	assert.Nil(created.Create())
+	RunMigration()
+	assert.Nil(db.First(&created, created.ID).Error)
+	assert.Nil(created.EmailVerifiedAt)
+}
+
+// The column is only modified while too short, not on every start
+func TestRunMigration_IPAddrLength(t *testing.T) {
+	assert := asserthelper.New(t)
+	table := GetDB().NewScope(&TwoFactorsCookie{}).TableName()
+	assert.Equal(int64(45), columnLength(table, "ip_addr"))
+	assert.Equal(int64(0), columnLength(table, "unknown"))
+}
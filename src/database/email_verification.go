@@ -0,0 +1,130 @@
+package database
+
+import (
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+/*
+	Emailed to confirm an address, either the one given at registration or the one replacing it.
+	Only its sha256 hash is stored.
+*/
+type EmailVerificationToken struct {
+	BaseModel
+	TokenHash	string `json:"-" validate:"len=64,hexadecimal" gorm:"type:varchar(64);unique_index"`
+	UserID		uint `json:"-" gorm:"index"`
+	// The address the token was sent to, it replaces the email of the user once verified
+	Email		string `json:"-" validate:"email,required" gorm:"type:varchar(100)"`
+	// SRP users prove their password with the email as identity, changing it requires a new verifier
+	SRPSalt		[]byte `json:"-"`
+	SRPVerifier	[]byte `json:"-"`
+	Expires		time.Time `json:"-"`
+	UsedAt		*time.Time `json:"-"`
+}
+
+var ErrInvalidVerificationToken = errors.New("invalid, expired or already used email verification token")
+
+func (t EmailVerificationToken) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&t)
+}
+
+func (t *EmailVerificationToken) Update() error {
+	return GetDB().Save(&t).Error
+}
+
+func (t *EmailVerificationToken) Create() error {
+	return GetDB().Create(&t).Error
+}
+
+func (t *EmailVerificationToken) Delete() error {
+	return GetDB().Unscoped().Delete(&t).Error
+}
+
+// Tokens issued to the user since the given time, used or not
+func CountEmailVerificationTokens(userID uint, since time.Time) (int, error) {
+	var count int
+	err := GetDB().Model(&EmailVerificationToken{}).
+		Where("user_id = ?", userID).
+		Where("created_at > ?", since).
+		Count(&count).Error
+	return count, err
+}
+
+/*
+	Uses the token to mark its address as verified, replacing the email of the user if it is a new one.
+	Other pending tokens of the user are invalidated. Fails with the database unique error if the address
+	was taken by another account in between.
+*/
+func VerifyEmail(tokenHash string) (User, error) {
+	var user User
+	tx := GetDB().Begin()
+	err := verifyEmail(tx, tokenHash, &user)
+	if err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	return user, tx.Commit().Error
+}
+
+func verifyEmail(tx *gorm.DB, tokenHash string, user *User) error {
+	var token EmailVerificationToken
+	result := tx.Where("token_hash = ?", tokenHash).First(&token)
+	if result.RecordNotFound() {
+		return ErrInvalidVerificationToken
+	} else if result.Error != nil {
+		return result.Error
+	}
+	now := time.Now()
+	// Conditional, a token can only be used once
+	result = tx.Model(&EmailVerificationToken{}).
+		Where("id = ?", token.ID).
+		Where("used_at IS NULL").
+		Where("expires > ?", now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrInvalidVerificationToken
+	}
+	err := tx.Model(&EmailVerificationToken{}).
+		Where("user_id = ?", token.UserID).
+		Where("used_at IS NULL").
+		Update("used_at", now).Error
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"email":             token.Email,
+		"email_verified_at": now,
+	}
+	if token.SRPVerifier != nil {
+		updates["srp_salt"] = token.SRPSalt
+		updates["srp_verifier"] = token.SRPVerifier
+	}
+	err = tx.Model(&User{}).Where("id = ?", token.UserID).Updates(updates).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("id = ?", token.UserID).First(user).Error
+}
+
+/*
+	Invalidates the pending changes of address of the user. Called when their credentials change: an SRP verifier
+	computed with the new address would be stale, and would bring the previous password back.
+*/
+func cancelEmailChanges(tx *gorm.DB, userID uint) error {
+	return tx.Model(&EmailVerificationToken{}).
+		Where("user_id = ?", userID).
+		Where("used_at IS NULL").
+		Where("email <> (SELECT email FROM users WHERE id = ?)", userID).
+		Update("used_at", time.Now()).Error
+}
+
+func PurgeEmailVerificationTokens() error {
+	return GetDB().Unscoped().Where("expires < ?", time.Now()).Delete(EmailVerificationToken{}).Error
+}
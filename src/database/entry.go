@@ -12,6 +12,8 @@ var validate *validator.Validate
 type PartialEntry struct {
 	Content		string `json:"content" gorm:"type:varchar"`
 	Title		string `json:"title" gorm:"type:varchar" validate:"required,min=3"`
+	// Version of the data key the content is encrypted with, 0 for the key derived from the password
+	KeyVersion	int `json:"key_version" gorm:"not null;default:0" validate:"min=0"`
 }
 
 /*
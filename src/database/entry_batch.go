@@ -0,0 +1,95 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+var ErrEntryNotFound = errors.New("entry not found")
+
+/*
+	One operation of a batch. Entry is the entry to create, or the new version of the entry of the same ID.
+	Its labels replace the current ones, they must belong to the user and are not saved.
+*/
+type EntryOperation struct {
+	Op		string
+	Entry	Entry
+}
+
+// The operation at Index failed, nothing of the batch was applied
+type EntryBatchError struct {
+	Index	int
+	Err		error
+}
+
+func (e EntryBatchError) Error() string {
+	return fmt.Sprintf("operation %v: %v", e.Index, e.Err)
+}
+
+/*
+	Applies all the operations in a single transaction, in order. Returns the entries created or updated, in the
+	order of the operations, an empty entry for deletions.
+	Entries of other users, or already deleted, fail the batch with ErrEntryNotFound.
+*/
+func ApplyEntryBatch(userID uint, operations []EntryOperation) ([]Entry, error) {
+	tx := GetDB().Begin()
+	entries, err := applyEntryBatch(tx, userID, operations)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return entries, tx.Commit().Error
+}
+
+func applyEntryBatch(tx *gorm.DB, userID uint, operations []EntryOperation) ([]Entry, error) {
+	entries := make([]Entry, 0, len(operations))
+	// Labels are only associated, not saved again
+	save := tx.Set("gorm:association_autoupdate", false)
+	for i, operation := range operations {
+		entry := operation.Entry
+		entry.UserID = userID
+		var err error
+		switch operation.Op {
+		case BatchCreate:
+			entry.ID = 0
+			err = save.Create(&entry).Error
+		case BatchUpdate:
+			var current Entry
+			result := tx.Where("id = ?", entry.ID).Where("user_id = ?", userID).First(&current)
+			if result.RecordNotFound() {
+				return nil, EntryBatchError{Index: i, Err: ErrEntryNotFound}
+			} else if result.Error != nil {
+				return nil, result.Error
+			}
+			err = tx.Model(&current).Association("Labels").Clear().Error
+			if err == nil {
+				// Keeps the date unless a new one is given
+				if entry.CreatedAt.IsZero() {
+					entry.CreatedAt = current.CreatedAt
+				}
+				err = save.Save(&entry).Error
+			}
+		case BatchDelete:
+			result := tx.Where("id = ?", entry.ID).Where("user_id = ?", userID).Delete(&Entry{})
+			if result.Error == nil && result.RowsAffected != 1 {
+				return nil, EntryBatchError{Index: i, Err: ErrEntryNotFound}
+			}
+			err = result.Error
+			entry = Entry{}
+		default:
+			return nil, EntryBatchError{Index: i, Err: errors.New("unknown operation " + operation.Op)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
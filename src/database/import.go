@@ -0,0 +1,111 @@
+package database
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// A label read from an export archive, ArchiveID is its ID in the archive
+type ImportedLabel struct {
+	ArchiveID	uint
+	Label		Label
+	// Encrypted avatar, nil without
+	Avatar		[]byte
+}
+
+// An entry read from an export archive. LabelIDs are IDs in the archive.
+type ImportedEntry struct {
+	ArchiveID	uint
+	Entry		Entry
+	LabelIDs	[]uint
+}
+
+// What became of an imported label or entry: the row created, or the one already there
+type ImportOutcome struct {
+	ID			uint
+	Created		bool
+}
+
+/*
+	Creates the labels and entries the user does not have yet, in a single transaction.
+
+	A label already exists if the user has one with the same name regardless of case, it is then left untouched.
+	An entry already exists if the user has one created at the same time with the same title and content, so that
+	importing an archive twice, or in the account it comes from, does not duplicate anything.
+
+	storeAvatar is called with the ID of every label created with an avatar, an error rolls the import back.
+	Outcomes are in the same order as labels and entries.
+*/
+func ImportDiary(userID uint, labels []ImportedLabel, entries []ImportedEntry,
+	storeAvatar func(labelID uint, avatar []byte) error) ([]ImportOutcome, []ImportOutcome, error) {
+	tx := GetDB().Begin()
+	labelOutcomes, entryOutcomes, err := importDiary(tx, userID, labels, entries, storeAvatar)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	return labelOutcomes, entryOutcomes, tx.Commit().Error
+}
+
+func importDiary(tx *gorm.DB, userID uint, labels []ImportedLabel, entries []ImportedEntry,
+	storeAvatar func(labelID uint, avatar []byte) error) ([]ImportOutcome, []ImportOutcome, error) {
+	labelOutcomes := make([]ImportOutcome, 0, len(labels))
+	// By ID in the archive
+	importedLabels := make(map[uint]Label, len(labels))
+	for _, imported := range labels {
+		label, exists, err := findLabelByName(tx, userID, imported.Label.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			label = imported.Label
+			label.ID = 0
+			label.UserID = userID
+			label.HasAvatar = imported.Avatar != nil
+			label.AvatarVersion = 0
+			err = tx.Create(&label).Error
+			if err != nil {
+				return nil, nil, err
+			}
+			if label.HasAvatar {
+				err = storeAvatar(label.ID, imported.Avatar)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		importedLabels[imported.ArchiveID] = label
+		labelOutcomes = append(labelOutcomes, ImportOutcome{ID: label.ID, Created: !exists})
+	}
+
+	entryOutcomes := make([]ImportOutcome, 0, len(entries))
+	for _, imported := range entries {
+		var existing Entry
+		result := tx.
+			Where("user_id = ?", userID).
+			Where("created_at = ?", imported.Entry.CreatedAt).
+			Where("title = ?", imported.Entry.Title).
+			Where("content = ?", imported.Entry.Content).
+			First(&existing)
+		if result.Error == nil {
+			entryOutcomes = append(entryOutcomes, ImportOutcome{ID: existing.ID})
+			continue
+		} else if !result.RecordNotFound() {
+			return nil, nil, result.Error
+		}
+
+		entry := imported.Entry
+		entry.ID = 0
+		entry.UserID = userID
+		entry.Labels = make([]Label, 0, len(imported.LabelIDs))
+		for _, labelID := range imported.LabelIDs {
+			entry.Labels = append(entry.Labels, importedLabels[labelID])
+		}
+		// Labels are only associated, not saved again
+		err := tx.Set("gorm:association_autoupdate", false).Create(&entry).Error
+		if err != nil {
+			return nil, nil, err
+		}
+		entryOutcomes = append(entryOutcomes, ImportOutcome{ID: entry.ID, Created: true})
+	}
+	return labelOutcomes, entryOutcomes, nil
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"time"
+)
+
+const (
+	KDFPBKDF2SHA256 = "PBKDF2-SHA256"
+	KDFArgon2id = "Argon2id"
+)
+
+// Lower bounds, following OWASP recommendations
+const (
+	minPBKDF2Iterations = 100000
+	minArgon2MemoryKiB = 19 * 1024
+)
+
+/*
+	How clients derive the encryption key from the password. Users without parameters use the derivation
+	clients had before parameters were stored, version 0.
+
+	Version is increased on every change, so that a client can tell its cached parameters are stale,
+	and two clients cannot overwrite each other's changes.
+*/
+type KDFParams struct {
+	BaseModel
+	UserID		uint `json:"-" gorm:"unique_index"`
+	Version		int `json:"version" validate:"min=1"`
+	Algorithm	string `json:"algorithm" validate:"oneof=PBKDF2-SHA256 Argon2id" gorm:"type:varchar(20)"`
+	Salt		[]byte `json:"salt" validate:"min=16,max=64"`
+	// PBKDF2 iterations, or Argon2 time cost
+	Iterations	int `json:"iterations" validate:"min=1,max=10000000"`
+	// Argon2 only
+	MemoryKiB	int `json:"memory_kib" validate:"min=0,max=4194304" gorm:"column:memory_kib"`
+	Parallelism	int `json:"parallelism" validate:"min=0,max=16"`
+}
+
+func (KDFParams) TableName() string {
+	return "kdf_params"
+}
+
+var ErrWeakKDFParams = errors.New("key derivation parameters too weak")
+
+func (p KDFParams) Validate() error {
+	validate = validator.New()
+	err := validate.Struct(&p)
+	if err != nil {
+		return err
+	}
+	switch p.Algorithm {
+	case KDFPBKDF2SHA256:
+		if p.Iterations < minPBKDF2Iterations {
+			return ErrWeakKDFParams
+		}
+	case KDFArgon2id:
+		if p.MemoryKiB < minArgon2MemoryKiB || p.Parallelism < 1 {
+			return ErrWeakKDFParams
+		}
+	}
+	return nil
+}
+
+func (p *KDFParams) Update() error {
+	return GetDB().Save(&p).Error
+}
+
+func (p *KDFParams) Create() error {
+	return GetDB().Create(&p).Error
+}
+
+func (p *KDFParams) Delete() error {
+	return GetDB().Unscoped().Delete(&p).Error
+}
+
+// Returns false if the user has no parameters, i.e. version 0
+func GetKDFParams(userID uint) (KDFParams, bool, error) {
+	var params KDFParams
+	result := GetDB().Where("user_id = ?", userID).First(&params)
+	if result.RecordNotFound() {
+		return KDFParams{}, false, nil
+	}
+	return params, result.Error == nil, result.Error
+}
+
+/*
+	Saves the parameters as version previousVersion + 1.
+	Returns false if the stored version is not previousVersion anymore, i.e. another client changed them in between.
+*/
+func ReplaceKDFParams(userID uint, params KDFParams, previousVersion int) (bool, error) {
+	params.UserID = userID
+	params.Version = previousVersion + 1
+	err := params.Validate()
+	if err != nil {
+		return false, err
+	}
+	if previousVersion == 0 {
+		// The unique index refuses a concurrent first insert
+		now := time.Now()
+		result := GetDB().Exec(`INSERT INTO kdf_params (created_at, updated_at, user_id, version, algorithm, salt,
+			iterations, memory_kib, parallelism)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id) DO NOTHING`,
+			now, now, userID, params.Version, params.Algorithm, params.Salt, params.Iterations, params.MemoryKiB,
+			params.Parallelism)
+		return result.RowsAffected == 1, result.Error
+	}
+	result := GetDB().Model(&KDFParams{}).
+		Where("user_id = ?", userID).
+		Where("version = ?", previousVersion).
+		Updates(map[string]interface{}{
+			"version":     params.Version,
+			"algorithm":   params.Algorithm,
+			"salt":        params.Salt,
+			"iterations":  params.Iterations,
+			"memory_kib":  params.MemoryKiB,
+			"parallelism": params.Parallelism,
+		})
+	return result.RowsAffected == 1, result.Error
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"bytes"
+	asserthelper "github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func pbkdf2Params() KDFParams {
+	return KDFParams{
+		Algorithm:  KDFPBKDF2SHA256,
+		Salt:       bytes.Repeat([]byte{1}, 16),
+		Iterations: 600000,
+	}
+}
+
+func TestKDFParams_Validate(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	params := pbkdf2Params()
+	params.Version = 1
+	assert.Nil(params.Validate())
+
+	params.Iterations = 1000
+	assert.Equal(ErrWeakKDFParams, params.Validate())
+
+	params = KDFParams{Version: 1, Algorithm: KDFArgon2id, Salt: params.Salt, Iterations: 2, MemoryKiB: 19 * 1024}
+	assert.Equal(ErrWeakKDFParams, params.Validate())
+	params.Parallelism = 1
+	assert.Nil(params.Validate())
+
+	params.Algorithm = "scrypt"
+	assert.NotNil(params.Validate())
+	params.Algorithm = KDFArgon2id
+	params.Salt = []byte("short")
+	assert.NotNil(params.Validate())
+}
+
+func TestReplaceKDFParams(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(KDFParams{})
+
+	_, found, err := GetKDFParams(1)
+	assert.Nil(err)
+	assert.False(found)
+
+	// Only one of concurrent changes from the same version wins
+	var wg sync.WaitGroup
+	results := make(chan bool, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replaced, err := ReplaceKDFParams(1, pbkdf2Params(), 0)
+			assert.Nil(err)
+			results <- replaced
+		}()
+	}
+	wg.Wait()
+	close(results)
+	replacedCount := 0
+	for replaced := range results {
+		if replaced {
+			replacedCount++
+		}
+	}
+	assert.Equal(1, replacedCount)
+
+	params, found, _ := GetKDFParams(1)
+	assert.True(found)
+	assert.Equal(1, params.Version)
+
+	// Stale version
+	argon := KDFParams{Algorithm: KDFArgon2id, Salt: params.Salt, Iterations: 3, MemoryKiB: 65536, Parallelism: 4}
+	replaced, err := ReplaceKDFParams(1, argon, 0)
+	assert.Nil(err)
+	assert.False(replaced)
+
+	replaced, err = ReplaceKDFParams(1, argon, 1)
+	assert.Nil(err)
+	assert.True(replaced)
+	params, _, _ = GetKDFParams(1)
+	assert.Equal(2, params.Version)
+	assert.Equal(KDFArgon2id, params.Algorithm)
+	assert.Equal(65536, params.MemoryKiB)
+
+	// Invalid parameters are not saved
+	_, err = ReplaceKDFParams(1, KDFParams{Algorithm: KDFPBKDF2SHA256, Salt: params.Salt, Iterations: 10}, 2)
+	assert.Equal(ErrWeakKDFParams, err)
+	params, _, _ = GetKDFParams(1)
+	assert.Equal(2, params.Version)
+}
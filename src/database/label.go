@@ -1,11 +1,17 @@
 package database
 
-import "github.com/go-playground/validator/v10"
+import (
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
 
 // The user modifiable part
 type PartialLabel struct {
 	Name string `json:"name" validate:"alphanumunicode,max=100"`
 	Color string `json:"color" validate:"hexcolor"`
+	// Version of the data key the avatar is encrypted with, 0 for the key derived from the password
+	KeyVersion int `json:"key_version" gorm:"not null;default:0" validate:"min=0"`
 }
 
 type Label struct {
@@ -14,6 +20,8 @@ type Label struct {
 	UserID uint `json:"user_id"`
 	AvatarUrl string `json:"avatar_url" gorm:"-"`
 	HasAvatar bool `json:"has_avatar"`
+	// Increased when the avatar is stored again under a new name, e.g. re-encrypted with a new key
+	AvatarVersion int `json:"-" gorm:"not null;default:0"`
 //	Entries		[]Entry `json:"entries" gorm:"many2many:entry_labels;"`
 }
 
@@ -46,4 +54,21 @@ func (label Label) Validate() error {
 
 func (label *Label) Delete() error {
 	return GetDB().Delete(&label).Error
-}
\ No newline at end of file
+}
+
+// Label names are unique per user, regardless of case
+func FindLabelByName(userID uint, name string) (Label, bool, error) {
+	return findLabelByName(GetDB(), userID, name)
+}
+
+func findLabelByName(tx *gorm.DB, userID uint, name string) (Label, bool, error) {
+	var label Label
+	result := tx.
+		Where("user_id = ?", userID).
+		Where("LOWER(name) = ?", strings.ToLower(name)).
+		First(&label)
+	if result.RecordNotFound() {
+		return Label{}, false, nil
+	}
+	return label, result.Error == nil, result.Error
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"fmt"
 	"github.com/go-playground/validator/v10"
 )
 
@@ -46,7 +47,7 @@ func BuildValidationErrorMsg(errs validator.ValidationErrors) string {
 		if err.Param() != "" {
 			msg += " " + err.Param()
 		}
-		msg += "'. Got value: '" + err.Value().(string) + "'.\n"
+		msg += "'. Got value: '" + fmt.Sprint(err.Value()) + "'.\n"
 	}
 	return msg
 }
\ No newline at end of file
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// An entry re-encrypted with a new key
+type ReEncryptedEntry struct {
+	ID        uint      `json:"id"`
+	// As read by the client, the entry must not have changed since
+	UpdatedAt time.Time `json:"updated_at"`
+	Content   string    `json:"content"`
+}
+
+/*
+	What replaces the password. Either Password, a bcrypt hash, or the SRP salt and verifier are set.
+	WrappedKey is the data key wrapped with the new password, required once the user has a data key.
+*/
+type Credentials struct {
+	Password    string
+	SRPSalt     []byte
+	SRPVerifier []byte
+	WrappedKey  []byte
+}
+
+var ErrDataChanged = errors.New("entries or labels changed during the password change")
+
+/*
+	Replaces the credentials of the user and the content of all their entries encrypted with the key derived from the
+	password (key version 0) in a single transaction, so that data is never left encrypted with two keys.
+	Data encrypted with the data key is left untouched, only the password wrapping of the data key is replaced.
+
+	avatarVersions gives the current version of every label with a key version 0 avatar, the new avatars having been
+	stored under the next version. Returns ErrDataChanged if any entry or label was created, deleted or modified
+	in between, in which case nothing is changed.
+*/
+func ChangePassword(userID uint, credentials Credentials, entries []ReEncryptedEntry, avatarVersions map[uint]int) error {
+	tx := GetDB().Begin()
+	err := changePassword(tx, userID, credentials, entries, avatarVersions)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func changePassword(tx *gorm.DB, userID uint, credentials Credentials, entries []ReEncryptedEntry, avatarVersions map[uint]int) error {
+	for _, entry := range entries {
+		result := tx.Model(&Entry{}).
+			Where("id = ?", entry.ID).
+			Where("user_id = ?", userID).
+			Where("updated_at = ?", entry.UpdatedAt).
+			Where("key_version = ?", 0).
+			Update("content", entry.Content)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrDataChanged
+		}
+	}
+	var count int
+	err := tx.Model(&Entry{}).Where("user_id = ?", userID).Where("key_version = ?", 0).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count != len(entries) {
+		return ErrDataChanged
+	}
+
+	for labelID, version := range avatarVersions {
+		result := tx.Model(&Label{}).
+			Where("id = ?", labelID).
+			Where("user_id = ?", userID).
+			Where("has_avatar = ?", true).
+			Where("avatar_version = ?", version).
+			Where("key_version = ?", 0).
+			Update("avatar_version", version + 1)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrDataChanged
+		}
+	}
+	err = tx.Model(&Label{}).
+		Where("user_id = ?", userID).
+		Where("has_avatar = ?", true).
+		Where("key_version = ?", 0).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count != len(avatarVersions) {
+		return ErrDataChanged
+	}
+
+	return replaceCredentials(tx, userID, credentials)
+}
+
+// Also replaces the password wrapping of the data key, which must be given if the user has one
+func replaceCredentials(tx *gorm.DB, userID uint, credentials Credentials) error {
+	if credentials.WrappedKey != nil {
+		result := tx.Model(&WrappedKey{}).
+			Where("user_id = ?", userID).
+			Where("kind = ?", WrappedWithPassword).
+			Update("wrapped", credentials.WrappedKey)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrDataChanged
+		}
+	} else {
+		// The data key would be lost
+		var count int
+		err := tx.Model(&WrappedKey{}).Where("user_id = ?", userID).Where("kind = ?", WrappedWithPassword).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count != 0 {
+			return ErrDataChanged
+		}
+	}
+
+	return updateCredentials(tx, userID, credentials)
+}
+
+func updateCredentials(tx *gorm.DB, userID uint, credentials Credentials) error {
+	err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"password":     credentials.Password,
+		"uses_srp":     credentials.Password == "",
+		"srp_salt":     credentials.SRPSalt,
+		"srp_verifier": credentials.SRPVerifier,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return cancelEmailChanges(tx, userID)
+}
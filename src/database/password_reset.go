@@ -0,0 +1,126 @@
+package database
+
+import (
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Emailed to a user who forgot their password. Only its sha256 hash is stored.
+type PasswordResetToken struct {
+	BaseModel
+	TokenHash	string `json:"-" validate:"len=64,hexadecimal" gorm:"type:varchar(64);unique_index"`
+	UserID		uint `json:"-" gorm:"index"`
+	Expires		time.Time `json:"-"`
+	UsedAt		*time.Time `json:"-"`
+}
+
+var ErrInvalidResetToken = errors.New("invalid, expired or already used password reset token")
+
+func (t PasswordResetToken) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&t)
+}
+
+func (t *PasswordResetToken) Update() error {
+	return GetDB().Save(&t).Error
+}
+
+func (t *PasswordResetToken) Create() error {
+	return GetDB().Create(&t).Error
+}
+
+func (t *PasswordResetToken) Delete() error {
+	return GetDB().Unscoped().Delete(&t).Error
+}
+
+// Unused and not expired, ErrInvalidResetToken otherwise
+func GetPasswordResetToken(tokenHash string) (PasswordResetToken, error) {
+	var token PasswordResetToken
+	result := GetDB().
+		Where("token_hash = ?", tokenHash).
+		Where("used_at IS NULL").
+		Where("expires > ?", time.Now()).
+		First(&token)
+	if result.RecordNotFound() {
+		return token, ErrInvalidResetToken
+	}
+	return token, result.Error
+}
+
+// Tokens issued to the user since the given time, used or not
+func CountPasswordResetTokens(userID uint, since time.Time) (int, error) {
+	var count int
+	err := GetDB().Model(&PasswordResetToken{}).
+		Where("user_id = ?", userID).
+		Where("created_at > ?", since).
+		Count(&count).Error
+	return count, err
+}
+
+/*
+	Uses the token to replace the credentials of its user, and invalidates their other tokens.
+
+	The data key cannot be unwrapped without the old password: if the user has a recovery key, the password wrapping
+	is kept so that RecoverAccount can replace it later, otherwise it is deleted and the client can create a new data
+	key, see SaveWrappedKey. Data encrypted with the previous keys stays as is, unreadable.
+*/
+func ResetPassword(tokenHash string, credentials Credentials) (User, error) {
+	var user User
+	tx := GetDB().Begin()
+	err := resetPassword(tx, tokenHash, credentials, &user)
+	if err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	return user, tx.Commit().Error
+}
+
+func resetPassword(tx *gorm.DB, tokenHash string, credentials Credentials, user *User) error {
+	var token PasswordResetToken
+	result := tx.Where("token_hash = ?", tokenHash).First(&token)
+	if result.RecordNotFound() {
+		return ErrInvalidResetToken
+	} else if result.Error != nil {
+		return result.Error
+	}
+	// Conditional, a token can only be used once
+	result = tx.Model(&PasswordResetToken{}).
+		Where("id = ?", token.ID).
+		Where("used_at IS NULL").
+		Where("expires > ?", time.Now()).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrInvalidResetToken
+	}
+	err := tx.Model(&PasswordResetToken{}).
+		Where("user_id = ?", token.UserID).
+		Where("used_at IS NULL").
+		Update("used_at", time.Now()).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("id = ?", token.UserID).First(user).Error
+	if err != nil {
+		return err
+	}
+	if !user.HasRecoveryKey {
+		err = tx.Unscoped().
+			Where("user_id = ?", user.ID).
+			Where("kind = ?", WrappedWithPassword).
+			Delete(WrappedKey{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return updateCredentials(tx, user.ID, credentials)
+}
+
+func PurgePasswordResetTokens() error {
+	return GetDB().Unscoped().Where("expires < ?", time.Now()).Delete(PasswordResetToken{}).Error
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"time"
+)
+
+// One-time code replacing the second factor when the user lost their device. Only its sha256 hash is stored.
+type RecoveryCode struct {
+	BaseModel
+	UserID		uint `json:"-" gorm:"index"`
+	CodeHash	string `json:"-" validate:"len=64,hexadecimal" gorm:"type:varchar(64);unique_index"`
+	UsedAt		*time.Time `json:"-"`
+}
+
+func (c RecoveryCode) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&c)
+}
+
+func (c *RecoveryCode) Update() error {
+	return GetDB().Save(&c).Error
+}
+
+func (c *RecoveryCode) Create() error {
+	return GetDB().Create(&c).Error
+}
+
+func (c *RecoveryCode) Delete() error {
+	return GetDB().Delete(&c).Error
+}
+
+// Previous codes, used or not, stop working
+func ReplaceRecoveryCodes(userID uint, hashes []string) error {
+	tx := GetDB().Begin()
+	err := tx.Unscoped().Where("user_id = ?", userID).Delete(RecoveryCode{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, hash := range hashes {
+		code := RecoveryCode{UserID: userID, CodeHash: hash}
+		err = code.Validate()
+		if err == nil {
+			err = tx.Create(&code).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+/*
+	Marks the code as used.
+	Returns false if the code does not exist or was already used, concurrent requests cannot both succeed.
+*/
+func ConsumeRecoveryCode(userID uint, hash string) (bool, error) {
+	result := GetDB().Model(&RecoveryCode{}).
+		Where("user_id = ?", userID).
+		Where("code_hash = ?", hash).
+		Where("used_at IS NULL").
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func CountRemainingRecoveryCodes(userID uint) (int, error) {
+	var count int
+	err := GetDB().Model(&RecoveryCode{}).
+		Where("user_id = ?", userID).
+		Where("used_at IS NULL").
+		Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+)
+
+/*
+	The recovery key is a high entropy phrase kept offline by the user. Clients derive two values from it: a key
+	wrapping the data key, never sent, and a secret proving possession of the phrase, of which only the hash is stored.
+*/
+
+var ErrLegacyData = errors.New("data still encrypted with the key derived from the password")
+
+/*
+	Stores the recovery wrapping of the data key and the hash of the recovery secret, replacing any previous ones.
+	Refused with ErrLegacyData while entries or avatars are still encrypted with the key derived from the password,
+	as they could not be recovered.
+*/
+func SetRecoveryKey(userID uint, secretHash []byte, key WrappedKey) error {
+	key.UserID = userID
+	key.Kind = WrappedWithRecoveryKey
+	err := key.Validate()
+	if err != nil {
+		return err
+	}
+	tx := GetDB().Begin()
+	err = setRecoveryKey(tx, secretHash, key)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func setRecoveryKey(tx *gorm.DB, secretHash []byte, key WrappedKey) error {
+	var entries, avatars int
+	err := tx.Model(&Entry{}).Where("user_id = ?", key.UserID).Where("key_version = ?", 0).Count(&entries).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(&Label{}).
+		Where("user_id = ?", key.UserID).
+		Where("has_avatar = ?", true).
+		Where("key_version = ?", 0).
+		Count(&avatars).Error
+	if err != nil {
+		return err
+	}
+	if entries + avatars > 0 {
+		return ErrLegacyData
+	}
+
+	err = saveWrappedKey(tx, key)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&User{}).Where("id = ?", key.UserID).Updates(map[string]interface{}{
+		"recovery_key_hash": secretHash,
+		"has_recovery_key":  true,
+	}).Error
+}
+
+/*
+	Replaces the credentials of a user who lost them, provided secretHash still matches their recovery key.
+	credentials.WrappedKey is the data key wrapped with the new password. The recovery key itself stays valid.
+	Returns ErrDataChanged if the recovery key was replaced in between.
+*/
+func RecoverAccount(userID uint, secretHash []byte, credentials Credentials) error {
+	if credentials.WrappedKey == nil {
+		return ErrDataChanged
+	}
+	tx := GetDB().Begin()
+	err := recoverAccount(tx, userID, secretHash, credentials)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func recoverAccount(tx *gorm.DB, userID uint, secretHash []byte, credentials Credentials) error {
+	var count int
+	err := tx.Model(&User{}).
+		Where("id = ?", userID).
+		Where("has_recovery_key = ?", true).
+		Where("recovery_key_hash = ?", secretHash).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return ErrDataChanged
+	}
+	return replaceCredentials(tx, userID, credentials)
+}
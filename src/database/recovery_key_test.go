@@ -0,0 +1,40 @@
+package database
+
+import (
+	"bytes"
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRecoverAccount(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(WrappedKey{})
+	GetDB().Unscoped().Delete(User{})
+	user := User{Email: "recovery@keys.com", Password: "toto"}
+	assert.Nil(Insert(&user))
+
+	hash := bytes.Repeat([]byte{1}, 32)
+	recovery := WrappedKey{KeyVersion: 1, Wrapped: bytes.Repeat([]byte{2}, 32)}
+
+	// The data key must exist first
+	assert.Equal(ErrKeyVersionMismatch, SetRecoveryKey(user.ID, hash, recovery))
+	assert.Nil(SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithPassword, KeyVersion: 1, Wrapped: bytes.Repeat([]byte{3}, 32)}))
+
+	legacy := Entry{PartialEntry: PartialEntry{Title: "Title", Content: "legacy"}, UserID: user.ID}
+	assert.Nil(Insert(&legacy))
+	assert.Equal(ErrLegacyData, SetRecoveryKey(user.ID, hash, recovery))
+	GetDB().Model(&legacy).Update("key_version", 1)
+	assert.Nil(SetRecoveryKey(user.ID, hash, recovery))
+
+	credentials := Credentials{Password: "new hash", WrappedKey: bytes.Repeat([]byte{4}, 32)}
+	assert.Equal(ErrDataChanged, RecoverAccount(user.ID, bytes.Repeat([]byte{9}, 32), credentials))
+	assert.Equal(ErrDataChanged, RecoverAccount(user.ID, hash, Credentials{Password: "new hash"}))
+	assert.Nil(RecoverAccount(user.ID, hash, credentials))
+
+	GetDB().Where("id = ?", user.ID).First(&user)
+	assert.Equal("new hash", user.Password)
+	assert.True(user.HasRecoveryKey)
+	keys, _ := GetWrappedKeys(user.ID)
+	assert.Equal(credentials.WrappedKey, keys[0].Wrapped)
+	assert.Equal(recovery.Wrapped, keys[1].Wrapped)
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"time"
+)
+
+/*
+	Opaque token exchanged for a new access token. Only its sha256 hash is stored.
+
+	Every token issued from the same login shares a Family, so that reusing an already exchanged token
+	(which means it leaked) revokes the whole session.
+*/
+type RefreshToken struct {
+	BaseModel
+	TokenHash		string `json:"-" validate:"len=64,hexadecimal" gorm:"type:varchar(64);unique_index"`
+	Family			string `json:"-" validate:"uuid4" gorm:"type:varchar(36);index"`
+	UserID			uint `json:"-"`
+	// How the user authenticated when the session started, e.g. with or without a second factor
+	AuthLevel		string `json:"-" validate:"required" gorm:"type:varchar(20)"`
+	// Duration of the access tokens issued with this token, in nanoseconds
+	SessionDuration	time.Duration `json:"-"`
+	Expires			time.Time `json:"-"`
+	// Absolute ceiling of the session, never extended by a refresh
+	SessionExpires	time.Time `json:"-"`
+	UsedAt			*time.Time `json:"-"`
+	Revoked			bool `json:"-"`
+}
+
+func (t RefreshToken) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&t)
+}
+
+func (t *RefreshToken) Update() error {
+	return GetDB().Save(&t).Error
+}
+
+func (t *RefreshToken) Create() error {
+	return GetDB().Create(&t).Error
+}
+
+func (t *RefreshToken) Delete() error {
+	return GetDB().Delete(&t).Error
+}
+
+/*
+	Marks the token as exchanged.
+	Returns false if it already was, which happens when two requests race or when a stolen token is replayed.
+*/
+func (t *RefreshToken) MarkUsed() (bool, error) {
+	now := time.Now()
+	result := GetDB().Model(&RefreshToken{}).
+		Where("id = ?", t.ID).
+		Where("used_at IS NULL").
+		Update("used_at", now)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	t.UsedAt = &now
+	return true, nil
+}
+
+func RevokeRefreshTokenFamily(family string) error {
+	return GetDB().Model(&RefreshToken{}).
+		Where("family = ?", family).
+		Update("revoked", true).Error
+}
+
+func RevokeUserRefreshTokens(userID uint) error {
+	return GetDB().Model(&RefreshToken{}).
+		Where("user_id = ?", userID).
+		Update("revoked", true).Error
+}
+
+// Deletes the tokens of sessions that reached their ceiling, they cannot be used anymore
+func PurgeRefreshTokens() error {
+	return GetDB().Unscoped().Where("session_expires < ?", time.Now()).Delete(RefreshToken{}).Error
+}
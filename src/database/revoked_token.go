@@ -0,0 +1,56 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"time"
+)
+
+/*
+	An access token that must be refused even though its signature and expiration are valid.
+
+	When Jti is empty, every token of the user issued before IssuedBefore is revoked. Tokens only carry their issue
+	time in whole seconds, IssuedBefore is truncated the same way so that a token issued right after the revocation,
+	in the same second, is still accepted.
+	Rows are useless once Expires is reached, as the tokens they target are expired too.
+*/
+type RevokedToken struct {
+	BaseModel
+	Jti				string `validate:"omitempty,uuid4" gorm:"type:varchar(36);index"`
+	UserID			uint `gorm:"index"`
+	IssuedBefore	time.Time
+	Expires			time.Time `gorm:"index"`
+}
+
+func (t RevokedToken) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&t)
+}
+
+func (t *RevokedToken) Update() error {
+	return GetDB().Save(&t).Error
+}
+
+func (t *RevokedToken) Create() error {
+	return GetDB().Create(&t).Error
+}
+
+func (t *RevokedToken) Delete() error {
+	return GetDB().Delete(&t).Error
+}
+
+func IsTokenRevoked(jti string, userID uint, issuedAt time.Time) (bool, error) {
+	var count int
+	query := GetDB().Model(&RevokedToken{}).Where("expires > ?", time.Now())
+	// An empty jti would match every user-wide revocation
+	if jti == "" {
+		query = query.Where("jti = '' AND user_id = ? AND issued_before > ?", userID, issuedAt)
+	} else {
+		query = query.Where("jti = ? OR (jti = '' AND user_id = ? AND issued_before > ?)", jti, userID, issuedAt)
+	}
+	err := query.Count(&count).Error
+	return count > 0, err
+}
+
+func PurgeRevokedTokens() error {
+	return GetDB().Unscoped().Where("expires < ?", time.Now()).Delete(RevokedToken{}).Error
+}
@@ -11,8 +11,10 @@ import (
 
 type TwoFactorsCookie struct {
 	BaseModel
-	Uuid		string `json:"-" validate:"uuid4" gorm:"type:varchar(36)"`
-	IpAddr		string `json:"ip_addr" validate:"ipv4" gorm:"type:varchar(12)"`
+	// Random token, UUIDs for cookies created before
+	Uuid		string `json:"-" validate:"required,max=36" gorm:"type:varchar(36)"`
+	// IPv4 or IPv6, as given by context.RealIP()
+	IpAddr		string `json:"ip_addr" validate:"omitempty,ip" gorm:"type:varchar(45)"`
 	UserAgent	string `json:"user_agent" validate:"max=200" gorm:"type:varchar(200)"`
 	Expires		time.Time `json:"expires"`
 	LastUsed	time.Time `json:"last_used"`
@@ -33,6 +35,31 @@ func (t *TwoFactorsCookie) Create() error {
 	return GetDB().Create(&t).Error
 }
 
+// Unscoped, a revoked device has nothing worth keeping
 func (t *TwoFactorsCookie) Delete() error {
-	return GetDB().Delete(&t).Error
+	return GetDB().Unscoped().Delete(&t).Error
+}
+
+func (t TwoFactorsCookie) IsExpired() bool {
+	return !time.Now().Before(t.Expires)
+}
+
+// The trusted devices of the user, most recently used first
+func GetTwoFactorsCookies(userID uint) ([]TwoFactorsCookie, error) {
+	var cookies []TwoFactorsCookie
+	err := GetDB().
+		Where("user_id = ?", userID).
+		Where("expires > ?", time.Now()).
+		Order("last_used desc").
+		Find(&cookies).Error
+	return cookies, err
+}
+
+func DeleteUserTwoFactorsCookies(userID uint) error {
+	return GetDB().Unscoped().Where("user_id = ?", userID).Delete(TwoFactorsCookie{}).Error
+}
+
+// Expired cookies are refused at login, their rows can be deleted
+func PurgeTwoFactorsCookies() error {
+	return GetDB().Unscoped().Where("expires < ?", time.Now()).Delete(TwoFactorsCookie{}).Error
 }
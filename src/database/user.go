@@ -1,14 +1,26 @@
 package database
 
 import (
+	"fmt"
+	"github.com/Yuruh/encrypted-diary/src/envelope"
 	"github.com/go-playground/validator/v10"
+	"strconv"
+	"time"
 )
 
 type User struct {
 	BaseModel
 	Email       string  `gorm:"type:varchar(100);unique_index" json:"email" validate:"email,required"`
+	// Set once the user opened the link emailed at registration, nil until then
+	EmailVerifiedAt	*time.Time `json:"email_verified_at"`
+	// bcrypt hash, empty once the user switched to SRP
 	Password	string  `gorm:"not null" json:"-"`
 
+	// Zero-knowledge login (SRP-6a), the server only knows a verifier derived from the password
+	UsesSRP		bool	`json:"uses_srp" gorm:"not null;default:false"`
+	SRPSalt		[]byte	`json:"-"`
+	SRPVerifier	[]byte	`json:"-"`
+
 	// todo find out if i can remove this
 	Entries		[]Entry	`json:"-"`
 	Labels		[]Label `json:"-"`
@@ -17,9 +29,208 @@ type User struct {
 	TwoFactorsCookies []TwoFactorsCookie `json:"two_factors_cookies"`
 
 
-	// Stored encrypted
+	// Stored encrypted, use SetOTPSecret and GetOTPSecret
 	OTPSecret	string 	`json:"-"`
 	HasRegisteredOTP bool `json:"has_registered_otp"`
+	// Secret being enrolled, it only replaces OTPSecret once a code generated with it is confirmed
+	PendingOTPSecret string `json:"-"`
+	// Time step of the last code accepted, codes up to this one cannot be used again
+	LastOTPTimeStep int64 `json:"-" gorm:"not null;default:0"`
+
+	/*
+		Version of the random key entries are encrypted with, 0 if the user has none and entries are encrypted with
+		the key derived from the password. The key itself is only stored wrapped, see WrappedKey.
+	*/
+	DataKeyVersion int `json:"data_key_version" gorm:"not null;default:0"`
+
+	// SHA-256 of the secret proving possession of the recovery key, see SetRecoveryKey
+	RecoveryKeyHash []byte `json:"-"`
+	HasRecoveryKey bool `json:"has_recovery_key" gorm:"not null;default:false"`
+
+	// The account and all its data are purged at this time, unless the user cancels, see ScheduleAccountDeletion
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at"`
+
+	// At least one security key is registered
+	HasRegisteredWebAuthn bool `json:"has_registered_webauthn"`
+}
+
+// Whether a second factor is required to log in
+func (user User) HasTwoFactors() bool {
+	return user.HasRegisteredOTP || user.HasRegisteredWebAuthn
+}
+
+// Binds the encrypted secret to its user and column, it cannot be copied to another account or promoted in database
+func (user User) secretAdditionalData(column string) []byte {
+	return []byte(column + ":" + strconv.Itoa(int(user.ID)))
+}
+
+const (
+	otpSecretData = "otp-secret"
+	pendingOTPSecretData = "pending-otp-secret"
+)
+
+func (user *User) SetOTPSecret(secret string, e *envelope.Envelope) error {
+	encrypted, err := e.Encrypt([]byte(secret), user.secretAdditionalData(otpSecretData))
+	if err != nil {
+		return fmt.Errorf("could not encrypt otp secret: %v", err)
+	}
+	return GetDB().Model(user).Update("OTPSecret", encrypted).Error
+}
+
+// Secrets saved before encryption are returned as is, until cmd/encrypt-otp-secrets is run
+func (user User) GetOTPSecret(e *envelope.Envelope) (string, error) {
+	secret, err := e.Decrypt(user.OTPSecret, user.secretAdditionalData(otpSecretData))
+	if err == envelope.ErrNotEncrypted {
+		return user.OTPSecret, nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not decrypt otp secret: %v", err)
+	}
+	return string(secret), nil
+}
+
+// Saves a secret waiting to be confirmed, the active one is left untouched
+func (user *User) SetPendingOTPSecret(secret string, e *envelope.Envelope) error {
+	encrypted, err := e.Encrypt([]byte(secret), user.secretAdditionalData(pendingOTPSecretData))
+	if err != nil {
+		return fmt.Errorf("could not encrypt otp secret: %v", err)
+	}
+	return GetDB().Model(user).Update("PendingOTPSecret", encrypted).Error
+}
+
+// Empty if no enrolment is pending
+func (user User) GetPendingOTPSecret(e *envelope.Envelope) (string, error) {
+	if user.PendingOTPSecret == "" {
+		return "", nil
+	}
+	secret, err := e.Decrypt(user.PendingOTPSecret, user.secretAdditionalData(pendingOTPSecretData))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt pending otp secret: %v", err)
+	}
+	return string(secret), nil
+}
+
+/*
+	The pending secret replaces the active one, and OTP is enabled if it was not. step is the time step of the code
+	that confirmed it, it cannot be used again.
+	Returns false if the pending secret changed meanwhile, e.g. confirmed by a concurrent request.
+*/
+func (user *User) ConfirmPendingOTPSecret(e *envelope.Envelope, step int64) (bool, error) {
+	secret, err := user.GetPendingOTPSecret(e)
+	if err != nil {
+		return false, err
+	}
+	if secret == "" {
+		return false, nil
+	}
+	encrypted, err := e.Encrypt([]byte(secret), user.secretAdditionalData(otpSecretData))
+	if err != nil {
+		return false, fmt.Errorf("could not encrypt otp secret: %v", err)
+	}
+	result := GetDB().Model(&User{}).
+		Where("id = ? AND pending_otp_secret = ?", user.ID, user.PendingOTPSecret).
+		Updates(map[string]interface{}{
+			"otp_secret":         encrypted,
+			"pending_otp_secret": "",
+			"has_registered_otp": true,
+			"last_otp_time_step": step,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+/*
+	Remembers the time step of an accepted code of the active secret.
+	Returns false if this step or a later one was already used, e.g. by a concurrent request with the same code.
+*/
+func (user *User) ConsumeOTPTimeStep(step int64) (bool, error) {
+	result := GetDB().Model(&User{}).
+		Where("id = ? AND last_otp_time_step < ?", user.ID, step).
+		Update("last_otp_time_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		user.LastOTPTimeStep = step
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Forgets both the active and the pending secret
+func (user *User) DisableOTP() error {
+	return GetDB().Model(user).Updates(map[string]interface{}{
+		"otp_secret":         "",
+		"pending_otp_secret": "",
+		"has_registered_otp": false,
+	}).Error
+}
+
+// Replaces the bcrypt hash by an SRP verifier, the password cannot be checked server side anymore
+func (user *User) EnableSRP(salt []byte, verifier []byte) error {
+	tx := GetDB().Begin()
+	err := tx.Model(user).Updates(map[string]interface{}{
+		"password":     "",
+		"uses_srp":     true,
+		"srp_salt":     salt,
+		"srp_verifier": verifier,
+	}).Error
+	if err == nil {
+		err = cancelEmailChanges(tx, user.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Whether MigrateOTPSecret would update the user
+func (user User) NeedsOTPSecretMigration(e *envelope.Envelope) bool {
+	for _, value := range []string{user.OTPSecret, user.PendingOTPSecret} {
+		if (value != "" && !envelope.IsEncrypted(value)) || e.NeedsRewrap(value) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Encrypts plaintext secrets, or rewraps the active and pending secrets with the newest master key.
+	Returns whether the user was updated.
+*/
+func (user *User) MigrateOTPSecret(e *envelope.Envelope) (bool, error) {
+	updated := false
+	if user.OTPSecret != "" && !envelope.IsEncrypted(user.OTPSecret) {
+		err := user.SetOTPSecret(user.OTPSecret, e)
+		if err != nil {
+			return false, err
+		}
+		updated = true
+	}
+	if user.PendingOTPSecret != "" && !envelope.IsEncrypted(user.PendingOTPSecret) {
+		err := user.SetPendingOTPSecret(user.PendingOTPSecret, e)
+		if err != nil {
+			return updated, err
+		}
+		updated = true
+	}
+	columns := map[string]*string{"OTPSecret": &user.OTPSecret, "PendingOTPSecret": &user.PendingOTPSecret}
+	for column, value := range columns {
+		if !e.NeedsRewrap(*value) {
+			continue
+		}
+		rewrapped, err := e.Rewrap(*value)
+		if err != nil {
+			return updated, err
+		}
+		err = GetDB().Model(user).Update(column, rewrapped).Error
+		if err != nil {
+			return updated, err
+		}
+		updated = true
+	}
+	return updated, nil
 }
 
 func (user *User) Create() error {
@@ -1,8 +1,11 @@
 package database
 
 import (
+	"bytes"
+	"github.com/Yuruh/encrypted-diary/src/envelope"
 	"github.com/go-playground/validator/v10"
 	asserthelper "github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 )
 
@@ -84,4 +87,119 @@ func TestUser_Delete(t *testing.T) {
 	var foundUser User
 	result := GetDB().Where("id = ?", user.ID).First(&foundUser)
 	assert.Equal(true, result.RecordNotFound())
-}
\ No newline at end of file
+}
+
+func TestUser_OTPSecret(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(User{})
+	oldKey := envelope.MasterKey{ID: "1", Secret: bytes.Repeat([]byte{1}, 32)}
+	e, _ := envelope.New([]envelope.MasterKey{oldKey})
+	user := User{Email: "otp@otp.com", Password: "toto", OTPSecret: "2SH3V3GDW7ZNMGYE"}
+	assert.Nil(user.Create())
+
+	// Saved before encryption
+	secret, err := user.GetOTPSecret(e)
+	assert.Nil(err)
+	assert.Equal("2SH3V3GDW7ZNMGYE", secret)
+
+	assert.Equal(true, user.NeedsOTPSecretMigration(e))
+	updated, err := user.MigrateOTPSecret(e)
+	assert.Nil(err)
+	assert.Equal(true, updated)
+	var found User
+	GetDB().Where("id = ?", user.ID).First(&found)
+	assert.Equal(true, envelope.IsEncrypted(found.OTPSecret))
+	secret, err = found.GetOTPSecret(e)
+	assert.Nil(err)
+	assert.Equal("2SH3V3GDW7ZNMGYE", secret)
+
+	assert.Equal(false, found.NeedsOTPSecretMigration(e))
+	updated, err = found.MigrateOTPSecret(e)
+	assert.Nil(err)
+	assert.Equal(false, updated)
+
+	// Not readable from another account
+	other := User{Email: "other@otp.com", Password: "toto", OTPSecret: found.OTPSecret}
+	assert.Nil(other.Create())
+	_, err = other.GetOTPSecret(e)
+	assert.NotNil(err)
+
+	// Rotation
+	rotated, _ := envelope.New([]envelope.MasterKey{oldKey, {ID: "2", Secret: bytes.Repeat([]byte{2}, 32)}})
+	updated, err = found.MigrateOTPSecret(rotated)
+	assert.Nil(err)
+	assert.Equal(true, updated)
+	GetDB().Where("id = ?", user.ID).First(&found)
+	assert.Equal(false, rotated.NeedsRewrap(found.OTPSecret))
+	secret, err = found.GetOTPSecret(rotated)
+	assert.Nil(err)
+	assert.Equal("2SH3V3GDW7ZNMGYE", secret)
+
+	assert.Nil(user.SetOTPSecret("NEWSECRET", rotated))
+	GetDB().Where("id = ?", user.ID).First(&found)
+	assert.NotContains(found.OTPSecret, "NEWSECRET")
+	secret, _ = found.GetOTPSecret(rotated)
+	assert.Equal("NEWSECRET", secret)
+}
+
+func TestUser_MigratePendingOTPSecret(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(User{})
+	e, _ := envelope.New([]envelope.MasterKey{{ID: "1", Secret: bytes.Repeat([]byte{1}, 32)}})
+	// Enrolment started before encryption, nothing active yet
+	user := User{Email: "otp@otp.com", Password: "toto", PendingOTPSecret: "2SH3V3GDW7ZNMGYE"}
+	assert.Nil(user.Create())
+
+	assert.Equal(true, user.NeedsOTPSecretMigration(e))
+	updated, err := user.MigrateOTPSecret(e)
+	assert.Nil(err)
+	assert.Equal(true, updated)
+	var found User
+	GetDB().Where("id = ?", user.ID).First(&found)
+	assert.Equal(true, envelope.IsEncrypted(found.PendingOTPSecret))
+	assert.Equal("", found.OTPSecret)
+	secret, err := found.GetPendingOTPSecret(e)
+	assert.Nil(err)
+	assert.Equal("2SH3V3GDW7ZNMGYE", secret)
+	assert.Equal(false, found.NeedsOTPSecretMigration(e))
+}
+
+func TestUser_ConsumeOTPTimeStep(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(User{})
+	user := User{Email: "otp@otp.com", Password: "toto"}
+	assert.Nil(user.Create())
+
+	// Concurrent requests with the same code
+	const attempts = 5
+	var wg sync.WaitGroup
+	results := make(chan bool, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			copied := user
+			consumed, err := copied.ConsumeOTPTimeStep(100)
+			assert.Nil(err)
+			results <- consumed
+		}()
+	}
+	wg.Wait()
+	close(results)
+	accepted := 0
+	for consumed := range results {
+		if consumed {
+			accepted++
+		}
+	}
+	assert.Equal(1, accepted)
+
+	// Earlier steps are refused, later ones accepted
+	consumed, err := user.ConsumeOTPTimeStep(99)
+	assert.Nil(err)
+	assert.Equal(false, consumed)
+	consumed, err = user.ConsumeOTPTimeStep(101)
+	assert.Nil(err)
+	assert.Equal(true, consumed)
+	assert.Equal(int64(101), user.LastOTPTimeStep)
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"time"
+)
+
+/*
+	A pending security key registration or authentication, by challenge. Stored so that a ceremony can be finished
+	on any instance, and after a restart. A challenge can only be used once.
+*/
+type WebAuthnCeremony struct {
+	BaseModel
+	Challenge	string `validate:"required,max=64" gorm:"type:varchar(64);unique_index"`
+	Kind		string `validate:"required,max=20" gorm:"type:varchar(20)"`
+	UserID		uint `gorm:"index"`
+	Expires		time.Time `gorm:"index"`
+}
+
+func (c WebAuthnCeremony) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&c)
+}
+
+func (c *WebAuthnCeremony) Update() error {
+	return GetDB().Save(&c).Error
+}
+
+func (c *WebAuthnCeremony) Create() error {
+	return GetDB().Create(&c).Error
+}
+
+func (c *WebAuthnCeremony) Delete() error {
+	return GetDB().Unscoped().Delete(&c).Error
+}
+
+// Deletes the ceremony and returns it. False if unknown, expired, or taken by a concurrent request.
+func TakeWebAuthnCeremony(challenge string) (WebAuthnCeremony, bool, error) {
+	var ceremony WebAuthnCeremony
+	result := GetDB().
+		Where("challenge = ?", challenge).
+		Where("expires > ?", time.Now()).
+		First(&ceremony)
+	if result.RecordNotFound() {
+		return ceremony, false, nil
+	} else if result.Error != nil {
+		return ceremony, false, result.Error
+	}
+	// Only one of concurrent requests deletes it
+	result = GetDB().Unscoped().Where("id = ?", ceremony.ID).Delete(WebAuthnCeremony{})
+	if result.Error != nil {
+		return ceremony, false, result.Error
+	}
+	return ceremony, result.RowsAffected == 1, nil
+}
+
+func PurgeWebAuthnCeremonies() error {
+	return GetDB().Unscoped().Where("expires < ?", time.Now()).Delete(WebAuthnCeremony{}).Error
+}
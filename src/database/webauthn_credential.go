@@ -0,0 +1,64 @@
+package database
+
+import (
+	"github.com/go-playground/validator/v10"
+	"time"
+)
+
+// A security key registered as a second factor. A user can register several.
+type WebAuthnCredential struct {
+	BaseModel
+	UserID			uint `json:"-" gorm:"index"`
+	// base64url encoded, as sent by clients
+	CredentialID	string `json:"credential_id" validate:"required,max=1400" gorm:"type:varchar(1400);unique_index"`
+	// COSE_Key encoded
+	PublicKey		[]byte `json:"-" validate:"required"`
+	SignCount		uint32 `json:"-"`
+	Name			string `json:"name" validate:"max=100" gorm:"type:varchar(100)"`
+	LastUsed		*time.Time `json:"last_used"`
+}
+
+func (c WebAuthnCredential) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&c)
+}
+
+func (c *WebAuthnCredential) Update() error {
+	return GetDB().Save(&c).Error
+}
+
+func (c *WebAuthnCredential) Create() error {
+	return GetDB().Create(&c).Error
+}
+
+// Unscoped, so that the same key can be registered again
+func (c *WebAuthnCredential) Delete() error {
+	return GetDB().Unscoped().Delete(&c).Error
+}
+
+func GetWebAuthnCredentials(userID uint) ([]WebAuthnCredential, error) {
+	var credentials []WebAuthnCredential
+	err := GetDB().Where("user_id = ?", userID).Order("created_at").Find(&credentials).Error
+	return credentials, err
+}
+
+/*
+	Stores the counter of the last signature. Fails if another request stored a greater one in between,
+	which means the same signature was used twice or the key has been cloned.
+*/
+func (c *WebAuthnCredential) MarkUsed(signCount uint32) (bool, error) {
+	now := time.Now()
+	result := GetDB().Model(&WebAuthnCredential{}).
+		Where("id = ?", c.ID).
+		Where("sign_count = ?", c.SignCount).
+		Updates(map[string]interface{}{"sign_count": signCount, "last_used": now})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	c.SignCount = signCount
+	c.LastUsed = &now
+	return true, nil
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	WrappedWithPassword = "password"
+	WrappedWithRecoveryKey = "recovery"
+)
+
+/*
+	The data key of a user, encrypted by the client with a key the server does not know, e.g. derived from
+	the password. The same data key can be wrapped several ways, one per kind, so that any of them gives access
+	to the data.
+*/
+type WrappedKey struct {
+	BaseModel
+	UserID		uint `json:"-" gorm:"unique_index:idx_wrapped_keys_user_kind"`
+	Kind		string `json:"kind" validate:"oneof=password recovery" gorm:"type:varchar(20);unique_index:idx_wrapped_keys_user_kind"`
+	// Version of the data key, see User.DataKeyVersion
+	KeyVersion	int `json:"key_version" validate:"min=1"`
+	Wrapped		[]byte `json:"wrapped" validate:"min=16,max=1024"`
+}
+
+var ErrKeyVersionMismatch = errors.New("key version mismatch")
+
+func (k WrappedKey) Validate() error {
+	validate = validator.New()
+	return validate.Struct(&k)
+}
+
+func (k *WrappedKey) Update() error {
+	return GetDB().Save(&k).Error
+}
+
+func (k *WrappedKey) Create() error {
+	return GetDB().Create(&k).Error
+}
+
+func (k *WrappedKey) Delete() error {
+	return GetDB().Unscoped().Delete(&k).Error
+}
+
+func GetWrappedKeys(userID uint) ([]WrappedKey, error) {
+	var keys []WrappedKey
+	err := GetDB().Where("user_id = ?", userID).Order("kind").Find(&keys).Error
+	return keys, err
+}
+
+/*
+	Saves a wrapping of the current data key of the user, replacing the previous one of the same kind.
+	A user without password wrapping, because they have no data key yet or lost it in a password reset, creates a new
+	one by saving its password wrapping with the next version. Returns ErrKeyVersionMismatch for any other version.
+*/
+func SaveWrappedKey(userID uint, key WrappedKey) error {
+	key.UserID = userID
+	err := key.Validate()
+	if err != nil {
+		return err
+	}
+	tx := GetDB().Begin()
+	err = saveWrappedKey(tx, key)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func saveWrappedKey(tx *gorm.DB, key WrappedKey) error {
+	var user User
+	err := tx.Select("data_key_version").Where("id = ?", key.UserID).First(&user).Error
+	if err != nil {
+		return err
+	}
+	var wrappings int
+	err = tx.Model(&WrappedKey{}).
+		Where("user_id = ?", key.UserID).
+		Where("kind = ?", WrappedWithPassword).
+		Count(&wrappings).Error
+	if err != nil {
+		return err
+	}
+	if wrappings == 0 && key.KeyVersion == user.DataKeyVersion + 1 && key.Kind == WrappedWithPassword {
+		// Conditional, two clients cannot both create a data key
+		result := tx.Model(&User{}).
+			Where("id = ?", key.UserID).
+			Where("data_key_version = ?", user.DataKeyVersion).
+			Update("data_key_version", key.KeyVersion)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrKeyVersionMismatch
+		}
+	} else if key.KeyVersion != user.DataKeyVersion {
+		return ErrKeyVersionMismatch
+	}
+
+	err = tx.Unscoped().Where("user_id = ?", key.UserID).Where("kind = ?", key.Kind).Delete(WrappedKey{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&key).Error
+}
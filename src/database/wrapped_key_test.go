@@ -0,0 +1,42 @@
+package database
+
+import (
+	"bytes"
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSaveWrappedKey(t *testing.T) {
+	assert := asserthelper.New(t)
+	GetDB().Unscoped().Delete(WrappedKey{})
+	GetDB().Unscoped().Delete(User{})
+	user := User{Email: "keys@keys.com", Password: "toto"}
+	assert.Nil(Insert(&user))
+
+	wrapped := bytes.Repeat([]byte{1}, 32)
+
+	// Only the password wrapping of version 1 creates the data key
+	assert.Equal(ErrKeyVersionMismatch, SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithRecoveryKey, KeyVersion: 1, Wrapped: wrapped}))
+	assert.Equal(ErrKeyVersionMismatch, SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithPassword, KeyVersion: 2, Wrapped: wrapped}))
+	assert.NotNil(SaveWrappedKey(user.ID, WrappedKey{Kind: "other", KeyVersion: 1, Wrapped: wrapped}))
+	assert.NotNil(SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithPassword, KeyVersion: 1, Wrapped: []byte("short")}))
+
+	assert.Nil(SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithPassword, KeyVersion: 1, Wrapped: wrapped}))
+	GetDB().Where("id = ?", user.ID).First(&user)
+	assert.Equal(1, user.DataKeyVersion)
+
+	// Re-wrapping replaces the previous wrapping of the same kind
+	assert.Nil(SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithRecoveryKey, KeyVersion: 1, Wrapped: wrapped}))
+	rewrapped := bytes.Repeat([]byte{2}, 32)
+	assert.Nil(SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithPassword, KeyVersion: 1, Wrapped: rewrapped}))
+	assert.Equal(ErrKeyVersionMismatch, SaveWrappedKey(user.ID, WrappedKey{Kind: WrappedWithPassword, KeyVersion: 2, Wrapped: wrapped}))
+
+	keys, err := GetWrappedKeys(user.ID)
+	assert.Nil(err)
+	assert.Equal(2, len(keys))
+	assert.Equal(WrappedWithPassword, keys[0].Kind)
+	assert.Equal(rewrapped, keys[0].Wrapped)
+	assert.Equal(WrappedWithRecoveryKey, keys[1].Kind)
+	GetDB().Where("id = ?", user.ID).First(&user)
+	assert.Equal(1, user.DataKeyVersion)
+}
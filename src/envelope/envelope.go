@@ -0,0 +1,259 @@
+/*
+	Envelope encryption of secrets stored in database, such as OTP secrets.
+
+	Each value is encrypted with its own random data key (AES-256-GCM), and the data key is encrypted ("wrapped")
+	with a master key from the server configuration. A database dump is useless without the master key.
+
+	Master keys are versioned: the newest one wraps, every one unwraps, so that values encrypted before a rotation
+	stay readable until they are rewrapped with the new key.
+*/
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of encrypted values, followed by the master key ID, the wrapped data key and the encrypted value
+const prefix = "env1"
+
+const keySize = 32
+
+var ErrNotEncrypted = errors.New("value is not encrypted")
+
+type MasterKey struct {
+	ID     string
+	Secret []byte
+}
+
+type Envelope struct {
+	// Oldest first, the last one wraps
+	keys []MasterKey
+}
+
+func New(keys []MasterKey) (*Envelope, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no master key")
+	}
+	for _, key := range keys {
+		if len(key.Secret) != keySize {
+			return nil, fmt.Errorf("master key %v must be %v bytes long", key.ID, keySize)
+		}
+		if key.ID == "" || strings.Contains(key.ID, ":") {
+			return nil, errors.New("master key IDs must be non empty and cannot contain ':'")
+		}
+	}
+	return &Envelope{keys: keys}, nil
+}
+
+/*
+	Reads keys from a list of id:secret separated by commas, oldest first.
+	Secrets are 32 bytes, base64 encoded, e.g. generated with `openssl rand -base64 32`.
+*/
+func ParseList(list string) ([]MasterKey, error) {
+	var keys []MasterKey
+	for i, elem := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(elem), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad master key format at position %v, expected id:secret", i)
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("master key %v is not base64 encoded: %v", parts[0], err)
+		}
+		keys = append(keys, MasterKey{ID: parts[0], Secret: secret})
+	}
+	return keys, nil
+}
+
+func FromEnv(name string) (*Envelope, error) {
+	list := os.Getenv(name)
+	if list == "" {
+		return nil, fmt.Errorf("env variable %v missing", name)
+	}
+	keys, err := ParseList(list)
+	if err != nil {
+		return nil, err
+	}
+	return New(keys)
+}
+
+func (e *Envelope) current() MasterKey {
+	return e.keys[len(e.keys)-1]
+}
+
+func (e *Envelope) find(id string) (MasterKey, bool) {
+	for _, key := range e.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return MasterKey{}, false
+}
+
+// Nonce followed by the ciphertext
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+func wrap(masterKey MasterKey, dataKey []byte) ([]byte, error) {
+	// Binding the key ID prevents passing off a data key as wrapped by another master key
+	return seal(masterKey.Secret, dataKey, []byte(masterKey.ID))
+}
+
+/*
+	additionalData is not encrypted but must be given again to decrypt, e.g. the ID of the row the value
+	belongs to, so that an encrypted value copied to another row cannot be decrypted.
+*/
+func (e *Envelope) Encrypt(plaintext []byte, additionalData []byte) (string, error) {
+	dataKey := make([]byte, keySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, plaintext, additionalData)
+	if err != nil {
+		return "", err
+	}
+	masterKey := e.current()
+	wrapped, err := wrap(masterKey, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return format(masterKey.ID, wrapped, sealed), nil
+}
+
+func format(keyID string, wrapped []byte, sealed []byte) string {
+	return strings.Join([]string{
+		prefix,
+		keyID,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(sealed),
+	}, ":")
+}
+
+type parsedValue struct {
+	keyID   string
+	wrapped []byte
+	sealed  []byte
+}
+
+func parse(value string) (parsedValue, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 || parts[0] != prefix {
+		return parsedValue{}, ErrNotEncrypted
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return parsedValue{}, fmt.Errorf("bad wrapped key encoding: %v", err)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return parsedValue{}, fmt.Errorf("bad ciphertext encoding: %v", err)
+	}
+	return parsedValue{parts[1], wrapped, sealed}, nil
+}
+
+func (e *Envelope) unwrap(parsed parsedValue) ([]byte, error) {
+	masterKey, found := e.find(parsed.keyID)
+	if !found {
+		return nil, fmt.Errorf("unknown master key %v", parsed.keyID)
+	}
+	dataKey, err := open(masterKey.Secret, parsed.wrapped, []byte(masterKey.ID))
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key: %v", err)
+	}
+	return dataKey, nil
+}
+
+// Returns ErrNotEncrypted if the value was not produced by Encrypt
+func (e *Envelope) Decrypt(value string, additionalData []byte) ([]byte, error) {
+	parsed, err := parse(value)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := e.unwrap(parsed)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(dataKey, parsed.sealed, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt value: %v", err)
+	}
+	return plaintext, nil
+}
+
+func IsEncrypted(value string) bool {
+	_, err := parse(value)
+	return err == nil
+}
+
+// Whether the value is wrapped with an older master key
+func (e *Envelope) NeedsRewrap(value string) bool {
+	parsed, err := parse(value)
+	return err == nil && parsed.keyID != e.current().ID
+}
+
+// Wraps the data key of the value with the newest master key. The value itself is not decrypted.
+func (e *Envelope) Rewrap(value string) (string, error) {
+	parsed, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := e.unwrap(parsed)
+	if err != nil {
+		return "", err
+	}
+	masterKey := e.current()
+	wrapped, err := wrap(masterKey, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return format(masterKey.ID, wrapped, parsed.sealed), nil
+}
+
+/*
+	Derives a secret for another purpose from the newest master key, e.g. to compute values that must be stable
+	but unpredictable. Derived secrets change when the master key is rotated.
+*/
+func (e *Envelope) DeriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, e.current().Secret)
+	mac.Write([]byte("derive:" + purpose))
+	return mac.Sum(nil)
+}
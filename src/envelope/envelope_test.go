@@ -0,0 +1,101 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	asserthelper "github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+)
+
+func key(id string, b byte) MasterKey {
+	return MasterKey{ID: id, Secret: bytes.Repeat([]byte{b}, keySize)}
+}
+
+func TestEnvelope_EncryptDecrypt(t *testing.T) {
+	assert := asserthelper.New(t)
+	e, err := New([]MasterKey{key("1", 1)})
+	assert.Nil(err)
+
+	value, err := e.Encrypt([]byte("2SH3V3GDW7ZNMGYE"), []byte("user:42"))
+	assert.Nil(err)
+	assert.Equal(true, IsEncrypted(value))
+	assert.Equal(false, strings.Contains(value, "2SH3V3GDW7ZNMGYE"))
+
+	plaintext, err := e.Decrypt(value, []byte("user:42"))
+	assert.Nil(err)
+	assert.Equal("2SH3V3GDW7ZNMGYE", string(plaintext))
+
+	// Values are bound to their additional data
+	_, err = e.Decrypt(value, []byte("user:43"))
+	assert.NotNil(err)
+
+	// Each encryption uses a new data key
+	other, _ := e.Encrypt([]byte("2SH3V3GDW7ZNMGYE"), []byte("user:42"))
+	assert.NotEqual(value, other)
+
+	// Without the master key
+	e2, _ := New([]MasterKey{key("1", 2)})
+	_, err = e2.Decrypt(value, []byte("user:42"))
+	assert.NotNil(err)
+
+	_, err = e.Decrypt("2SH3V3GDW7ZNMGYE", nil)
+	assert.Equal(ErrNotEncrypted, err)
+	assert.Equal(false, IsEncrypted("2SH3V3GDW7ZNMGYE"))
+}
+
+func TestEnvelope_Rotation(t *testing.T) {
+	assert := asserthelper.New(t)
+	old, _ := New([]MasterKey{key("1", 1)})
+	value, _ := old.Encrypt([]byte("secret"), nil)
+
+	rotated, _ := New([]MasterKey{key("1", 1), key("2", 2)})
+	assert.Equal(true, rotated.NeedsRewrap(value))
+	plaintext, err := rotated.Decrypt(value, nil)
+	assert.Nil(err)
+	assert.Equal("secret", string(plaintext))
+
+	rewrapped, err := rotated.Rewrap(value)
+	assert.Nil(err)
+	assert.Equal(false, rotated.NeedsRewrap(rewrapped))
+
+	// The old key can be removed once every value has been rewrapped
+	newOnly, _ := New([]MasterKey{key("2", 2)})
+	plaintext, err = newOnly.Decrypt(rewrapped, nil)
+	assert.Nil(err)
+	assert.Equal("secret", string(plaintext))
+	_, err = newOnly.Decrypt(value, nil)
+	assert.NotNil(err)
+}
+
+func TestFromEnv(t *testing.T) {
+	assert := asserthelper.New(t)
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, keySize))
+	os.Setenv("TEST_MASTER_KEYS", "1:" + secret + ", 2:" + secret)
+	defer os.Unsetenv("TEST_MASTER_KEYS")
+
+	e, err := FromEnv("TEST_MASTER_KEYS")
+	assert.Nil(err)
+	assert.Equal("2", e.current().ID)
+
+	_, err = FromEnv("TEST_MASTER_KEYS_NOT_SET")
+	assert.NotNil(err)
+
+	_, err = ParseList("1:" + base64.StdEncoding.EncodeToString([]byte("too short")))
+	assert.Nil(err)
+	_, err = New([]MasterKey{{ID: "1", Secret: []byte("too short")}})
+	assert.NotNil(err)
+}
+
+func TestEnvelope_DeriveKey(t *testing.T) {
+	assert := asserthelper.New(t)
+	e, _ := New([]MasterKey{key("1", 1)})
+
+	assert.Equal(32, len(e.DeriveKey("decoy")))
+	assert.Equal(e.DeriveKey("decoy"), e.DeriveKey("decoy"))
+	assert.NotEqual(e.DeriveKey("decoy"), e.DeriveKey("other"))
+
+	rotated, _ := New([]MasterKey{key("1", 1), key("2", 2)})
+	assert.NotEqual(e.DeriveKey("decoy"), rotated.DeriveKey("decoy"))
+}
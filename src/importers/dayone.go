@@ -0,0 +1,65 @@
+package importers
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The parts of a Day One JSON export we read. Photos and locations are not imported.
+type dayOneExport struct {
+	Entries []struct {
+		UUID			string `json:"uuid"`
+		CreationDate	string `json:"creationDate"`
+		Text			string `json:"text"`
+		Tags			[]string `json:"tags"`
+	} `json:"entries"`
+}
+
+/*
+	Reads a Day One JSON export, either the JSON file of a journal, or the zip Day One exports with a JSON file per
+	journal. Day One entries have no title, it is taken from the first line.
+*/
+func ParseDayOne(content []byte) ([]Record, []RecordError, error) {
+	journals := [][]byte{content}
+	if isZip(content) {
+		archive, err := readZip(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		journals = nil
+		for _, file := range archive.filesWithExtension(".json") {
+			journal, err := archive.read(file)
+			if err != nil {
+				return nil, nil, errors.New(file.Name + ": " + err.Error())
+			}
+			journals = append(journals, journal)
+		}
+		if len(journals) == 0 {
+			return nil, nil, errors.New("no journal in the archive")
+		}
+	}
+
+	records := []Record{}
+	var recordErrors []RecordError
+	for _, journal := range journals {
+		var export dayOneExport
+		if json.Unmarshal(journal, &export) != nil {
+			return nil, nil, errors.New("not a Day One JSON export")
+		}
+		for _, entry := range export.Entries {
+			date, err := time.Parse(time.RFC3339, entry.CreationDate)
+			if err != nil {
+				recordErrors = append(recordErrors, RecordError{Source: entry.UUID, Error: "Bad creation date"})
+				continue
+			}
+			records = append(records, Record{
+				Source:  entry.UUID,
+				Content: entry.Text,
+				Date:    date,
+				Tags:    entry.Tags,
+			})
+		}
+	}
+	return records, recordErrors, nil
+}
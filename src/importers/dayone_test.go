@@ -0,0 +1,34 @@
+package importers
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const dayOneJournal = `{
+	"metadata": {"version": "1.0"},
+	"entries": [
+		{"uuid": "A1", "creationDate": "2019-03-04T05:06:07Z", "text": "# Lisbon\nSunny day", "tags": ["Travel"]},
+		{"uuid": "B2", "creationDate": "yesterday", "text": "Lost"}
+	]
+}`
+
+func TestParseDayOne(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	for _, content := range [][]byte{[]byte(dayOneJournal), zipOf(map[string]string{"Journal.json": dayOneJournal, "photos/a.jpeg": "jpeg"})} {
+		records, recordErrors, err := Parse(DayOne, content)
+		assert.Nil(err)
+		assert.Equal(1, len(records))
+		assert.Equal("A1", records[0].Source)
+		assert.Equal("Lisbon", records[0].Title)
+		assert.Equal("# Lisbon\nSunny day", records[0].Content)
+		assert.True(time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC).Equal(records[0].Date))
+		assert.Equal([]string{"Travel"}, records[0].Tags)
+		assert.Equal([]RecordError{{Source: "B2", Error: "Bad creation date"}}, recordErrors)
+	}
+
+	_, _, err := Parse(DayOne, zipOf(map[string]string{"photos/a.jpeg": "jpeg"}))
+	assert.NotNil(err)
+}
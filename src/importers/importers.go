@@ -0,0 +1,194 @@
+package importers
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Formats of the parsers available by default
+const (
+	DayOne = "dayone"
+	Journey = "journey"
+	Markdown = "markdown"
+)
+
+// Most files in an archive
+const maxArchiveFiles = 10000
+
+/*
+	Bounds the decompressed size of all the files read from an archive together, so that an archive of highly
+	compressed files cannot exhaust the memory. Replaced in tests.
+*/
+var maxDecompressedSize int64 = 200 * 1024 * 1024
+
+// Longest title derived from the content
+const maxTitleLength = 100
+
+var ErrUnknownFormat = errors.New("unknown import format")
+
+var errArchiveTooLarge = errors.New("archive too large once decompressed")
+
+// An entry read from another journaling app, not encrypted yet
+type Record struct {
+	// File name or ID in the source, to tell the user which entry it is
+	Source		string `json:"source"`
+	Title		string `json:"title"`
+	// Markdown, or plain text
+	Content		string `json:"content"`
+	Date		time.Time `json:"date"`
+	Tags		[]string `json:"tags"`
+}
+
+// An entry of the source that could not be read, the others are still imported
+type RecordError struct {
+	Source		string `json:"source"`
+	Error		string `json:"error"`
+}
+
+/*
+	Reads the export of a journaling app. Entries that cannot be read are returned as RecordError,
+	an error means the whole export cannot be read.
+*/
+type Parser func(content []byte) ([]Record, []RecordError, error)
+
+var parsers = map[string]Parser{
+	DayOne: ParseDayOne,
+	Journey: ParseJourney,
+	Markdown: ParseMarkdown,
+}
+
+// Adds a parser, or replaces the one of the same format
+func Register(format string, parser Parser) {
+	parsers[format] = parser
+}
+
+func Formats() []string {
+	formats := make([]string, 0, len(parsers))
+	for format := range parsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Parses content with the parser of format, and normalizes the records, see normalize
+func Parse(format string, content []byte) ([]Record, []RecordError, error) {
+	parser, found := parsers[format]
+	if !found {
+		return nil, nil, ErrUnknownFormat
+	}
+	records, recordErrors, err := parser(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range records {
+		records[i] = normalize(records[i])
+	}
+	if recordErrors == nil {
+		recordErrors = []RecordError{}
+	}
+	return records, recordErrors, nil
+}
+
+/*
+	Gives a title to records without one, from the first line of the content, or the date if it is too short.
+	Tags are trimmed, and duplicates regardless of case removed.
+*/
+func normalize(record Record) Record {
+	record.Title = strings.TrimSpace(record.Title)
+	if record.Title == "" {
+		record.Title = titleFromContent(record.Content)
+	}
+	if utf8.RuneCountInString(record.Title) < 3 {
+		record.Title = record.Date.Format("January 2, 2006")
+	}
+
+	tags := make([]string, 0, len(record.Tags))
+	seen := make(map[string]bool, len(record.Tags))
+	for _, tag := range record.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	record.Tags = tags
+	return record
+}
+
+// The first non empty line, without markdown heading marks
+func titleFromContent(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if line == "" {
+			continue
+		}
+		if utf8.RuneCountInString(line) > maxTitleLength {
+			line = string([]rune(line)[:maxTitleLength])
+		}
+		return line
+	}
+	return ""
+}
+
+func isZip(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("PK\x03\x04"))
+}
+
+// Files are read within the decompressed size left
+type zipArchive struct {
+	reader *zip.Reader
+	remaining int64
+}
+
+func readZip(content []byte) (*zipArchive, error) {
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, errors.New("bad zip archive")
+	}
+	if len(reader.File) > maxArchiveFiles {
+		return nil, errors.New("too many files in the archive")
+	}
+	return &zipArchive{reader: reader, remaining: maxDecompressedSize}, nil
+}
+
+// Once errArchiveTooLarge is returned, the archive must be given up
+func (archive *zipArchive) read(file *zip.File) ([]byte, error) {
+	opened, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer opened.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(opened, archive.remaining + 1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > archive.remaining {
+		archive.remaining = 0
+		return nil, errArchiveTooLarge
+	}
+	archive.remaining -= int64(len(content))
+	return content, nil
+}
+
+// Files of the archive with the given extension, regardless of case, skipping folders and macOS metadata
+func (archive *zipArchive) filesWithExtension(extension string) []*zip.File {
+	var files []*zip.File
+	for _, file := range archive.reader.File {
+		if file.FileInfo().IsDir() || strings.HasPrefix(file.Name, "__MACOSX/") {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(file.Name), extension) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
@@ -0,0 +1,92 @@
+package importers
+
+import (
+	"archive/zip"
+	"bytes"
+	asserthelper "github.com/stretchr/testify/assert"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testModified = time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+
+// A zip archive of the given files, modified at testModified
+func zipOf(files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for _, name := range names {
+		file, _ := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: testModified})
+		_, _ = file.Write([]byte(files[name]))
+	}
+	_ = writer.Close()
+	return buffer.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	_, _, err := Parse("unknown", []byte("{}"))
+	assert.Equal(ErrUnknownFormat, err)
+	_, _, err = Parse(DayOne, []byte("not json"))
+	assert.NotNil(err)
+
+	Register("test", func(content []byte) ([]Record, []RecordError, error) {
+		return []Record{{Content: string(content), Date: testModified, Tags: []string{" Work ", "work", "", "Home"}}}, nil, nil
+	})
+	defer delete(parsers, "test")
+	assert.Equal([]string{DayOne, Journey, Markdown, "test"}, Formats())
+
+	records, recordErrors, err := Parse("test", []byte("\n## Heading title\nBody"))
+	assert.Nil(err)
+	assert.Equal([]RecordError{}, recordErrors)
+	assert.Equal("Heading title", records[0].Title)
+	assert.Equal([]string{"Work", "Home"}, records[0].Tags)
+
+	// Too short to be a title
+	records, _, _ = Parse("test", []byte("Hi"))
+	assert.Equal("May 6, 2020", records[0].Title)
+}
+
+func TestTitleFromContent(t *testing.T) {
+	assert := asserthelper.New(t)
+	assert.Equal("", titleFromContent("\n  \n"))
+	long := ""
+	for i := 0; i < 30; i++ {
+		long += "éèàù "
+	}
+	assert.Equal(maxTitleLength, len([]rune(titleFromContent(long))))
+}
+
+// Files are read within a total budget, whatever their number, so that small archives cannot exhaust the memory
+func TestReadZip_Limits(t *testing.T) {
+	assert := asserthelper.New(t)
+	previous := maxDecompressedSize
+	maxDecompressedSize = 4096
+	defer func() { maxDecompressedSize = previous }()
+
+	files := map[string]string{}
+	for i := 0; i < 3; i++ {
+		files["entry" + strconv.Itoa(i) + ".md"] = "---\ntitle: Entry\n---\n" + strings.Repeat("a", 1500)
+	}
+	_, _, err := ParseMarkdown(zipOf(files))
+	assert.Equal(errArchiveTooLarge, err)
+	delete(files, "entry2.md")
+	records, _, err := ParseMarkdown(zipOf(files))
+	assert.Nil(err)
+	assert.Equal(2, len(records))
+
+	many := map[string]string{}
+	for i := 0; i <= maxArchiveFiles; i++ {
+		many[strconv.Itoa(i) + ".md"] = ""
+	}
+	_, err = readZip(zipOf(many))
+	assert.NotNil(err)
+}
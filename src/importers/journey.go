@@ -0,0 +1,55 @@
+package importers
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The parts of a Journey entry we read. Photos, location and weather are not imported.
+type journeyEntry struct {
+	ID			string `json:"id"`
+	Text		string `json:"text"`
+	// Milliseconds since epoch
+	DateJournal	int64 `json:"date_journal"`
+	Tags		[]string `json:"tags"`
+}
+
+// Reads a Journey export, a zip with a JSON file per entry. Titles are taken from the first line.
+func ParseJourney(content []byte) ([]Record, []RecordError, error) {
+	if !isZip(content) {
+		return nil, nil, errors.New("not a Journey zip export")
+	}
+	archive, err := readZip(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := []Record{}
+	var recordErrors []RecordError
+	for _, file := range archive.filesWithExtension(".json") {
+		data, err := archive.read(file)
+		if err == errArchiveTooLarge {
+			return nil, nil, err
+		} else if err != nil {
+			recordErrors = append(recordErrors, RecordError{Source: file.Name, Error: err.Error()})
+			continue
+		}
+		var entry journeyEntry
+		if json.Unmarshal(data, &entry) != nil {
+			recordErrors = append(recordErrors, RecordError{Source: file.Name, Error: "Not a Journey entry"})
+			continue
+		}
+		if entry.DateJournal <= 0 {
+			recordErrors = append(recordErrors, RecordError{Source: file.Name, Error: "Missing date"})
+			continue
+		}
+		records = append(records, Record{
+			Source:  file.Name,
+			Content: entry.Text,
+			Date:    time.Unix(0, entry.DateJournal * int64(time.Millisecond)).UTC(),
+			Tags:    entry.Tags,
+		})
+	}
+	return records, recordErrors, nil
+}
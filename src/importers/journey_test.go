@@ -0,0 +1,32 @@
+package importers
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseJourney(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	archive := zipOf(map[string]string{
+		"1551675967000-abc.json": `{"id": "abc", "text": "Walk in the park\nWith friends", "date_journal": 1551675967000, "tags": ["friends"]}`,
+		"1551675967000-abc-photo.jpg": "jpeg",
+		"broken.json": "{",
+		"undated.json": `{"id": "undated", "text": "No date"}`,
+	})
+	records, recordErrors, err := Parse(Journey, archive)
+	assert.Nil(err)
+	assert.Equal(1, len(records))
+	assert.Equal("Walk in the park", records[0].Title)
+	assert.Equal("1551675967000-abc.json", records[0].Source)
+	assert.True(time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC).Equal(records[0].Date))
+	assert.Equal([]string{"friends"}, records[0].Tags)
+	assert.Equal([]RecordError{
+		{Source: "broken.json", Error: "Not a Journey entry"},
+		{Source: "undated.json", Error: "Missing date"},
+	}, recordErrors)
+
+	_, _, err = Parse(Journey, []byte(`{"text": "not a zip"}`))
+	assert.NotNil(err)
+}
@@ -0,0 +1,120 @@
+package importers
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"strings"
+	"time"
+)
+
+// Date formats accepted in front matter, the first ones without time zone are read as UTC
+var frontMatterDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+type frontMatter struct {
+	Title	string `yaml:"title"`
+	Date	string `yaml:"date"`
+	// A list, or a comma separated string
+	Tags	interface{} `yaml:"tags"`
+}
+
+func parseFrontMatterDate(value string) (time.Time, error) {
+	for _, layout := range frontMatterDateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, errors.New("Bad date " + value)
+}
+
+func parseFrontMatterTags(value interface{}) []string {
+	var tags []string
+	switch value := value.(type) {
+	case string:
+		tags = strings.Split(value, ",")
+	case []interface{}:
+		for _, tag := range value {
+			if tag, ok := tag.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// Splits the YAML front matter between --- lines from the rest of the document. Empty without front matter.
+func splitFrontMatter(document string) (string, string) {
+	document = strings.TrimPrefix(strings.Replace(document, "\r\n", "\n", -1), "\ufeff")
+	if !strings.HasPrefix(document, "---\n") {
+		return "", document
+	}
+	lines := strings.SplitAfter(document, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "---" || line == "..." {
+			return strings.Join(lines[1:i], ""), strings.TrimLeft(strings.Join(lines[i + 1:], ""), "\n")
+		}
+	}
+	return "", document
+}
+
+func parseMarkdownDocument(document string, modified time.Time) (Record, error) {
+	header, body := splitFrontMatter(document)
+	var matter frontMatter
+	err := yaml.Unmarshal([]byte(header), &matter)
+	if err != nil {
+		return Record{}, errors.New("Bad front matter")
+	}
+	record := Record{Title: matter.Title, Content: body, Date: modified, Tags: parseFrontMatterTags(matter.Tags)}
+	if matter.Date != "" {
+		record.Date, err = parseFrontMatterDate(matter.Date)
+		if err != nil {
+			return Record{}, err
+		}
+	}
+	if record.Date.IsZero() {
+		return Record{}, errors.New("Missing date")
+	}
+	return record, nil
+}
+
+/*
+	Reads a zip of Markdown files (.md or .markdown), with an optional YAML front matter giving the title, date and
+	tags. Without date in the front matter, the modification time of the file is used.
+*/
+func ParseMarkdown(content []byte) ([]Record, []RecordError, error) {
+	if !isZip(content) {
+		return nil, nil, errors.New("not a zip of Markdown files")
+	}
+	archive, err := readZip(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := append(archive.filesWithExtension(".md"), archive.filesWithExtension(".markdown")...)
+	records := []Record{}
+	var recordErrors []RecordError
+	for _, file := range files {
+		data, err := archive.read(file)
+		if err == errArchiveTooLarge {
+			return nil, nil, err
+		} else if err != nil {
+			recordErrors = append(recordErrors, RecordError{Source: file.Name, Error: err.Error()})
+			continue
+		}
+		record, err := parseMarkdownDocument(string(data), file.Modified)
+		if err != nil {
+			recordErrors = append(recordErrors, RecordError{Source: file.Name, Error: err.Error()})
+			continue
+		}
+		record.Source = file.Name
+		records = append(records, record)
+	}
+	return records, recordErrors, nil
+}
@@ -0,0 +1,41 @@
+package importers
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	archive := zipOf(map[string]string{
+		"diary/2019-03-04.md": "---\r\ntitle: Lisbon\r\ndate: 2019-03-04\r\ntags: [Travel, Portugal]\r\n---\r\n\r\nSunny day\r\n",
+		"diary/notes.markdown": "---\ndate: 2019-03-05 10:30\ntags: work, meetings\n---\n# Standup\nNothing new",
+		"diary/plain.md": "Written without front matter",
+		"diary/bad-date.md": "---\ndate: someday\n---\nText",
+		"diary/bad-yaml.md": "---\ntags: [unclosed\n---\nText",
+		"diary/image.png": "png",
+	})
+	records, recordErrors, err := Parse(Markdown, archive)
+	assert.Nil(err)
+	assert.Equal(3, len(records))
+
+	assert.Equal("diary/2019-03-04.md", records[0].Source)
+	assert.Equal("Lisbon", records[0].Title)
+	assert.Equal("Sunny day\n", records[0].Content)
+	assert.True(time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC).Equal(records[0].Date))
+	assert.Equal([]string{"Travel", "Portugal"}, records[0].Tags)
+
+	assert.Equal("Written without front matter", records[1].Title)
+	assert.True(testModified.Equal(records[1].Date))
+
+	assert.Equal("Standup", records[2].Title)
+	assert.True(time.Date(2019, 3, 5, 10, 30, 0, 0, time.UTC).Equal(records[2].Date))
+	assert.Equal([]string{"work", "meetings"}, records[2].Tags)
+
+	assert.Equal([]RecordError{
+		{Source: "diary/bad-date.md", Error: "Bad date someday"},
+		{Source: "diary/bad-yaml.md", Error: "Bad front matter"},
+	}, recordErrors)
+}
@@ -0,0 +1,25 @@
+package jobs
+
+import (
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"time"
+)
+
+/*
+	Runs job in its own goroutine every interval, for as long as the program runs.
+	A failing run is reported to sentry and does not stop the next ones.
+*/
+func Every(interval time.Duration, name string, job func() error) *time.Ticker {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			err := job()
+			if err != nil {
+				fmt.Println("JOB ERROR:", name, err.Error())
+				sentry.CaptureException(fmt.Errorf("job %s: %v", name, err))
+			}
+		}
+	}()
+	return ticker
+}
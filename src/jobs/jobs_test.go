@@ -0,0 +1,24 @@
+package jobs
+
+import (
+	"errors"
+	asserthelper "github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	assert := asserthelper.New(t)
+	var runs int32
+
+	ticker := Every(time.Millisecond * 10, "test job", func() error {
+		atomic.AddInt32(&runs, 1)
+		// Errors must not stop the job
+		return errors.New("job failed")
+	})
+	time.Sleep(time.Millisecond * 55)
+	ticker.Stop()
+
+	assert.GreaterOrEqual(atomic.LoadInt32(&runs), int32(3))
+}
@@ -0,0 +1,79 @@
+package keyring
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// A public key as described by RFC 7517, with the curve specific members of RFC 7518 and RFC 8037
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Elliptic curve coordinates are left padded to the curve size
+func encodeCoordinate(n *big.Int, size int) string {
+	b := n.Bytes()
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return encode(padded)
+}
+
+func (k Key) JWK() (JWK, error) {
+	public, err := k.VerificationKey()
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk := JWK{KeyID: k.ID, Algorithm: k.Alg(), Use: "sig"}
+	switch key := public.(type) {
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encode(key)
+	case *ecdsa.PublicKey:
+		jwk.KeyType = "EC"
+		jwk.Curve = key.Curve.Params().Name
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.X = encodeCoordinate(key.X, size)
+		jwk.Y = encodeCoordinate(key.Y, size)
+	default:
+		return JWK{}, fmt.Errorf("key %v has no public key", k.ID)
+	}
+	return jwk, nil
+}
+
+/*
+Public keys of every asymmetric key still accepted, retiring ones included so that their tokens
+can be verified until the end of the grace window. HMAC keys are never published.
+*/
+func (k *Keyring) JWKS() (JWKSet, error) {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.Keys() {
+		if !key.IsAsymmetric() || !key.IsValidAt(time.Now()) {
+			continue
+		}
+		jwk, err := key.JWK()
+		if err != nil {
+			return JWKSet{}, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
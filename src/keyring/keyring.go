@@ -0,0 +1,329 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key used for tokens without kid header, i.e. issued before key rotation existed
+const LegacyKeyID = "default"
+
+const (
+	// Shared secret, whoever verifies tokens can also sign them
+	AlgorithmHS512 = "HS512"
+	// Asymmetric algorithms, the public key can be published to let other services verify tokens
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmES256 = "ES256"
+)
+
+type Key struct {
+	ID string `json:"kid"`
+	// HS512 when empty
+	Algorithm string `json:"alg,omitempty"`
+	// The HMAC secret, or the PKCS #8 private key of asymmetric algorithms
+	Secret    []byte    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+	// Once set, the key does not sign anymore, and stops being accepted at this date
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+}
+
+func (k Key) Alg() string {
+	if k.Algorithm == "" {
+		return AlgorithmHS512
+	}
+	return k.Algorithm
+}
+
+func (k Key) IsAsymmetric() bool {
+	return k.Alg() != AlgorithmHS512
+}
+
+func (k Key) signingMethod() (jwt.SigningMethod, error) {
+	switch k.Alg() {
+	case AlgorithmHS512:
+		return jwt.SigningMethodHS512, nil
+	case AlgorithmEdDSA:
+		return SigningMethodEdDSA, nil
+	case AlgorithmES256:
+		return jwt.SigningMethodES256, nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %v", k.Algorithm)
+}
+
+func (k Key) privateKey() (crypto.Signer, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(k.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse key %v: %v", k.ID, err)
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key %v is not a signing key", k.ID)
+	}
+	return signer, nil
+}
+
+// What jwt-go expects to sign with this key
+func (k Key) SigningKey() (interface{}, error) {
+	if !k.IsAsymmetric() {
+		return k.Secret, nil
+	}
+	return k.privateKey()
+}
+
+// What jwt-go expects to verify with this key
+func (k Key) VerificationKey() (interface{}, error) {
+	if !k.IsAsymmetric() {
+		return k.Secret, nil
+	}
+	signer, err := k.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Public(), nil
+}
+
+// Generates a new key. size is the secret length in bytes, only used by HS512.
+func Generate(kid string, algorithm string, size int) (Key, error) {
+	key := Key{ID: kid, Algorithm: algorithm, CreatedAt: time.Now()}
+	var private interface{}
+	var err error
+	switch key.Alg() {
+	case AlgorithmHS512:
+		key.Secret = make([]byte, size)
+		_, err = rand.Read(key.Secret)
+		return key, err
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return Key{}, fmt.Errorf("unsupported algorithm %v", algorithm)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	key.Secret, err = x509.MarshalPKCS8PrivateKey(private)
+	return key, err
+}
+
+func (k Key) IsRetiring() bool {
+	return k.RetiresAt != nil
+}
+
+func (k Key) IsValidAt(date time.Time) bool {
+	return k.RetiresAt == nil || date.Before(*k.RetiresAt)
+}
+
+/*
+A set of signing keys. The newest key that is not retiring signs, every key that is not retired yet verifies,
+so that tokens signed with a retiring key stay valid during the grace window.
+*/
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   []Key
+	loader func() ([]Key, error)
+}
+
+func New(keys []Key) *Keyring {
+	k := &Keyring{}
+	k.set(keys)
+	return k
+}
+
+func (k *Keyring) set(keys []Key) {
+	sorted := make([]Key, len(keys))
+	copy(sorted, keys)
+	// Newest first
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreatedAt.After(sorted[j].CreatedAt)
+	})
+	k.mu.Lock()
+	k.keys = sorted
+	k.mu.Unlock()
+}
+
+func (k *Keyring) Keys() []Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]Key, len(k.keys))
+	copy(keys, k.keys)
+	return keys
+}
+
+// Reads keys again from where they were loaded, so that added or retired keys are taken into account
+func (k *Keyring) Reload() error {
+	if k.loader == nil {
+		return nil
+	}
+	keys, err := k.loader()
+	if err != nil {
+		return err
+	}
+	k.set(keys)
+	return nil
+}
+
+func (k *Keyring) SigningKey() (Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if !key.IsRetiring() {
+			return key, nil
+		}
+	}
+	return Key{}, errors.New("no active signing key")
+}
+
+func (k *Keyring) find(kid string) (Key, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Signs the claims with the newest key, referenced in the kid header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	method, err := key.signingMethod()
+	if err != nil {
+		return "", err
+	}
+	signingKey, err := key.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(signingKey)
+}
+
+// To be given to jwt.Parse
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		kid = LegacyKeyID
+	}
+	key, found := k.find(kid)
+	if !found {
+		return nil, fmt.Errorf("unexpected jwt key id=%v", kid)
+	}
+	// The algorithm is bound to the key, never chosen by the token
+	if token.Method.Alg() != key.Alg() {
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", token.Header["alg"])
+	}
+	if !key.IsValidAt(time.Now()) {
+		return nil, fmt.Errorf("retired jwt key id=%v", kid)
+	}
+	return key.VerificationKey()
+}
+
+/*
+Loads the keys configured for the given prefix, by order of precedence:
+  - <prefix>_KEYS_DIR: a directory of JSON keys, as written by the keyring command. Reload() reads it again.
+  - <prefix>_KEYS: a list of kid:secret separated by commas, the last one signs.
+  - <prefix>_SECRET: a single key, with the legacy key ID.
+*/
+func FromEnv(prefix string) (*Keyring, error) {
+	if dir := os.Getenv(prefix + "_KEYS_DIR"); dir != "" {
+		return FromDirectory(dir)
+	}
+	if list := os.Getenv(prefix + "_KEYS"); list != "" {
+		keys, err := ParseList(list)
+		if err != nil {
+			return nil, err
+		}
+		return New(keys), nil
+	}
+	if secret := os.Getenv(prefix + "_SECRET"); secret != "" {
+		return New([]Key{{ID: LegacyKeyID, Secret: []byte(secret)}}), nil
+	}
+	return nil, fmt.Errorf("no key configured for %v", prefix)
+}
+
+func IsConfigured(prefix string) bool {
+	return os.Getenv(prefix+"_KEYS_DIR") != "" || os.Getenv(prefix+"_KEYS") != "" ||
+		os.Getenv(prefix+"_SECRET") != ""
+}
+
+func ParseList(list string) ([]Key, error) {
+	var keys []Key
+	// Keys are ordered oldest first, we give them increasing creation dates accordingly
+	origin := time.Unix(0, 0)
+	for i, elem := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(elem), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad key format at position %v, expected kid:secret", i)
+		}
+		keys = append(keys, Key{
+			ID:        parts[0],
+			Secret:    []byte(parts[1]),
+			CreatedAt: origin.Add(time.Duration(i) * time.Second),
+		})
+	}
+	return keys, nil
+}
+
+func FromDirectory(dir string) (*Keyring, error) {
+	loader := func() ([]Key, error) {
+		return ReadDirectory(dir)
+	}
+	keys, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	k := New(keys)
+	k.loader = loader
+	return k, nil
+}
+
+func ReadDirectory(dir string) ([]Key, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key %v: %v", file, err)
+		}
+		var key Key
+		err = json.Unmarshal(content, &key)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse key %v: %v", file, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func WriteKey(dir string, key Key) error {
+	content, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Secrets must only be readable by the server
+	return ioutil.WriteFile(filepath.Join(dir, key.ID+".json"), content, 0600)
+}
@@ -0,0 +1,216 @@
+package keyring
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	asserthelper "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func claims() jwt.StandardClaims {
+	return jwt.StandardClaims{
+		Subject:   "42",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func parse(k *Keyring, ss string) error {
+	_, err := jwt.Parse(ss, k.Keyfunc)
+	return err
+}
+
+func TestKeyring_Sign(t *testing.T) {
+	assert := asserthelper.New(t)
+	old := Key{ID: "old", Secret: []byte("old secret"), CreatedAt: time.Now().Add(-time.Hour)}
+	recent := Key{ID: "recent", Secret: []byte("recent secret"), CreatedAt: time.Now()}
+	k := New([]Key{recent, old})
+
+	ss, err := k.Sign(claims())
+	assert.Nil(err)
+	token, _ := jwt.Parse(ss, nil)
+	assert.Equal("recent", token.Header["kid"])
+	assert.Equal("HS512", token.Header["alg"])
+	assert.Nil(parse(k, ss))
+
+	// Tokens from other keyrings are refused
+	assert.NotNil(parse(New([]Key{{ID: "recent", Secret: []byte("other")}}), ss))
+	assert.NotNil(parse(New([]Key{{ID: "other", Secret: []byte("recent secret")}}), ss))
+
+	_, err = New(nil).Sign(claims())
+	assert.NotNil(err)
+}
+
+func TestKeyring_RetiringKeyGraceWindow(t *testing.T) {
+	assert := asserthelper.New(t)
+	graceEnd := time.Now().Add(time.Hour)
+	old := Key{ID: "old", Secret: []byte("old secret"), CreatedAt: time.Now().Add(-time.Hour)}
+	k := New([]Key{old})
+	ss, _ := k.Sign(claims())
+
+	// A new key is added and the old one is retiring
+	old.RetiresAt = &graceEnd
+	newKey := Key{ID: "new", Secret: []byte("new secret"), CreatedAt: time.Now()}
+	k = New([]Key{old, newKey})
+
+	// Still valid during the grace window
+	assert.Nil(parse(k, ss))
+	// But not used to sign anymore
+	signingKey, _ := k.SigningKey()
+	assert.Equal("new", signingKey.ID)
+
+	// Even if it is the newest key
+	k = New([]Key{{ID: "newest", Secret: []byte("s"), CreatedAt: time.Now().Add(time.Hour), RetiresAt: &graceEnd}, newKey})
+	signingKey, _ = k.SigningKey()
+	assert.Equal("new", signingKey.ID)
+
+	// Refused once the grace window is over
+	graceEnd = time.Now().Add(-time.Second)
+	old.RetiresAt = &graceEnd
+	k = New([]Key{old, newKey})
+	assert.NotNil(parse(k, ss))
+}
+
+func TestKeyring_LegacyToken(t *testing.T) {
+	assert := asserthelper.New(t)
+	k := New([]Key{{ID: LegacyKeyID, Secret: []byte("secret")}})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims())
+	ss, _ := token.SignedString([]byte("secret"))
+	assert.Nil(parse(k, ss))
+
+	// Algorithm must match
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	ss, _ = token.SignedString([]byte("secret"))
+	assert.NotNil(parse(k, ss))
+}
+
+func TestParseList(t *testing.T) {
+	assert := asserthelper.New(t)
+	keys, err := ParseList("first:secret1, second:secret:with:colons")
+	assert.Nil(err)
+	assert.Equal(2, len(keys))
+	assert.Equal("secret:with:colons", string(keys[1].Secret))
+
+	signingKey, _ := New(keys).SigningKey()
+	assert.Equal("second", signingKey.ID)
+
+	_, err = ParseList("first:secret1,nosecret")
+	assert.NotNil(err)
+}
+
+func TestFromEnv(t *testing.T) {
+	assert := asserthelper.New(t)
+	os.Setenv("TEST_KEYRING_SECRET", "single secret")
+	defer os.Unsetenv("TEST_KEYRING_SECRET")
+
+	assert.Equal(true, IsConfigured("TEST_KEYRING"))
+	k, err := FromEnv("TEST_KEYRING")
+	assert.Nil(err)
+	signingKey, _ := k.SigningKey()
+	assert.Equal(LegacyKeyID, signingKey.ID)
+
+	os.Setenv("TEST_KEYRING_KEYS", "a:secret_a,b:secret_b")
+	defer os.Unsetenv("TEST_KEYRING_KEYS")
+	k, err = FromEnv("TEST_KEYRING")
+	assert.Nil(err)
+	signingKey, _ = k.SigningKey()
+	assert.Equal("b", signingKey.ID)
+
+	_, err = FromEnv("TEST_KEYRING_NOT_SET")
+	assert.NotNil(err)
+	assert.Equal(false, IsConfigured("TEST_KEYRING_NOT_SET"))
+}
+
+func TestFromDirectory(t *testing.T) {
+	assert := asserthelper.New(t)
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(WriteKey(dir, Key{ID: "first", Secret: []byte("first secret"), CreatedAt: time.Now().Add(-time.Minute)}))
+	k, err := FromDirectory(dir)
+	assert.Nil(err)
+	ss, _ := k.Sign(claims())
+
+	// Rotation
+	retires := time.Now().Add(time.Hour)
+	assert.Nil(WriteKey(dir, Key{ID: "first", Secret: []byte("first secret"), CreatedAt: time.Now().Add(-time.Minute), RetiresAt: &retires}))
+	assert.Nil(WriteKey(dir, Key{ID: "second", Secret: []byte("second secret"), CreatedAt: time.Now()}))
+	assert.Nil(k.Reload())
+
+	assert.Equal(2, len(k.Keys()))
+	signingKey, _ := k.SigningKey()
+	assert.Equal("second", signingKey.ID)
+	assert.Nil(parse(k, ss))
+
+	info, _ := os.Stat(dir + "/second.json")
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestKeyring_Asymmetric(t *testing.T) {
+	assert := asserthelper.New(t)
+	for _, alg := range []string{AlgorithmEdDSA, AlgorithmES256} {
+		key, err := Generate("asymmetric", alg, 0)
+		assert.Nil(err)
+		k := New([]Key{key})
+
+		ss, err := k.Sign(claims())
+		assert.Nil(err)
+		token, _ := jwt.Parse(ss, nil)
+		assert.Equal(alg, token.Header["alg"])
+		assert.Nil(parse(k, ss))
+
+		// Verifying only needs the public key
+		public, _ := key.VerificationKey()
+		_, err = jwt.Parse(ss, func(token *jwt.Token) (interface{}, error) { return public, nil })
+		assert.Nil(err)
+
+		// Another key of the same algorithm does not verify
+		other, _ := Generate("asymmetric", alg, 0)
+		assert.NotNil(parse(New([]Key{other}), ss))
+	}
+
+	// The algorithm is the key's, a token signed with the same ID but HMAC is refused
+	key, _ := Generate("asymmetric", AlgorithmEdDSA, 0)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims())
+	token.Header["kid"] = "asymmetric"
+	ss, _ := token.SignedString(key.Secret)
+	assert.NotNil(parse(New([]Key{key}), ss))
+
+	_, err := Generate("unknown", "RS256", 0)
+	assert.NotNil(err)
+}
+
+func TestKeyring_JWKS(t *testing.T) {
+	assert := asserthelper.New(t)
+	ed, _ := Generate("ed", AlgorithmEdDSA, 0)
+	ec, _ := Generate("ec", AlgorithmES256, 0)
+	retired := time.Now().Add(-time.Second)
+	old, _ := Generate("old", AlgorithmEdDSA, 0)
+	old.RetiresAt = &retired
+	hmac, _ := Generate("hmac", AlgorithmHS512, 64)
+	assert.Equal(64, len(hmac.Secret))
+
+	set, err := New([]Key{ed, ec, old, hmac}).JWKS()
+	assert.Nil(err)
+	// Neither the retired key nor the HMAC secret are published
+	assert.Equal(2, len(set.Keys))
+	for _, jwk := range set.Keys {
+		assert.Equal("sig", jwk.Use)
+		switch jwk.KeyID {
+		case "ed":
+			assert.Equal("OKP", jwk.KeyType)
+			assert.Equal("Ed25519", jwk.Curve)
+			assert.Equal(43, len(jwk.X))
+		case "ec":
+			assert.Equal("EC", jwk.KeyType)
+			assert.Equal("P-256", jwk.Curve)
+			assert.Equal(43, len(jwk.X))
+			assert.Equal(43, len(jwk.Y))
+		default:
+			t.Errorf("unexpected key %v", jwk.KeyID)
+		}
+	}
+}
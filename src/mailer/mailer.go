@@ -0,0 +1,259 @@
+/*
+	Sends emails to users: password resets, security alerts...
+	Messages are built from templates, see Render, and sent over SMTP, configured with:
+
+		SMTP_HOST, SMTP_PORT (default 587)
+		SMTP_USERNAME, SMTP_PASSWORD, optional: no authentication without them
+		SMTP_FROM, the sender address
+		SMTP_TLS: "starttls" (default), "tls" for implicit TLS (usually port 465), or "none" for a local sink
+
+	With MAILER=log, messages are only logged instead, which is enough for development. Only explicitly: a server
+	that forgot SMTP_HOST gets ErrNotConfigured, so that features relying on emails are disabled instead of
+	silently not sending them.
+*/
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type Sender interface {
+	Send(message Message) error
+}
+
+const (
+	TLSNone     = "none"
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+)
+
+// Values of MAILER
+const (
+	MailerSMTP = "smtp"
+	MailerLog  = "log"
+)
+
+const defaultPort = "587"
+
+// Connections are given up after this long
+const timeout = time.Second * 10
+
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	TLS      string
+}
+
+// Logs messages instead of sending them. The content is left out, it holds links to reset passwords.
+type LogSender struct{}
+
+func (LogSender) Send(message Message) error {
+	log.Printf("mail to %v: %v", message.To, message.Subject)
+	return nil
+}
+
+// Neither SMTP_HOST nor MAILER is set
+var ErrNotConfigured = errors.New("emails not configured, SMTP_HOST missing")
+
+// Configured from the environment, see the package documentation
+func FromEnv() (Sender, error) {
+	host := os.Getenv("SMTP_HOST")
+	switch os.Getenv("MAILER") {
+	case MailerLog:
+		return LogSender{}, nil
+	case "":
+		if host == "" {
+			return nil, ErrNotConfigured
+		}
+	case MailerSMTP:
+	default:
+		return nil, fmt.Errorf("unknown MAILER %v, expected %v or %v", os.Getenv("MAILER"), MailerSMTP, MailerLog)
+	}
+	if host == "" {
+		return nil, errors.New("SMTP_HOST missing, or MAILER=log to only log emails")
+	}
+	sender := &SMTPSender{
+		Host:     host,
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		TLS:      os.Getenv("SMTP_TLS"),
+	}
+	if sender.Port == "" {
+		sender.Port = defaultPort
+	}
+	if sender.TLS == "" {
+		sender.TLS = TLSStartTLS
+	}
+	if sender.TLS != TLSNone && sender.TLS != TLSStartTLS && sender.TLS != TLSImplicit {
+		return nil, fmt.Errorf("unknown SMTP_TLS mode %v", sender.TLS)
+	}
+	if sender.From == "" {
+		return nil, errors.New("SMTP_FROM missing")
+	}
+	return sender, nil
+}
+
+// Rejects line breaks, which would let an address inject headers
+func checkAddress(address string) error {
+	if strings.ContainsAny(address, "\r\n") {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	return nil
+}
+
+// The whole exchange must end before the timeout, a stalled server would otherwise hold the connection forever
+func (s *SMTPSender) dial() (*smtp.Client, error) {
+	address := net.JoinHostPort(s.Host, s.Port)
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if s.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: s.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if s.TLS == TLSStartTLS {
+		err = client.StartTLS(&tls.Config{ServerName: s.Host})
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (s *SMTPSender) Send(message Message) error {
+	for _, address := range []string{s.From, message.To} {
+		if err := checkAddress(address); err != nil {
+			return err
+		}
+	}
+	data, err := build(s.From, message)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.dial()
+	if err != nil {
+		return fmt.Errorf("could not connect to smtp server: %v", err)
+	}
+	defer client.Close()
+	if s.Username != "" {
+		// net/smtp refuses to send the password in clear, unless to localhost
+		err = client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host))
+		if err != nil {
+			return fmt.Errorf("smtp authentication failed: %v", err)
+		}
+	}
+	err = client.Mail(s.From)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(message.To)
+	if err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func writePart(writer *multipart.Writer, contentType string, content string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType + "; charset=UTF-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoder := quotedprintable.NewWriter(part)
+	_, err = encoder.Write([]byte(content))
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// The raw message, a multipart/alternative with the text and HTML versions
+func build(from string, message Message) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	err := writePart(writer, "text/plain", message.Text)
+	if err != nil {
+		return nil, err
+	}
+	if message.HTML != "" {
+		err = writePart(writer, "text/html", message.HTML)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var data bytes.Buffer
+	headers := [][2]string{
+		{"From", from},
+		{"To", message.To},
+		{"Subject", mime.QEncoding.Encode("UTF-8", message.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + writer.Boundary()},
+	}
+	for _, header := range headers {
+		data.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	data.WriteString("\r\n")
+	data.Write(body.Bytes())
+	return data.Bytes(), nil
+}
@@ -0,0 +1,164 @@
+package mailer
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+type received struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// Local SMTP sink, accepts one connection and sends what it received on the channel
+func smtpSink(t *testing.T) (string, string, <-chan received) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan received, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		text := textproto.NewConn(conn)
+		defer text.Close()
+		var message received
+		_ = text.PrintfLine("220 localhost ESMTP sink")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO", "HELO":
+				_ = text.PrintfLine("250 localhost")
+			case "MAIL":
+				message.from = line
+				_ = text.PrintfLine("250 OK")
+			case "RCPT":
+				message.to = append(message.to, line)
+				_ = text.PrintfLine("250 OK")
+			case "DATA":
+				_ = text.PrintfLine("354 Go ahead")
+				message.data, _ = text.ReadDotBytes()
+				_ = text.PrintfLine("250 OK")
+				messages <- message
+			case "QUIT":
+				_ = text.PrintfLine("221 Bye")
+				return
+			default:
+				_ = text.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return host, port, messages
+}
+
+func TestSMTPSender_Send(t *testing.T) {
+	assert := asserthelper.New(t)
+	host, port, messages := smtpSink(t)
+	sender := &SMTPSender{Host: host, Port: port, From: "diary@example.com", TLS: TLSNone}
+
+	err := sender.Send(Message{
+		To:      "user@example.com",
+		Subject: "Réinitialisation",
+		Text:    "text version",
+		HTML:    "<p>html version</p>",
+	})
+	assert.Nil(err)
+	message := <-messages
+	assert.Equal("MAIL FROM:<diary@example.com>", strings.SplitN(message.from, " BODY", 2)[0])
+	assert.Equal([]string{"RCPT TO:<user@example.com>"}, message.to)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(message.data)))
+	assert.Nil(err)
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	assert.Equal("Réinitialisation", subject)
+	assert.Equal("user@example.com", parsed.Header.Get("To"))
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	assert.Nil(err)
+	assert.Equal("multipart/alternative", mediaType)
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	var contents []string
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		// The multipart reader decodes quoted-printable
+		content, _ := ioutil.ReadAll(part)
+		contents = append(contents, string(content))
+	}
+	assert.Equal([]string{"text version", "<p>html version</p>"}, contents)
+}
+
+func TestSMTPSender_HeaderInjection(t *testing.T) {
+	sender := &SMTPSender{Host: "127.0.0.1", Port: "1", From: "diary@example.com", TLS: TLSNone}
+	err := sender.Send(Message{To: "user@example.com\r\nBcc: other@example.com", Subject: "Hi", Text: "text"})
+	asserthelper.NotNil(t, err)
+}
+
+func TestFromEnv(t *testing.T) {
+	assert := asserthelper.New(t)
+	defer os.Setenv("MAILER", os.Getenv("MAILER"))
+	defer os.Unsetenv("SMTP_HOST")
+	defer os.Unsetenv("SMTP_FROM")
+	os.Unsetenv("MAILER")
+
+	// Logging is never the default, emails are disabled instead
+	_, err := FromEnv()
+	assert.Equal(ErrNotConfigured, err)
+	os.Setenv("MAILER", MailerSMTP)
+	_, err = FromEnv()
+	assert.NotNil(err)
+	assert.NotEqual(ErrNotConfigured, err)
+	os.Setenv("MAILER", "stdout")
+	_, err = FromEnv()
+	assert.NotNil(err)
+
+	os.Setenv("MAILER", MailerLog)
+	sender, err := FromEnv()
+	assert.Nil(err)
+	assert.IsType(LogSender{}, sender)
+
+	os.Setenv("MAILER", "")
+	os.Setenv("SMTP_HOST", "smtp.example.com")
+	os.Setenv("SMTP_FROM", "diary@example.com")
+	sender, err = FromEnv()
+	assert.Nil(err)
+	assert.Equal("587", sender.(*SMTPSender).Port)
+}
+
+func TestRender(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	message, err := Render(PasswordReset, "user@example.com", map[string]string{
+		"Link":     "https://app.example.com/reset?token=<script>",
+		"ValidFor": "1 hour",
+	})
+	assert.Nil(err)
+	assert.Equal("user@example.com", message.To)
+	assert.Contains(message.Text, "https://app.example.com/reset?token=<script>")
+	assert.Contains(message.Text, "unreadable")
+	assert.NotContains(message.HTML, "<script>")
+	assert.Contains(message.HTML, "<!DOCTYPE html>")
+	assert.Contains(message.HTML, "unreadable")
+
+	_, err = Render("unknown", "user@example.com", nil)
+	assert.NotNil(err)
+}
@@ -0,0 +1,133 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Names of the templates, see Render
+const (
+	PasswordReset = "password_reset"
+	AccountLocked = "account_locked"
+	VerifyEmail = "verify_email"
+	AccountDeletion = "account_deletion"
+)
+
+type emailTemplate struct {
+	subject string
+	text    string
+	html    string
+}
+
+const htmlLayout = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #333333; max-width: 600px; margin: auto;">
+{{template "content" .}}
+<p style="color: #888888; font-size: 12px;">Encrypted Diary</p>
+</body>
+</html>`
+
+var templates = map[string]emailTemplate{
+	PasswordReset: {
+		subject: "Reset your password",
+		text: `Someone, hopefully you, asked to reset the password of your Encrypted Diary account.
+
+Your entries are encrypted with your password, and nobody else can read them, not even us.
+If you reset your password, the entries you wrote so far will become unreadable, unless you set up a recovery key.
+If you have one, use it to recover your account instead.
+
+To reset your password, open this link within {{.ValidFor}}:
+{{.Link}}
+
+If you did not ask for it, you can ignore this email, your password will not change.
+`,
+		html: `{{define "content"}}
+<p>Someone, hopefully you, asked to reset the password of your Encrypted Diary account.</p>
+<p><strong>Your entries are encrypted with your password, and nobody else can read them, not even us.
+If you reset your password, the entries you wrote so far will become unreadable, unless you set up a recovery key.</strong>
+If you have one, use it to recover your account instead.</p>
+<p>To reset your password, open this link within {{.ValidFor}}:<br><a href="{{.Link}}">{{.Link}}</a></p>
+<p>If you did not ask for it, you can ignore this email, your password will not change.</p>
+{{end}}`,
+	},
+	VerifyEmail: {
+		subject: "Confirm your email address",
+		text: `Please confirm that {{.Email}} is the address of your Encrypted Diary account by opening this link
+within {{.ValidFor}}:
+{{.Link}}
+
+If you did not create an account or change its address, you can ignore this email.
+`,
+		html: `{{define "content"}}
+<p>Please confirm that {{.Email}} is the address of your Encrypted Diary account by opening this link
+within {{.ValidFor}}:<br><a href="{{.Link}}">{{.Link}}</a></p>
+<p>If you did not create an account or change its address, you can ignore this email.</p>
+{{end}}`,
+	},
+	AccountDeletion: {
+		subject: "Your account will be deleted",
+		text: `Your Encrypted Diary account and all its entries will be permanently deleted on {{.Date}}.
+
+If you change your mind, log in and cancel the deletion before then. Afterwards, nothing can be recovered.
+`,
+		html: `{{define "content"}}
+<p>Your Encrypted Diary account and all its entries will be permanently deleted on {{.Date}}.</p>
+<p>If you change your mind, log in and cancel the deletion before then. Afterwards, nothing can be recovered.</p>
+{{end}}`,
+	},
+	AccountLocked: {
+		subject: "Your account has been locked",
+		text: `Your Encrypted Diary account has been locked until {{.Until}} after too many failed {{.Kind}} attempts.
+
+If it was not you, someone may be trying to guess your credentials. Your entries remain encrypted, but you
+should make sure your password is strong and that two factor authentication is enabled.
+`,
+		html: `{{define "content"}}
+<p>Your Encrypted Diary account has been locked until {{.Until}} after too many failed {{.Kind}} attempts.</p>
+<p>If it was not you, someone may be trying to guess your credentials. Your entries remain encrypted, but you
+should make sure your password is strong and that two factor authentication is enabled.</p>
+{{end}}`,
+	},
+}
+
+// Builds the message from the template name, data is escaped in the HTML version
+func Render(name string, to string, data interface{}) (Message, error) {
+	found, ok := templates[name]
+	if !ok {
+		return Message{}, fmt.Errorf("unknown email template %v", name)
+	}
+
+	var text bytes.Buffer
+	textTemplate, err := texttemplate.New(name).Parse(found.text)
+	if err != nil {
+		return Message{}, err
+	}
+	err = textTemplate.Execute(&text, data)
+	if err != nil {
+		return Message{}, err
+	}
+
+	var html bytes.Buffer
+	htmlTemplate, err := htmltemplate.New(name).Parse(htmlLayout)
+	if err != nil {
+		return Message{}, err
+	}
+	_, err = htmlTemplate.Parse(found.html)
+	if err != nil {
+		return Message{}, err
+	}
+	err = htmlTemplate.Execute(&html, data)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		To:      to,
+		Subject: found.subject,
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/Yuruh/encrypted-diary/src/helpers"
 	"github.com/ovh/go-ovh/ovh"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
@@ -72,6 +73,54 @@ func UploadFileToPrivateObjectStorage(fileDescriptor string, file io.Reader) err
 	return nil
 }
 
+// Deleting a file that does not exist is not an error
+func DeleteFileFromPrivateObjectStorage(fileDescriptor string) error {
+	access, err := getStorageAccess()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(http.MethodDelete, os.Getenv("OVH_OPENSTACK_CONTAINER_URL") + fileDescriptor, nil)
+	if err != nil {
+		return fmt.Errorf("could not create http request: %v", err)
+	}
+	req.Header.Add("X-Auth-Token", access.Token)
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("delete file failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status code %v", res.StatusCode)
+	}
+	return nil
+}
+
+func DownloadFileFromPrivateObjectStorage(fileDescriptor string) ([]byte, error) {
+	access, err := getStorageAccess()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest(http.MethodGet, os.Getenv("OVH_OPENSTACK_CONTAINER_URL") + fileDescriptor, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request: %v", err)
+	}
+	req.Header.Add("X-Auth-Token", access.Token)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download file failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v", res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
 
 // Adapted from https://docs.openstack.org/swift/latest/api/temporary_url_middleware.html#hmac-sha1-signature-for-temporary-urls
 func generateTempUrlSig(fileDescriptor string, duration time.Duration) ObjectTempPublicUrl {
@@ -0,0 +1,49 @@
+/*
+	Random values that must not be guessed: OTP secrets, cookie identifiers, tokens...
+	Always drawn from crypto/rand, never from math/rand which is predictable.
+*/
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+)
+
+// 160 bits, the length recommended by RFC 4226 for HOTP / TOTP secrets
+const DefaultSize = 20
+
+// 128 bits, below this a secret can not be considered safe (RFC 4226 section 4)
+const MinSize = 16
+
+// size random bytes
+func Bytes(size int) ([]byte, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid secret size %v", size)
+	}
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not read random bytes: %v", err)
+	}
+	return b, nil
+}
+
+// size random bytes, base32 encoded as expected by OTP applications
+func Base32(size int) (string, error) {
+	b, err := Bytes(size)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+// size random bytes, base64url encoded without padding, safe in URLs and cookies
+func Token(size int) (string, error) {
+	b, err := Bytes(size)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
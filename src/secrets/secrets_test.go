@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBytes(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	b, err := Bytes(DefaultSize)
+	assert.Nil(err)
+	assert.Equal(20, len(b))
+
+	_, err = Bytes(0)
+	assert.NotNil(err)
+	_, err = Bytes(-1)
+	assert.NotNil(err)
+}
+
+// Every byte value must be reachable, with roughly the same frequency
+func TestBytes_Distribution(t *testing.T) {
+	assert := asserthelper.New(t)
+	const samples = 256 * 1000
+
+	b, err := Bytes(samples)
+	assert.Nil(err)
+	var counts [256]int
+	for _, value := range b {
+		counts[value]++
+	}
+
+	// Chi-squared test with 255 degrees of freedom, 360 is exceeded with a probability below 0.001%
+	expected := float64(samples) / 256
+	chiSquared := 0.0
+	for value, count := range counts {
+		assert.NotZero(count, "byte %v never drawn", value)
+		diff := float64(count) - expected
+		chiSquared += diff * diff / expected
+	}
+	assert.Less(chiSquared, 360.0)
+}
+
+func TestBase32(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	s1, err := Base32(DefaultSize)
+	assert.Nil(err)
+	// 160 bits, 5 bits per character, no padding
+	assert.Equal(32, len(s1))
+	decoded, err := base32.StdEncoding.DecodeString(s1)
+	assert.Nil(err)
+	assert.Equal(DefaultSize, len(decoded))
+
+	s2, _ := Base32(DefaultSize)
+	assert.NotEqual(s1, s2)
+
+	s3, err := Base32(MinSize)
+	assert.Nil(err)
+	decoded, err = base32.StdEncoding.DecodeString(s3)
+	assert.Nil(err)
+	assert.Equal(MinSize, len(decoded))
+}
+
+func TestToken(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	token, err := Token(24)
+	assert.Nil(err)
+	assert.Equal(32, len(token))
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	assert.Nil(err)
+	assert.Equal(24, len(decoded))
+
+	other, _ := Token(24)
+	assert.NotEqual(token, other)
+}
@@ -0,0 +1,245 @@
+/*
+SRP-6a (http://srp.stanford.edu/design.html), an augmented password authenticated key exchange: the server only
+stores a verifier derived from the password, and the password never leaves the client, not even at registration.
+
+Parameters are those of RFC 5054 with the 2048 bits group and SHA-256. Numbers are big endian, and A, B, g and S are
+left padded to the size of N wherever they are hashed:
+
+	k  = H(N | PAD(g))
+	x  = H(salt | H(I | ":" | P))
+	v  = g^x
+	u  = H(PAD(A) | PAD(B))
+	K  = H(PAD(S))
+	M1 = H(H(N) xor H(PAD(g)) | H(I) | salt | PAD(A) | PAD(B) | K)
+	M2 = H(PAD(A) | M1 | K)
+
+I is the email of the user, as registered. The client proves it knows the password with M1, the server proves it
+knows the verifier with M2.
+*/
+package srp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+)
+
+// RFC 5054, appendix A, 2048 bits group
+const groupPrime = "" +
+	"AC6BDB41324A9A9BF166DE5E1389582FAF72B6651987EE07FC3192943DB56050A37329CBB4A099ED8193E0757767A13DD52312AB4B03310D" +
+	"CD7F48A9DA04FD50E8083969EDB767B0CF6095179A163AB3661A05FBD5FAAAE82918A9962F0B93B855F97993EC975EEAA80D740ADBF4FF74" +
+	"7359D041D5C33EA71D281E446B14773BCA97B43A23FB801676BD207A436C6481F1D2B9078717461A5B9D32E688F87748544523B524B0D57D" +
+	"5EA77A2775D2ECFA032CFBDBF52FB3786160279004E57AE6AF874E7303CE53299CCC041C7BC308D82A5698F3A8D0C38271AE35F8E9DBFBB6" +
+	"94B5C803D89F7AE435DE236D525F54759B65E372FCD68EF20FA7111F9E4AFF73"
+
+const groupGenerator = 2
+
+// Size of the random secret exponents, in bytes
+const ephemeralSize = 32
+
+// Bounds of the size of the salt chosen by the client, in bytes
+const (
+	MinSaltSize = 16
+	MaxSaltSize = 64
+)
+
+var (
+	n    *big.Int
+	g    = big.NewInt(groupGenerator)
+	k    *big.Int
+	nLen int
+)
+
+func init() {
+	n, _ = new(big.Int).SetString(groupPrime, 16)
+	nLen = (n.BitLen() + 7) / 8
+	k = new(big.Int).SetBytes(hash(n.Bytes(), pad(g)))
+}
+
+var (
+	ErrBadEphemeral = errors.New("bad public ephemeral value")
+	ErrBadVerifier  = errors.New("bad verifier")
+	ErrBadProof     = errors.New("bad proof")
+)
+
+func hash(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// Left pads to the size of N
+func pad(x *big.Int) []byte {
+	b := x.Bytes()
+	if len(b) >= nLen {
+		return b
+	}
+	padded := make([]byte, nLen)
+	copy(padded[nLen-len(b):], b)
+	return padded
+}
+
+func randomExponent() (*big.Int, error) {
+	b := make([]byte, ephemeralSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Rejects values that are 0 mod N, which would let anyone compute the session key
+func isValidPublic(x *big.Int) bool {
+	return x.Sign() > 0 && new(big.Int).Mod(x, n).Sign() != 0
+}
+
+func privateKey(salt []byte, identity string, password string) *big.Int {
+	inner := hash([]byte(identity + ":" + password))
+	return new(big.Int).SetBytes(hash(salt, inner))
+}
+
+// Computed by the client at registration. Exported for tests and as a reference for client implementations.
+func Verifier(salt []byte, identity string, password string) []byte {
+	return new(big.Int).Exp(g, privateKey(salt, identity, password), n).Bytes()
+}
+
+// Checks a verifier sent by a client before storing it
+func ValidateVerifier(verifier []byte) error {
+	v := new(big.Int).SetBytes(verifier)
+	if !isValidPublic(v) || v.Cmp(n) >= 0 {
+		return ErrBadVerifier
+	}
+	return nil
+}
+
+func scramble(A *big.Int, B *big.Int) *big.Int {
+	return new(big.Int).SetBytes(hash(pad(A), pad(B)))
+}
+
+func clientProof(identity string, salt []byte, A *big.Int, B *big.Int, key []byte) []byte {
+	hn := hash(n.Bytes())
+	hg := hash(pad(g))
+	for i := range hn {
+		hn[i] ^= hg[i]
+	}
+	return hash(hn, hash([]byte(identity)), salt, pad(A), pad(B), key)
+}
+
+func serverProof(A *big.Int, m1 []byte, key []byte) []byte {
+	return hash(pad(A), m1, key)
+}
+
+// Server side of one authentication. It must only be used once.
+type Server struct {
+	identity string
+	salt     []byte
+	v        *big.Int
+	b        *big.Int
+	B        *big.Int
+}
+
+// Picks the secret ephemeral value for the user with the given salt and verifier
+func NewServer(identity string, salt []byte, verifier []byte) (*Server, error) {
+	v := new(big.Int).SetBytes(verifier)
+	if !isValidPublic(v) {
+		return nil, ErrBadVerifier
+	}
+	b, err := randomExponent()
+	if err != nil {
+		return nil, err
+	}
+	// B = kv + g^b
+	B := new(big.Int).Mul(k, v)
+	B.Add(B, new(big.Int).Exp(g, b, n))
+	B.Mod(B, n)
+	return &Server{identity: identity, salt: salt, v: v, b: b, B: B}, nil
+}
+
+// To be sent to the client, along with the salt
+func (s *Server) PublicEphemeral() []byte {
+	return pad(s.B)
+}
+
+/*
+	Checks the proof of the client for its public ephemeral value A.
+	Returns the server proof, which the client checks to make sure it talks to a server knowing the verifier.
+*/
+func (s *Server) Verify(clientEphemeral []byte, proof []byte) ([]byte, error) {
+	A := new(big.Int).SetBytes(clientEphemeral)
+	if !isValidPublic(A) {
+		return nil, ErrBadEphemeral
+	}
+	u := scramble(A, s.B)
+	if u.Sign() == 0 {
+		return nil, ErrBadEphemeral
+	}
+	// S = (A * v^u) ^ b
+	S := new(big.Int).Exp(s.v, u, n)
+	S.Mul(S, A)
+	S.Exp(S, s.b, n)
+	key := hash(pad(S))
+
+	expected := clientProof(s.identity, s.salt, A, s.B, key)
+	if subtle.ConstantTimeCompare(expected, proof) != 1 {
+		return nil, ErrBadProof
+	}
+	return serverProof(A, proof, key), nil
+}
+
+// Client side of one authentication, exported for tests and as a reference for client implementations
+type Client struct {
+	identity string
+	password string
+	a        *big.Int
+	A        *big.Int
+	m1       []byte
+	key      []byte
+}
+
+func NewClient(identity string, password string) (*Client, error) {
+	a, err := randomExponent()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{identity: identity, password: password, a: a, A: new(big.Int).Exp(g, a, n)}, nil
+}
+
+func (c *Client) PublicEphemeral() []byte {
+	return pad(c.A)
+}
+
+// Computes the proof to send from the salt and the public ephemeral value received from the server
+func (c *Client) Proof(salt []byte, serverEphemeral []byte) ([]byte, error) {
+	B := new(big.Int).SetBytes(serverEphemeral)
+	if !isValidPublic(B) {
+		return nil, ErrBadEphemeral
+	}
+	u := scramble(c.A, B)
+	if u.Sign() == 0 {
+		return nil, ErrBadEphemeral
+	}
+	x := privateKey(salt, c.identity, c.password)
+	// S = (B - k * g^x) ^ (a + u * x)
+	base := new(big.Int).Exp(g, x, n)
+	base.Mul(base, k)
+	base.Sub(B, base)
+	base.Mod(base, n)
+	exponent := new(big.Int).Mul(u, x)
+	exponent.Add(exponent, c.a)
+	S := new(big.Int).Exp(base, exponent, n)
+	c.key = hash(pad(S))
+	c.m1 = clientProof(c.identity, salt, c.A, B, c.key)
+	return c.m1, nil
+}
+
+// Checks the proof returned by the server
+func (c *Client) VerifyServer(proof []byte) bool {
+	if c.key == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(serverProof(c.A, c.m1, c.key), proof) == 1
+}
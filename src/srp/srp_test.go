@@ -0,0 +1,83 @@
+package srp
+
+import (
+	asserthelper "github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+var salt = []byte("0123456789abcdef")
+
+func authenticate(t *testing.T, registered string, typed string) ([]byte, *Client, error) {
+	server, err := NewServer("user@mail.com", salt, Verifier(salt, "user@mail.com", registered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient("user@mail.com", typed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := client.Proof(salt, server.PublicEphemeral())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverProof, err := server.Verify(client.PublicEphemeral(), proof)
+	return serverProof, client, err
+}
+
+func TestAuthentication(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	serverProof, client, err := authenticate(t, "correct horse", "correct horse")
+	assert.Nil(err)
+	assert.True(client.VerifyServer(serverProof))
+	assert.False(client.VerifyServer(append([]byte{}, serverProof[1:]...)))
+
+	_, _, err = authenticate(t, "correct horse", "correct h0rse")
+	assert.Equal(ErrBadProof, err)
+}
+
+func TestVerifier(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	v := Verifier(salt, "user@mail.com", "pwd")
+	assert.Nil(ValidateVerifier(v))
+	// Salted, and bound to the identity
+	assert.NotEqual(v, Verifier([]byte("another salt 123"), "user@mail.com", "pwd"))
+	assert.NotEqual(v, Verifier(salt, "other@mail.com", "pwd"))
+
+	assert.Equal(ErrBadVerifier, ValidateVerifier(nil))
+	assert.Equal(ErrBadVerifier, ValidateVerifier(n.Bytes()))
+	assert.Equal(ErrBadVerifier, ValidateVerifier(new(big.Int).Add(n, big.NewInt(1)).Bytes()))
+}
+
+// A client sending A = 0 mod N would get S = 0 and be logged in without the password
+func TestServer_Verify_BadEphemeral(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	for _, A := range []*big.Int{big.NewInt(0), n, new(big.Int).Mul(n, big.NewInt(2))} {
+		server, err := NewServer("user@mail.com", salt, Verifier(salt, "user@mail.com", "pwd"))
+		assert.Nil(err)
+		forged := hash(pad(big.NewInt(0)))
+		proof := clientProof("user@mail.com", salt, A, server.B, forged)
+		_, err = server.Verify(A.Bytes(), proof)
+		assert.Equal(ErrBadEphemeral, err)
+	}
+}
+
+func TestClient_Proof_BadEphemeral(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	client, err := NewClient("user@mail.com", "pwd")
+	assert.Nil(err)
+	_, err = client.Proof(salt, n.Bytes())
+	assert.Equal(ErrBadEphemeral, err)
+	assert.False(client.VerifyServer([]byte("anything")))
+}
+
+func TestPad(t *testing.T) {
+	assert := asserthelper.New(t)
+
+	assert.Equal(256, len(pad(big.NewInt(2))))
+	assert.Equal(n.Bytes(), pad(n))
+}
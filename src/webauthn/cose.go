@@ -0,0 +1,111 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 8152)
+const (
+	algorithmES256 = -7
+	algorithmEdDSA = -8
+)
+
+const (
+	keyTypeOKP   = 1
+	keyTypeEC2   = 2
+	curveP256    = 1
+	curveEd25519 = 6
+)
+
+// A COSE_Key, only with the members used by EC2 and OKP keys
+type coseKey struct {
+	KeyType   int    `cbor:"1,keyasint"`
+	Algorithm int    `cbor:"3,keyasint"`
+	Curve     int    `cbor:"-1,keyasint"`
+	X         []byte `cbor:"-2,keyasint"`
+	Y         []byte `cbor:"-3,keyasint,omitempty"`
+}
+
+type publicKey struct {
+	algorithm int
+	ecdsa     *ecdsa.PublicKey
+	ed25519   ed25519.PublicKey
+}
+
+func parsePublicKey(raw []byte) (publicKey, error) {
+	var key coseKey
+	err := cbor.Unmarshal(raw, &key)
+	if err != nil {
+		return publicKey{}, fmt.Errorf("bad COSE key: %v", err)
+	}
+	switch {
+	case key.Algorithm == algorithmES256 && key.KeyType == keyTypeEC2 && key.Curve == curveP256:
+		if len(key.X) != 32 || len(key.Y) != 32 {
+			return publicKey{}, errors.New("bad P-256 coordinates")
+		}
+		x := new(big.Int).SetBytes(key.X)
+		y := new(big.Int).SetBytes(key.Y)
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return publicKey{}, errors.New("point not on P-256")
+		}
+		return publicKey{algorithm: key.Algorithm, ecdsa: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	case key.Algorithm == algorithmEdDSA && key.KeyType == keyTypeOKP && key.Curve == curveEd25519:
+		if len(key.X) != ed25519.PublicKeySize {
+			return publicKey{}, errors.New("bad Ed25519 key size")
+		}
+		return publicKey{algorithm: key.Algorithm, ed25519: key.X}, nil
+	}
+	return publicKey{}, fmt.Errorf("unsupported key, algorithm %v", key.Algorithm)
+}
+
+// ES256 signatures are ASN.1 encoded
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func (k publicKey) verify(signed []byte, signature []byte) error {
+	switch k.algorithm {
+	case algorithmES256:
+		var sig ecdsaSignature
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) != 0 {
+			return errors.New("bad ES256 signature encoding")
+		}
+		hash := sha256.Sum256(signed)
+		if !ecdsa.Verify(k.ecdsa, hash[:], sig.R, sig.S) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case algorithmEdDSA:
+		if !ed25519.Verify(k.ed25519, signed, signature) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported algorithm")
+}
+
+// Encodes a public key the way authenticators do
+func EncodePublicKey(key interface{}) ([]byte, error) {
+	switch public := key.(type) {
+	case *ecdsa.PublicKey:
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		xBytes := public.X.Bytes()
+		yBytes := public.Y.Bytes()
+		copy(x[32-len(xBytes):], xBytes)
+		copy(y[32-len(yBytes):], yBytes)
+		return cbor.Marshal(coseKey{KeyType: keyTypeEC2, Algorithm: algorithmES256, Curve: curveP256, X: x, Y: y})
+	case ed25519.PublicKey:
+		return cbor.Marshal(coseKey{KeyType: keyTypeOKP, Algorithm: algorithmEdDSA, Curve: curveEd25519, X: public})
+	}
+	return nil, errors.New("unsupported key type")
+}
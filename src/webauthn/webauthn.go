@@ -0,0 +1,370 @@
+/*
+Server side of the WebAuthn ceremonies (https://www.w3.org/TR/webauthn/), for security keys used as a second factor.
+
+Only what a second factor needs is implemented: attestation statements are not verified, we ask for
+"none" as we do not restrict which authenticators users can register, and user verification is not required
+since the password is the first factor. Supported algorithms are ES256 and EdDSA.
+*/
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// The server the credentials are scoped to
+type RelyingParty struct {
+	// The domain, e.g. diary.yuruh.fr
+	ID   string
+	Name string
+	// Where the ceremony is run from, e.g. https://app.diary.yuruh.fr
+	Origin string
+}
+
+const challengeSize = 32
+
+// Timeout given to the browser, in milliseconds
+const ceremonyTimeout = 120000
+
+const (
+	flagUserPresent            = 0x01
+	flagAttestedCredentialData = 0x40
+)
+
+var ErrChallengeMismatch = errors.New("challenge mismatch")
+
+// Binary fields are base64url encoded, as expected by the client side helpers
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	// Some clients keep the padding
+	return base64.RawURLEncoding.DecodeString(trimPadding(s))
+}
+
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// Credential IDs are stored and sent to clients in this form
+func EncodeID(id []byte) string {
+	return encode(id)
+}
+
+func NewChallenge() (string, error) {
+	b := make([]byte, challengeSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	UserVerification string `json:"userVerification"`
+}
+
+// To be given to navigator.credentials.create
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RelyingParty           RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Parameters             []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// To be given to navigator.credentials.get
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RelyingPartyID   string                 `json:"rpId"`
+	Timeout          int                    `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+func descriptors(credentialIDs []string) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, len(credentialIDs))
+	for i, id := range credentialIDs {
+		list[i] = CredentialDescriptor{Type: "public-key", ID: id}
+	}
+	return list
+}
+
+// userHandle must not contain personal information, existing credentials are excluded so a key is not registered twice
+func (rp RelyingParty) CreationOptions(challenge string, userHandle []byte, userName string, existing []string) CreationOptions {
+	return CreationOptions{
+		Challenge:    challenge,
+		RelyingParty: RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:         UserEntity{ID: encode(userHandle), Name: userName, DisplayName: userName},
+		Parameters: []CredentialParameter{
+			{Type: "public-key", Algorithm: algorithmES256},
+			{Type: "public-key", Algorithm: algorithmEdDSA},
+		},
+		Timeout:                ceremonyTimeout,
+		ExcludeCredentials:     descriptors(existing),
+		AuthenticatorSelection: AuthenticatorSelection{UserVerification: "discouraged"},
+		Attestation:            "none",
+	}
+}
+
+func (rp RelyingParty) RequestOptions(challenge string, allowed []string) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RelyingPartyID:   rp.ID,
+		Timeout:          ceremonyTimeout,
+		AllowCredentials: descriptors(allowed),
+		UserVerification: "discouraged",
+	}
+}
+
+// The PublicKeyCredential returned by navigator.credentials.create, binary fields base64url encoded
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// The PublicKeyCredential returned by navigator.credentials.get, binary fields base64url encoded
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Reads the challenge the client signed, to find the ceremony it belongs to
+func ClientDataChallenge(clientDataJSON string) (string, error) {
+	raw, err := decode(clientDataJSON)
+	if err != nil {
+		return "", fmt.Errorf("bad client data encoding: %v", err)
+	}
+	var data clientData
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		return "", fmt.Errorf("bad client data: %v", err)
+	}
+	return trimPadding(data.Challenge), nil
+}
+
+func (rp RelyingParty) verifyClientData(raw []byte, ceremony string, challenge string) error {
+	var data clientData
+	err := json.Unmarshal(raw, &data)
+	if err != nil {
+		return fmt.Errorf("bad client data: %v", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("unexpected ceremony %v", data.Type)
+	}
+	if trimPadding(data.Challenge) != trimPadding(challenge) {
+		return ErrChallengeMismatch
+	}
+	if data.Origin != rp.Origin {
+		return fmt.Errorf("unexpected origin %v", data.Origin)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(raw []byte) (authenticatorData, error) {
+	var data authenticatorData
+	if len(raw) < 37 {
+		return data, errors.New("authenticator data too short")
+	}
+	data.rpIDHash = raw[:32]
+	data.flags = raw[32]
+	data.signCount = binary.BigEndian.Uint32(raw[33:37])
+	if data.flags&flagAttestedCredentialData == 0 {
+		return data, nil
+	}
+	// AAGUID, then the credential ID preceded by its length, then the COSE key
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return data, errors.New("attested credential data too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return data, errors.New("credential ID too short")
+	}
+	data.credentialID = rest[:idLength]
+	// Extensions may follow the key, it is decoded to know where it ends
+	decoder := cbor.NewDecoder(bytes.NewReader(rest[idLength:]))
+	var key cbor.RawMessage
+	err := decoder.Decode(&key)
+	if err != nil {
+		return data, fmt.Errorf("bad credential public key: %v", err)
+	}
+	data.publicKey = key
+	return data, nil
+}
+
+func (rp RelyingParty) verifyAuthenticatorData(data authenticatorData) error {
+	expected := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data.rpIDHash, expected[:]) {
+		return errors.New("credential scoped to another relying party")
+	}
+	if data.flags&flagUserPresent == 0 {
+		return errors.New("user not present")
+	}
+	return nil
+}
+
+// A registered security key
+type Credential struct {
+	ID []byte
+	// COSE_Key encoded
+	PublicKey []byte
+	SignCount uint32
+}
+
+type attestationObject struct {
+	Format    string          `cbor:"fmt"`
+	AuthData  []byte          `cbor:"authData"`
+	Statement cbor.RawMessage `cbor:"attStmt"`
+}
+
+// Checks the result of navigator.credentials.create for the given challenge
+func (rp RelyingParty) VerifyAttestation(response AttestationResponse, challenge string) (Credential, error) {
+	if response.Type != "public-key" {
+		return Credential{}, fmt.Errorf("unexpected credential type %v", response.Type)
+	}
+	rawClientData, err := decode(response.Response.ClientDataJSON)
+	if err != nil {
+		return Credential{}, fmt.Errorf("bad client data encoding: %v", err)
+	}
+	err = rp.verifyClientData(rawClientData, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	rawAttestation, err := decode(response.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("bad attestation encoding: %v", err)
+	}
+	var attestation attestationObject
+	err = cbor.Unmarshal(rawAttestation, &attestation)
+	if err != nil {
+		return Credential{}, fmt.Errorf("bad attestation: %v", err)
+	}
+	data, err := parseAuthenticatorData(attestation.AuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	err = rp.verifyAuthenticatorData(data)
+	if err != nil {
+		return Credential{}, err
+	}
+	if data.credentialID == nil {
+		return Credential{}, errors.New("no attested credential")
+	}
+	// Makes sure the key can be used before registering it
+	_, err = parsePublicKey(data.publicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+	return Credential{ID: data.credentialID, PublicKey: data.publicKey, SignCount: data.signCount}, nil
+}
+
+/*
+Checks the result of navigator.credentials.get for the given challenge, signed by the given credential.
+Returns the new signature counter to store.
+*/
+func (rp RelyingParty) VerifyAssertion(response AssertionResponse, challenge string, credential Credential) (uint32, error) {
+	if response.Type != "public-key" {
+		return 0, fmt.Errorf("unexpected credential type %v", response.Type)
+	}
+	rawClientData, err := decode(response.Response.ClientDataJSON)
+	if err != nil {
+		return 0, fmt.Errorf("bad client data encoding: %v", err)
+	}
+	err = rp.verifyClientData(rawClientData, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	rawData, err := decode(response.Response.AuthenticatorData)
+	if err != nil {
+		return 0, fmt.Errorf("bad authenticator data encoding: %v", err)
+	}
+	data, err := parseAuthenticatorData(rawData)
+	if err != nil {
+		return 0, err
+	}
+	err = rp.verifyAuthenticatorData(data)
+	if err != nil {
+		return 0, err
+	}
+	signature, err := decode(response.Response.Signature)
+	if err != nil {
+		return 0, fmt.Errorf("bad signature encoding: %v", err)
+	}
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, rawData...), clientDataHash[:]...)
+	err = key.verify(signed, signature)
+	if err != nil {
+		return 0, err
+	}
+	// Authenticators without counter always send 0, otherwise it must increase, or the key has been cloned
+	if (data.signCount != 0 || credential.SignCount != 0) && data.signCount <= credential.SignCount {
+		return 0, errors.New("signature counter did not increase, the authenticator may be cloned")
+	}
+	return data.signCount, nil
+}
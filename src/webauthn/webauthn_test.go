@@ -0,0 +1,93 @@
+package webauthn_test
+
+import (
+	"github.com/Yuruh/encrypted-diary/src/webauthn"
+	"github.com/Yuruh/encrypted-diary/src/webauthn/webauthntest"
+	asserthelper "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var rp = webauthn.RelyingParty{ID: "diary.example.com", Name: "Diary", Origin: "https://app.diary.example.com"}
+
+func register(t *testing.T, authenticator *webauthntest.Authenticator) webauthn.Credential {
+	challenge, _ := webauthn.NewChallenge()
+	response, err := authenticator.Create(rp.CreationOptions(challenge, []byte("1"), "user@example.com", nil))
+	asserthelper.Nil(t, err)
+	credential, err := rp.VerifyAttestation(response, challenge)
+	asserthelper.Nil(t, err)
+	return credential
+}
+
+func TestCeremonies(t *testing.T) {
+	assert := asserthelper.New(t)
+	for _, eddsa := range []bool{false, true} {
+		authenticator := webauthntest.New(rp.Origin)
+		authenticator.EdDSA = eddsa
+		credential := register(t, authenticator)
+		assert.Equal(32, len(credential.ID))
+
+		challenge, _ := webauthn.NewChallenge()
+		options := rp.RequestOptions(challenge, []string{"unknown", webauthn.EncodeID(credential.ID)})
+		response, err := authenticator.Get(options)
+		assert.Nil(err)
+
+		read, err := webauthn.ClientDataChallenge(response.Response.ClientDataJSON)
+		assert.Nil(err)
+		assert.Equal(challenge, read)
+
+		count, err := rp.VerifyAssertion(response, challenge, credential)
+		assert.Nil(err)
+		assert.Equal(uint32(1), count)
+
+		// Another challenge
+		other, _ := webauthn.NewChallenge()
+		_, err = rp.VerifyAssertion(response, other, credential)
+		assert.Equal(webauthn.ErrChallengeMismatch, err)
+
+		// Another key
+		otherCredential := register(t, webauthntest.New(rp.Origin))
+		_, err = rp.VerifyAssertion(response, challenge, otherCredential)
+		assert.NotNil(err)
+	}
+}
+
+func TestVerifyAttestationOrigin(t *testing.T) {
+	assert := asserthelper.New(t)
+	challenge, _ := webauthn.NewChallenge()
+
+	// Phishing site relaying the ceremony
+	response, _ := webauthntest.New("https://diary.evil.com").Create(rp.CreationOptions(challenge, []byte("1"), "user", nil))
+	_, err := rp.VerifyAttestation(response, challenge)
+	assert.NotNil(err)
+
+	// Credential scoped to another relying party
+	options := rp.CreationOptions(challenge, []byte("1"), "user", nil)
+	options.RelyingParty.ID = "evil.com"
+	response, _ = webauthntest.New(rp.Origin).Create(options)
+	_, err = rp.VerifyAttestation(response, challenge)
+	assert.NotNil(err)
+}
+
+func TestVerifyAssertionCounter(t *testing.T) {
+	assert := asserthelper.New(t)
+	authenticator := webauthntest.New(rp.Origin)
+	credential := register(t, authenticator)
+
+	challenge, _ := webauthn.NewChallenge()
+	response, _ := authenticator.Get(rp.RequestOptions(challenge, []string{webauthn.EncodeID(credential.ID)}))
+	credential.SignCount, _ = rp.VerifyAssertion(response, challenge, credential)
+
+	// The same assertion, or one from a cloned key, does not increase the counter
+	_, err := rp.VerifyAssertion(response, challenge, credential)
+	assert.NotNil(err)
+
+	// Authenticators without counter
+	authenticator = webauthntest.New(rp.Origin)
+	authenticator.StaticCount = true
+	credential = register(t, authenticator)
+	for i := 0; i < 2; i++ {
+		response, _ = authenticator.Get(rp.RequestOptions(challenge, []string{webauthn.EncodeID(credential.ID)}))
+		_, err = rp.VerifyAssertion(response, challenge, credential)
+		assert.Nil(err)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+A software authenticator, to run WebAuthn ceremonies in tests without a browser nor a security key.
+*/
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/Yuruh/encrypted-diary/src/webauthn"
+	"github.com/fxamacker/cbor/v2"
+	"math/big"
+)
+
+type credential struct {
+	id         []byte
+	rpID       string
+	ecdsaKey   *ecdsa.PrivateKey
+	ed25519Key ed25519.PrivateKey
+	signCount  uint32
+}
+
+type Authenticator struct {
+	// The origin the browser would report
+	Origin string
+	// Creates Ed25519 keys instead of P-256
+	EdDSA bool
+	// Counter sent with every signature, when false the counter keeps increasing as real keys do
+	StaticCount bool
+	credentials map[string]*credential
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, credentials: map[string]*credential{}}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.Origin})
+	return data
+}
+
+func authenticatorData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, signCount)
+	return append(data, counter...)
+}
+
+// Answers navigator.credentials.create
+func (a *Authenticator) Create(options webauthn.CreationOptions) (webauthn.AttestationResponse, error) {
+	cred := &credential{id: make([]byte, 32), rpID: options.RelyingParty.ID}
+	_, err := rand.Read(cred.id)
+	if err != nil {
+		return webauthn.AttestationResponse{}, err
+	}
+	var public interface{}
+	if a.EdDSA {
+		public, cred.ed25519Key, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		cred.ecdsaKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err == nil {
+			public = &cred.ecdsaKey.PublicKey
+		}
+	}
+	if err != nil {
+		return webauthn.AttestationResponse{}, err
+	}
+	coseKey, err := webauthn.EncodePublicKey(public)
+	if err != nil {
+		return webauthn.AttestationResponse{}, err
+	}
+
+	// User present and attested credential data
+	authData := authenticatorData(cred.rpID, 0x41, cred.signCount)
+	// Zero AAGUID, as sent with "none" attestation
+	authData = append(authData, make([]byte, 16)...)
+	idLength := make([]byte, 2)
+	binary.BigEndian.PutUint16(idLength, uint16(len(cred.id)))
+	authData = append(authData, idLength...)
+	authData = append(authData, cred.id...)
+	authData = append(authData, coseKey...)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return webauthn.AttestationResponse{}, err
+	}
+	a.credentials[encode(cred.id)] = cred
+
+	var response webauthn.AttestationResponse
+	response.ID = encode(cred.id)
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = encode(a.clientData("webauthn.create", options.Challenge))
+	response.Response.AttestationObject = encode(attestation)
+	return response, nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// Answers navigator.credentials.get with the first allowed credential it holds
+func (a *Authenticator) Get(options webauthn.RequestOptions) (webauthn.AssertionResponse, error) {
+	var cred *credential
+	for _, allowed := range options.AllowCredentials {
+		if found, ok := a.credentials[allowed.ID]; ok && found.rpID == options.RelyingPartyID {
+			cred = found
+			break
+		}
+	}
+	if cred == nil {
+		return webauthn.AssertionResponse{}, errors.New("no credential for this relying party")
+	}
+	if !a.StaticCount {
+		cred.signCount++
+	}
+
+	authData := authenticatorData(cred.rpID, 0x01, cred.signCount)
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+
+	var signature []byte
+	var err error
+	if cred.ed25519Key != nil {
+		signature = ed25519.Sign(cred.ed25519Key, signed)
+	} else {
+		hash := sha256.Sum256(signed)
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, cred.ecdsaKey, hash[:])
+		if err != nil {
+			return webauthn.AssertionResponse{}, err
+		}
+		signature, err = asn1.Marshal(ecdsaSignature{r, s})
+		if err != nil {
+			return webauthn.AssertionResponse{}, err
+		}
+	}
+
+	var response webauthn.AssertionResponse
+	response.ID = encode(cred.id)
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = encode(clientData)
+	response.Response.AuthenticatorData = encode(authData)
+	response.Response.Signature = encode(signature)
+	return response, nil
+}